@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// tokenAuthorized reports whether r carries token as a bearer token or
+// ?token=, comparing in constant time. Basic Auth credentials, sent for
+// admin_user, leave the token to ?token=.
+func tokenAuthorized(r *http.Request, token string) bool {
+	header := r.Header.Get("Authorization")
+	given := strings.TrimPrefix(header, "Bearer ")
+	if given == "" || strings.HasPrefix(header, "Basic ") {
+		given = r.URL.Query().Get("token")
+	}
+	return subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
+
+// defaultProtectedPaths are the operational endpoints admin_user guards
+// when protected_paths isn't set. Beacon and badge routes stay open.
+var defaultProtectedPaths = []string{"/metrics", "/admin/", "/debug/", "/stats/"}
+
+// protectedPath reports whether p falls under one of protected_paths. An
+// entry covers itself and everything below it, with or without a
+// trailing slash.
+func protectedPath(p string) bool {
+	paths := config().ProtectedPaths
+	if paths == nil {
+		paths = defaultProtectedPaths
+	}
+	for _, prefix := range paths {
+		prefix = strings.TrimSuffix(prefix, "/")
+		if p == prefix || strings.HasPrefix(p, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// basicAuthorized reports whether r carries admin_user and admin_password
+// as HTTP Basic Auth, comparing both in constant time.
+func basicAuthorized(r *http.Request, c *Config) bool {
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	userOK := subtle.ConstantTimeCompare([]byte(user), []byte(c.AdminUser))
+	passwordOK := subtle.ConstantTimeCompare([]byte(password), []byte(c.AdminPassword))
+	return userOK&passwordOK == 1
+}
+
+// withAdminAuth answers requests under protected_paths with 401 unless
+// they carry the admin credentials, when admin_user is set.
+func withAdminAuth(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := config()
+		if c.AdminUser != "" && protectedPath(r.URL.Path) && !basicAuthorized(r, c) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="ga-beacon", charset="UTF-8"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// accountsResponse is what /admin/accounts reports. API secrets are
+// deliberately left out.
+type accountsResponse struct {
+	MeasurementID string            `json:"measurement_id,omitempty"`
+	Accounts      map[string]string `json:"accounts"`
+	Streams       map[string]string `json:"streams"`
+}
+
+// adminAccountsHandler lists the measurement id each configured account
+// and stream delivers to, for holders of admin_token.
+func adminAccountsHandler(w http.ResponseWriter, r *http.Request) {
+	c := config()
+	if c.AdminToken == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if !tokenAuthorized(r, c.AdminToken) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	resp := accountsResponse{
+		MeasurementID: c.MeasurementID,
+		Accounts:      make(map[string]string, len(c.Accounts)),
+		Streams:       make(map[string]string, len(c.Streams)),
+	}
+	for account, creds := range c.Accounts {
+		resp.Accounts[account] = creds.MeasurementID
+	}
+	for name, creds := range c.Streams {
+		resp.Streams[name] = creds.MeasurementID
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(resp)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAdminAccounts(t *testing.T) {
+	configured := Config{
+		MeasurementID: "G-TOP",
+		APISecret:     "secret-top",
+		AdminToken:    "admin-token",
+		Accounts:      map[string]Credentials{"docs": {MeasurementID: "G-DOCS", APISecret: "secret-docs"}},
+		Streams:       map[string]Credentials{"app": {MeasurementID: "G-APP", APISecret: "secret-app"}},
+	}
+	withoutToken := configured
+	withoutToken.AdminToken = ""
+	tests := []struct {
+		name     string
+		config   Config
+		target   string
+		auth     string // Authorization header
+		wantCode int
+	}{
+		{"bearer token", configured, "/admin/accounts", "Bearer admin-token", http.StatusOK},
+		{"?token=", configured, "/admin/accounts?token=admin-token", "", http.StatusOK},
+		{"?token= alongside Basic Auth", configured, "/admin/accounts?token=admin-token", "Basic dXNlcjpwYXNz", http.StatusOK},
+		{"no token", configured, "/admin/accounts", "", http.StatusUnauthorized},
+		{"wrong token", configured, "/admin/accounts", "Bearer admin-tokem", http.StatusUnauthorized},
+		{"token prefix", configured, "/admin/accounts?token=admin", "", http.StatusUnauthorized},
+		{"admin_token unset", withoutToken, "/admin/accounts", "Bearer ", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, tt.config)
+			r := httptest.NewRequest("GET", tt.target, nil)
+			if tt.auth != "" {
+				r.Header.Set("Authorization", tt.auth)
+			}
+			w := httptest.NewRecorder()
+			newMux(&server{sender: &recordingSender{}}).ServeHTTP(w, r)
+
+			if w.Code != tt.wantCode {
+				t.Fatalf("status %d, want %d", w.Code, tt.wantCode)
+			}
+			if body := w.Body.String(); strings.Contains(body, "secret") {
+				t.Errorf("response includes an api_secret:\n%s", body)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			var got accountsResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			want := accountsResponse{
+				MeasurementID: "G-TOP",
+				Accounts:      map[string]string{"docs": "G-DOCS"},
+				Streams:       map[string]string{"app": "G-APP"},
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("response = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestAdminBasicAuth(t *testing.T) {
+	guarded := Config{AdminUser: "ops", AdminPassword: "hunter2"}
+	healthzOnly := guarded
+	healthzOnly.ProtectedPaths = []string{"/healthz/"}
+	tests := []struct {
+		name           string
+		config         Config
+		target         string
+		user, password string // Basic Auth, if user is set
+		wantCode       int
+	}{
+		{"protected without credentials", guarded, "/metrics", "", "", http.StatusUnauthorized},
+		{"protected with credentials", guarded, "/metrics", "ops", "hunter2", http.StatusOK},
+		{"wrong password", guarded, "/metrics", "ops", "hunter3", http.StatusUnauthorized},
+		{"wrong user", guarded, "/metrics", "root", "hunter2", http.StatusUnauthorized},
+		{"stats protected", guarded, "/stats/acct", "", "", http.StatusUnauthorized},
+		{"debug protected", guarded, "/debug/acct/page", "", "", http.StatusUnauthorized},
+		{"admin protected", guarded, "/admin/accounts", "", "", http.StatusUnauthorized},
+		{"beacon open", withTestCreds(guarded), "/acct/page?pixel", "", "", http.StatusOK},
+		{"healthz open", withTestCreds(guarded), "/healthz", "", "", http.StatusOK},
+		{"admin_user unset", Config{}, "/metrics", "", "", http.StatusOK},
+		{"protected_paths replaces defaults", healthzOnly, "/healthz", "", "", http.StatusUnauthorized},
+		{"default left open by protected_paths", healthzOnly, "/metrics", "", "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, tt.config)
+			r := httptest.NewRequest("GET", tt.target, nil)
+			r.Header.Set("User-Agent", "Mozilla/5.0")
+			if tt.user != "" {
+				r.SetBasicAuth(tt.user, tt.password)
+			}
+			w := httptest.NewRecorder()
+			withAdminAuth(newMux(&server{sender: &recordingSender{}})).ServeHTTP(w, r)
+
+			if w.Code != tt.wantCode {
+				t.Fatalf("status %d, want %d", w.Code, tt.wantCode)
+			}
+			challenge := w.Header().Get("WWW-Authenticate")
+			if tt.wantCode == http.StatusUnauthorized && !strings.HasPrefix(challenge, "Basic ") {
+				t.Errorf("WWW-Authenticate = %q, want a Basic challenge", challenge)
+			}
+			if tt.wantCode != http.StatusUnauthorized && challenge != "" {
+				t.Errorf("WWW-Authenticate = %q, want none", challenge)
+			}
+		})
+	}
+}
+
+func TestProtectedPath(t *testing.T) {
+	useConfig(t, Config{ProtectedPaths: []string{"/metrics", "/ops/"}})
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"/metrics", true},
+		{"/metrics/", true},
+		{"/metrics/raw", true},
+		{"/metricsz", false},
+		{"/ops", true},
+		{"/ops/tasks", true},
+		{"/opsx", false},
+		{"/acct/metrics", false},
+	}
+	for _, tt := range tests {
+		if got := protectedPath(tt.path); got != tt.want {
+			t.Errorf("protectedPath(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestAdminAuthValidated(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  Config
+		wantErr bool
+	}{
+		{"unset", Config{}, false},
+		{"user and password", Config{AdminUser: "ops", AdminPassword: "hunter2"}, false},
+		{"user alone", Config{AdminUser: "ops"}, true},
+		{"password alone", Config{AdminPassword: "hunter2"}, true},
+		{"protected_paths", Config{ProtectedPaths: []string{"/metrics", "/ops/"}}, false},
+		{"relative protected path", Config{ProtectedPaths: []string{"metrics"}}, true},
+		{"root protected path", Config{ProtectedPaths: []string{"/"}}, true},
+	}
+	for _, tt := range tests {
+		c := withTestCreds(tt.config)
+		if err := c.validate(); (err != nil) != tt.wantErr {
+			t.Errorf("%s: err = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"os"
+	"time"
+)
+
+// The images and account page are compiled in, so the binary runs from any
+// working directory.
+//
+//go:embed static page.html
+var embeddedAssets embed.FS
+
+var (
+	pixel        []byte
+	badge        []byte
+	badgeGif     []byte
+	badgeFlat    []byte
+	badgeFlatGif []byte
+	favicon      []byte
+	pageTemplate *template.Template
+
+	// assetsModified is the Last-Modified time of the fixed images.
+	assetsModified time.Time
+)
+
+// loadAssets loads the images and page template from dir, laid out like
+// the repository (static/ and page.html), or from the embedded copies when
+// dir is empty.
+func loadAssets(dir string) error {
+	var fsys fs.FS = embeddedAssets
+	if dir != "" {
+		fsys = os.DirFS(dir)
+	}
+
+	for path, dst := range map[string]*[]byte{
+		"static/pixel.gif":      &pixel,
+		"static/badge.svg":      &badge,
+		"static/badge.gif":      &badgeGif,
+		"static/badge-flat.svg": &badgeFlat,
+		"static/badge-flat.gif": &badgeFlatGif,
+	} {
+		b, err := fs.ReadFile(fsys, path)
+		if err != nil {
+			return fmt.Errorf("cannot load asset: %v", err)
+		}
+		*dst = b
+	}
+
+	// A static_dir without a favicon still works; /favicon.ico is then
+	// answered with 204.
+	favicon, _ = fs.ReadFile(fsys, "static/favicon.ico")
+
+	t, err := template.ParseFS(fsys, "page.html")
+	if err != nil {
+		return fmt.Errorf("cannot load page template: %v", err)
+	}
+	pageTemplate = t
+	assetsModified = time.Now().UTC().Truncate(time.Second)
+	return nil
+}
+
+// faviconHandler serves the favicon browsers fetch for the account page.
+// It is routed ahead of the hit handler, so it never counts as a hit.
+func faviconHandler(w http.ResponseWriter, r *http.Request) {
+	if favicon == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "image/x-icon")
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	http.ServeContent(w, r, "", assetsModified, bytes.NewReader(favicon))
+}
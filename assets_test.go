@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeAssetDir lays out files, relative paths to contents, under a temp
+// dir the way static_dir expects.
+func writeAssetDir(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestLoadAssets(t *testing.T) {
+	complete := map[string]string{
+		"static/pixel.gif":      "GIF89a-custom",
+		"static/badge.svg":      "<svg/>",
+		"static/badge.gif":      "GIF89a",
+		"static/badge-flat.svg": "<svg/>",
+		"static/badge-flat.gif": "GIF89a",
+		"static/favicon.ico":    "ico",
+		"page.html":             "{{.}}",
+	}
+	without := func(name string) map[string]string {
+		files := make(map[string]string)
+		for k, v := range complete {
+			if k != name {
+				files[k] = v
+			}
+		}
+		return files
+	}
+	withFile := func(name, content string) map[string]string {
+		files := without(name)
+		files[name] = content
+		return files
+	}
+
+	tests := []struct {
+		name        string
+		files       map[string]string // nil for the embedded assets
+		wantErr     bool
+		wantPixel   string // prefix
+		wantFavicon bool
+	}{
+		{"embedded", nil, false, "GIF89a", true},
+		{"static_dir", complete, false, "GIF89a-custom", true},
+		{"static_dir without favicon", without("static/favicon.ico"), false, "GIF89a-custom", false},
+		{"static_dir missing pixel", without("static/pixel.gif"), true, "", false},
+		{"static_dir missing page.html", without("page.html"), true, "", false},
+		{"malformed page.html", withFile("page.html", "{{.Broken"), true, "", false},
+	}
+	t.Cleanup(func() {
+		if err := loadAssets(""); err != nil {
+			t.Errorf("restoring embedded assets: %v", err)
+		}
+	})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := ""
+			if tt.files != nil {
+				dir = writeAssetDir(t, tt.files)
+			}
+			err := loadAssets(dir)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadAssets() = %v, want error: %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !bytes.HasPrefix(pixel, []byte(tt.wantPixel)) {
+				t.Errorf("pixel starts %q, want %q", pixel[:min(len(pixel), 16)], tt.wantPixel)
+			}
+			if (favicon != nil) != tt.wantFavicon {
+				t.Errorf("favicon loaded: %v, want %v", favicon != nil, tt.wantFavicon)
+			}
+			if pageTemplate == nil {
+				t.Error("page template not loaded")
+			}
+		})
+	}
+}
+
+func TestFavicon(t *testing.T) {
+	tests := []struct {
+		name     string
+		files    map[string]string // nil for the embedded assets
+		method   string
+		wantCode int
+		wantType string
+	}{
+		{"embedded", nil, "GET", http.StatusOK, "image/x-icon"},
+		{"HEAD", nil, "HEAD", http.StatusOK, "image/x-icon"},
+		{"static_dir without favicon", map[string]string{
+			"static/pixel.gif":      "GIF89a",
+			"static/badge.svg":      "<svg/>",
+			"static/badge.gif":      "GIF89a",
+			"static/badge-flat.svg": "<svg/>",
+			"static/badge-flat.gif": "GIF89a",
+			"page.html":             "{{.}}",
+		}, "GET", http.StatusNoContent, ""},
+	}
+	t.Cleanup(func() {
+		if err := loadAssets(""); err != nil {
+			t.Errorf("restoring embedded assets: %v", err)
+		}
+	})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := ""
+			if tt.files != nil {
+				dir = writeAssetDir(t, tt.files)
+			}
+			if err := loadAssets(dir); err != nil {
+				t.Fatal(err)
+			}
+			useConfig(t, withTestCreds(Config{}))
+			sender := &recordingSender{}
+			r := httptest.NewRequest(tt.method, "/favicon.ico", nil)
+			r.Header.Set("User-Agent", "Mozilla/5.0")
+			w := httptest.NewRecorder()
+			newMux(&server{sender: sender}).ServeHTTP(w, r)
+
+			if w.Code != tt.wantCode {
+				t.Errorf("status %d, want %d", w.Code, tt.wantCode)
+			}
+			if got := w.Header().Get("Content-Type"); got != tt.wantType {
+				t.Errorf("Content-Type %q, want %q", got, tt.wantType)
+			}
+			if tt.method == "GET" && !bytes.Equal(w.Body.Bytes(), favicon) {
+				t.Errorf("body is %d bytes, want the %d-byte favicon", w.Body.Len(), len(favicon))
+			}
+			if c := w.Header().Get("Set-Cookie"); c != "" {
+				t.Errorf("Set-Cookie %q, want none", c)
+			}
+			if n := len(sender.sent()); n != 0 {
+				t.Errorf("sent %d hits, want none", n)
+			}
+		})
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"math"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Upper bound on a decoded ?logo= data URI, so a badge can't be used to
+// serve arbitrarily large SVGs.
+const maxLogoBytes = 4096
+
+// Horizontal space a logo takes up on the left segment, including padding.
+const logoSpace = 17
+
+// Left-hand text of a counter badge, unless ?label= replaces it.
+const defaultBadgeLabel = "pageviews"
+
+// Longest ?label= accepted, in runes; longer labels are truncated.
+const maxBadgeLabelLength = 32
+
+// Built-in logos selectable by name with ?logo=<name>.
+var builtinLogos = map[string]string{
+	"analytics": svgDataURI(`<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 14 14"><path fill="#fff" d="M1 8h3v5H1zM5.5 4h3v9h-3zM10 1h3v12h-3z"/></svg>`),
+	"trend":     svgDataURI(`<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 14 14"><path fill="none" stroke="#fff" stroke-width="1.5" d="M1 12l4-5 3 3 5-7"/></svg>`),
+}
+
+// Image types accepted in a ?logo= data URI.
+var logoMediaTypes = []string{"image/svg+xml", "image/png", "image/gif", "image/jpeg"}
+
+func svgDataURI(svg string) string {
+	return "data:image/svg+xml;base64," + base64.StdEncoding.EncodeToString([]byte(svg))
+}
+
+// badgeLogo resolves a ?logo= value to a data URI: either a built-in logo
+// name or a base64 data URI of an accepted image type within maxLogoBytes.
+func badgeLogo(v string) (string, bool) {
+	if v == "" {
+		return "", false
+	}
+	if uri, ok := builtinLogos[v]; ok {
+		return uri, true
+	}
+
+	// An unescaped "+" in the query string arrives as a space.
+	v = strings.ReplaceAll(v, " ", "+")
+	for _, mediaType := range logoMediaTypes {
+		data, ok := strings.CutPrefix(v, "data:"+mediaType+";base64,")
+		if !ok {
+			continue
+		}
+		if len(data) > base64.StdEncoding.EncodedLen(maxLogoBytes) {
+			return "", false
+		}
+		decoded, err := base64.StdEncoding.DecodeString(data)
+		if err != nil || len(decoded) == 0 || len(decoded) > maxLogoBytes {
+			return "", false
+		}
+		return v, true
+	}
+	return "", false
+}
+
+type badgeData struct {
+	Label      string
+	Value      string
+	Logo       string
+	Color      string
+	Width      int
+	LeftWidth  int
+	RightWidth int
+	LabelX     float64
+	ValueX     float64
+}
+
+// badgeStyle is one of the SVG badge looks selectable with ?style=.
+type badgeStyle struct {
+	tmpl    *template.Template
+	color   string // right-hand color when ?color= is absent or invalid
+	padding int    // around the text of each segment
+	upper   bool   // text is rendered in capitals
+	spacing int    // extra width per character, for letter-spacing
+}
+
+// SVG badge styles, keyed by the name imageStyle returns. "svg" is the
+// original look (static/badge.svg), which ?style=plastic also selects.
+// "flat-square" reproduces static/badge-flat.svg.
+var badgeStyles = map[string]badgeStyle{
+	"svg": {color: "#1288ca", padding: 10, tmpl: template.Must(template.New("svg").Parse(`<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink" width="{{.Width}}" height="18">
+  <linearGradient id="a" x2="0" y2="100%">
+    <stop offset="0" stop-color="#fff" stop-opacity=".7"/>
+    <stop offset=".1" stop-color="#aaa" stop-opacity=".1"/>
+    <stop offset=".9" stop-opacity=".3"/>
+    <stop offset="1" stop-opacity=".5"/>
+  </linearGradient>
+  <rect rx="4" width="{{.Width}}" height="18" fill="#555"/>
+  <rect rx="4" x="{{.LeftWidth}}" width="{{.RightWidth}}" height="18" fill="{{.Color}}"/>
+  <path fill="{{.Color}}" d="M{{.LeftWidth}} 0h4v18h-4z"/>
+  <rect rx="4" width="{{.Width}}" height="18" fill="url(#a)"/>
+  {{- if .Logo}}
+  <image x="5" y="2" width="14" height="14" xlink:href="{{.Logo}}"/>
+  {{- end}}
+  <g fill="#fff" text-anchor="middle"
+     font-family="DejaVu Sans,Verdana,Geneva,sans-serif" font-size="11">
+    <text x="{{.LabelX}}" y="13" fill="#010101" fill-opacity=".3">{{html .Label}}</text>
+    <text x="{{.LabelX}}" y="12">{{html .Label}}</text>
+    <text x="{{.ValueX}}" y="13" fill="#010101" fill-opacity=".3">{{html .Value}}</text>
+    <text x="{{.ValueX}}" y="12">{{html .Value}}</text>
+  </g>
+</svg>
+`))},
+	"flat": {color: "#007ec6", padding: 10, tmpl: template.Must(template.New("flat").Parse(`<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink" width="{{.Width}}" height="20">
+    <linearGradient id="s" x2="0" y2="100%">
+        <stop offset="0" stop-color="#bbb" stop-opacity=".1"/>
+        <stop offset="1" stop-opacity=".1"/>
+    </linearGradient>
+    <clipPath id="r">
+        <rect width="{{.Width}}" height="20" rx="3" fill="#fff"/>
+    </clipPath>
+    <g clip-path="url(#r)">
+        <path fill="#555" d="M0 0h{{.LeftWidth}}v20H0z"/>
+        <path fill="{{.Color}}" d="M{{.LeftWidth}} 0h{{.RightWidth}}v20H{{.LeftWidth}}z"/>
+        <path fill="url(#s)" d="M0 0h{{.Width}}v20H0z"/>
+    </g>
+    {{- if .Logo}}
+    <image x="5" y="3" width="14" height="14" xlink:href="{{.Logo}}"/>
+    {{- end}}
+    <g fill="#fff" text-anchor="middle" font-family="DejaVu Sans,Verdana,Geneva,sans-serif" font-size="11">
+        <text x="{{.LabelX}}" y="15" fill="#010101" fill-opacity=".3">{{html .Label}}</text>
+        <text x="{{.LabelX}}" y="14">{{html .Label}}</text>
+        <text x="{{.ValueX}}" y="15" fill="#010101" fill-opacity=".3">{{html .Value}}</text>
+        <text x="{{.ValueX}}" y="14">{{html .Value}}</text>
+    </g>
+</svg>
+`))},
+	"flat-square": {color: "#007ec6", padding: 10, tmpl: template.Must(template.New("flat-square").Parse(`<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink" width="{{.Width}}" height="20">
+    <g shape-rendering="crispEdges">
+        <path fill="#555" d="M0 0h{{.LeftWidth}}v20H0z"/>
+        <path fill="{{.Color}}" d="M{{.LeftWidth}} 0h{{.RightWidth}}v20H{{.LeftWidth}}z"/>
+    </g>
+    {{- if .Logo}}
+    <image x="5" y="3" width="14" height="14" xlink:href="{{.Logo}}"/>
+    {{- end}}
+    <g fill="#fff" text-anchor="middle" font-family="DejaVu Sans,Verdana,Geneva,sans-serif" font-size="11">
+        <text x="{{.LabelX}}" y="14">
+            {{html .Label}}
+        </text>
+        <text x="{{.ValueX}}" y="14">
+            {{html .Value}}
+        </text>
+    </g>
+</svg>
+`))},
+	"for-the-badge": {color: "#007ec6", padding: 24, upper: true, spacing: 1, tmpl: template.Must(template.New("for-the-badge").Parse(`<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink" width="{{.Width}}" height="28">
+    <g shape-rendering="crispEdges">
+        <path fill="#555" d="M0 0h{{.LeftWidth}}v28H0z"/>
+        <path fill="{{.Color}}" d="M{{.LeftWidth}} 0h{{.RightWidth}}v28H{{.LeftWidth}}z"/>
+    </g>
+    {{- if .Logo}}
+    <image x="9" y="7" width="14" height="14" xlink:href="{{.Logo}}"/>
+    {{- end}}
+    <g fill="#fff" text-anchor="middle" font-family="DejaVu Sans,Verdana,Geneva,sans-serif" font-size="10" font-weight="bold" letter-spacing="1">
+        <text x="{{.LabelX}}" y="18">{{html .Label}}</text>
+        <text x="{{.ValueX}}" y="18">{{html .Value}}</text>
+    </g>
+</svg>
+`))},
+}
+
+// Named colors accepted by ?color=, as on shields.io.
+var badgeColors = map[string]string{
+	"brightgreen": "#4c1",
+	"green":       "#97ca00",
+	"yellowgreen": "#a4a61d",
+	"yellow":      "#dfb317",
+	"orange":      "#fe7d37",
+	"red":         "#e05d44",
+	"blue":        "#007ec6",
+	"lightgrey":   "#9f9f9f",
+	"grey":        "#555",
+	"gray":        "#555",
+}
+
+var hexColorPattern = regexp.MustCompile(`^[0-9a-fA-F]{6}$`)
+
+// badgeColor resolves a ?color= value, either a named color or six hex
+// digits, to an SVG fill. Anything else gives def.
+func badgeColor(v, def string) string {
+	if c, ok := badgeColors[strings.ToLower(v)]; ok {
+		return c
+	}
+	if hexColorPattern.MatchString(v) {
+		return "#" + strings.ToLower(v)
+	}
+	return def
+}
+
+// badgeLabel returns the left-hand text for a ?label= value: the default
+// when empty, otherwise the value with control characters dropped and
+// truncated to maxBadgeLabelLength runes.
+func badgeLabel(v string) string {
+	v = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, strings.TrimSpace(v))
+	if v == "" {
+		return defaultBadgeLabel
+	}
+	if utf8.RuneCountInString(v) > maxBadgeLabelLength {
+		v = string([]rune(v)[:maxBadgeLabelLength])
+	}
+	return v
+}
+
+// segmentWidth is the width of a badge segment holding text in style s.
+func (s badgeStyle) segmentWidth(text string) int {
+	return int(math.Ceil(measureText(text))) + utf8.RuneCountInString(text)*s.spacing + s.padding
+}
+
+// countUnits are the suffixes humanizeCount abbreviates counts with.
+var countUnits = []struct {
+	size   int64
+	suffix string
+}{
+	{1e3, "k"},
+	{1e6, "M"},
+	{1e9, "B"},
+	{1e12, "T"},
+}
+
+// badgeValue returns n as shown on a badge: humanized, unless the query
+// asks for the ?exact count.
+func badgeValue(n int64, query url.Values) string {
+	if query.Has("exact") {
+		return strconv.FormatInt(n, 10)
+	}
+	return humanizeCount(n)
+}
+
+// humanizeCount abbreviates n to one decimal place with a k, M, B or T
+// suffix, such as 1.2k for 1234 or 1.5M for 1500000, dropping a ".0".
+// Counts under 1000 are shown as they are. Rounding that would reach
+// 1000 of a unit moves up to the next one, so 999999 is 1M.
+func humanizeCount(n int64) string {
+	if n < 1000 {
+		return strconv.FormatInt(n, 10)
+	}
+	var tenths int64
+	var suffix string
+	for i, u := range countUnits {
+		// Round to tenths of the unit without computing n*10, which
+		// could overflow.
+		tenth := u.size / 10
+		tenths = n / tenth
+		if n%tenth >= tenth-tenth/2 {
+			tenths++
+		}
+		suffix = u.suffix
+		if tenths < 10000 || i == len(countUnits)-1 {
+			break
+		}
+	}
+	if tenths%10 == 0 {
+		return strconv.FormatInt(tenths/10, 10) + suffix
+	}
+	return strconv.FormatInt(tenths/10, 10) + "." + strconv.FormatInt(tenths%10, 10) + suffix
+}
+
+// renderedBadges holds recently rendered SVGs, since a badge is usually
+// requested many times over with the same count.
+var renderedBadges = newTTLCache[[]byte](maxCachedBadges, badgeCacheTTL)
+
+const (
+	maxCachedBadges = 1024
+	badgeCacheTTL   = 10 * time.Minute
+)
+
+// renderBadge renders the SVG badge for style (a badgeStyles key) showing
+// label and value, with logo on its left segment and color, a ?color=
+// value, on its right. Segment widths follow the measured text so neither
+// side clips or leaves a gap. The result may be shared and must not be
+// modified.
+func renderBadge(style, label, value, color, logo string) ([]byte, error) {
+	s, ok := badgeStyles[style]
+	if !ok {
+		return nil, fmt.Errorf("unknown badge style %q", style)
+	}
+	key := strings.Join([]string{style, label, value, color, logo}, "\x00")
+	if b, ok := renderedBadges.Get(key, time.Now()); ok {
+		return b, nil
+	}
+
+	if s.upper {
+		label, value = strings.ToUpper(label), strings.ToUpper(value)
+	}
+	data := badgeData{Label: label, Value: value, Color: badgeColor(color, s.color)}
+	data.LeftWidth = s.segmentWidth(label)
+	data.RightWidth = s.segmentWidth(value)
+	data.LabelX = float64(data.LeftWidth) / 2
+	if logo != "" {
+		data.Logo = logo
+		data.LeftWidth += logoSpace
+		data.LabelX += logoSpace
+	}
+	data.ValueX = float64(data.LeftWidth) + float64(data.RightWidth)/2
+	data.Width = data.LeftWidth + data.RightWidth
+
+	var buf bytes.Buffer
+	if err := s.tmpl.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+	renderedBadges.Add(key, buf.Bytes(), time.Now())
+	return buf.Bytes(), nil
+}
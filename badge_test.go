@@ -0,0 +1,442 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"math"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLiveCountBadge(t *testing.T) {
+	tests := []struct {
+		count int64
+		want  string
+	}{
+		{0, "0"},
+		{999, "999"},
+		{1_500_000, "1.5M"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			useConfig(t, Config{})
+			hitCounts = newMemoryCounterStore()
+			t.Cleanup(func() { hitCounts = newMemoryCounterStore() })
+			hitCounts.(*memoryCounterStore).counts["acct"] = tt.count
+
+			w := httptest.NewRecorder()
+			writeImage(w, httptest.NewRequest("GET", "/acct/page", nil), url.Values{"label": {"views"}}, "acct")
+			body := w.Body.String()
+
+			var root struct{ XMLName xml.Name }
+			if err := xml.Unmarshal([]byte(body), &root); err != nil || root.XMLName.Local != "svg" {
+				t.Fatalf("not an <svg> document (%v): %s", err, body)
+			}
+			for _, text := range []string{">views<", ">" + tt.want + "<"} {
+				if !strings.Contains(body, text) {
+					t.Errorf("badge doesn't contain %q: %s", text, body)
+				}
+			}
+		})
+	}
+}
+
+func TestBadgeColor(t *testing.T) {
+	tests := []struct {
+		v, want string
+	}{
+		{"brightgreen", "#4c1"},
+		{"Blue", "#007ec6"},
+		{"ff8800", "#ff8800"},
+		{"ABCDEF", "#abcdef"},
+		{"fff", "#default"},         // too short
+		{"#ff8800", "#default"},     // leading # not accepted
+		{"ff88zz", "#default"},      // not hex
+		{`"/><script>`, "#default"}, // markup
+		{"", "#default"},
+	}
+	for _, tt := range tests {
+		if got := badgeColor(tt.v, "#default"); got != tt.want {
+			t.Errorf("badgeColor(%q) = %q, want %q", tt.v, got, tt.want)
+		}
+	}
+}
+
+func TestBadgeStylesAndColors(t *testing.T) {
+	tests := []struct {
+		name        string
+		query       url.Values
+		wantType    string
+		wantHeight  string // of the SVG, or "" for a GIF
+		wantColor   string
+		wantContent string
+	}{
+		{"default", url.Values{}, "image/svg+xml", `height="18"`, "#1288ca", ""},
+		{"named color", url.Values{"color": {"brightgreen"}}, "image/svg+xml", `height="18"`, "#4c1", ""},
+		{"hex color", url.Values{"color": {"ff8800"}}, "image/svg+xml", `height="18"`, "#ff8800", ""},
+		{"invalid hex falls back", url.Values{"color": {"ff88zz"}}, "image/svg+xml", `height="18"`, "#1288ca", ""},
+		{"style=plastic", url.Values{"style": {"plastic"}}, "image/svg+xml", `height="18"`, "#1288ca", ""},
+		{"style=flat", url.Values{"style": {"flat"}}, "image/svg+xml", `height="20"`, "#007ec6", "clip-path"},
+		{"style=flat-square", url.Values{"style": {"flat-square"}, "color": {"red"}}, "image/svg+xml", `height="20"`, "#e05d44", "crispEdges"},
+		{"style=for-the-badge", url.Values{"style": {"for-the-badge"}}, "image/svg+xml", `height="28"`, "#007ec6", "PAGEVIEWS"},
+		{"unknown style", url.Values{"style": {"bogus"}}, "image/svg+xml", `height="18"`, "#1288ca", ""},
+		{"?flat alias", url.Values{"flat": {""}}, "image/svg+xml", `height="20"`, "#007ec6", ""},
+		{"?gif alias", url.Values{"gif": {""}}, "image/gif", "", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, Config{})
+			w := httptest.NewRecorder()
+			writeImage(w, httptest.NewRequest("GET", "/acct/page", nil), tt.query, "acct")
+			body := w.Body.String()
+
+			if ct := w.Header().Get("Content-Type"); ct != tt.wantType {
+				t.Errorf("Content-Type = %q, want %q", ct, tt.wantType)
+			}
+			if tt.wantHeight != "" && !strings.Contains(body, tt.wantHeight) {
+				t.Errorf("badge isn't %s: %s", tt.wantHeight, body)
+			}
+			if tt.wantColor != "" && !strings.Contains(body, `fill="`+tt.wantColor+`"`) {
+				t.Errorf("badge isn't filled with %s: %s", tt.wantColor, body)
+			}
+			if tt.wantContent != "" && !strings.Contains(body, tt.wantContent) {
+				t.Errorf("badge doesn't contain %q: %s", tt.wantContent, body)
+			}
+		})
+	}
+}
+
+func TestBadgeLogo(t *testing.T) {
+	png := "data:image/png;base64," + base64.StdEncoding.EncodeToString([]byte("\x89PNG\r\n\x1a\n\x00\xfb\xef\xbe"))
+	full := "data:image/gif;base64," + base64.StdEncoding.EncodeToString(make([]byte, maxLogoBytes))
+	oversized := "data:image/gif;base64," + base64.StdEncoding.EncodeToString(make([]byte, maxLogoBytes+1))
+	tests := []struct {
+		name string
+		logo string
+		want string // data URI embedded in the badge, or "" for none
+	}{
+		{"none", "", ""},
+		{"built-in", "analytics", builtinLogos["analytics"]},
+		{"unknown name", "rocket", ""},
+		{"png data URI", png, png},
+		{"plus sent unescaped", strings.ReplaceAll(png, "+", " "), png},
+		{"at the size limit", full, full},
+		{"oversized", oversized, ""},
+		{"not an image", "data:text/html;base64," + base64.StdEncoding.EncodeToString([]byte("<script>x</script>")), ""},
+		{"image type not accepted", "data:image/webp;base64,UklGRg==", ""},
+		{"not base64 encoded", "data:image/svg+xml,<svg/>", ""},
+		{"malformed base64", "data:image/png;base64,iVBOR*w0K", ""},
+		{"truncated base64", "data:image/png;base64,iVBORw0", ""},
+		{"empty image", "data:image/png;base64,", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, Config{})
+			got, ok := badgeLogo(tt.logo)
+			if got != tt.want || ok != (tt.want != "") {
+				t.Errorf("badgeLogo(%.40q) = %.40q, %v, want %.40q", tt.logo, got, ok, tt.want)
+			}
+
+			w := httptest.NewRecorder()
+			writeImage(w, httptest.NewRequest("GET", "/acct/page", nil), url.Values{"logo": {tt.logo}}, "acct")
+			body := w.Body.String()
+			if embedded := strings.Contains(body, "<image"); embedded != (tt.want != "") {
+				t.Errorf("badge has a logo: %v, want %v", embedded, tt.want != "")
+			}
+			if tt.want != "" && !strings.Contains(body, `xlink:href="`+tt.want+`"`) {
+				t.Errorf("badge doesn't embed %.40q", tt.want)
+			}
+		})
+	}
+}
+
+func TestBadgeRenderEvent(t *testing.T) {
+	tests := []struct {
+		name      string
+		mode      string
+		accounts  map[string]string
+		target    string
+		want      []string
+		wantStyle string
+	}{
+		{"default", "", nil, "/acct/page", []string{"page_view"}, ""},
+		{"also", "also", nil, "/acct/page?style=flat", []string{"page_view", "badge_render"}, "flat"},
+		{"instead", "instead", nil, "/acct/page?gif", []string{"badge_render"}, "gif"},
+		{"pixel hits unaffected", "also", nil, "/acct/page?pixel", []string{"page_view"}, ""},
+		{"beacon hits unaffected", "instead", nil, "/acct/page?beacon", []string{"page_view"}, ""},
+		{"per account", "also", map[string]string{"acct": "instead"}, "/acct/page", []string{"badge_render"}, "svg"},
+		{"other account falls back", "instead", map[string]string{"other": ""}, "/acct/page", []string{"badge_render"}, "svg"},
+		{"per account off", "also", map[string]string{"acct": ""}, "/acct/page", []string{"page_view"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, Config{BadgeEvent: tt.mode, BadgeEventAccounts: tt.accounts})
+			payload := payloadFor(t, httptest.NewRequest("GET", tt.target, nil), "203.0.113.7")
+			var names []string
+			for _, e := range payload.Events {
+				names = append(names, e.Name)
+			}
+			if !reflect.DeepEqual(names, tt.want) {
+				t.Fatalf("events = %v, want %v", names, tt.want)
+			}
+			if tt.wantStyle == "" {
+				return
+			}
+			render := payload.Events[len(payload.Events)-1]
+			if render.Params["account"] != "acct" || render.Params["badge_style"] != tt.wantStyle {
+				t.Errorf("badge_render account = %v, badge_style = %v, want acct, %s", render.Params["account"], render.Params["badge_style"], tt.wantStyle)
+			}
+			if render.Params["page_path"] != payload.Events[0].Params["page_path"] {
+				t.Errorf("badge_render page_path = %v, want the page view's", render.Params["page_path"])
+			}
+		})
+	}
+}
+
+func TestBadgeEventValidated(t *testing.T) {
+	tests := []struct {
+		mode     string
+		accounts map[string]string
+		wantErr  bool
+	}{
+		{"also", map[string]string{"acct": "instead"}, false},
+		{"sometimes", nil, true},
+		{"", map[string]string{"acct": "always"}, true},
+	}
+	for _, tt := range tests {
+		c := withTestCreds(Config{BadgeEvent: tt.mode, BadgeEventAccounts: tt.accounts})
+		if err := c.validate(); (err != nil) != tt.wantErr {
+			t.Errorf("badge_event %q, badge_event_accounts %v: validate() = %v, want error: %v", tt.mode, tt.accounts, err, tt.wantErr)
+		}
+	}
+}
+
+// flakyStore is a memory store whose reads fail while down is set.
+type flakyStore struct {
+	*memoryCounterStore
+	down bool
+}
+
+func (s *flakyStore) Get(account string) (int64, error) {
+	if s.down {
+		return 0, errors.New("store unavailable")
+	}
+	return s.memoryCounterStore.Get(account)
+}
+
+func TestBadgeServesStaleCountWhileStoreIsDown(t *testing.T) {
+	tests := []struct {
+		name       string
+		config     Config
+		seen       bool // whether the count was read before the outage
+		want       string
+		wantHeader bool
+	}{
+		{"stale count", Config{}, true, ">42<", false},
+		{"flagged when debugging", Config{Debug: true}, true, ">42<", true},
+		{"never read", Config{}, false, ">0<", false},
+		{"disabled", Config{StaleCountSeconds: -1}, true, ">0<", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, tt.config)
+			store := &flakyStore{memoryCounterStore: newMemoryCounterStore()}
+			store.counts["acct"] = 42
+			hitCounts = store
+			t.Cleanup(func() { hitCounts = newMemoryCounterStore() })
+
+			render := func() *httptest.ResponseRecorder {
+				w := httptest.NewRecorder()
+				writeImage(w, httptest.NewRequest("GET", "/acct/page", nil), url.Values{}, "acct")
+				return w
+			}
+			if tt.seen {
+				render()
+			}
+			store.down = true
+			w := render()
+
+			if body := w.Body.String(); !strings.Contains(body, tt.want) {
+				t.Errorf("badge doesn't contain %q: %s", tt.want, body)
+			}
+			if got := w.Header().Get("X-Beacon-Stale-Count") != ""; got != tt.wantHeader {
+				t.Errorf("X-Beacon-Stale-Count set = %v, want %v", got, tt.wantHeader)
+			}
+		})
+	}
+}
+
+func TestStaticImageConditionalRequests(t *testing.T) {
+	useConfig(t, Config{})
+	if err := loadAssets(""); err != nil {
+		t.Fatal(err)
+	}
+	fetch := func(query url.Values, header map[string]string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/acct/page", nil)
+		for k, v := range header {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		writeImage(w, r, query, "acct")
+		return w
+	}
+	tests := []struct {
+		name  string
+		query url.Values
+	}{
+		{"pixel", url.Values{"pixel": {""}}},
+		{"png pixel", url.Values{"pixel": {"png"}}},
+		{"gif", url.Values{"gif": {""}}},
+		{"flat gif", url.Values{"flat-gif": {""}}},
+		{"gif with color", url.Values{"gif": {""}, "color": {"red"}}},
+	}
+	etags := make(map[string]string)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			first := fetch(tt.query, nil)
+			etag, modified := first.Header().Get("ETag"), first.Header().Get("Last-Modified")
+			if first.Code != 200 || etag == "" || modified == "" || first.Body.Len() == 0 {
+				t.Fatalf("first fetch: %d, ETag %q, Last-Modified %q, %d bytes; want 200 with both validators and the image",
+					first.Code, etag, modified, first.Body.Len())
+			}
+			if other, ok := etags[etag]; ok {
+				t.Errorf("ETag %s is shared with %s", etag, other)
+			}
+			etags[etag] = tt.name
+
+			for _, header := range []map[string]string{
+				{"If-None-Match": etag},
+				{"If-Modified-Since": modified},
+			} {
+				w := fetch(tt.query, header)
+				if w.Code != 304 || w.Body.Len() != 0 {
+					t.Errorf("refetch with %v: %d, %d bytes; want 304 and no body", header, w.Code, w.Body.Len())
+				}
+			}
+			if w := fetch(tt.query, map[string]string{"If-None-Match": `"stale"`}); w.Code != 200 {
+				t.Errorf("refetch with a stale ETag: %d, want 200", w.Code)
+			}
+		})
+	}
+
+	t.Run("counter badge", func(t *testing.T) {
+		w := fetch(url.Values{}, nil)
+		if w.Header().Get("ETag") != "" || !strings.Contains(w.Header().Get("Cache-Control"), "no-cache") {
+			t.Errorf("counter badge: ETag %q, Cache-Control %q; want no ETag and no-cache",
+				w.Header().Get("ETag"), w.Header().Get("Cache-Control"))
+		}
+	})
+}
+
+func TestBadgeCacheControl(t *testing.T) {
+	if err := loadAssets(""); err != nil {
+		t.Fatal(err)
+	}
+	const (
+		revalidate = "no-cache, private"
+		noStore    = "no-cache, no-store, must-revalidate, private"
+		fiveMin    = "private, max-age=300"
+	)
+	tests := []struct {
+		name         string
+		cacheSeconds int
+		target       string
+		want         string
+	}{
+		{"pixel", 0, "/acct/a?pixel", revalidate},
+		{"gif badge", 0, "/acct/b?gif", revalidate},
+		{"counter badge", 0, "/acct/c", noStore},
+		{"pixel with badge_cache_seconds", 300, "/acct/d?pixel", revalidate},
+		{"gif badge with badge_cache_seconds", 300, "/acct/e?gif", fiveMin},
+		{"flat gif badge with badge_cache_seconds", 300, "/acct/f?flat-gif", fiveMin},
+		{"counter badge with badge_cache_seconds", 300, "/acct/g", noStore},
+		{"flat counter badge with badge_cache_seconds", 300, "/acct/h?style=flat", noStore},
+		{"png badge with badge_cache_seconds", 300, "/acct/i?png", noStore},
+		{"beacon with badge_cache_seconds", 300, "/acct/j?beacon", noStore},
+	}
+	for _, tt := range tests {
+		// The headers don't depend on whether the client has a cid yet.
+		for client, cid := range map[string]string{"new": "", "returning": "7777.8888"} {
+			t.Run(tt.name+", "+client+" client", func(t *testing.T) {
+				useConfig(t, withTestCreds(Config{BadgeCacheSeconds: tt.cacheSeconds}))
+				w := serveHit(t, &server{sender: &recordingSender{}}, tt.target, cid)
+				if got := w.Header().Get("Cache-Control"); got != tt.want {
+					t.Errorf("Cache-Control = %q, want %q", got, tt.want)
+				}
+				if expires := w.Header().Get("Expires"); (tt.want == noStore) != (expires != "") {
+					t.Errorf("Expires = %q, want it only on uncached responses", expires)
+				}
+			})
+		}
+	}
+}
+
+func TestBadgeCacheSecondsValidated(t *testing.T) {
+	for _, tt := range []struct {
+		seconds int
+		wantErr bool
+	}{
+		{0, false},
+		{3600, false},
+		{-1, true},
+	} {
+		c := withTestCreds(Config{BadgeCacheSeconds: tt.seconds})
+		if err := c.validate(); (err != nil) != tt.wantErr {
+			t.Errorf("badge_cache_seconds %d: err = %v, want error %v", tt.seconds, err, tt.wantErr)
+		}
+	}
+}
+
+func TestHumanizeCount(t *testing.T) {
+	tests := []struct {
+		n    int64
+		want string
+	}{
+		{0, "0"},
+		{7, "7"},
+		{999, "999"},
+		{1000, "1k"},
+		{1049, "1k"},
+		{1050, "1.1k"},
+		{1234, "1.2k"},
+		{9_999, "10k"},
+		{99_949, "99.9k"},
+		{999_949, "999.9k"},
+		{999_950, "1M"},
+		{999_999, "1M"},
+		{1_000_000, "1M"},
+		{1_500_000, "1.5M"},
+		{999_999_999, "1B"},
+		{2_345_678_901, "2.3B"},
+		{1_000_000_000_000, "1T"},
+		{math.MaxInt64, "9223372T"},
+	}
+	for _, tt := range tests {
+		if got := humanizeCount(tt.n); got != tt.want {
+			t.Errorf("humanizeCount(%d) = %q, want %q", tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestBadgeValue(t *testing.T) {
+	tests := []struct {
+		query string
+		n     int64
+		want  string
+	}{
+		{"", 1234, "1.2k"},
+		{"exact", 1234, "1234"},
+		{"exact=1&label=views", 1_500_000, "1500000"},
+		{"exact", 999, "999"},
+	}
+	for _, tt := range tests {
+		query, _ := url.ParseQuery(tt.query)
+		if got := badgeValue(tt.n, query); got != tt.want {
+			t.Errorf("badgeValue(%d, ?%s) = %q, want %q", tt.n, tt.query, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// batcher is a Sender that holds payloads for a short window so that one
+// client's hits reach GA as a single request of up to maxPayloadEvents
+// events. Hits are only combined when everything outside their events
+// matches; the batch is timed by its first hit.
+type batcher struct {
+	sender Sender
+	window time.Duration
+
+	mu      sync.Mutex
+	pending map[string]*batch
+	wg      sync.WaitGroup
+}
+
+type batch struct {
+	// ctx is the context of the batch's first hit, so cancelling the
+	// queue that handed it over aborts the post.
+	ctx     context.Context
+	meta    HitMeta
+	payload GA4Payload
+	timer   *time.Timer
+
+	// hits are the hits with events in the batch, told how its post went.
+	hits []*batchedHit
+}
+
+// batchedHit calls done once every batch holding part of a hit has been
+// posted, with the first error among them.
+type batchedHit struct {
+	mu    sync.Mutex
+	parts int
+	err   error
+	done  func(error)
+}
+
+func (h *batchedHit) finish(err error) {
+	h.mu.Lock()
+	if h.err == nil {
+		h.err = err
+	}
+	h.parts--
+	last := h.parts == 0
+	h.mu.Unlock()
+	if last && h.done != nil {
+		h.done(h.err)
+	}
+}
+
+func newBatcher(sender Sender, window time.Duration) *batcher {
+	return &batcher{sender: sender, window: window, pending: make(map[string]*batch)}
+}
+
+// batchKey identifies the payloads that may share a request.
+func batchKey(meta HitMeta, payload GA4Payload) string {
+	consent := Consent{}
+	if payload.Consent != nil {
+		consent = *payload.Consent
+	}
+	return fmt.Sprintf("%s|%s|%s|%s|%q|%t|%+v", meta.Creds.MeasurementID, meta.Creds.APISecret,
+		payload.ClientID, payload.AppInstanceID, payload.UserID, payload.NonPersonalizedAds, consent)
+}
+
+// Send adds payload's events to the pending batch for its client, sending
+// any batch that fills up. The rest go when the window closes. It can't
+// know how delivery went; SendAsync reports that.
+func (b *batcher) Send(ctx context.Context, meta HitMeta, payload GA4Payload) error {
+	b.SendAsync(ctx, meta, payload, nil)
+	return nil
+}
+
+// SendAsync is Send, calling done, if it isn't nil, once the hit's events
+// have been posted, with the error of a post that failed.
+func (b *batcher) SendAsync(ctx context.Context, meta HitMeta, payload GA4Payload, done func(error)) {
+	key := batchKey(meta, payload)
+	hit := &batchedHit{done: done}
+	var full []*batch
+
+	b.mu.Lock()
+	events := payload.Events
+	if len(events) == 0 {
+		b.mu.Unlock()
+		if done != nil {
+			done(nil)
+		}
+		return
+	}
+	for len(events) > 0 {
+		cur := b.pending[key]
+		if cur == nil {
+			cur = &batch{ctx: ctx, meta: meta, payload: payload}
+			cur.payload.Events = nil
+			b.pending[key] = cur
+			b.wg.Add(1)
+			cur.timer = time.AfterFunc(b.window, func() {
+				defer b.wg.Done()
+				b.flush(key, cur)
+			})
+		}
+
+		n := min(maxPayloadEvents-len(cur.payload.Events), len(events))
+		cur.payload.Events = append(cur.payload.Events, events[:n]...)
+		cur.hits = append(cur.hits, hit)
+		hit.parts++
+		events = events[n:]
+		if len(cur.payload.Events) == maxPayloadEvents {
+			if cur.timer.Stop() {
+				b.wg.Done()
+			}
+			delete(b.pending, key)
+			full = append(full, cur)
+		}
+	}
+	b.mu.Unlock()
+
+	for _, f := range full {
+		b.send(f)
+	}
+}
+
+// flush sends the batch for key if it is still pending as cur.
+func (b *batcher) flush(key string, cur *batch) {
+	b.mu.Lock()
+	if b.pending[key] != cur {
+		b.mu.Unlock()
+		return
+	}
+	delete(b.pending, key)
+	b.mu.Unlock()
+	b.send(cur)
+}
+
+// send posts cur and tells its hits how that went. The post, not the wait
+// for the window, is what slow_send_threshold_ms times.
+func (b *batcher) send(cur *batch) {
+	ctx := withRequestID(cur.ctx, cur.meta.RequestID)
+	start := time.Now()
+	err := b.sender.Send(ctx, cur.meta, cur.payload)
+	warnIfSlow(ctx, cur.meta, time.Since(start))
+	for _, hit := range cur.hits {
+		hit.finish(err)
+	}
+}
+
+// Close sends every pending batch without waiting for its window, and
+// waits for batches already being sent.
+func (b *batcher) Close() {
+	b.mu.Lock()
+	pending := b.pending
+	b.pending = make(map[string]*batch)
+	for _, cur := range pending {
+		if cur.timer.Stop() {
+			b.wg.Done()
+		}
+	}
+	b.mu.Unlock()
+
+	for _, cur := range pending {
+		b.send(cur)
+	}
+	b.wg.Wait()
+}
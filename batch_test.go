@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestBatcher(t *testing.T) {
+	creds := Credentials{MeasurementID: "G-TEST", APISecret: "secret"}
+	hit := func(cid string, events int) GA4Payload {
+		p := GA4Payload{ClientID: cid}
+		for i := 0; i < events; i++ {
+			p.Events = append(p.Events, GA4Event{Name: "page_view"})
+		}
+		return p
+	}
+	hits := func(n int, cid string) []GA4Payload {
+		var ps []GA4Payload
+		for i := 0; i < n; i++ {
+			ps = append(ps, hit(cid, 1))
+		}
+		return ps
+	}
+	denied := hit("1.1", 1)
+	denied.Consent = &Consent{AdUserData: consentDenied}
+
+	tests := []struct {
+		name     string
+		payloads []GA4Payload
+		close    bool  // Close rather than wait out the window
+		want     []int // events per post, sorted
+	}{
+		{"30 hits for one client", hits(30, "1.1"), true, []int{5, 25}},
+		{"30 events in one hit", []GA4Payload{hit("1.1", 30)}, true, []int{5, 25}},
+		{"two clients", append(hits(3, "1.1"), hits(2, "2.2")...), true, []int{2, 3}},
+		{"different consent", []GA4Payload{hit("1.1", 1), denied, hit("1.1", 1)}, true, []int{1, 2}},
+		{"exactly a full batch", hits(25, "1.1"), true, []int{25}},
+		{"flushed when the window closes", hits(3, "1.1"), false, []int{3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeCollector(t, Config{})
+			b := newBatcher(gaSender{}, 50*time.Millisecond)
+			for i, p := range tt.payloads {
+				if err := b.Send(context.Background(), HitMeta{Creds: creds, CID: p.ClientID}, p); err != nil {
+					t.Fatalf("Send #%d: %v", i, err)
+				}
+			}
+			if tt.close {
+				b.Close()
+			} else {
+				deadline := time.Now().Add(2 * time.Second)
+				for len(f.posted()) < len(tt.want) && time.Now().Before(deadline) {
+					time.Sleep(10 * time.Millisecond)
+				}
+			}
+
+			var got []int
+			for _, p := range f.posted() {
+				got = append(got, len(p.Events))
+			}
+			slices.Sort(got)
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("posts of %v events, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBatcherReportsDelivery(t *testing.T) {
+	creds := Credentials{MeasurementID: "G-TEST", APISecret: "secret"}
+	tests := []struct {
+		name      string
+		status    int
+		cancel    bool  // cancel the hits' context before the window closes
+		events    []int // events per hit, all from one client
+		wantPosts int
+		wantErr   bool
+	}{
+		{"delivered", 0, false, []int{1, 1, 1}, 1, false},
+		{"split across batches", 0, false, []int{30}, 2, false},
+		{"rejected", http.StatusBadRequest, false, []int{1, 1}, 1, true},
+		{"cancelled", 0, true, []int{1, 1}, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeCollector(t, Config{})
+			f.status = tt.status
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			b := newBatcher(gaSender{}, 50*time.Millisecond)
+			results := make(chan error, len(tt.events))
+			for _, n := range tt.events {
+				p := GA4Payload{ClientID: "1.1"}
+				for i := 0; i < n; i++ {
+					p.Events = append(p.Events, GA4Event{Name: "page_view"})
+				}
+				b.SendAsync(ctx, HitMeta{Creds: creds, CID: "1.1"}, p, func(err error) { results <- err })
+			}
+			if tt.cancel {
+				cancel()
+			}
+			b.Close()
+
+			for i := range tt.events {
+				select {
+				case err := <-results:
+					if (err != nil) != tt.wantErr {
+						t.Errorf("hit #%d: err = %v, want error %v", i, err, tt.wantErr)
+					}
+				case <-time.After(2 * time.Second):
+					t.Fatalf("done called for %d of %d hits", i, len(tt.events))
+				}
+			}
+			select {
+			case err := <-results:
+				t.Errorf("done called again, with %v", err)
+			default:
+			}
+			if got := len(f.posted()); got != tt.wantPosts {
+				t.Errorf("collector got %d posts, want %d", got, tt.wantPosts)
+			}
+		})
+	}
+}
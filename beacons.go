@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// BeaconConfig is a separate beacon served under PathPrefix, with its own
+// GA4 property, default event and reserved params. Settings it leaves
+// empty fall back to the top-level config.
+type BeaconConfig struct {
+	PathPrefix       string   `json:"path_prefix" yaml:"path_prefix"`
+	MeasurementID    string   `json:"measurement_id" yaml:"measurement_id"`
+	APISecret        string   `json:"api_secret" yaml:"api_secret"`
+	DefaultEventName string   `json:"default_event_name" yaml:"default_event_name"`
+	ReservedParams   []string `json:"reserved_params" yaml:"reserved_params"`
+
+	// Set by prepare when ReservedParams is given.
+	reserved map[string]bool
+}
+
+func (b *BeaconConfig) credentials() Credentials {
+	return Credentials{MeasurementID: b.MeasurementID, APISecret: b.APISecret}
+}
+
+// validate checks b on its own; validateBeacons checks the set.
+func (b *BeaconConfig) validate(c *Config) error {
+	p := b.PathPrefix
+	if !strings.HasPrefix(p, "/") || strings.HasSuffix(p, "/") {
+		return fmt.Errorf("path_prefix %q must start with / and not end with one", p)
+	}
+	for _, segment := range strings.Split(p[1:], "/") {
+		if !validAccount(segment) {
+			return fmt.Errorf("path_prefix %q has an invalid segment %q", p, segment)
+		}
+	}
+	if (b.MeasurementID != "" || b.APISecret != "") && !b.credentials().complete(c) {
+		return fmt.Errorf("beacon %s: measurement_id and api_secret must be set together", p)
+	}
+	if b.DefaultEventName != "" {
+		if err := validateName("event", b.DefaultEventName); err != nil {
+			return fmt.Errorf("beacon %s: default_event_name: %v", p, err)
+		}
+	}
+	return nil
+}
+
+func validateBeacons(beacons []BeaconConfig, c *Config) error {
+	seen := make(map[string]bool, len(beacons))
+	for i := range beacons {
+		if err := beacons[i].validate(c); err != nil {
+			return err
+		}
+		if seen[beacons[i].PathPrefix] {
+			return fmt.Errorf("path_prefix %q is used by more than one beacon", beacons[i].PathPrefix)
+		}
+		seen[beacons[i].PathPrefix] = true
+	}
+	return nil
+}
+
+// matchBeacon returns the beacon whose path_prefix is the longest one p
+// falls under, or nil when none does.
+func matchBeacon(p string) *BeaconConfig {
+	var match *BeaconConfig
+	beacons := config().Beacons
+	for i := range beacons {
+		prefix := beacons[i].PathPrefix
+		if p != prefix && !strings.HasPrefix(p, prefix+"/") {
+			continue
+		}
+		if match == nil || len(prefix) > len(match.PathPrefix) {
+			match = &beacons[i]
+		}
+	}
+	return match
+}
+
+type beaconKey struct{}
+
+// withBeacons serves a request under a beacon's path_prefix as though it
+// had been made without the prefix, with the beacon in its context.
+func withBeacons(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b := matchBeacon(r.URL.Path)
+		if b == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+		r = r.WithContext(context.WithValue(r.Context(), beaconKey{}, b))
+		http.StripPrefix(b.PathPrefix, h).ServeHTTP(w, r)
+	})
+}
+
+// beaconFrom returns the beacon a request was routed to, or nil for the
+// top-level one.
+func beaconFrom(c context.Context) *BeaconConfig {
+	b, _ := c.Value(beaconKey{}).(*BeaconConfig)
+	return b
+}
+
+// beaconByPrefix returns the beacon configured with path_prefix p, or nil.
+func beaconByPrefix(p string) *BeaconConfig {
+	beacons := config().Beacons
+	for i := range beacons {
+		if beacons[i].PathPrefix == p {
+			return &beacons[i]
+		}
+	}
+	return nil
+}
+
+// beaconPrefix returns the path_prefix of the beacon a request was routed
+// to, or "" for the top-level one.
+func beaconPrefix(c context.Context) string {
+	if b := beaconFrom(c); b != nil {
+		return b.PathPrefix
+	}
+	return ""
+}
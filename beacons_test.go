@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBeaconRouting(t *testing.T) {
+	f := newFakeCollector(t, Config{
+		DefaultEventName: "page_view",
+		Beacons: []BeaconConfig{
+			{PathPrefix: "/docs", MeasurementID: "G-DOCS", APISecret: "docs-secret", DefaultEventName: "doc_view", ReservedParams: []string{"internal"}},
+			{PathPrefix: "/docs/v2", MeasurementID: "G-DOCSV2", APISecret: "v2-secret"},
+			{PathPrefix: "/blog", DefaultEventName: "post_view"},
+		},
+	})
+	tests := []struct {
+		name       string
+		target     string
+		wantID     string
+		wantSecret string
+		wantEvent  string
+		wantCookie string // path of the cid cookie
+		wantParam  bool   // whether ?internal= is forwarded as custom_internal
+	}{
+		{"top-level", "/acct/top?pixel&internal=1", "G-TEST", "secret", "page_view", "/acct", true},
+		{"beacon", "/docs/acct/intro?pixel&internal=1", "G-DOCS", "docs-secret", "doc_view", "/docs/acct", false},
+		{"longest prefix", "/docs/v2/acct/intro?pixel&internal=1", "G-DOCSV2", "v2-secret", "page_view", "/docs/v2/acct", true},
+		{"beacon without credentials", "/blog/acct/post?pixel&internal=1", "G-TEST", "secret", "post_view", "/blog/acct", true},
+		{"prefix is whole segments", "/docsite/intro?pixel&internal=1", "G-TEST", "secret", "page_view", "/docsite", true},
+	}
+	h := withBeacons(newMux(&server{sender: gaSender{}}))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := len(f.posted())
+			r := httptest.NewRequest("GET", tt.target, nil)
+			r.Header.Set("User-Agent", "Mozilla/5.0")
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d, want 200", w.Code)
+			}
+
+			f.mu.Lock()
+			if len(f.requests) != before+1 {
+				f.mu.Unlock()
+				t.Fatalf("collector got %d requests, want 1", len(f.requests)-before)
+			}
+			q := f.requests[before].URL.Query()
+			p := f.payloads[before]
+			f.mu.Unlock()
+			if q.Get("measurement_id") != tt.wantID || q.Get("api_secret") != tt.wantSecret {
+				t.Errorf("posted to %s/%s, want %s/%s", q.Get("measurement_id"), q.Get("api_secret"), tt.wantID, tt.wantSecret)
+			}
+			e := p.Events[len(p.Events)-1]
+			if e.Name != tt.wantEvent {
+				t.Errorf("event %q, want %q", e.Name, tt.wantEvent)
+			}
+			if _, ok := e.Params["custom_internal"]; ok != tt.wantParam {
+				t.Errorf("internal param forwarded: %v, want %v", ok, tt.wantParam)
+			}
+			if c := w.Header().Get("Set-Cookie"); !strings.Contains(c, "Path="+tt.wantCookie+";") && !strings.HasSuffix(c, "Path="+tt.wantCookie) {
+				t.Errorf("Set-Cookie %q, want Path=%s", c, tt.wantCookie)
+			}
+		})
+	}
+}
+
+func TestValidateBeacons(t *testing.T) {
+	tests := []struct {
+		name    string
+		beacons []BeaconConfig
+		wantErr bool
+	}{
+		{"valid", []BeaconConfig{{PathPrefix: "/docs"}, {PathPrefix: "/docs/v2", MeasurementID: "G-X", APISecret: "s"}}, false},
+		{"no leading slash", []BeaconConfig{{PathPrefix: "docs"}}, true},
+		{"trailing slash", []BeaconConfig{{PathPrefix: "/docs/"}}, true},
+		{"root", []BeaconConfig{{PathPrefix: "/"}}, true},
+		{"empty segment", []BeaconConfig{{PathPrefix: "/docs//v2"}}, true},
+		{"bad segment", []BeaconConfig{{PathPrefix: "/do cs"}}, true},
+		{"duplicate", []BeaconConfig{{PathPrefix: "/docs"}, {PathPrefix: "/docs"}}, true},
+		{"id without secret", []BeaconConfig{{PathPrefix: "/docs", MeasurementID: "G-X"}}, true},
+		{"bad default_event_name", []BeaconConfig{{PathPrefix: "/docs", DefaultEventName: "doc-view"}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := withTestCreds(Config{Beacons: tt.beacons})
+			if err := c.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() = %v, want error: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// User agents of crawlers, link unfurlers, image proxies, uptime monitors
+// and HTTP libraries, matched case-insensitively as substrings.
+var defaultBotUserAgents = []string{
+	"bot", "crawler", "spider", "slurp", "facebookexternalhit",
+	"github-camo", "headlesschrome", "lighthouse", "pingdom",
+	"statuscake", "uptimerobot", "curl/", "wget/", "python-requests",
+	"python-urllib", "go-http-client", "okhttp", "java/", "libwww-perl",
+}
+
+var botHits = newCounter("beacon_bot_hits_total", "Hits not sent to GA because the user agent is a known bot.")
+
+// uaMatcher matches user agents against substrings and /regex/ patterns.
+type uaMatcher struct {
+	substrings []string
+	patterns   []*regexp.Regexp
+}
+
+func newUAMatcher(substrings []string) *uaMatcher {
+	m := &uaMatcher{}
+	for _, s := range substrings {
+		m.substrings = append(m.substrings, strings.ToLower(s))
+	}
+	return m
+}
+
+// parseUAMatcher parses entries that are either case-insensitive substrings
+// or, when wrapped in slashes, regular expressions.
+func parseUAMatcher(entries []string, setting string) (*uaMatcher, error) {
+	m := &uaMatcher{}
+	for _, entry := range entries {
+		if len(entry) > 2 && strings.HasPrefix(entry, "/") && strings.HasSuffix(entry, "/") {
+			re, err := regexp.Compile(entry[1 : len(entry)-1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s entry %q: %v", setting, entry, err)
+			}
+			m.patterns = append(m.patterns, re)
+			continue
+		}
+		if entry == "" {
+			return nil, fmt.Errorf("empty %s entry", setting)
+		}
+		m.substrings = append(m.substrings, strings.ToLower(entry))
+	}
+	return m, nil
+}
+
+func (m *uaMatcher) Match(ua string) bool {
+	lower := strings.ToLower(ua)
+	for _, s := range m.substrings {
+		if strings.Contains(lower, s) {
+			return true
+		}
+	}
+	for _, re := range m.patterns {
+		if re.MatchString(ua) {
+			return true
+		}
+	}
+	return false
+}
+
+// isBot reports whether hits from ua should not be sent to GA.
+func isBot(ua string) bool {
+	c := config()
+	return c.bots.Match(ua) && !c.allowedBots.Match(ua)
+}
+
+// botFilter builds the bot filter from c's bot_user_agents, which add to
+// the built-in list unless replace_default_bots is set, and
+// allowed_user_agents.
+func botFilter(c *Config) (bots, allowed *uaMatcher, err error) {
+	if bots, err = parseUAMatcher(c.BotUserAgents, "bot_user_agents"); err != nil {
+		return nil, nil, err
+	}
+	if !c.ReplaceDefaultBots {
+		bots.substrings = append(newUAMatcher(defaultBotUserAgents).substrings, bots.substrings...)
+	}
+	if allowed, err = parseUAMatcher(c.AllowedUserAgents, "allowed_user_agents"); err != nil {
+		return nil, nil, err
+	}
+	return bots, allowed, nil
+}
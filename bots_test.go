@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const (
+	chromeUA    = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36"
+	firefoxUA   = "Mozilla/5.0 (X11; Linux x86_64; rv:125.0) Gecko/20100101 Firefox/125.0"
+	safariUA    = "Mozilla/5.0 (iPhone; CPU iPhone OS 17_4 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.4 Mobile/15E148 Safari/604.1"
+	googlebotUA = "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)"
+	bingbotUA   = "Mozilla/5.0 (compatible; bingbot/2.0; +http://www.bing.com/bingbot.htm)"
+	camoUA      = "github-camo (876de43e)"
+	curlUA      = "curl/8.5.0"
+	uptimeUA    = "Mozilla/5.0+(compatible; UptimeRobot/2.0; http://www.uptimerobot.com/)"
+	pythonUA    = "python-requests/2.31.0"
+	slackUA     = "Slackbot-LinkExpanding 1.0 (+https://api.slack.com/robots)"
+)
+
+func TestIsBot(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+		ua     string
+		want   bool
+	}{
+		{"Chrome", Config{}, chromeUA, false},
+		{"Firefox", Config{}, firefoxUA, false},
+		{"Safari", Config{}, safariUA, false},
+		{"Googlebot", Config{}, googlebotUA, true},
+		{"bingbot", Config{}, bingbotUA, true},
+		{"GitHub camo", Config{}, camoUA, true},
+		{"curl", Config{}, curlUA, true},
+		{"UptimeRobot", Config{}, uptimeUA, true},
+		{"python-requests", Config{}, pythonUA, true},
+		{"custom substring", Config{BotUserAgents: []string{"firefox"}}, firefoxUA, true},
+		{"custom regex", Config{BotUserAgents: []string{`/Chrome\/12\d/`}}, chromeUA, true},
+		{"custom regex is case-sensitive", Config{BotUserAgents: []string{`/chrome/`}}, chromeUA, false},
+		{"custom entries add to the defaults", Config{BotUserAgents: []string{"firefox"}}, curlUA, true},
+		{"replaced defaults", Config{BotUserAgents: []string{"firefox"}, ReplaceDefaultBots: true}, curlUA, false},
+		{"allowed bot", Config{AllowedUserAgents: []string{"slackbot"}}, slackUA, false},
+		{"allow-list leaves other bots", Config{AllowedUserAgents: []string{"slackbot"}}, googlebotUA, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, tt.config)
+			if got := isBot(tt.ua); got != tt.want {
+				t.Errorf("isBot(%q) = %v, want %v", tt.ua, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBotFilterRejectsBadEntries(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+	}{
+		{"bad bot regex", Config{BotUserAgents: []string{"/(/"}}},
+		{"empty bot entry", Config{BotUserAgents: []string{""}}},
+		{"bad allowed regex", Config{AllowedUserAgents: []string{"/[/"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := botFilter(&tt.config); err == nil {
+				t.Error("botFilter accepted the entry")
+			}
+		})
+	}
+}
+
+func TestBotsStillGetImage(t *testing.T) {
+	useConfig(t, withTestCreds(Config{}))
+	tests := []struct {
+		name     string
+		ua       string
+		wantSent int
+	}{
+		{"Googlebot", googlebotUA, 0},
+		{"GitHub camo", camoUA, 0},
+		{"Chrome", chromeUA, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sender := &recordingSender{}
+			before := botHits.Value()
+			r := httptest.NewRequest("GET", "/acct/page?pixel", nil)
+			r.Header.Set("User-Agent", tt.ua)
+			w := httptest.NewRecorder()
+			(&server{sender: sender}).handler(w, r)
+
+			if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/gif" {
+				t.Errorf("got %d %s, want the pixel", w.Code, w.Header().Get("Content-Type"))
+			}
+			if n := len(sender.sent()); n != tt.wantSent {
+				t.Errorf("sent %d hits, want %d", n, tt.wantSent)
+			}
+			if got := botHits.Value() - before; int(got) != 1-tt.wantSent {
+				t.Errorf("beacon_bot_hits_total rose by %v, want %d", got, 1-tt.wantSent)
+			}
+		})
+	}
+}
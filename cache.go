@@ -0,0 +1,94 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// ttlCache is a size-bounded LRU whose entries also expire after a fixed TTL.
+// It backs the various short-lived per-client lookups so none of them can
+// grow without bound.
+type ttlCache[V any] struct {
+	mu    sync.Mutex
+	max   int
+	ttl   time.Duration
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+type ttlEntry[V any] struct {
+	key     string
+	value   V
+	expires time.Time
+}
+
+func newTTLCache[V any](max int, ttl time.Duration) *ttlCache[V] {
+	return &ttlCache[V]{
+		max:   max,
+		ttl:   ttl,
+		ll:    list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+// Get returns the live value stored under key, if any.
+func (c *ttlCache[V]) Get(key string, now time.Time) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var zero V
+	el, ok := c.items[key]
+	if !ok {
+		return zero, false
+	}
+	e := el.Value.(*ttlEntry[V])
+	if now.After(e.expires) {
+		c.remove(el)
+		return zero, false
+	}
+	c.ll.MoveToFront(el)
+	return e.value, true
+}
+
+// Add stores value under key, resetting its expiry and evicting the least
+// recently used entry when the cache is full.
+func (c *ttlCache[V]) Add(key string, value V, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		e := el.Value.(*ttlEntry[V])
+		e.value = value
+		e.expires = now.Add(c.ttl)
+		c.ll.MoveToFront(el)
+		return
+	}
+
+	c.items[key] = c.ll.PushFront(&ttlEntry[V]{key: key, value: value, expires: now.Add(c.ttl)})
+	for c.max > 0 && c.ll.Len() > c.max {
+		c.remove(c.ll.Back())
+	}
+}
+
+// Delete removes key, if present.
+func (c *ttlCache[V]) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		c.remove(el)
+	}
+}
+
+// Len returns the number of entries, including any not yet swept.
+func (c *ttlCache[V]) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ll.Len()
+}
+
+func (c *ttlCache[V]) remove(el *list.Element) {
+	c.ll.Remove(el)
+	delete(c.items, el.Value.(*ttlEntry[V]).key)
+}
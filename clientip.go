@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// parseTrustedProxies parses CIDRs or single addresses.
+func parseTrustedProxies(entries []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", entry)
+			}
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %v", entry, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func isTrustedProxy(ip net.IP) bool {
+	for _, n := range config().proxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the visitor's address. Forwarding headers are only
+// believed when the immediate peer is a trusted proxy. X-Forwarded-For is
+// then walked from the right, since each proxy appends the address it saw
+// and anything further left may have been sent by the client: the first
+// hop that isn't itself a trusted proxy wins. Without one, X-Real-IP is
+// used.
+func clientIP(r *http.Request) string {
+	peer := hostIP(r.RemoteAddr)
+	if peer == nil {
+		return r.RemoteAddr
+	}
+	if !isTrustedProxy(peer) {
+		return peer.String()
+	}
+
+	hops := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := hostIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			// A malformed hop can't be vouched for, and nor can
+			// anything to its left.
+			break
+		}
+		if !isTrustedProxy(ip) {
+			return ip.String()
+		}
+	}
+	if ip := hostIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); ip != nil {
+		return ip.String()
+	}
+	return peer.String()
+}
+
+// anonymizeIP zeroes the last octet of an IPv4 address or the last 80 bits
+// of an IPv6 address, returning "" for anything unparseable.
+func anonymizeIP(ip string) string {
+	addr := hostIP(ip)
+	if addr == nil {
+		return ""
+	}
+	if v4 := addr.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return addr.Mask(net.CIDRMask(48, 128)).String()
+}
+
+// anonymizeIPEnabled reports whether anonymize_ip is on, as it is unless
+// set to false.
+func anonymizeIPEnabled() bool {
+	return config().AnonymizeIP == nil || *config().AnonymizeIP
+}
+
+// isHTTPS reports whether r reached us, or the proxy in front of us, over
+// HTTPS. X-Forwarded-Proto is only believed from trusted_proxies.
+func isHTTPS(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+	peer := hostIP(r.RemoteAddr)
+	return peer != nil && isTrustedProxy(peer) && r.Header.Get("X-Forwarded-Proto") == "https"
+}
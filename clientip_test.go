@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	useConfig(t, Config{TrustedProxies: []string{"10.0.0.0/8", "192.0.2.1"}})
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  string
+		realIP     string
+		want       string
+	}{
+		{"direct", "203.0.113.7:1234", "", "", "203.0.113.7"},
+		{"untrusted peer's headers ignored", "203.0.113.7:1234", "198.51.100.1", "198.51.100.2", "203.0.113.7"},
+		{"single hop", "10.0.0.1:1234", "198.51.100.1", "", "198.51.100.1"},
+		{"multi hop through trusted proxies", "10.0.0.1:1234", "198.51.100.1, 192.0.2.1, 10.1.2.3", "", "198.51.100.1"},
+		{"spoofed leftmost entry", "10.0.0.1:1234", "1.2.3.4, 198.51.100.1", "", "198.51.100.1"},
+		{"private client behind proxy", "10.0.0.1:1234", "172.16.0.5", "", "172.16.0.5"},
+		{"malformed hop stops the walk", "10.0.0.1:1234", "198.51.100.1, junk", "198.51.100.9", "198.51.100.9"},
+		{"all hops trusted falls back to X-Real-IP", "10.0.0.1:1234", "10.0.0.2", "198.51.100.3", "198.51.100.3"},
+		{"no headers", "10.0.0.1:1234", "", "", "10.0.0.1"},
+		{"ipv6 peer", "[2001:db8::1]:1234", "", "", "2001:db8::1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/acct/page", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.forwarded != "" {
+				r.Header.Set("X-Forwarded-For", tt.forwarded)
+			}
+			if tt.realIP != "" {
+				r.Header.Set("X-Real-IP", tt.realIP)
+			}
+			if got := clientIP(r); got != tt.want {
+				t.Errorf("clientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAnonymizeIP(t *testing.T) {
+	tests := []struct {
+		ip, want string
+	}{
+		{"203.0.113.77", "203.0.113.0"},
+		{"203.0.113.77:8080", "203.0.113.0"},
+		{"::ffff:203.0.113.77", "203.0.113.0"},
+		{"2001:db8:85a3:8d3:1319:8a2e:370:7348", "2001:db8:85a3::"},
+		{"[2001:db8:85a3:8d3::1]:443", "2001:db8:85a3::"},
+		{"::1", "::"},
+		{"", ""},
+		{"not-an-ip", ""},
+		{"300.1.2.3", ""},
+		{"2001:db8::zz", ""},
+	}
+	for _, tt := range tests {
+		if got := anonymizeIP(tt.ip); got != tt.want {
+			t.Errorf("anonymizeIP(%q) = %q, want %q", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestIPAddressParam(t *testing.T) {
+	off := false
+	tests := []struct {
+		name   string
+		config Config
+		ip     string
+		want   string
+	}{
+		{"IPv4 anonymized by default", Config{}, "203.0.113.77", "203.0.113.0"},
+		{"IPv6 anonymized by default", Config{}, "2001:db8:85a3:8d3::1", "2001:db8:85a3::"},
+		{"anonymize_ip off", Config{AnonymizeIP: &off}, "203.0.113.77", "203.0.113.77"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, tt.config)
+			if got := hitEventParams(t, tt.ip)["ip_address"]; got != tt.want {
+				t.Errorf("ip_address = %v, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	// Largest request body /collect/ accepts unless max_body_bytes is set.
+	defaultMaxBodyBytes = 64 << 10
+
+	// GA4 takes at most this many events per request.
+	maxPayloadEvents = 25
+
+	maxEventNameLength = 40
+)
+
+var eventNamePattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]*$`)
+
+// Prefixes GA4 reserves for its own event and param names, and the
+// event names it reserves.
+var (
+	reservedEventPrefixes = []string{"_", "ga_", "google_", "firebase_"}
+	reservedEventNames    = map[string]bool{
+		"ad_activeview": true, "ad_click": true, "ad_exposure": true, "ad_impression": true,
+		"ad_query": true, "adunit_exposure": true, "app_clear_data": true, "app_install": true,
+		"app_update": true, "app_remove": true, "error": true, "first_open": true,
+		"first_visit": true, "in_app_purchase": true, "notification_dismiss": true,
+		"notification_foreground": true, "notification_open": true, "notification_receive": true,
+		"os_update": true, "screen_view": true, "session_start": true, "user_engagement": true,
+	}
+)
+
+// collectRequest is the body of POST /collect/<account>.
+type collectRequest struct {
+	ClientID string     `json:"client_id"`
+	UserID   string     `json:"user_id"`
+	Events   []GA4Event `json:"events"`
+}
+
+// validateName checks name against GA4's rules for the names of events
+// (kind "event") or event params (kind "param").
+func validateName(kind, name string) error {
+	max := maxEventNameLength
+	if kind == "param" {
+		max = maxParamNameLength
+	}
+	if len(name) > max {
+		return fmt.Errorf("%s name %q is longer than %d characters", kind, name, max)
+	}
+	if !eventNamePattern.MatchString(name) {
+		return fmt.Errorf("%s name %q must start with a letter and contain only letters, digits and underscores", kind, name)
+	}
+	lower := strings.ToLower(name)
+	for _, prefix := range reservedEventPrefixes {
+		if strings.HasPrefix(lower, prefix) {
+			return fmt.Errorf("%s name %q uses the reserved prefix %q", kind, name, prefix)
+		}
+	}
+	if kind == "event" && reservedEventNames[lower] {
+		return fmt.Errorf("event name %q is reserved", name)
+	}
+	return nil
+}
+
+// checkParamNames drops params GA4 would reject from params, with a
+// warning, or with strict_names returns an error for the first of them.
+func checkParamNames(c context.Context, params map[string]interface{}) error {
+	for name := range params {
+		if err := validateName("param", name); err != nil {
+			if config().StrictNames {
+				return err
+			}
+			logger(c).Warn("dropping param", "err", err)
+			delete(params, name)
+		}
+	}
+	return nil
+}
+
+// maxBodyBytes is the largest /collect/ body accepted; longer ones get 413.
+func maxBodyBytes() int64 {
+	if config().MaxBodyBytes > 0 {
+		return config().MaxBodyBytes
+	}
+	return defaultMaxBodyBytes
+}
+
+// collectHandler accepts custom events for an account as JSON, fills in
+// what the beacon knows about the client, and delivers them like a hit.
+func (s *server) collectHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := withRequestID(r.Context(), incomingRequestID(r))
+	received := time.Now()
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	account := strings.Trim(strings.TrimPrefix(r.URL.Path, "/collect/"), "/")
+	if account == "" || strings.Contains(account, "/") {
+		http.Error(w, "expected /collect/<account>", http.StatusNotFound)
+		return
+	}
+	if !validAccount(account) {
+		http.Error(w, "invalid account", http.StatusBadRequest)
+		return
+	}
+	account = normalizeAccount(account)
+	if retiredAccount(account) {
+		http.Error(w, "account retired", http.StatusGone)
+		return
+	}
+	if !allowedAccount(account) {
+		http.NotFound(w, r)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodyBytes()))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, "body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, "cannot read body", http.StatusBadRequest)
+		return
+	}
+	var req collectRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		http.Error(w, "malformed JSON body", http.StatusBadRequest)
+		return
+	}
+	if len(req.Events) == 0 || len(req.Events) > maxPayloadEvents {
+		http.Error(w, fmt.Sprintf("expected 1 to %d events", maxPayloadEvents), http.StatusBadRequest)
+		return
+	}
+	for _, event := range req.Events {
+		if err := validateName("event", event.Name); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := checkParamNames(ctx, event.Params); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if req.ClientID != "" && !clientIDPattern.MatchString(req.ClientID) {
+		http.Error(w, "malformed client_id", http.StatusBadRequest)
+		return
+	}
+	if req.UserID != "" && !validUserID(req.UserID) {
+		http.Error(w, "invalid user_id", http.StatusBadRequest)
+		return
+	}
+
+	query := r.URL.Query()
+	hitsReceived.Inc("account", metricAccount(account), "type", "collect")
+	if trackingDenied(r.Header, query) && skipDeniedHits() {
+		hitsNotTracked.Inc()
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	cid := req.ClientID
+	if cid == "" {
+		if cookie, err := readCookie(r, cidCookieName()); err == nil {
+			cid = cookie.Value
+		} else if config().StableCIDFallback {
+			cid = stableClientID(clientIP(r), r.Header.Get("User-Agent"))
+		} else if err := generateUUID(&cid); err != nil {
+			http.Error(w, "cannot generate client id", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	ip, ua := clientIP(r), r.Header.Get("User-Agent")
+	if rateLimited(ip, cid, received) {
+		hitsDropped.Inc("reason", "rate_limited")
+		http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+		return
+	}
+	key := idempotencyKey(r.Header, query)
+	if repeatedKey(account, key, received) {
+		hitsDropped.Inc("reason", "repeated_key")
+		logger(ctx).Info("skipping events with an idempotency key already seen", "cid", cid)
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	session := touchSession(r, cid, received)
+	for i := range req.Events {
+		params := req.Events[i].Params
+		if params == nil {
+			params = map[string]interface{}{}
+		}
+		defaults := map[string]interface{}{
+			"session_id":     session.ID,
+			"session_number": session.Number,
+			"user_agent":     ua,
+		}
+		if config().ParseUserAgent {
+			addDeviceParams(defaults, ua)
+		}
+		if config().IPMode != "none" {
+			if anonymizeIPEnabled() {
+				defaults["ip_address"] = anonymizeIP(ip)
+			} else {
+				defaults["ip_address"] = ip
+			}
+		}
+		mergeParams(ctx, params, defaults, nil)
+		req.Events[i].Params = params
+	}
+
+	payload := GA4Payload{
+		UserID:             req.UserID,
+		TimestampMicros:    received.UnixMicro(),
+		NonPersonalizedAds: config().NonPersonalizedAds || isTruthy(query.Get("npa")),
+		Events:             req.Events,
+		Received:           received,
+	}
+	setClientIdentity(&payload, query, cid)
+	if trackingDenied(r.Header, query) {
+		payload.Consent = &Consent{AdUserData: consentDenied, AdPersonalization: consentDenied}
+		payload.NonPersonalizedAds = true
+	} else {
+		payload.Consent = requestedConsent(query)
+	}
+	publishDebugEvent(account, payload)
+
+	creds, ok := credentialsFor(ctx, account, query.Get("stream"))
+	if !ok {
+		forgetKey(account, key)
+		http.Error(w, "no GA4 property configured for account", http.StatusNotFound)
+		return
+	}
+	logger(ctx).Info("collected events", "account", account, "cid", cid, "events", len(payload.Events))
+	meta := HitMeta{Creds: creds, Account: account, UA: ua, IP: ip, CID: cid, Stream: query.Get("stream"), Beacon: beaconPrefix(ctx), RequestID: requestID(ctx)}
+	if err := s.sender.Send(ctx, meta, payload); err != nil {
+		forgetKey(account, key)
+		logger(ctx).Error("cannot deliver collected events", "cid", cid, "err", err)
+		http.Error(w, "cannot deliver events", http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
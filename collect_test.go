@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestValidateName(t *testing.T) {
+	tests := []struct {
+		kind, name string
+		wantErr    bool
+	}{
+		{"event", "cta_click", false},
+		{"event", "Download2", false},
+		{"event", strings.Repeat("a", maxEventNameLength), false},
+		{"event", strings.Repeat("a", maxEventNameLength+1), true},
+		{"event", "2fast", true},
+		{"event", "cta-click", true},
+		{"event", "", true},
+		{"event", "_internal", true},
+		{"event", "ga_thing", true},
+		{"event", "Firebase_x", true},
+		{"event", "session_start", true},
+		{"event", "First_Visit", true},
+		{"param", "session_start", false},
+		{"param", strings.Repeat("p", maxParamNameLength+1), true},
+	}
+	for _, tt := range tests {
+		if err := validateName(tt.kind, tt.name); (err != nil) != tt.wantErr {
+			t.Errorf("validateName(%q, %q) = %v, want error: %v", tt.kind, tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestCollectHandler(t *testing.T) {
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		body     string
+		wantCode int
+		wantSent bool
+	}{
+		{"valid event", "POST", "/collect/acct", `{"client_id": "1234.5678", "events": [{"name": "cta_click", "params": {"button": "signup"}}]}`, http.StatusAccepted, true},
+		{"without client_id", "POST", "/collect/acct", `{"events": [{"name": "download"}]}`, http.StatusAccepted, true},
+		{"bad event name", "POST", "/collect/acct", `{"events": [{"name": "cta-click"}]}`, http.StatusBadRequest, false},
+		{"reserved event name", "POST", "/collect/acct", `{"events": [{"name": "session_start"}]}`, http.StatusBadRequest, false},
+		{"no events", "POST", "/collect/acct", `{"events": []}`, http.StatusBadRequest, false},
+		{"too many events", "POST", "/collect/acct", `{"events": [` + strings.Repeat(`{"name":"e"},`, maxPayloadEvents) + `{"name":"e"}]}`, http.StatusBadRequest, false},
+		{"malformed JSON", "POST", "/collect/acct", `{"events": [`, http.StatusBadRequest, false},
+		{"malformed client_id", "POST", "/collect/acct", `{"client_id": "<x>", "events": [{"name": "download"}]}`, http.StatusBadRequest, false},
+		{"user_id", "POST", "/collect/acct", `{"user_id": "user-42", "events": [{"name": "download"}]}`, http.StatusAccepted, true},
+		{"blank user_id", "POST", "/collect/acct", `{"user_id": " ", "events": [{"name": "download"}]}`, http.StatusBadRequest, false},
+		{"oversized body", "POST", "/collect/acct", `{"events": [{"name": "download", "params": {"pad": "` + strings.Repeat("x", 600) + `"}}]}`, http.StatusRequestEntityTooLarge, false},
+		{"GET", "GET", "/collect/acct", ``, http.StatusMethodNotAllowed, false},
+		{"no account", "POST", "/collect/", `{"events": [{"name": "download"}]}`, http.StatusNotFound, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, withTestCreds(Config{MaxBodyBytes: 512}))
+			sender := &recordingSender{}
+			r := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			r.Header.Set("User-Agent", "test-agent/1.0")
+			w := httptest.NewRecorder()
+			(&server{sender: sender}).collectHandler(w, r)
+
+			if w.Code != tt.wantCode {
+				t.Errorf("status %d, want %d: %s", w.Code, tt.wantCode, w.Body)
+			}
+			sent := sender.sent()
+			if (len(sent) == 1) != tt.wantSent || len(sent) > 1 {
+				t.Fatalf("sent %d payloads, want one: %v", len(sent), tt.wantSent)
+			}
+			if !tt.wantSent {
+				return
+			}
+			p := sent[0].Payload
+			if p.ClientID == "" || sent[0].Meta.Account != "acct" {
+				t.Errorf("client_id %q, account %q: want a client id and account acct", p.ClientID, sent[0].Meta.Account)
+			}
+			params := p.Events[0].Params
+			for _, k := range []string{"session_id", "session_number", "ip_address"} {
+				if _, ok := params[k]; !ok {
+					t.Errorf("%s not merged into the event: %v", k, params)
+				}
+			}
+			if params["user_agent"] != "test-agent/1.0" {
+				t.Errorf("user_agent = %v, want the request's", params["user_agent"])
+			}
+		})
+	}
+}
+
+func TestStrictNames(t *testing.T) {
+	longName := strings.Repeat("k", 40)
+	tests := []struct {
+		name       string
+		strict     bool
+		target     string
+		wantSent   bool
+		wantEvent  string
+		wantParams []string // custom params expected
+	}{
+		{"lenient, bad ?event=", false, "/acct/strict-a?pixel&event=ga_click", true, "page_view", nil},
+		{"strict, bad ?event=", true, "/acct/strict-b?pixel&event=ga_click", false, "", nil},
+		{"lenient, param name repaired", false, "/acct/strict-c?pixel&utm-source=x", true, "page_view", []string{"custom_utm_source"}},
+		{"strict, param name GA4 rejects", true, "/acct/strict-d?pixel&utm-source=x", false, "", nil},
+		{"lenient, long param name cut", false, "/acct/strict-e?pixel&" + longName + "=x", true, "page_view", []string{("custom_" + longName)[:maxParamNameLength]}},
+		{"strict, long param name", true, "/acct/strict-f?pixel&" + longName + "=x", false, "", nil},
+		{"strict, valid names", true, "/acct/strict-g?pixel&event=ci_ping&plan=pro", true, "ci_ping", []string{"custom_plan"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, withTestCreds(Config{StrictNames: tt.strict}))
+			sender := &recordingSender{}
+			before := hitsDropped.Value("reason", "invalid_name")
+			serveHit(t, &server{sender: sender}, tt.target, "1234.5678")
+
+			sent := sender.sent()
+			if (len(sent) == 1) != tt.wantSent {
+				t.Fatalf("sent %d hits, want sent: %v", len(sent), tt.wantSent)
+			}
+			if !tt.wantSent {
+				if dropped := hitsDropped.Value("reason", "invalid_name") - before; dropped != 1 {
+					t.Errorf("beacon_hits_dropped_total{reason=invalid_name} rose by %v, want 1", dropped)
+				}
+				return
+			}
+			e := sent[0].Payload.Events[len(sent[0].Payload.Events)-1]
+			if e.Name != tt.wantEvent {
+				t.Errorf("event name = %q, want %q", e.Name, tt.wantEvent)
+			}
+			for _, p := range tt.wantParams {
+				if _, ok := e.Params[p]; !ok {
+					t.Errorf("%s missing from %v", p, e.Params)
+				}
+			}
+		})
+	}
+}
+
+func TestStrictNamesInCollect(t *testing.T) {
+	tests := []struct {
+		name     string
+		strict   bool
+		wantCode int
+	}{
+		{"lenient drops the param", false, http.StatusAccepted},
+		{"strict refuses the request", true, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, withTestCreds(Config{StrictNames: tt.strict}))
+			sender := &recordingSender{}
+			body := `{"events": [{"name": "download", "params": {"file": "a.zip", "google_id": "x"}}]}`
+			w := httptest.NewRecorder()
+			(&server{sender: sender}).collectHandler(w, httptest.NewRequest("POST", "/collect/acct", strings.NewReader(body)))
+
+			if w.Code != tt.wantCode {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.wantCode, w.Body)
+			}
+			if tt.strict {
+				return
+			}
+			params := sender.sent()[0].Payload.Events[0].Params
+			if _, ok := params["google_id"]; ok {
+				t.Error("google_id sent, want it dropped")
+			}
+			if params["file"] != "a.zip" {
+				t.Errorf("file = %v, want a.zip", params["file"])
+			}
+		})
+	}
+}
+
+func TestCollectBodyLimit(t *testing.T) {
+	const event = `{"events": [{"name": "download"}]}`
+	// padded is event with trailing whitespace making it n bytes long.
+	padded := func(n int) string { return event + strings.Repeat(" ", n-len(event)) }
+	tests := []struct {
+		name     string
+		limit    int64
+		size     int
+		wantCode int
+	}{
+		{"default limit, just under", 0, defaultMaxBodyBytes - 1, http.StatusAccepted},
+		{"default limit, at it", 0, defaultMaxBodyBytes, http.StatusAccepted},
+		{"default limit, over", 0, defaultMaxBodyBytes + 1, http.StatusRequestEntityTooLarge},
+		{"max_body_bytes, just under", 1024, 1023, http.StatusAccepted},
+		{"max_body_bytes, over", 1024, 1025, http.StatusRequestEntityTooLarge},
+		{"max_body_bytes above the default", 128 << 10, 100 << 10, http.StatusAccepted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, withTestCreds(Config{MaxBodyBytes: tt.limit}))
+			sender := &recordingSender{}
+			r := httptest.NewRequest("POST", "/collect/acct", strings.NewReader(padded(tt.size)))
+			w := httptest.NewRecorder()
+			(&server{sender: sender}).collectHandler(w, r)
+			if w.Code != tt.wantCode {
+				t.Errorf("status %d, want %d: %s", w.Code, tt.wantCode, w.Body)
+			}
+			if wantSent := tt.wantCode == http.StatusAccepted; (len(sender.sent()) == 1) != wantSent {
+				t.Errorf("sent %d payloads, want sent: %v", len(sender.sent()), wantSent)
+			}
+		})
+	}
+
+	if c := withTestCreds(Config{MaxBodyBytes: -1}); c.validate() == nil {
+		t.Error("negative max_body_bytes validated")
+	}
+}
+
+func TestMaxHeaderBytes(t *testing.T) {
+	addr := freeAddr(t)
+	newFakeCollector(t, Config{ListenAddr: addr})
+	saved := hitCounts
+	t.Cleanup(func() { hitCounts = saved })
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- run(ctx, *config()) }()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("run() = %v", err)
+		}
+	})
+	waitForListener(t, addr)
+
+	tests := []struct {
+		name     string
+		size     int
+		wantCode int
+	}{
+		{"long referer", 8 << 10, http.StatusOK},
+		{"oversized headers", 32 << 10, http.StatusRequestHeaderFieldsTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", "http://"+addr+"/healthz", nil)
+			req.Header.Set("Referer", "https://example.com/?q="+strings.Repeat("x", tt.size))
+			resp, err := http.DefaultTransport.RoundTrip(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.wantCode {
+				t.Errorf("status %d, want %d", resp.StatusCode, tt.wantCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"compress/gzip"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Content types worth compressing. Everything else (GIF, PNG) is already
+// compressed and is passed through untouched.
+var compressibleTypes = map[string]bool{
+	"text/plain":       true,
+	"text/html":        true,
+	"image/svg+xml":    true,
+	"application/json": true,
+}
+
+// Responses shorter than this are sent as they are; gzip's framing would
+// save little or nothing.
+const gzipMinSize = 512
+
+// withGzip compresses the response when the client accepts gzip, the
+// handler's Content-Type is compressible and the body reaches gzipMinSize.
+// Handlers must set Content-Type before their first Write, since that is
+// when the decision is made.
+func withGzip(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if r.Method == http.MethodHead || !acceptsGzip(r.Header.Get("Accept-Encoding")) {
+			h(w, r)
+			return
+		}
+
+		gw := &gzipResponseWriter{ResponseWriter: w}
+		defer gw.Close()
+		h(gw, r)
+	}
+}
+
+// acceptsGzip reports whether an Accept-Encoding header allows gzip.
+func acceptsGzip(header string) bool {
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if coding != "gzip" && coding != "*" {
+			continue
+		}
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if v, err := strconv.ParseFloat(q, 64); err == nil && v == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// gzipResponseWriter holds back the status and body of a compressible
+// response until it reaches gzipMinSize, then switches to gzip.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz      *gzip.Writer
+	decided bool
+
+	// Set while a compressible response is still under gzipMinSize.
+	buffering bool
+	code      int
+	buf       []byte
+}
+
+func (g *gzipResponseWriter) WriteHeader(code int) {
+	if g.decided {
+		return
+	}
+	g.decided = true
+	if g.compressible(code) {
+		g.buffering, g.code = true, code
+		return
+	}
+	g.ResponseWriter.WriteHeader(code)
+}
+
+func (g *gzipResponseWriter) Write(b []byte) (int, error) {
+	if !g.decided {
+		g.WriteHeader(http.StatusOK)
+	}
+	if g.buffering {
+		g.buf = append(g.buf, b...)
+		if len(g.buf) >= gzipMinSize {
+			if err := g.startGzip(); err != nil {
+				return 0, err
+			}
+		}
+		return len(b), nil
+	}
+	if g.gz != nil {
+		return g.gz.Write(b)
+	}
+	return g.ResponseWriter.Write(b)
+}
+
+// Close sends a response that stayed under gzipMinSize as it is, or
+// flushes any buffered compressed data.
+func (g *gzipResponseWriter) Close() error {
+	if g.buffering {
+		g.buffering = false
+		g.ResponseWriter.WriteHeader(g.code)
+		_, err := g.ResponseWriter.Write(g.buf)
+		return err
+	}
+	if g.gz == nil {
+		return nil
+	}
+	return g.gz.Close()
+}
+
+func (g *gzipResponseWriter) compressible(code int) bool {
+	h := g.Header()
+	if code == http.StatusNoContent || code == http.StatusNotModified || h.Get("Content-Encoding") != "" {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(h.Get("Content-Type"))
+	return err == nil && compressibleTypes[mediaType]
+}
+
+func (g *gzipResponseWriter) startGzip() error {
+	g.buffering = false
+
+	h := g.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Encoding", "gzip")
+	g.ResponseWriter.WriteHeader(g.code)
+	g.gz = gzip.NewWriter(g.ResponseWriter)
+	_, err := g.gz.Write(g.buf)
+	g.buf = nil
+	return err
+}
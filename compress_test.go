@@ -0,0 +1,147 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestWithGzip(t *testing.T) {
+	large := `{"items":[` + strings.Repeat(`"value",`, 200) + `"end"]}`
+	tests := []struct {
+		name           string
+		acceptEncoding string
+		contentType    string
+		body           string
+		wantGzip       bool
+	}{
+		{"large JSON, gzip accepted", "gzip, deflate", "application/json", large, true},
+		{"wildcard", "*", "application/json", large, true},
+		{"no Accept-Encoding", "", "application/json", large, false},
+		{"gzip refused", "gzip;q=0, identity", "application/json", large, false},
+		{"other codings only", "br, deflate", "application/json", large, false},
+		{"small body", "gzip", "application/json", `{"ok":true}`, false},
+		{"already compressed type", "gzip", "image/gif", large, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := withGzip(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tt.contentType)
+				io.WriteString(w, tt.body)
+			})
+			r := httptest.NewRequest("GET", "/export", nil)
+			if tt.acceptEncoding != "" {
+				r.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+			w := httptest.NewRecorder()
+			h(w, r)
+
+			if vary := w.Header().Values("Vary"); !strings.Contains(strings.Join(vary, ","), "Accept-Encoding") {
+				t.Errorf("Vary = %q, want Accept-Encoding", vary)
+			}
+			if ct := w.Header().Get("Content-Type"); ct != tt.contentType {
+				t.Errorf("Content-Type = %q, want %q", ct, tt.contentType)
+			}
+			body := w.Body.String()
+			if gotGzip := w.Header().Get("Content-Encoding") == "gzip"; gotGzip != tt.wantGzip {
+				t.Fatalf("gzip-encoded = %v, want %v", gotGzip, tt.wantGzip)
+			}
+			if tt.wantGzip {
+				zr, err := gzip.NewReader(w.Body)
+				if err != nil {
+					t.Fatalf("gzip.NewReader: %v", err)
+				}
+				b, err := io.ReadAll(zr)
+				if err != nil {
+					t.Fatalf("reading gzip body: %v", err)
+				}
+				body = string(b)
+			}
+			if body != tt.body {
+				t.Errorf("body = %q, want %q", body, tt.body)
+			}
+		})
+	}
+}
+
+func TestBeaconResponsesAreGzipped(t *testing.T) {
+	useConfig(t, Config{})
+	if err := loadAssets(""); err != nil {
+		t.Fatal(err)
+	}
+	hitCounts = fixedCountStore{1234}
+	t.Cleanup(func() { hitCounts = newMemoryCounterStore() })
+	mux := newMux(&server{sender: &recordingSender{}})
+	fetch := func(target, acceptEncoding string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", target, nil)
+		if acceptEncoding != "" {
+			r.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w
+	}
+
+	tests := []struct {
+		name     string
+		target   string
+		wantGzip bool
+	}{
+		{"svg badge", "/acct/page", true},
+		{"flat svg badge", "/acct/page?style=flat", true},
+		{"account page", "/acct", true},
+		{"gif badge", "/acct/page?gif", false},
+		{"pixel", "/acct/page?pixel", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plain := fetch(tt.target, "")
+			if ce := plain.Header().Get("Content-Encoding"); ce != "" {
+				t.Fatalf("without Accept-Encoding: Content-Encoding = %q, want none", ce)
+			}
+			w := fetch(tt.target, "gzip")
+			if gotGzip := w.Header().Get("Content-Encoding") == "gzip"; gotGzip != tt.wantGzip {
+				t.Fatalf("gzip-encoded = %v, want %v", gotGzip, tt.wantGzip)
+			}
+			body := w.Body.Bytes()
+			if tt.wantGzip {
+				zr, err := gzip.NewReader(w.Body)
+				if err != nil {
+					t.Fatalf("gzip.NewReader: %v", err)
+				}
+				if body, err = io.ReadAll(zr); err != nil {
+					t.Fatalf("reading gzip body: %v", err)
+				}
+			}
+			// The account page's script nonce is new on every request.
+			nonce := regexp.MustCompile(`nonce="[^"]*"`)
+			body = nonce.ReplaceAll(body, nil)
+			if want := nonce.ReplaceAllString(plain.Body.String(), ""); string(body) != want {
+				t.Errorf("body with gzip differs from the plain one:\n%s\nwant\n%s", body, want)
+			}
+		})
+	}
+}
+
+func TestMetricsAreGzipped(t *testing.T) {
+	r := httptest.NewRequest("GET", "/metrics", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	newMux(&server{sender: &recordingSender{}}).ServeHTTP(w, r)
+
+	if w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("/metrics not gzip-encoded; headers %v", w.Header())
+	}
+	zr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(zr)
+	if !strings.Contains(string(b), "# TYPE beacon_hits_dropped_total counter") {
+		t.Errorf("decompressed /metrics lacks beacon_hits_dropped_total:\n%s", b)
+	}
+}
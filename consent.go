@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+var hitsNotTracked = newCounter("beacon_hits_not_tracked_total", "Hits not sent to GA because the visitor opted out with Do Not Track or ?consent=denied.")
+
+// Consent is the Measurement Protocol consent object.
+type Consent struct {
+	AdUserData        string `json:"ad_user_data,omitempty"`
+	AdPersonalization string `json:"ad_personalization,omitempty"`
+}
+
+const (
+	consentGranted = "GRANTED"
+	consentDenied  = "DENIED"
+)
+
+// Consent types accepted as ?consent_<type>= and in consent_defaults. The
+// Measurement Protocol's consent object has no analytics_storage, so
+// denying it opts the visitor out like ?consent=denied.
+var consentTypes = []string{"ad_user_data", "ad_personalization", "analytics_storage"}
+
+// parseConsent maps "granted" or "denied", in any case, to the value GA4
+// expects, and anything else to "".
+func parseConsent(v string) string {
+	switch strings.ToLower(v) {
+	case "granted":
+		return consentGranted
+	case "denied":
+		return consentDenied
+	}
+	return ""
+}
+
+// consentValue returns the hit's consent for typ from ?consent_<typ>=, or
+// else from consent_defaults, or "" if neither gives a valid value.
+func consentValue(query url.Values, typ string) string {
+	if v := parseConsent(query.Get("consent_" + typ)); v != "" {
+		return v
+	}
+	return parseConsent(config().ConsentDefaults[typ])
+}
+
+// requestedConsent returns the consent object for a hit whose visitor
+// didn't opt out, or nil when nothing is known about their ad consent.
+func requestedConsent(query url.Values) *Consent {
+	c := Consent{
+		AdUserData:        consentValue(query, "ad_user_data"),
+		AdPersonalization: consentValue(query, "ad_personalization"),
+	}
+	if c == (Consent{}) {
+		return nil
+	}
+	return &c
+}
+
+// trackingDenied reports whether the visitor opted out, with ?consent=denied,
+// analytics_storage consent denied or, when respect_dnt is set, a DNT: 1
+// header.
+func trackingDenied(header http.Header, query url.Values) bool {
+	if query.Get("consent") == "denied" || consentValue(query, "analytics_storage") == consentDenied {
+		return true
+	}
+	return config().RespectDNT && header.Get("DNT") == "1"
+}
+
+// skipDeniedHits reports whether hits from visitors who opted out are
+// dropped, rather than sent with consent denied.
+func skipDeniedHits() bool {
+	return config().DeniedConsentMode != "send"
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTrackingDenied(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   Config
+		target   string
+		dnt      string
+		wantSent int
+		wantDeny bool // payload sent with consent denied
+	}{
+		{"tracked", Config{}, "/acct/page?pixel", "", 1, false},
+		{"DNT ignored by default", Config{}, "/acct/page?pixel", "1", 1, false},
+		{"DNT respected", Config{RespectDNT: true}, "/acct/page?pixel", "1", 0, false},
+		{"DNT: 0", Config{RespectDNT: true}, "/acct/page?pixel", "0", 1, false},
+		{"consent=denied", Config{}, "/acct/page?pixel&consent=denied", "", 0, false},
+		{"analytics_storage denied", Config{}, "/acct/page?pixel&consent_analytics_storage=denied", "", 0, false},
+		{"badge with DNT", Config{RespectDNT: true}, "/acct/page", "1", 0, false},
+		{"sent with consent denied", Config{RespectDNT: true, DeniedConsentMode: "send"}, "/acct/page?pixel", "1", 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, withTestCreds(tt.config))
+			sender := &recordingSender{}
+			r := httptest.NewRequest("GET", tt.target, nil)
+			if tt.dnt != "" {
+				r.Header.Set("DNT", tt.dnt)
+			}
+			w := httptest.NewRecorder()
+			(&server{sender: sender}).handler(w, r)
+
+			if w.Code != http.StatusOK {
+				t.Errorf("status %d, want the image served", w.Code)
+			}
+			sent := sender.sent()
+			if len(sent) != tt.wantSent {
+				t.Fatalf("sent %d hits, want %d", len(sent), tt.wantSent)
+			}
+			if len(sent) == 0 {
+				return
+			}
+			p := sent[0].Payload
+			denied := p.Consent != nil && p.Consent.AdUserData == consentDenied && p.Consent.AdPersonalization == consentDenied && p.NonPersonalizedAds
+			if denied != tt.wantDeny {
+				t.Errorf("consent %+v, npa %v: denied = %v, want %v", p.Consent, p.NonPersonalizedAds, denied, tt.wantDeny)
+			}
+		})
+	}
+}
+
+func TestConsentObject(t *testing.T) {
+	tests := []struct {
+		name     string
+		defaults map[string]string
+		query    string
+		want     string // JSON of the consent object, "" when omitted
+	}{
+		{"none", nil, "", ""},
+		{"ad_user_data", nil, "consent_ad_user_data=granted", `{"ad_user_data":"GRANTED"}`},
+		{"both", nil, "consent_ad_user_data=granted&consent_ad_personalization=denied", `{"ad_user_data":"GRANTED","ad_personalization":"DENIED"}`},
+		{"any case", nil, "consent_ad_personalization=Denied", `{"ad_personalization":"DENIED"}`},
+		{"invalid value", nil, "consent_ad_user_data=maybe", ""},
+		{"analytics_storage granted only", nil, "consent_analytics_storage=granted", ""},
+		{"consent_defaults", map[string]string{"ad_user_data": "denied"}, "", `{"ad_user_data":"DENIED"}`},
+		{"query beats consent_defaults", map[string]string{"ad_user_data": "denied"}, "consent_ad_user_data=granted", `{"ad_user_data":"GRANTED"}`},
+		{"invalid query falls back", map[string]string{"ad_user_data": "denied"}, "consent_ad_user_data=yes", `{"ad_user_data":"DENIED"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, Config{ConsentDefaults: tt.defaults})
+			p := payloadFor(t, httptest.NewRequest("GET", "/acct/page?pixel&"+tt.query, nil), "192.0.2.1")
+			b, err := json.Marshal(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var fields map[string]json.RawMessage
+			json.Unmarshal(b, &fields)
+			if got := string(fields["consent"]); got != tt.want {
+				t.Errorf("consent = %s, want %s", got, tt.want)
+			}
+			for k := range p.Events[len(p.Events)-1].Params {
+				if strings.HasPrefix(k, "custom_consent") {
+					t.Errorf("%s sent, want consent_* params reserved", k)
+				}
+			}
+		})
+	}
+}
+
+func TestConsentDefaultsValidated(t *testing.T) {
+	tests := []struct {
+		defaults map[string]string
+		wantErr  bool
+	}{
+		{map[string]string{"ad_user_data": "granted", "analytics_storage": "DENIED"}, false},
+		{map[string]string{"ad_storage": "granted"}, true},
+		{map[string]string{"ad_personalization": "yes"}, true},
+	}
+	for _, tt := range tests {
+		c := withTestCreds(Config{ConsentDefaults: tt.defaults})
+		if err := c.validate(); (err != nil) != tt.wantErr {
+			t.Errorf("consent_defaults %v: validate() = %v, want error: %v", tt.defaults, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// Default limit on the size of a single tracking cookie as read or written.
+// Real cids are a few dozen bytes, so anything near this is not ours.
+const defaultMaxCookieBytes = 256
+
+var cookiesRejected = newCounter("beacon_cookies_rejected_total", "Tracking cookies ignored or not set for exceeding max_cookie_bytes.")
+
+func maxCookieBytes() int {
+	if config().MaxCookieBytes > 0 {
+		return config().MaxCookieBytes
+	}
+	return defaultMaxCookieBytes
+}
+
+// cookieBytes is what c adds to the Cookie header browsers send back:
+// its name and value. Attributes such as Path and Domain stay with the
+// browser, so they don't count.
+func cookieBytes(c *http.Cookie) int {
+	return len(c.Name) + len("=") + len(c.Value)
+}
+
+// readCookie returns the named cookie, treating one larger than
+// max_cookie_bytes as absent so the caller mints a fresh value instead of
+// trusting unbounded client data.
+func readCookie(r *http.Request, name string) (*http.Cookie, error) {
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return nil, err
+	}
+	if n := cookieBytes(cookie); n > maxCookieBytes() {
+		cookiesRejected.Inc()
+		logger(r.Context()).Warn("ignoring oversized cookie", "cookie", name, "bytes", n)
+		return nil, http.ErrNoCookie
+	}
+	return cookie, nil
+}
+
+// setCookies writes the given cookies only if together they stay within
+// max_cookie_bytes, measured as readCookie does, so we never grow the
+// Cookie header past what proxies in front of the beacon accept.
+func setCookies(w http.ResponseWriter, cookies ...*http.Cookie) bool {
+	size := 0
+	names := make([]string, 0, len(cookies))
+	for _, c := range cookies {
+		size += cookieBytes(c)
+		names = append(names, c.Name)
+	}
+	if size > maxCookieBytes() {
+		cookiesRejected.Inc()
+		slog.Warn("not setting cookies over max_cookie_bytes", "cookies", names, "bytes", size, "max_cookie_bytes", maxCookieBytes())
+		return false
+	}
+	for _, c := range cookies {
+		http.SetCookie(w, c)
+	}
+	return true
+}
+
+// CookieConfig sets the attributes of the cid cookie.
+type CookieConfig struct {
+	Name     string `json:"name" yaml:"name"`           // default "cid"
+	Domain   string `json:"domain" yaml:"domain"`       // default: the beacon's host only
+	Path     string `json:"path" yaml:"path"`           // default: the account, e.g. /my-project
+	MaxAge   int    `json:"max_age" yaml:"max_age"`     // seconds; default: a session cookie
+	SameSite string `json:"same_site" yaml:"same_site"` // lax, strict or none
+	Secure   bool   `json:"secure" yaml:"secure"`       // always on over HTTPS
+}
+
+var sameSiteModes = map[string]http.SameSite{
+	"lax":    http.SameSiteLaxMode,
+	"strict": http.SameSiteStrictMode,
+	"none":   http.SameSiteNoneMode,
+}
+
+func cidCookieName() string {
+	if config().Cookie.Name != "" {
+		return config().Cookie.Name
+	}
+	return "cid"
+}
+
+// cidCookie builds the cookie carrying cid. Over HTTPS it defaults to
+// SameSite=None; Secure, so badges embedded on other sites keep their
+// cookie.
+func cidCookie(r *http.Request, cid, accountPath string) *http.Cookie {
+	cc := config().Cookie
+	cookie := &http.Cookie{
+		Name:   cidCookieName(),
+		Value:  cid,
+		Path:   accountPath,
+		Domain: cc.Domain,
+		MaxAge: cc.MaxAge,
+		Secure: cc.Secure || isHTTPS(r),
+	}
+	if cc.Path != "" {
+		cookie.Path = cc.Path
+	}
+	if mode, ok := sameSiteModes[strings.ToLower(cc.SameSite)]; ok {
+		cookie.SameSite = mode
+	} else if isHTTPS(r) {
+		cookie.SameSite = http.SameSiteNoneMode
+	}
+	if cookie.SameSite == http.SameSiteNoneMode {
+		// Browsers reject SameSite=None cookies without Secure.
+		cookie.Secure = true
+	}
+	return cookie
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCIDCookieAttributes(t *testing.T) {
+	tests := []struct {
+		name      string
+		cookie    CookieConfig
+		https     bool
+		forwarded string // X-Forwarded-Proto
+		peer      string
+		want      string
+	}{
+		{
+			name: "defaults over http",
+			want: "cid=abc; Path=/acct",
+		},
+		{
+			name:  "defaults over https",
+			https: true,
+			want:  "cid=abc; Path=/acct; Secure; SameSite=None",
+		},
+		{
+			name:   "configured attributes",
+			cookie: CookieConfig{Name: "vid", Domain: "example.com", Path: "/", MaxAge: 3600, SameSite: "Lax", Secure: true},
+			want:   "vid=abc; Path=/; Domain=example.com; Max-Age=3600; Secure; SameSite=Lax",
+		},
+		{
+			name:   "same_site none forces secure",
+			cookie: CookieConfig{SameSite: "none"},
+			want:   "cid=abc; Path=/acct; Secure; SameSite=None",
+		},
+		{
+			name:      "forwarded https from trusted proxy",
+			forwarded: "https",
+			peer:      "10.0.0.1:1234",
+			want:      "cid=abc; Path=/acct; Secure; SameSite=None",
+		},
+		{
+			name:      "forwarded https from untrusted peer ignored",
+			forwarded: "https",
+			peer:      "203.0.113.7:1234",
+			want:      "cid=abc; Path=/acct",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, Config{Cookie: tt.cookie, TrustedProxies: []string{"10.0.0.0/8"}})
+			r := httptest.NewRequest("GET", "/acct/page", nil)
+			if tt.https {
+				r.TLS = &tls.ConnectionState{}
+			}
+			if tt.peer != "" {
+				r.RemoteAddr = tt.peer
+			}
+			if tt.forwarded != "" {
+				r.Header.Set("X-Forwarded-Proto", tt.forwarded)
+			}
+			if got := cidCookie(r, "abc", "/acct").String(); got != tt.want {
+				t.Errorf("cookie = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsHTTPS(t *testing.T) {
+	useConfig(t, Config{TrustedProxies: []string{"10.0.0.0/8"}})
+	tests := []struct {
+		peer, proto string
+		tls         bool
+		want        bool
+	}{
+		{"203.0.113.7:1", "", false, false},
+		{"203.0.113.7:1", "", true, true},
+		{"203.0.113.7:1", "https", false, false},
+		{"10.0.0.1:1", "https", false, true},
+		{"10.0.0.1:1", "http", false, false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tt.peer
+		if tt.proto != "" {
+			r.Header.Set("X-Forwarded-Proto", tt.proto)
+		}
+		if tt.tls {
+			r.TLS = &tls.ConnectionState{}
+		}
+		if got := isHTTPS(r); got != tt.want {
+			t.Errorf("isHTTPS(peer %s, proto %q, tls %t) = %t, want %t", tt.peer, tt.proto, tt.tls, got, tt.want)
+		}
+	}
+}
+
+func TestOversizedCookieIsReplaced(t *testing.T) {
+	useConfig(t, Config{MeasurementID: "G-TEST", APISecret: "secret", MaxCookieBytes: 64})
+	sender := &recordingSender{}
+	s := &server{sender: sender}
+
+	r := httptest.NewRequest("GET", "/acct/page?pixel", nil)
+	r.AddCookie(&http.Cookie{Name: "cid", Value: strings.Repeat("x", 100)})
+	w := httptest.NewRecorder()
+	s.handler(w, r)
+
+	hits := sender.sent()
+	if len(hits) != 1 {
+		t.Fatalf("sent %d hits, want 1", len(hits))
+	}
+	cid := hits[0].Meta.CID
+	if cid == "" || strings.Contains(cid, "xxx") {
+		t.Errorf("cid = %q, want a fresh id", cid)
+	}
+	if got := w.Header().Get("Set-Cookie"); !strings.HasPrefix(got, "cid="+cid+";") {
+		t.Errorf("Set-Cookie = %q, want the fresh cid", got)
+	}
+}
+
+func TestSetCookiesMeasuresNameAndValue(t *testing.T) {
+	useConfig(t, Config{MaxCookieBytes: 64})
+	tests := []struct {
+		name   string
+		cookie *http.Cookie
+		want   bool
+	}{
+		{"long attributes", &http.Cookie{Name: "cid", Value: "abc", Path: "/" + strings.Repeat("a", 64), Domain: strings.Repeat("d", 60) + ".example.com"}, true},
+		{"at the limit", &http.Cookie{Name: "cid", Value: strings.Repeat("v", 60)}, true},
+		{"over the limit", &http.Cookie{Name: "cid", Value: strings.Repeat("v", 61)}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			if got := setCookies(w, tt.cookie); got != tt.want {
+				t.Errorf("setCookies = %t, want %t", got, tt.want)
+			}
+			if set := w.Header().Get("Set-Cookie") != ""; set != tt.want {
+				t.Errorf("Set-Cookie present = %t, want %t", set, tt.want)
+			}
+
+			// A cookie that could be set must be read back.
+			r := httptest.NewRequest("GET", "/", nil)
+			r.AddCookie(tt.cookie)
+			_, err := readCookie(r, tt.cookie.Name)
+			if (err == nil) != tt.want {
+				t.Errorf("readCookie err = %v, want accepted %t", err, tt.want)
+			}
+		})
+	}
+}
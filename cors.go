@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Methods and request headers browsers may use across origins.
+const (
+	corsAllowMethods = "GET, HEAD, POST, OPTIONS"
+	corsAllowHeaders = "Content-Type, X-Client-ID"
+)
+
+// corsOrigin returns the Access-Control-Allow-Origin value for a request
+// from origin: "*" when allowed_origins contains it, origin itself when
+// it is listed, and "" otherwise.
+func corsOrigin(origin string) string {
+	if origin == "" {
+		return ""
+	}
+	for _, allowed := range config().AllowedOrigins {
+		if allowed == "*" {
+			return "*"
+		}
+		if strings.EqualFold(allowed, origin) {
+			return origin
+		}
+	}
+	return ""
+}
+
+// withCORS lets pages on allowed_origins fetch h. Preflight OPTIONS
+// requests are answered here, with 403 for origins not on the list;
+// other requests from allowed origins get Access-Control-Allow-Origin.
+func withCORS(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(config().AllowedOrigins) == 0 {
+			h(w, r)
+			return
+		}
+		origin := r.Header.Get("Origin")
+		allow := corsOrigin(origin)
+		if allow != "*" {
+			w.Header().Add("Vary", "Origin")
+		}
+
+		if r.Method == http.MethodOptions && origin != "" && r.Header.Get("Access-Control-Request-Method") != "" {
+			if allow == "" {
+				http.Error(w, "origin not allowed", http.StatusForbidden)
+				return
+			}
+			w.Header().Set("Access-Control-Allow-Origin", allow)
+			w.Header().Set("Access-Control-Allow-Methods", corsAllowMethods)
+			w.Header().Set("Access-Control-Allow-Headers", corsAllowHeaders)
+			w.Header().Set("Access-Control-Max-Age", "86400")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		if allow != "" {
+			w.Header().Set("Access-Control-Allow-Origin", allow)
+			w.Header().Set("Access-Control-Expose-Headers", "CID")
+		}
+		h(w, r)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCORS(t *testing.T) {
+	listed := []string{"https://example.com", "https://docs.example.org"}
+	tests := []struct {
+		name      string
+		origins   []string
+		method    string
+		target    string
+		origin    string
+		preflight bool
+		wantCode  int
+		wantAllow string
+		wantVary  bool
+	}{
+		{"preflight from listed origin", listed, "OPTIONS", "/collect/acct", "https://example.com", true, http.StatusNoContent, "https://example.com", true},
+		{"preflight matches case-insensitively", listed, "OPTIONS", "/collect/acct", "https://DOCS.example.org", true, http.StatusNoContent, "https://DOCS.example.org", true},
+		{"preflight from other origin", listed, "OPTIONS", "/collect/acct", "https://evil.example", true, http.StatusForbidden, "", true},
+		{"preflight with wildcard", []string{"*"}, "OPTIONS", "/acct/page", "https://anywhere.example", true, http.StatusNoContent, "*", false},
+		{"badge from listed origin", listed, "GET", "/acct/cors-a", "https://example.com", false, http.StatusOK, "https://example.com", true},
+		{"badge from other origin", listed, "GET", "/acct/cors-b", "https://evil.example", false, http.StatusOK, "", true},
+		{"badge without Origin", listed, "GET", "/acct/cors-c", "", false, http.StatusOK, "", true},
+		{"collect from listed origin", listed, "POST", "/collect/acct", "https://example.com", false, http.StatusAccepted, "https://example.com", true},
+		{"no allowed_origins", nil, "GET", "/acct/cors-d", "https://example.com", false, http.StatusOK, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, withTestCreds(Config{AllowedOrigins: tt.origins}))
+			body := ""
+			if tt.method == "POST" {
+				body = `{"client_id":"1234567890.1700000000","events":[{"name":"signup"}]}`
+			}
+			r := httptest.NewRequest(tt.method, tt.target, strings.NewReader(body))
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			if tt.preflight {
+				r.Header.Set("Access-Control-Request-Method", "POST")
+				r.Header.Set("Access-Control-Request-Headers", "content-type")
+			}
+			sender := &recordingSender{}
+			w := httptest.NewRecorder()
+			newMux(&server{sender: sender}).ServeHTTP(w, r)
+
+			if w.Code != tt.wantCode {
+				t.Errorf("status %d, want %d", w.Code, tt.wantCode)
+			}
+			if got := w.Header().Get("Access-Control-Allow-Origin"); got != tt.wantAllow {
+				t.Errorf("Access-Control-Allow-Origin = %q, want %q", got, tt.wantAllow)
+			}
+			if vary := strings.Join(w.Header().Values("Vary"), ","); strings.Contains(vary, "Origin") != tt.wantVary {
+				t.Errorf("Vary = %q, want Origin listed: %v", vary, tt.wantVary)
+			}
+			if tt.preflight {
+				if tt.wantAllow != "" && (w.Header().Get("Access-Control-Allow-Methods") != corsAllowMethods ||
+					w.Header().Get("Access-Control-Allow-Headers") != corsAllowHeaders) {
+					t.Errorf("preflight headers %v, want the allowed methods and headers", w.Header())
+				}
+				if n := len(sender.sent()); n != 0 {
+					t.Errorf("preflight sent %d hits, want none", n)
+				}
+			}
+		})
+	}
+}
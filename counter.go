@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// How often the file counter store writes its counts out.
+const counterFlushInterval = 30 * time.Second
+
+// Default time a badge's last known count is shown for while the counter
+// store can't be read.
+const defaultStaleCountTTL = 10 * time.Minute
+
+// Most accounts a store counts besides the known ones (see knownAccount),
+// so made-up account names can't grow it without bound. Hits on further
+// accounts are served but not counted.
+const maxCountedAccounts = 10000
+
+var errTooManyAccounts = errors.New("too many accounts counted")
+
+var (
+	badgeCounts = newGauge("beacon_badge_count", "Hits counted per account for the live badges.")
+	staleCounts = newCounter("beacon_stale_counts_total", "Badges shown with their last known count because the counter store couldn't be read.")
+)
+
+// lastCounts holds the count last read for each badge, to show while the
+// store can't be read; nil when stale_count_seconds is -1.
+var lastCounts *ttlCache[staleCount]
+
+// staleCount is a count as read from the store at a time.
+type staleCount struct {
+	n    int64
+	read time.Time
+}
+
+// staleCountTTL is how long a badge's last known count may be shown, or
+// 0 if stale_count_seconds disables it.
+func staleCountTTL() time.Duration {
+	switch n := config().StaleCountSeconds; {
+	case n < 0:
+		return 0
+	case n > 0:
+		return time.Duration(n) * time.Second
+	}
+	return defaultStaleCountTTL
+}
+
+// CounterStore keeps the per-account hit counts the live badges show.
+type CounterStore interface {
+	// Incr adds one hit to account and returns the new count.
+	Incr(account string) (int64, error)
+	// Get returns the number of hits counted for account.
+	Get(account string) (int64, error)
+}
+
+// hitCounts is the store selected by counter_backend.
+var hitCounts CounterStore = newMemoryCounterStore()
+
+// newCounterStore returns the store for c's counter_backend: "memory" (the
+// default) or "file", loaded from counter_file.
+func newCounterStore(c *Config) (CounterStore, error) {
+	switch c.CounterBackend {
+	case "", "memory":
+		return newMemoryCounterStore(), nil
+	case "file":
+		return openFileCounterStore(c.CounterFile)
+	}
+	return nil, fmt.Errorf("unknown counter_backend %q", c.CounterBackend)
+}
+
+// countHit adds a hit to account's badge count.
+func countHit(account string) {
+	n, err := hitCounts.Incr(account)
+	if errors.Is(err, errTooManyAccounts) {
+		slog.Debug("not counting hit, too many accounts counted", "account", account)
+		return
+	}
+	if err != nil {
+		slog.Error("cannot count hit", "account", account, "err", err)
+		return
+	}
+	setBadgeCount(account, n)
+	dailyHits.Incr(account, time.Now())
+}
+
+// setBadgeCount exports account's count as a beacon_badge_count series,
+// for known accounts only.
+func setBadgeCount(account string, n int64) {
+	if knownAccount(account) {
+		badgeCounts.Set(float64(n), "account", account)
+	}
+}
+
+// canCount reports whether a store holding counts may count a hit on
+// account: one it already counts, a known one, or any while it counts
+// fewer than maxCountedAccounts.
+func canCount(counts map[string]int64, account string) bool {
+	if _, ok := counts[account]; ok {
+		return true
+	}
+	return len(counts) < maxCountedAccounts || knownAccount(account)
+}
+
+// badgeCount returns account's count as shown on its badge. If the store
+// can't be read, that is the count last read within stale_count_seconds,
+// flagged in an X-Beacon-Stale-Count header with its age when debugging,
+// or else 0.
+func badgeCount(w http.ResponseWriter, account string) int64 {
+	now := time.Now()
+	n, err := hitCounts.Get(account)
+	if err == nil {
+		if lastCounts != nil {
+			lastCounts.Add(account, staleCount{n: n, read: now}, now)
+		}
+		return n
+	}
+
+	slog.Error("cannot read hit count", "account", account, "err", err)
+	if lastCounts == nil {
+		return 0
+	}
+	last, ok := lastCounts.Get(account, now)
+	if !ok {
+		return 0
+	}
+	staleCounts.Inc()
+	if debugEnabled() {
+		w.Header().Set("X-Beacon-Stale-Count", strconv.Itoa(int(now.Sub(last.read).Seconds())))
+	}
+	return last.n
+}
+
+// memoryCounterStore keeps counts in memory; they start from zero when the
+// process restarts.
+type memoryCounterStore struct {
+	mu     sync.Mutex
+	counts map[string]int64
+}
+
+func newMemoryCounterStore() *memoryCounterStore {
+	return &memoryCounterStore{counts: make(map[string]int64)}
+}
+
+func (m *memoryCounterStore) Incr(account string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !canCount(m.counts, account) {
+		return 0, errTooManyAccounts
+	}
+	m.counts[account]++
+	return m.counts[account], nil
+}
+
+func (m *memoryCounterStore) Get(account string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.counts[account], nil
+}
+
+// Seed raises account's count to n, if it is lower.
+func (m *memoryCounterStore) Seed(account string, n int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.seed(account, n)
+}
+
+func (m *memoryCounterStore) seed(account string, n int64) bool {
+	if n <= m.counts[account] {
+		return false
+	}
+	m.counts[account] = n
+	return true
+}
+
+// fileCounterStore counts in memory and writes the counts to a JSON file
+// every counterFlushInterval and on shutdown, so they survive restarts.
+// Hits counted since the last flush are lost if the process crashes.
+type fileCounterStore struct {
+	memoryCounterStore
+	path  string
+	dirty bool
+}
+
+// openFileCounterStore loads the counts in path, starting empty if it
+// doesn't exist yet.
+func openFileCounterStore(path string) (*fileCounterStore, error) {
+	s := &fileCounterStore{path: path}
+	s.counts = make(map[string]int64)
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &s.counts); err != nil {
+		return nil, fmt.Errorf("cannot parse %s: %v", path, err)
+	}
+	for account, n := range s.counts {
+		setBadgeCount(account, n)
+	}
+	return s, nil
+}
+
+func (s *fileCounterStore) Incr(account string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !canCount(s.counts, account) {
+		return 0, errTooManyAccounts
+	}
+	s.counts[account]++
+	s.dirty = true
+	return s.counts[account], nil
+}
+
+// Seed raises account's count to n, if it is lower.
+func (s *fileCounterStore) Seed(account string, n int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.seed(account, n) {
+		s.dirty = true
+	}
+}
+
+// Flush writes the counts out if they changed since the last flush. The
+// file is replaced atomically, so a crash mid-write keeps the old counts.
+func (s *fileCounterStore) Flush() error {
+	s.mu.Lock()
+	if !s.dirty {
+		s.mu.Unlock()
+		return nil
+	}
+	b, err := json.Marshal(s.counts)
+	s.dirty = false
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return s.flushFailed(err)
+	}
+	_, err = tmp.Write(b)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return s.flushFailed(err)
+	}
+	return nil
+}
+
+// flushFailed marks the counts as still unwritten, so the next flush tries
+// again.
+func (s *fileCounterStore) flushFailed(err error) error {
+	s.mu.Lock()
+	s.dirty = true
+	s.mu.Unlock()
+	return err
+}
+
+// flushCounters flushes s every counterFlushInterval until ctx is done.
+// The last flush on shutdown is left to run.
+func flushCounters(ctx context.Context, s *fileCounterStore) {
+	ticker := time.NewTicker(counterFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.Flush(); err != nil {
+				slog.Error("cannot write counter_file", "err", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
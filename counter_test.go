@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMemoryCounterStoreIsBounded(t *testing.T) {
+	useConfig(t, Config{AllowedAccounts: []string{"allowed-*"}})
+	s := newMemoryCounterStore()
+	for i := 0; i < maxCountedAccounts; i++ {
+		if _, err := s.Incr(fmt.Sprintf("acct-%d", i)); err != nil {
+			t.Fatalf("Incr #%d: %v", i, err)
+		}
+	}
+
+	if _, err := s.Incr("one-too-many"); !errors.Is(err, errTooManyAccounts) {
+		t.Errorf("Incr past the limit: err = %v, want errTooManyAccounts", err)
+	}
+	if n, err := s.Incr("acct-0"); err != nil || n != 2 {
+		t.Errorf("Incr of a counted account = %d, %v, want 2", n, err)
+	}
+	if n, err := s.Incr("allowed-x"); err != nil || n != 1 {
+		t.Errorf("Incr of an allowed account = %d, %v, want 1", n, err)
+	}
+	if n, _ := s.Get("one-too-many"); n != 0 {
+		t.Errorf("Get of an uncounted account = %d, want 0", n)
+	}
+}
+
+func TestCounterStores(t *testing.T) {
+	backends := map[string]func(t *testing.T) CounterStore{
+		"memory": func(t *testing.T) CounterStore { return newMemoryCounterStore() },
+		"file": func(t *testing.T) CounterStore {
+			s, err := openFileCounterStore(filepath.Join(t.TempDir(), "counts.json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return s
+		},
+	}
+	for name, open := range backends {
+		t.Run(name, func(t *testing.T) {
+			useConfig(t, Config{})
+			s := open(t)
+			for i, want := range []int64{1, 2, 3} {
+				if n, err := s.Incr("a"); err != nil || n != want {
+					t.Errorf("Incr #%d = %d, %v, want %d", i+1, n, err, want)
+				}
+			}
+			if n, err := s.Incr("b"); err != nil || n != 1 {
+				t.Errorf("Incr of another account = %d, %v, want 1", n, err)
+			}
+			for account, want := range map[string]int64{"a": 3, "b": 1, "never": 0} {
+				if n, err := s.Get(account); err != nil || n != want {
+					t.Errorf("Get(%s) = %d, %v, want %d", account, n, err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestFileCounterStoreSurvivesRestart(t *testing.T) {
+	useConfig(t, Config{})
+	path := filepath.Join(t.TempDir(), "counts.json")
+	s, err := openFileCounterStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Flush with nothing counted wrote %s: %v", path, err)
+	}
+	for i := 0; i < 5; i++ {
+		s.Incr("a")
+	}
+	s.Incr("b")
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	s.Incr("a") // lost, as in a crash before the next flush
+
+	restarted, err := openFileCounterStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for account, want := range map[string]int64{"a": 5, "b": 1} {
+		if n, _ := restarted.Get(account); n != want {
+			t.Errorf("after restart, Get(%s) = %d, want %d", account, n, want)
+		}
+	}
+	if n, _ := restarted.Incr("a"); n != 6 {
+		t.Errorf("after restart, Incr(a) = %d, want 6", n)
+	}
+}
+
+func TestNewCounterStore(t *testing.T) {
+	dir := t.TempDir()
+	corrupt := filepath.Join(dir, "corrupt.json")
+	if err := os.WriteFile(corrupt, []byte("{"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		config  Config
+		want    string // type of store
+		wantErr bool
+	}{
+		{"default", Config{}, "*main.memoryCounterStore", false},
+		{"memory", Config{CounterBackend: "memory"}, "*main.memoryCounterStore", false},
+		{"file", Config{CounterBackend: "file", CounterFile: filepath.Join(dir, "new.json")}, "*main.fileCounterStore", false},
+		{"corrupt file", Config{CounterBackend: "file", CounterFile: corrupt}, "", true},
+		{"unknown", Config{CounterBackend: "redis"}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := newCounterStore(&tt.config)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newCounterStore() err = %v, want error: %v", err, tt.wantErr)
+			}
+			if got := fmt.Sprintf("%T", s); !tt.wantErr && got != tt.want {
+				t.Errorf("newCounterStore() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunFlushesCountsOnShutdown(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "counts.json")
+	addr := freeAddr(t)
+	newFakeCollector(t, Config{ListenAddr: addr, CounterBackend: "file", CounterFile: path, Accounts: map[string]Credentials{
+		"acct": {MeasurementID: "G-ACCT", APISecret: "secret"},
+	}})
+	saved := hitCounts
+	t.Cleanup(func() { hitCounts = saved })
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- run(ctx, *config()) }()
+	waitForListener(t, addr)
+
+	for i := 0; i < 3; i++ {
+		req, _ := http.NewRequest("GET", fmt.Sprintf("http://%s/acct/flush-%d?pixel", addr, i), nil)
+		req.Header.Set("User-Agent", "Mozilla/5.0")
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	// The badge count and /metrics both read from the store.
+	if got := badgeCounts.Value("account", "acct"); got != 3 {
+		t.Errorf("beacon_badge_count{account=acct} = %v, want 3", got)
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("counter_file not written on shutdown: %v", err)
+	}
+	var counts map[string]int64
+	if err := json.Unmarshal(b, &counts); err != nil || counts["acct"] != 3 {
+		t.Errorf("counter_file = %s, want acct at 3", b)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// Default most (account, day) pairs counted at once.
+	defaultMaxDailyCounts = 100000
+
+	// Days of daily counts kept and reported by /stats.
+	dailyCountDays = 30
+)
+
+var (
+	dailyCountsSize    = newGauge("beacon_daily_counts", "(account, day) pairs with a daily hit count.")
+	dailyCountsEvicted = newCounter("beacon_daily_counts_evicted_total", "Daily hit counts dropped to stay within max_daily_counts.")
+)
+
+// dailyHits is the per-day counter, sized by max_daily_counts at startup.
+var dailyHits = newDailyCounter(defaultMaxDailyCounts)
+
+// dailyCounter counts each account's hits per UTC day, for the trend
+// reported by /stats. It holds at most max (account, day) pairs: once
+// full, the pair counted least recently is dropped, which is an old day
+// or a quiet account, so made-up accounts can't grow it without bound.
+// Counts are kept in memory only, for dailyCountDays.
+type dailyCounter struct {
+	mu     sync.Mutex
+	counts *ttlCache[int64]
+}
+
+func newDailyCounter(max int) *dailyCounter {
+	return &dailyCounter{counts: newTTLCache[int64](max, dailyCountDays*24*time.Hour)}
+}
+
+func dailyKey(account string, day time.Time) string {
+	return account + " " + day.UTC().Format(time.DateOnly)
+}
+
+// Incr adds a hit at now to account's count for the day.
+func (d *dailyCounter) Incr(account string, now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	key := dailyKey(account, now)
+	n, found := d.counts.Get(key, now)
+	before := d.counts.Len()
+	d.counts.Add(key, n+1, now)
+	size := d.counts.Len()
+	if !found && size <= before {
+		dailyCountsEvicted.Add(float64(before + 1 - size))
+	}
+	dailyCountsSize.Set(float64(size))
+}
+
+// Days returns account's counts for the last dailyCountDays days up to
+// now, by date, leaving out days without hits.
+func (d *dailyCounter) Days(account string, now time.Time) map[string]int64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	days := make(map[string]int64)
+	for i := 0; i < dailyCountDays; i++ {
+		day := now.AddDate(0, 0, -i)
+		if n, ok := d.counts.Get(dailyKey(account, day), now); ok {
+			days[day.UTC().Format(time.DateOnly)] = n
+		}
+	}
+	return days
+}
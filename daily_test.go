@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDailyCounterEvictsLeastRecentlyCounted(t *testing.T) {
+	day := time.Date(2024, 5, 2, 12, 0, 0, 0, time.UTC)
+	d := newDailyCounter(3)
+	before := dailyCountsEvicted.Value()
+
+	d.Incr("old", day.AddDate(0, 0, -1))
+	d.Incr("busy", day)
+	d.Incr("quiet", day)
+	d.Incr("busy", day)  // keeps busy's day active
+	d.Incr("new", day)   // pushes out old's day
+	d.Incr("spray", day) // and then quiet's
+
+	if n := dailyCountsEvicted.Value() - before; n != 2 {
+		t.Errorf("evicted %v counts, want 2", n)
+	}
+	if n := dailyCountsSize.Value(); n != 3 {
+		t.Errorf("beacon_daily_counts = %v, want 3", n)
+	}
+	tests := []struct {
+		account string
+		want    int64
+	}{
+		{"old", 0},
+		{"quiet", 0},
+		{"busy", 2},
+		{"new", 1},
+		{"spray", 1},
+	}
+	for _, tt := range tests {
+		if got := d.Days(tt.account, day)["2024-05-02"]; got != tt.want {
+			t.Errorf("%s's count for the day = %d, want %d", tt.account, got, tt.want)
+		}
+	}
+}
+
+func TestStatsReportsDays(t *testing.T) {
+	now := time.Now().UTC()
+	old := dailyHits
+	dailyHits = newDailyCounter(100)
+	t.Cleanup(func() { dailyHits = old })
+	dailyHits.Incr("acct", now)
+	dailyHits.Incr("acct", now)
+	dailyHits.Incr("acct", now.AddDate(0, 0, -1))
+	dailyHits.Incr("acct", now.AddDate(0, 0, -dailyCountDays)) // too long ago to report
+
+	w := httptest.NewRecorder()
+	statsHandler(w, httptest.NewRequest("GET", "/stats/acct", nil))
+	var got statsResponse
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+		t.Fatalf("decoding %q: %v", w.Body.String(), err)
+	}
+	want := map[string]int64{
+		now.Format(time.DateOnly):                   2,
+		now.AddDate(0, 0, -1).Format(time.DateOnly): 1,
+	}
+	if len(got.Days) != len(want) {
+		t.Errorf("days = %v, want %v", got.Days, want)
+	}
+	for date, n := range want {
+		if got.Days[date] != n {
+			t.Errorf("days[%s] = %d, want %d", date, got.Days[date], n)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// debugEcho is what /debug/<account>/<page> reports about a hit.
+type debugEcho struct {
+	ClientID      string     `json:"client_id"`
+	NewClient     bool       `json:"new_client"`
+	IP            string     `json:"ip"`
+	UserAgent     string     `json:"user_agent"`
+	MeasurementID string     `json:"measurement_id,omitempty"`
+	Skipped       string     `json:"skipped,omitempty"`
+	Payload       GA4Payload `json:"payload"`
+}
+
+// debugEchoHandler shows the payload a hit on the same account and page
+// would send, without sending it, setting cookies or starting a session.
+// It only exists when debug is on, and redacts log_redact_params.
+func debugEchoHandler(w http.ResponseWriter, r *http.Request) {
+	if !config().Debug {
+		http.NotFound(w, r)
+		return
+	}
+	c := withRequestID(r.Context(), incomingRequestID(r))
+	received := time.Now()
+
+	params, query, err := hitParams(r, strings.TrimPrefix(r.URL.Path, "/debug"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(params) < 2 || params[0] == "" {
+		http.Error(w, "expected /debug/<account>/<page>", http.StatusNotFound)
+		return
+	}
+	if !validAccount(params[0]) {
+		http.Error(w, "invalid account", http.StatusBadRequest)
+		return
+	}
+	params[0] = normalizeAccount(params[0])
+	if !validPageLocation(query.Get("dl")) {
+		query.Set("dl", pageLocation(r, params))
+	}
+
+	echo := debugEcho{IP: clientIP(r), UserAgent: r.Header.Get("User-Agent")}
+	if override, ok := clientIDOverride(r.Header, query); ok {
+		echo.ClientID = override
+	} else if cookie, err := readCookie(r, cidCookieName()); err == nil {
+		echo.ClientID = cookie.Value
+	} else if config().StableCIDFallback {
+		echo.ClientID = stableClientID(echo.IP, echo.UserAgent)
+	} else if err := generateUUID(&echo.ClientID); err != nil {
+		http.Error(w, "cannot generate client id", http.StatusInternalServerError)
+		return
+	} else {
+		echo.NewClient = true
+	}
+
+	session := peekSession(r, echo.ClientID, received)
+	payload, err := buildPayload(c, params, query, r.Header, echo.UserAgent, echo.IP, echo.ClientID, session, echo.NewClient, received)
+	echo.Payload = redactPayload(payload)
+
+	creds, ok := credentialsFor(c, params[0], query.Get("stream"))
+	echo.MeasurementID = creds.MeasurementID
+	switch {
+	case err != nil:
+		echo.Skipped = err.Error()
+	case retiredAccount(params[0]):
+		echo.Skipped = "account retired"
+	case skipDeniedHits() && trackingDenied(r.Header, query):
+		echo.Skipped = "tracking denied"
+	case isBot(echo.UserAgent):
+		echo.Skipped = "bot user agent"
+	case !ok:
+		echo.Skipped = "no GA4 property configured"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(echo)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// comparablePayload decodes a payload's JSON with the fields that depend on
+// the moment of the hit removed.
+func comparablePayload(t *testing.T, b []byte) map[string]interface{} {
+	t.Helper()
+	var p map[string]interface{}
+	if err := json.Unmarshal(b, &p); err != nil {
+		t.Fatal(err)
+	}
+	delete(p, "timestamp_micros")
+	events, _ := p["events"].([]interface{})
+	for _, e := range events {
+		params, _ := e.(map[string]interface{})["params"].(map[string]interface{})
+		delete(params, "session_id")
+		delete(params, "timestamp")
+	}
+	return p
+}
+
+func TestDebugEchoMatchesHit(t *testing.T) {
+	useConfig(t, withTestCreds(Config{Debug: true}))
+	tests := []struct {
+		name   string
+		target string
+	}{
+		{"page", "/acct/echo-a"},
+		{"custom params", "/acct/echo-b?pixel&plan=pro&n.seats=3&dt=Pricing"},
+		{"deep page", "/acct/docs/echo-c?gif"},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cid := "4242." + string(rune('0'+i))
+			r := httptest.NewRequest("GET", "/debug"+tt.target, nil)
+			r.Header.Set("User-Agent", "test-agent/1.0")
+			r.AddCookie(&http.Cookie{Name: cidCookieName(), Value: cid})
+			w := httptest.NewRecorder()
+			debugEchoHandler(w, r)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", w.Code, w.Body)
+			}
+			if c := w.Header().Get("Set-Cookie"); c != "" {
+				t.Errorf("Set-Cookie = %q, want none", c)
+			}
+			var echo struct {
+				ClientID      string          `json:"client_id"`
+				UserAgent     string          `json:"user_agent"`
+				MeasurementID string          `json:"measurement_id"`
+				Skipped       string          `json:"skipped"`
+				Payload       json.RawMessage `json:"payload"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &echo); err != nil {
+				t.Fatal(err)
+			}
+			if echo.ClientID != cid || echo.UserAgent != "test-agent/1.0" || echo.MeasurementID != "G-TEST" || echo.Skipped != "" {
+				t.Errorf("echo = %+v, want cid %s, the request's user agent, G-TEST and nothing skipped", echo, cid)
+			}
+
+			// The same hit, really sent.
+			sender := &recordingSender{}
+			hit := httptest.NewRequest("GET", tt.target, nil)
+			hit.Header.Set("User-Agent", "test-agent/1.0")
+			hit.AddCookie(&http.Cookie{Name: cidCookieName(), Value: cid})
+			(&server{sender: sender}).handler(httptest.NewRecorder(), hit)
+			sent := sender.sent()
+			if len(sent) != 1 {
+				t.Fatalf("hit sent %d payloads, want 1", len(sent))
+			}
+			b, err := json.Marshal(sent[0].Payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := comparablePayload(t, echo.Payload), comparablePayload(t, b); !reflect.DeepEqual(got, want) {
+				t.Errorf("echoed payload\n%v\nwant what the hit sent\n%v", got, want)
+			}
+		})
+	}
+}
+
+func TestDebugEchoSkipsAndSendsNothing(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      Config
+		target      string
+		ua          string
+		wantCode    int
+		wantSkipped string
+	}{
+		{"debug off", Config{}, "/debug/acct/page", "", http.StatusNotFound, ""},
+		{"bot", Config{Debug: true}, "/debug/acct/page", "Googlebot/2.1", http.StatusOK, "bot user agent"},
+		{"tracking denied", Config{Debug: true}, "/debug/acct/page?consent=denied", "", http.StatusOK, "tracking denied"},
+		{"retired account", Config{Debug: true, RetiredAccounts: []string{"old"}}, "/debug/old/page", "", http.StatusOK, "account retired"},
+		{"no page", Config{Debug: true}, "/debug/acct", "", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeCollector(t, tt.config)
+			r := httptest.NewRequest("GET", tt.target, nil)
+			r.Header.Set("User-Agent", tt.ua)
+			w := httptest.NewRecorder()
+			newMux(&server{sender: gaSender{}}).ServeHTTP(w, r)
+
+			if w.Code != tt.wantCode {
+				t.Fatalf("status %d, want %d", w.Code, tt.wantCode)
+			}
+			if tt.wantSkipped != "" {
+				var echo debugEcho
+				json.Unmarshal(w.Body.Bytes(), &echo)
+				if echo.Skipped != tt.wantSkipped {
+					t.Errorf("skipped = %q, want %q", echo.Skipped, tt.wantSkipped)
+				}
+			}
+			if n := len(f.posted()); n != 0 {
+				t.Errorf("collector got %d posts, want none", n)
+			}
+		})
+	}
+}
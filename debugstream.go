@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const defaultDebugStreamClients = 5
+
+// Events buffered per client before further events are dropped for it.
+const debugStreamBuffer = 64
+
+type debugStreamEvent struct {
+	Account string     `json:"account"`
+	Payload GA4Payload `json:"payload"`
+}
+
+type debugStreamClient struct {
+	account string
+	events  chan debugStreamEvent
+}
+
+var debugStream struct {
+	mu      sync.Mutex
+	clients map[*debugStreamClient]bool
+}
+
+// publishDebugEvent hands a payload, stripped by streamPayload, to
+// connected /debug/stream clients. Slow clients miss events rather than
+// holding up the hit.
+func publishDebugEvent(account string, payload GA4Payload) {
+	debugStream.mu.Lock()
+	defer debugStream.mu.Unlock()
+	if len(debugStream.clients) == 0 {
+		return
+	}
+
+	ev := debugStreamEvent{Account: account, Payload: streamPayload(payload)}
+	for c := range debugStream.clients {
+		if c.account != "" && c.account != account {
+			continue
+		}
+		select {
+		case c.events <- ev:
+		default:
+		}
+	}
+}
+
+// debugStreamHandler streams processed events as Server-Sent Events to
+// holders of debug_stream_token, optionally filtered with ?account=.
+func debugStreamHandler(w http.ResponseWriter, r *http.Request) {
+	if config().DebugStreamToken == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if !tokenAuthorized(r, config().DebugStreamToken) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	client := &debugStreamClient{
+		account: normalizeAccount(r.URL.Query().Get("account")),
+		events:  make(chan debugStreamEvent, debugStreamBuffer),
+	}
+	if !addDebugStreamClient(client) {
+		http.Error(w, "too many debug stream clients", http.StatusServiceUnavailable)
+		return
+	}
+	defer removeDebugStreamClient(client)
+
+	// The stream stays open as long as the client wants, beyond
+	// request_timeout_seconds.
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev := <-client.events:
+			b, err := json.Marshal(ev)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "event: hit\ndata: %s\n\n", b)
+			flusher.Flush()
+		}
+	}
+}
+
+func addDebugStreamClient(c *debugStreamClient) bool {
+	limit := defaultDebugStreamClients
+	if config().DebugStreamMaxClients > 0 {
+		limit = config().DebugStreamMaxClients
+	}
+
+	debugStream.mu.Lock()
+	defer debugStream.mu.Unlock()
+	if len(debugStream.clients) >= limit {
+		return false
+	}
+	if debugStream.clients == nil {
+		debugStream.clients = make(map[*debugStreamClient]bool)
+	}
+	debugStream.clients[c] = true
+	return true
+}
+
+func removeDebugStreamClient(c *debugStreamClient) {
+	debugStream.mu.Lock()
+	delete(debugStream.clients, c)
+	debugStream.mu.Unlock()
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStreamPayload(t *testing.T) {
+	off := false
+	payload := GA4Payload{
+		ClientID: "1111.2222",
+		UserID:   "user-42",
+		Events: []GA4Event{{Name: "page_view", Params: map[string]interface{}{
+			"ip_address":   "203.0.113.7",
+			"user_agent":   "Mozilla/5.0",
+			"custom_token": "t0k3n",
+			"page_path":    "/docs",
+		}}},
+	}
+	tests := []struct {
+		name   string
+		config Config
+		want   map[string]interface{} // by field or param name
+	}{
+		{"defaults", Config{}, map[string]interface{}{
+			"client_id": redactedValue, "user_id": redactedValue,
+			"ip_address": "203.0.113.0", "user_agent": redactedValue, "custom_token": "t0k3n", "page_path": "/docs",
+		}},
+		{"log_redact_params", Config{LogRedactParams: []string{"token"}}, map[string]interface{}{
+			"client_id": redactedValue, "custom_token": redactedValue,
+		}},
+		{"debug", Config{Debug: true}, map[string]interface{}{
+			"client_id": "1111.2222", "user_id": "user-42", "ip_address": "203.0.113.0", "user_agent": "Mozilla/5.0",
+		}},
+		{"debug without anonymize_ip", Config{Debug: true, AnonymizeIP: &off}, map[string]interface{}{
+			"ip_address": "203.0.113.7",
+		}},
+		{"anonymize_ip off without debug", Config{AnonymizeIP: &off}, map[string]interface{}{
+			"ip_address": "203.0.113.0", "user_id": redactedValue,
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("DEBUG", "")
+			useConfig(t, tt.config)
+			got := streamPayload(payload)
+			fields := map[string]interface{}{"client_id": got.ClientID, "user_id": got.UserID}
+			for k, v := range got.Events[0].Params {
+				fields[k] = v
+			}
+			for k, want := range tt.want {
+				if fields[k] != want {
+					t.Errorf("%s = %v, want %v", k, fields[k], want)
+				}
+			}
+			if payload.ClientID != "1111.2222" || payload.Events[0].Params["ip_address"] != "203.0.113.7" {
+				t.Error("streamPayload changed the payload to be sent")
+			}
+		})
+	}
+}
+
+// openDebugStream connects to /debug/stream on srv with query, returning
+// the response and a reader of its event data lines.
+func openDebugStream(t *testing.T, srv *httptest.Server, query string) (*http.Response, *bufio.Scanner) {
+	t.Helper()
+	resp, err := http.Get(srv.URL + "/debug/stream" + query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp, bufio.NewScanner(resp.Body)
+}
+
+// nextStreamEvent returns the next event from a /debug/stream reader.
+func nextStreamEvent(t *testing.T, events *bufio.Scanner) debugStreamEvent {
+	t.Helper()
+	got := make(chan debugStreamEvent, 1)
+	go func() {
+		for events.Scan() {
+			if data, ok := strings.CutPrefix(events.Text(), "data: "); ok {
+				var ev debugStreamEvent
+				json.Unmarshal([]byte(data), &ev)
+				got <- ev
+				return
+			}
+		}
+	}()
+	select {
+	case ev := <-got:
+		return ev
+	case <-time.After(2 * time.Second):
+		t.Fatal("no event on the stream")
+		return debugStreamEvent{}
+	}
+}
+
+func TestDebugStreamAuth(t *testing.T) {
+	tests := []struct {
+		name     string
+		token    string // debug_stream_token
+		query    string
+		wantCode int
+	}{
+		{"disabled", "", "?token=anything", http.StatusNotFound},
+		{"no token", "s3cret", "", http.StatusUnauthorized},
+		{"wrong token", "s3cret", "?token=s3cre", http.StatusUnauthorized},
+		{"token", "s3cret", "?token=s3cret", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, Config{DebugStreamToken: tt.token})
+			srv := httptest.NewServer(newMux(&server{sender: &recordingSender{}}))
+			t.Cleanup(srv.Close)
+			resp, _ := openDebugStream(t, srv, tt.query)
+			if resp.StatusCode != tt.wantCode {
+				t.Errorf("status %d, want %d", resp.StatusCode, tt.wantCode)
+			}
+			if tt.wantCode == http.StatusOK && resp.Header.Get("Content-Type") != "text/event-stream" {
+				t.Errorf("Content-Type = %q, want text/event-stream", resp.Header.Get("Content-Type"))
+			}
+		})
+	}
+}
+
+func TestDebugStreamAccountFilter(t *testing.T) {
+	useConfig(t, Config{DebugStreamToken: "s3cret"})
+	srv := httptest.NewServer(newMux(&server{sender: &recordingSender{}}))
+	t.Cleanup(srv.Close)
+	_, docs := openDebugStream(t, srv, "?token=s3cret&account=docs")
+	_, all := openDebugStream(t, srv, "?token=s3cret")
+
+	publishDebugEvent("blog", GA4Payload{Events: []GA4Event{{Name: "blog_view"}}})
+	publishDebugEvent("docs", GA4Payload{Events: []GA4Event{{Name: "docs_view"}}})
+
+	for _, tt := range []struct {
+		name   string
+		events *bufio.Scanner
+		want   []string
+	}{
+		{"?account=docs", docs, []string{"docs"}},
+		{"unfiltered", all, []string{"blog", "docs"}},
+	} {
+		for _, want := range tt.want {
+			if ev := nextStreamEvent(t, tt.events); ev.Account != want {
+				t.Errorf("%s: got an event for %q, want %q", tt.name, ev.Account, want)
+			}
+		}
+	}
+}
+
+func TestDebugStreamClientCap(t *testing.T) {
+	tests := []struct {
+		max      int // debug_stream_max_clients
+		wantOpen int
+	}{
+		{0, defaultDebugStreamClients},
+		{1, 1},
+		{2, 2},
+	}
+	for _, tt := range tests {
+		useConfig(t, Config{DebugStreamToken: "s3cret", DebugStreamMaxClients: tt.max})
+		srv := httptest.NewServer(newMux(&server{sender: &recordingSender{}}))
+		var streams []*http.Response
+		for i := 0; i <= tt.wantOpen; i++ {
+			resp, err := http.Get(srv.URL + "/debug/stream?token=s3cret")
+			if err != nil {
+				t.Fatal(err)
+			}
+			streams = append(streams, resp)
+		}
+		open := 0
+		for i, resp := range streams {
+			switch resp.StatusCode {
+			case http.StatusOK:
+				open++
+			case http.StatusServiceUnavailable:
+			default:
+				t.Errorf("max %d: client #%d got status %d", tt.max, i+1, resp.StatusCode)
+			}
+			resp.Body.Close()
+		}
+		if open != tt.wantOpen {
+			t.Errorf("debug_stream_max_clients %d: %d clients connected, want %d", tt.max, open, tt.wantOpen)
+		}
+		srv.Close()
+	}
+}
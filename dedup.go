@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// How long a hit suppresses an identical one from the same client, unless
+// dedup_window_seconds says otherwise.
+const defaultDedupWindow = 2 * time.Second
+
+// How long an idempotency key is remembered, and the longest key taken.
+const (
+	idempotencyWindow    = 10 * time.Minute
+	maxIdempotencyKeyLen = 255
+)
+
+// recentPages remembers each client's recent hits by page, so a prefetch
+// followed by the render counts once. dedupMu makes its check-and-add
+// atomic, since the two requests usually arrive together. recentKeys
+// remembers the idempotency keys seen within idempotencyWindow.
+var (
+	recentPages *ttlCache[time.Time]
+	recentKeys  *ttlCache[time.Time]
+	dedupMu     sync.Mutex
+)
+
+func dedupWindow() time.Duration {
+	if config().DedupWindowSeconds > 0 {
+		return time.Duration(config().DedupWindowSeconds) * time.Second
+	}
+	return defaultDedupWindow
+}
+
+// duplicateHit reports whether cid hit the same account and page within
+// the dedup window. Like throttleHit, suppressed hits don't extend it.
+func duplicateHit(cid string, params []string, now time.Time) bool {
+	if recentPages == nil || len(params) < 2 {
+		return false
+	}
+	key := cid + "\x00" + params[0] + "/" + params[1]
+
+	dedupMu.Lock()
+	defer dedupMu.Unlock()
+	if _, ok := recentPages.Get(key, now); ok {
+		return true
+	}
+	recentPages.Add(key, now, now)
+	return false
+}
+
+// idempotencyKey returns the key a client sent to mark retries of the same
+// request, as an Idempotency-Key header or ?ik=, or "" if none or it is
+// longer than maxIdempotencyKeyLen.
+func idempotencyKey(header http.Header, query url.Values) string {
+	key := header.Get("Idempotency-Key")
+	if key == "" {
+		key = query.Get("ik")
+	}
+	if len(key) > maxIdempotencyKeyLen {
+		return ""
+	}
+	return key
+}
+
+// repeatedKey reports whether key was already seen for account within
+// idempotencyWindow, recording it if not. Requests without a key are
+// never repeats.
+func repeatedKey(account, key string, now time.Time) bool {
+	if recentKeys == nil || key == "" {
+		return false
+	}
+	key = idempotencyCacheKey(account, key)
+
+	dedupMu.Lock()
+	defer dedupMu.Unlock()
+	if _, ok := recentKeys.Get(key, now); ok {
+		return true
+	}
+	recentKeys.Add(key, now, now)
+	return false
+}
+
+// forgetKey drops key for account, so a retry of a request that failed
+// after its key was recorded isn't taken for a repeat.
+func forgetKey(account, key string) {
+	if recentKeys != nil && key != "" {
+		recentKeys.Delete(idempotencyCacheKey(account, key))
+	}
+}
+
+func idempotencyCacheKey(account, key string) string {
+	return account + "\x00" + key
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDuplicateHit(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	type hit struct {
+		cid, page string
+		at        time.Duration
+		want      bool
+	}
+	tests := []struct {
+		name   string
+		window int
+		hits   []hit
+	}{
+		{"default window", 0, []hit{
+			{"a", "page", 0, false},
+			{"a", "page", time.Second, true},
+			{"a", "other", time.Second, false}, // other pages count
+			{"b", "page", time.Second, false},  // and other clients
+			{"a", "page", 1900 * time.Millisecond, true},
+			{"a", "page", 2100 * time.Millisecond, false}, // just outside the window
+		}},
+		{"dedup_window_seconds", 5, []hit{
+			{"a", "page", 0, false},
+			{"a", "page", 4 * time.Second, true},
+			{"a", "page", 5100 * time.Millisecond, false},
+		}},
+		{"disabled", -1, []hit{
+			{"a", "page", 0, false},
+			{"a", "page", 0, false},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, Config{DedupWindowSeconds: tt.window})
+			for _, h := range tt.hits {
+				if got := duplicateHit(h.cid, []string{"acct", h.page}, start.Add(h.at)); got != h.want {
+					t.Errorf("hit from %s on %s at +%v: duplicate = %v, want %v", h.cid, h.page, h.at, got, h.want)
+				}
+			}
+		})
+	}
+}
+
+func TestDuplicateHitsAreServedNotSent(t *testing.T) {
+	tests := []struct {
+		name     string
+		gap      time.Duration
+		wantSent int
+	}{
+		{"within the window", 0, 1},
+		{"just outside the window", 1100 * time.Millisecond, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, withTestCreds(Config{DedupWindowSeconds: 1}))
+			sender := &recordingSender{}
+			s := &server{sender: sender}
+			for i := 0; i < 2; i++ {
+				if i > 0 {
+					time.Sleep(tt.gap)
+				}
+				w := serveHit(t, s, "/acct/dedup?pixel", "1234.5678")
+				if ct := w.Header().Get("Content-Type"); w.Code != 200 || ct != "image/gif" {
+					t.Errorf("hit %d: status %d, Content-Type %q; want the pixel", i+1, w.Code, ct)
+				}
+			}
+			if n := len(sender.sent()); n != tt.wantSent {
+				t.Errorf("sent %d hits, want %d", n, tt.wantSent)
+			}
+		})
+	}
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		query  string
+		want   string
+	}{
+		{"none", "", "", ""},
+		{"header", "view-1", "", "view-1"},
+		{"?ik=", "", "ik=view-2", "view-2"},
+		{"header beats ?ik=", "view-1", "ik=view-2", "view-1"},
+		{"longest", strings.Repeat("k", maxIdempotencyKeyLen), "", strings.Repeat("k", maxIdempotencyKeyLen)},
+		{"too long", strings.Repeat("k", maxIdempotencyKeyLen+1), "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			if tt.header != "" {
+				header.Set("Idempotency-Key", tt.header)
+			}
+			query, _ := url.ParseQuery(tt.query)
+			if got := idempotencyKey(header, query); got != tt.want {
+				t.Errorf("idempotencyKey() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRepeatedKey(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	type request struct {
+		account, key string
+		at           time.Duration
+		forget       bool // forgetKey after the request
+		want         bool
+	}
+	tests := []struct {
+		name     string
+		requests []request
+	}{
+		{"repeated within the window", []request{
+			{"acct", "k1", 0, false, false},
+			{"acct", "k1", time.Minute, false, true},
+			{"acct", "k2", time.Minute, false, false},
+		}},
+		{"after the window", []request{
+			{"acct", "k1", 0, false, false},
+			{"acct", "k1", idempotencyWindow + time.Second, false, false},
+		}},
+		{"other account", []request{
+			{"acct", "k1", 0, false, false},
+			{"other", "k1", time.Second, false, false},
+		}},
+		{"no key", []request{
+			{"acct", "", 0, false, false},
+			{"acct", "", 0, false, false},
+		}},
+		{"forgotten after a failure", []request{
+			{"acct", "k1", 0, true, false},
+			{"acct", "k1", time.Second, false, false},
+			{"acct", "k1", 2 * time.Second, false, true},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, Config{})
+			for i, r := range tt.requests {
+				if got := repeatedKey(r.account, r.key, start.Add(r.at)); got != r.want {
+					t.Errorf("request %d (%s, %q at +%v): repeated = %v, want %v", i+1, r.account, r.key, r.at, got, r.want)
+				}
+				if r.forget {
+					forgetKey(r.account, r.key)
+				}
+			}
+		})
+	}
+}
+
+func TestRepeatedKeysAreServedNotSent(t *testing.T) {
+	tests := []struct {
+		name     string
+		keys     []string // one request for each, as ?ik=, or as the header if prefixed with "h:"
+		wantSent int
+	}{
+		{"same key", []string{"view-1", "view-1"}, 1},
+		{"same key, header then ?ik=", []string{"h:view-1", "view-1"}, 1},
+		{"new key", []string{"view-1", "view-2"}, 2},
+		{"no keys", []string{"", ""}, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, withTestCreds(Config{}))
+			sender := &recordingSender{}
+			s := &server{sender: sender}
+			for i, key := range tt.keys {
+				// A page of its own, so the hit isn't taken for a duplicate.
+				target := fmt.Sprintf("/acct/ik-%d?pixel", i)
+				r := httptest.NewRequest("GET", target, nil)
+				if h, ok := strings.CutPrefix(key, "h:"); ok {
+					r.Header.Set("Idempotency-Key", h)
+				} else if key != "" {
+					r = httptest.NewRequest("GET", target+"&ik="+key, nil)
+				}
+				r.AddCookie(&http.Cookie{Name: cidCookieName(), Value: "1234.5678"})
+				w := httptest.NewRecorder()
+				s.handler(w, r)
+				if ct := w.Header().Get("Content-Type"); w.Code != http.StatusOK || ct != "image/gif" {
+					t.Errorf("request %d: status %d, Content-Type %q; want the pixel", i+1, w.Code, ct)
+				}
+			}
+			sent := sender.sent()
+			if len(sent) != tt.wantSent {
+				t.Errorf("sent %d hits, want %d", len(sent), tt.wantSent)
+			}
+			for _, h := range sent {
+				for _, e := range h.Payload.Events {
+					if _, ok := e.Params["custom_ik"]; ok {
+						t.Errorf("%s has custom_ik, want ik reserved", e.Name)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestRepeatedKeysInCollect(t *testing.T) {
+	useConfig(t, withTestCreds(Config{}))
+	sender := &recordingSender{}
+	s := &server{sender: sender}
+	collect := func(key string) int {
+		r := httptest.NewRequest("POST", "/collect/acct", strings.NewReader(`{"events": [{"name": "download"}]}`))
+		r.Header.Set("Idempotency-Key", key)
+		w := httptest.NewRecorder()
+		s.collectHandler(w, r)
+		return w.Code
+	}
+
+	// A send that fails leaves the key free for the client's retry.
+	sender.err = errors.New("queue full")
+	if code := collect("batch-1"); code == http.StatusAccepted {
+		t.Fatalf("failed send answered %d", code)
+	}
+	sender.err = nil
+	failed := len(sender.sent()) // recordingSender keeps failed sends too
+	for i, want := range []int{1, 1, 2} {
+		key := "batch-1"
+		if i == 2 {
+			key = "batch-2"
+		}
+		if code := collect(key); code != http.StatusAccepted {
+			t.Errorf("request %d with %s: status %d, want 202", i+1, key, code)
+		}
+		if n := len(sender.sent()) - failed; n != want {
+			t.Errorf("after request %d with %s: sent %d, want %d", i+1, key, n, want)
+		}
+	}
+}
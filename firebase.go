@@ -0,0 +1,44 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// A Firebase app instance id is 32 hex digits.
+var appInstanceIDPattern = regexp.MustCompile(`^[0-9A-Fa-f]{32}$`)
+
+// firebaseStream reports whether hits go to a Firebase app stream, keyed
+// by firebase_app_id and app_instance_id, rather than a web stream.
+func firebaseStream() bool {
+	return config().StreamType == "firebase"
+}
+
+// setClientIdentity identifies the client in payload the way the stream
+// expects: by client_id for web streams, or by app_instance_id for
+// Firebase ones.
+func setClientIdentity(payload *GA4Payload, query url.Values, cid string) {
+	if !firebaseStream() {
+		payload.ClientID = cid
+		return
+	}
+	payload.ClientID = ""
+	payload.AppInstanceID = appInstanceID(query.Get("aiid"), cid)
+}
+
+// appInstanceID is aiid if it is a valid app instance id, or else one
+// derived from cid, so a client keeps the same id across hits. UUID cids
+// just lose their hyphens.
+func appInstanceID(aiid, cid string) string {
+	if appInstanceIDPattern.MatchString(aiid) {
+		return strings.ToLower(aiid)
+	}
+	if id := strings.ReplaceAll(cid, "-", ""); appInstanceIDPattern.MatchString(id) {
+		return strings.ToLower(id)
+	}
+	sum := sha256.Sum256([]byte(cid))
+	return hex.EncodeToString(sum[:16])
+}
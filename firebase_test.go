@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAppInstanceID(t *testing.T) {
+	tests := []struct {
+		name, aiid, cid, want string
+	}{
+		{"aiid", "0123456789ABCDEF0123456789abcdef", "1.2", "0123456789abcdef0123456789abcdef"},
+		{"malformed aiid", "xyz", "0d6e3b2a-3f0c-4c59-9a0e-2b8d3c1f7a66", "0d6e3b2a3f0c4c599a0e2b8d3c1f7a66"},
+		{"UUID cid", "", "0D6E3B2A-3F0C-4C59-9A0E-2B8D3C1F7A66", "0d6e3b2a3f0c4c599a0e2b8d3c1f7a66"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := appInstanceID(tt.aiid, tt.cid)
+			if got != tt.want || !appInstanceIDPattern.MatchString(got) {
+				t.Errorf("appInstanceID(%q, %q) = %q, want %q", tt.aiid, tt.cid, got, tt.want)
+			}
+		})
+	}
+	// Other cids are hashed: stable per cid, and distinct between them.
+	a := appInstanceID("", "1234567890.1700000000")
+	if !appInstanceIDPattern.MatchString(a) || appInstanceID("", "1234567890.1700000000") != a {
+		t.Errorf("appInstanceID for a GA cid = %q, want a stable 32-digit hex id", a)
+	}
+	if b := appInstanceID("", "1234567890.1700000001"); a == b {
+		t.Errorf("two cids share app instance id %s", a)
+	}
+}
+
+func TestStreamType(t *testing.T) {
+	const aiid = "0123456789abcdef0123456789abcdef"
+	tests := []struct {
+		name        string
+		streamType  string
+		method      string
+		target      string
+		body        string
+		wantIDParam string // query param carrying the measurement id
+		wantAIID    string // "" for a web stream's client_id
+	}{
+		{"web", "", "GET", "/acct/web?pixel", "", "measurement_id", ""},
+		{"explicit web", "web", "GET", "/acct/web2?pixel&aiid=" + aiid, "", "measurement_id", ""},
+		{"firebase", "firebase", "GET", "/acct/app?pixel&aiid=" + aiid, "", "firebase_app_id", aiid},
+		{"firebase without aiid", "firebase", "GET", "/acct/app2?pixel", "", "firebase_app_id", appInstanceID("", "1234.5678")},
+		{"firebase /collect", "firebase", "POST", "/collect/acct?aiid=" + aiid, `{"events": [{"name": "level_up"}]}`, "firebase_app_id", aiid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeCollector(t, Config{StreamType: tt.streamType})
+			r := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+			r.Header.Set("User-Agent", "Mozilla/5.0")
+			r.AddCookie(&http.Cookie{Name: cidCookieName(), Value: "1234.5678"})
+			newMux(&server{sender: gaSender{}}).ServeHTTP(httptest.NewRecorder(), r)
+
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			if len(f.requests) != 1 {
+				t.Fatalf("collector got %d requests, want 1", len(f.requests))
+			}
+			q := f.requests[0].URL.Query()
+			for _, param := range []string{"measurement_id", "firebase_app_id"} {
+				want := ""
+				if param == tt.wantIDParam {
+					want = "G-TEST"
+				}
+				if got := q.Get(param); got != want {
+					t.Errorf("%s = %q, want %q", param, got, want)
+				}
+			}
+			p := f.payloads[0]
+			if tt.wantAIID == "" {
+				if p.ClientID != "1234.5678" || p.AppInstanceID != "" {
+					t.Errorf("client_id %q, app_instance_id %q; want client_id 1234.5678 only", p.ClientID, p.AppInstanceID)
+				}
+			} else if p.AppInstanceID != tt.wantAIID || p.ClientID != "" {
+				t.Errorf("client_id %q, app_instance_id %q; want app_instance_id %s only", p.ClientID, p.AppInstanceID, tt.wantAIID)
+			}
+			for _, e := range p.Events {
+				if _, ok := e.Params["custom_aiid"]; ok {
+					t.Errorf("%s has custom_aiid, want aiid reserved", e.Name)
+				}
+			}
+		})
+	}
+}
+
+func TestStreamTypeValidated(t *testing.T) {
+	tests := []struct {
+		config  Config
+		wantErr bool
+	}{
+		{Config{StreamType: "web"}, false},
+		{Config{StreamType: "firebase"}, false},
+		{Config{StreamType: "ios"}, true},
+		{Config{StreamType: "firebase", Mode: "ua"}, true},
+	}
+	for _, tt := range tests {
+		c := withTestCreds(tt.config)
+		if err := c.validate(); (err != nil) != tt.wantErr {
+			t.Errorf("stream_type %q, mode %q: validate() = %v, want error: %v", tt.config.StreamType, tt.config.Mode, err, tt.wantErr)
+		}
+	}
+}
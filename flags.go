@@ -0,0 +1,72 @@
+package main
+
+import (
+	"flag"
+	"os"
+)
+
+// cliFlags are settings given on the command line. They take precedence
+// over the environment, which takes precedence over the config file.
+type cliFlags struct {
+	config        string
+	measurementID string
+	apiSecret     string
+	port          string
+	addr          string
+	dryRun        bool
+}
+
+var flags cliFlags
+
+// parseFlags parses the command line into flags.
+func parseFlags(args []string) error {
+	fs := flag.NewFlagSet("ga-beacon", flag.ContinueOnError)
+	fs.StringVar(&flags.config, "config", "", "path to the config file (default $CONFIG_FILE or config.json)")
+	fs.StringVar(&flags.measurementID, "measurement-id", "", "GA4 measurement id, overriding the config file")
+	fs.StringVar(&flags.apiSecret, "api-secret", "", "GA4 API secret, overriding the config file")
+	fs.StringVar(&flags.port, "port", "", "port to listen on (default $PORT or 8080)")
+	fs.StringVar(&flags.addr, "addr", "", "host:port to listen on, overriding -port and $PORT")
+	fs.BoolVar(&flags.dryRun, "dry-run", false, "log payloads instead of sending them to GA")
+	return fs.Parse(args)
+}
+
+// configPath is the config file to load, and whether it was asked for
+// explicitly rather than being the default.
+func configPath() (string, bool) {
+	if flags.config != "" {
+		return flags.config, true
+	}
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		return path, true
+	}
+	return "config.json", false
+}
+
+// applyOverrides replaces config file values with those set in the
+// environment or on the command line.
+func applyOverrides(c *Config) {
+	if v := os.Getenv("GA_MEASUREMENT_ID"); v != "" {
+		c.MeasurementID = v
+	}
+	if v := os.Getenv("GA_API_SECRET"); v != "" {
+		c.APISecret = v
+	}
+	if v := os.Getenv("PORT"); v != "" {
+		c.Port = v
+	}
+	if flags.measurementID != "" {
+		c.MeasurementID = flags.measurementID
+	}
+	if flags.apiSecret != "" {
+		c.APISecret = flags.apiSecret
+	}
+	if flags.port != "" {
+		c.Port = flags.port
+	}
+	if flags.addr != "" {
+		c.ListenAddr = flags.addr
+	}
+	if flags.dryRun {
+		c.DryRun = true
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestConfigPrecedence(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string            // config file contents, "" for none
+		env     map[string]string // environment
+		args    []string          // command line
+		wantID  string
+		wantErr string
+	}{
+		{"config file", `{"measurement_id": "G-FILE", "api_secret": "s"}`, nil, nil, "G-FILE", ""},
+		{"env beats file", `{"measurement_id": "G-FILE", "api_secret": "s"}`, map[string]string{"GA_MEASUREMENT_ID": "G-ENV"}, nil, "G-ENV", ""},
+		{"flag beats env and file", `{"measurement_id": "G-FILE", "api_secret": "s"}`, map[string]string{"GA_MEASUREMENT_ID": "G-ENV"}, []string{"-measurement-id", "G-FLAG"}, "G-FLAG", ""},
+		{"flag beats file", `{"measurement_id": "G-FILE", "api_secret": "s"}`, nil, []string{"-measurement-id=G-FLAG"}, "G-FLAG", ""},
+		{"no config file", "", map[string]string{"GA_MEASUREMENT_ID": "G-ENV", "GA_API_SECRET": "s"}, nil, "G-ENV", ""},
+		{"secret from a flag", `{"measurement_id": "G-FILE"}`, nil, []string{"-api-secret", "s"}, "G-FILE", ""},
+		{"nothing set", "", nil, nil, "", "measurement_id and api_secret are required"},
+		{"secret missing", `{"measurement_id": "G-FILE"}`, map[string]string{"GA_MEASUREMENT_ID": "G-ENV"}, nil, "", "measurement_id and api_secret are required"},
+		{"dry run needs no secret", `{"measurement_id": "G-FILE", "dry_run": true}`, nil, nil, "G-FILE", ""},
+		{"-dry-run needs no secret", `{"measurement_id": "G-FILE"}`, nil, []string{"-dry-run"}, "G-FILE", ""},
+		{"dry run still needs an id", "", nil, []string{"-dry-run"}, "", "measurement_id and api_secret are required"},
+		{"explicit config file missing", "", nil, []string{"-config", "missing.json"}, "", "failed to read config file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Chdir(t.TempDir())
+			for _, k := range []string{"CONFIG_FILE", "GA_MEASUREMENT_ID", "GA_API_SECRET", "PORT"} {
+				t.Setenv(k, tt.env[k])
+			}
+			if tt.file != "" {
+				if err := os.WriteFile("config.json", []byte(tt.file), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			old := flags
+			t.Cleanup(func() { flags = old })
+			flags = cliFlags{}
+			if err := parseFlags(tt.args); err != nil {
+				t.Fatal(err)
+			}
+
+			cfg, err := loadConfig()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("loadConfig() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.MeasurementID != tt.wantID {
+				t.Errorf("measurement_id = %q, want %q", cfg.MeasurementID, tt.wantID)
+			}
+		})
+	}
+}
+
+func TestPortPrecedence(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		env  string
+		args []string
+		want string
+	}{
+		{"config file", `"port": "9000"`, "", nil, "9000"},
+		{"PORT beats file", `"port": "9000"`, "9001", nil, "9001"},
+		{"-port beats PORT", `"port": "9000"`, "9001", []string{"-port", "9002"}, "9002"},
+		{"default", ``, "", nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "config.json")
+			body := `{"measurement_id": "G-TEST", "api_secret": "s"`
+			if tt.file != "" {
+				body += ", " + tt.file
+			}
+			if err := os.WriteFile(path, []byte(body+"}"), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			t.Setenv("PORT", tt.env)
+			t.Setenv("GA_MEASUREMENT_ID", "")
+			t.Setenv("GA_API_SECRET", "")
+			old := flags
+			t.Cleanup(func() { flags = old })
+			flags = cliFlags{}
+			if err := parseFlags(append([]string{"-config", path}, tt.args...)); err != nil {
+				t.Fatal(err)
+			}
+
+			cfg, err := loadConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Port != tt.want {
+				t.Errorf("port = %q, want %q", cfg.Port, tt.want)
+			}
+		})
+	}
+}
+
+func TestEnvCredentials(t *testing.T) {
+	tests := []struct {
+		name       string
+		file       string // config file contents, "" for none
+		envID      string
+		envSecret  string
+		wantID     string
+		wantSecret string
+		wantErr    bool
+	}{
+		{"env only", "", "G-ENV", "env-secret", "G-ENV", "env-secret", false},
+		{"file only", `{"measurement_id": "G-FILE", "api_secret": "file-secret"}`, "", "", "G-FILE", "file-secret", false},
+		{"env overrides file", `{"measurement_id": "G-FILE", "api_secret": "file-secret"}`, "G-ENV", "env-secret", "G-ENV", "env-secret", false},
+		{"env completes file", `{"measurement_id": "G-FILE"}`, "", "env-secret", "G-FILE", "env-secret", false},
+		{"empty file, no env", `{}`, "", "", "", "", true},
+		{"no file, no env", "", "", "", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Chdir(t.TempDir())
+			t.Setenv("CONFIG_FILE", "")
+			t.Setenv("GA_MEASUREMENT_ID", tt.envID)
+			t.Setenv("GA_API_SECRET", tt.envSecret)
+			if tt.file != "" {
+				if err := os.WriteFile("config.json", []byte(tt.file), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			old := flags
+			t.Cleanup(func() { flags = old })
+			flags = cliFlags{}
+
+			cfg, err := loadConfig()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadConfig() error = %v, want error: %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if cfg.MeasurementID != tt.wantID || cfg.APISecret != tt.wantSecret {
+				t.Errorf("got %q/%q, want %q/%q", cfg.MeasurementID, cfg.APISecret, tt.wantID, tt.wantSecret)
+			}
+		})
+	}
+}
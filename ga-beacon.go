@@ -2,41 +2,456 @@ package main
 
 import (
 	"bytes"
+	"cmp"
 	"context"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"html/template"
 	"io/ioutil"
 	"log"
+	"log/slog"
+	"mime"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
-	"strconv"
+	"os/signal"
+	"path"
+	"regexp"
+	"slices"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"google.golang.org/appengine/delay"
 )
 
 // Config structure for GA4 settings
 type Config struct {
-	MeasurementID string `json:"measurement_id"`
-	APISecret     string `json:"api_secret"`
+	MeasurementID string `json:"measurement_id" yaml:"measurement_id"`
+	APISecret     string `json:"api_secret" yaml:"api_secret"`
+
+	// Minimum number of seconds between delivered hits for a single cid.
+	MinHitInterval int `json:"min_hit_interval" yaml:"min_hit_interval"`
+
+	// Additional data streams selectable per request with ?stream=<name>.
+	Streams map[string]Credentials `json:"streams" yaml:"streams"`
+
+	// Fail /healthz once deliveries have been failing for
+	// health_degraded_after seconds (default 60).
+	HealthRequireDelivery bool `json:"health_require_delivery" yaml:"health_require_delivery"`
+	HealthDegradedAfter   int  `json:"health_degraded_after" yaml:"health_degraded_after"`
+
+	// Request headers recorded as event params, keyed by header name.
+	HeaderParams map[string]string `json:"header_params" yaml:"header_params"`
+
+	// Size limit for tracking cookies we read or set (default 256 bytes).
+	MaxCookieBytes int `json:"max_cookie_bytes" yaml:"max_cookie_bytes"`
+
+	// Attributes of the cid cookie.
+	Cookie CookieConfig `json:"cookie" yaml:"cookie"`
+
+	// Request network Client Hints and record them as event params.
+	NetworkHints bool `json:"network_hints" yaml:"network_hints"`
+
+	// Record the device category, operating system and browser from the
+	// User-Agent as event params.
+	ParseUserAgent bool `json:"parse_user_agent" yaml:"parse_user_agent"`
+
+	// How session ids are generated: timestamp (default), random, cid or
+	// ga_cookie.
+	SessionStrategy string `json:"session_strategy" yaml:"session_strategy"`
+
+	// Total seconds allowed for delivering one hit to GA (default 10).
+	DeliveryTimeout int `json:"delivery_timeout" yaml:"delivery_timeout"`
+
+	// Whether badge hits also send, or send instead of page_view, a
+	// badge_render event: "" (default, page_view only), "also" or
+	// "instead". Overridable per account.
+	BadgeEvent         string            `json:"badge_event" yaml:"badge_event"`
+	BadgeEventAccounts map[string]string `json:"badge_event_accounts" yaml:"badge_event_accounts"`
+
+	// Seconds browsers may cache the GIF badges, which show no count
+	// (default 0, revalidated on every view so each one is counted).
+	// Pixels and counter badges are never cached.
+	BadgeCacheSeconds int `json:"badge_cache_seconds" yaml:"badge_cache_seconds"`
+
+	// Event name sent for hits instead of page_view, unless ?event=
+	// overrides it.
+	DefaultEventName string `json:"default_event_name" yaml:"default_event_name"`
+
+	// Where badge hit counts are kept: "memory" (default, reset on
+	// restart) or "file", a JSON file at counter_file.
+	CounterBackend string `json:"counter_backend" yaml:"counter_backend"`
+	CounterFile    string `json:"counter_file" yaml:"counter_file"`
+
+	// Most (account, day) pairs whose hits are counted for /stats at once
+	// (default 100000). The pair counted least recently is dropped first.
+	MaxDailyCounts int `json:"max_daily_counts" yaml:"max_daily_counts"`
+
+	// Seconds a badge's last known count is shown for while the counter
+	// store can't be read (default 600, -1 to show 0 instead).
+	StaleCountSeconds int `json:"stale_count_seconds" yaml:"stale_count_seconds"`
+
+	// Seed badge counts at startup with page views to date from the GA4
+	// properties in GAPropertyIDs (account to numeric property id), read
+	// from the Data API with the service account key in
+	// GACredentialsFile.
+	WarmFromGA        bool              `json:"warm_from_ga" yaml:"warm_from_ga"`
+	GACredentialsFile string            `json:"ga_credentials_file" yaml:"ga_credentials_file"`
+	GAPropertyIDs     map[string]string `json:"ga_property_ids" yaml:"ga_property_ids"`
+
+	// Refuse hits with event or param names GA4 would reject, rather than
+	// repairing or dropping the names.
+	StrictNames bool `json:"strict_names" yaml:"strict_names"`
+
+	// Params whose values are masked in any logged payload.
+	LogRedactParams []string `json:"log_redact_params" yaml:"log_redact_params"`
+
+	// How account path segments are normalized: "none" (default) or
+	// "lowercase".
+	NormalizeAccount string `json:"normalize_account" yaml:"normalize_account"`
+
+	// MaxMind DB used to add geo_country/geo_region params locally.
+	GeoDBPath string `json:"geo_db_path" yaml:"geo_db_path"`
+
+	// What is sent as ip_address: "full" (default) or "none".
+	IPMode string `json:"ip_mode" yaml:"ip_mode"`
+
+	// Give visitors without a cid cookie a client id derived from their
+	// IP and user agent, keyed with the salt, instead of a random one.
+	StableCIDFallback bool   `json:"stable_cid_fallback" yaml:"stable_cid_fallback"`
+	StableCIDSalt     string `json:"stable_cid_salt" yaml:"stable_cid_salt"`
+
+	// Zero the host part of client IPs before they are sent or logged
+	// (default true).
+	AnonymizeIP *bool `json:"anonymize_ip" yaml:"anonymize_ip"`
+
+	// Paths that are served an image but never tracked. Entries ending in
+	// "/" match as prefixes, entries with *, ? or [ as globs, and anything
+	// else exactly.
+	IgnorePaths []string `json:"ignore_paths" yaml:"ignore_paths"`
+
+	// Query params sent as numeric 1/0 when they hold a boolean value.
+	BooleanParams []string `json:"boolean_params" yaml:"boolean_params"`
+
+	// Query param or header carrying the event time, and its format:
+	// unix (default), unix_ms, unix_micros or a Go time layout.
+	TimestampParam  string `json:"timestamp_param" yaml:"timestamp_param"`
+	TimestampFormat string `json:"timestamp_format" yaml:"timestamp_format"`
+
+	// Accounts that are answered with 410 Gone and never tracked.
+	RetiredAccounts []string `json:"retired_accounts" yaml:"retired_accounts"`
+
+	// Where / redirects (default the project's GitHub page), or "" to
+	// serve a short landing page there instead.
+	RootRedirect *string `json:"root_redirect" yaml:"root_redirect"`
+
+	// Account names, or globs such as "docs-*", that hits are sent for.
+	// Others are served the image without tracking, or with
+	// unlisted_accounts "not_found", a 404. Empty allows every account.
+	AllowedAccounts  []string `json:"allowed_accounts" yaml:"allowed_accounts"`
+	UnlistedAccounts string   `json:"unlisted_accounts" yaml:"unlisted_accounts"`
+
+	// Mark every payload non_personalized_ads, not just those with ?npa=1.
+	NonPersonalizedAds bool `json:"non_personalized_ads" yaml:"non_personalized_ads"`
+
+	// Descriptive params attached to every event of an account, such as
+	// team or product area. Request params of the same name take
+	// precedence.
+	AccountMetadata map[string]map[string]interface{} `json:"account_metadata" yaml:"account_metadata"`
+
+	// Params attached to every event of every account, such as
+	// environment. account_metadata and request params of the same name
+	// take precedence.
+	DefaultParams map[string]interface{} `json:"default_params" yaml:"default_params"`
+
+	// Security headers for the account page, replacing or adding to the
+	// defaults by name. An empty value leaves a header out, and {nonce}
+	// stands for the nonce the page's inline script carries.
+	SecurityHeaders map[string]string `json:"security_headers" yaml:"security_headers"`
+
+	// Enables /debug/stream for holders of this token, with at most
+	// debug_stream_max_clients (default 5) connected at once.
+	DebugStreamToken      string `json:"debug_stream_token" yaml:"debug_stream_token"`
+	DebugStreamMaxClients int    `json:"debug_stream_max_clients" yaml:"debug_stream_max_clients"`
+
+	// Per-request timeout, including connecting, for posts to GA
+	// (default 10).
+	GADialTimeoutSeconds int `json:"ga_dial_timeout_seconds" yaml:"ga_dial_timeout_seconds"`
+
+	// Proxies (CIDRs or addresses) whose X-Forwarded-For and X-Real-IP
+	// headers are believed.
+	TrustedProxies []string `json:"trusted_proxies" yaml:"trusted_proxies"`
+
+	// GA4 properties for specific accounts. Accounts without an entry use
+	// the top-level measurement_id and api_secret.
+	Accounts map[string]Credentials `json:"accounts" yaml:"accounts"`
+
+	// Log full payloads and client IPs. Also enabled by a DEBUG env var.
+	Debug bool `json:"debug" yaml:"debug"`
+
+	// Seconds a client gets to send a request and read the response
+	// (default 10, -1 for no limit). /debug/stream is exempt.
+	RequestTimeoutSeconds int `json:"request_timeout_seconds" yaml:"request_timeout_seconds"`
+
+	// Largest /collect/ request body accepted, in bytes (default 64 KiB).
+	MaxBodyBytes int64 `json:"max_body_bytes" yaml:"max_body_bytes"`
+
+	// Seconds in-flight requests get to finish on shutdown (default 10),
+	// and then queued hits get to reach GA (default 15).
+	ShutdownGraceSeconds int `json:"shutdown_grace_seconds" yaml:"shutdown_grace_seconds"`
+	DrainTimeoutSeconds  int `json:"drain_timeout_seconds" yaml:"drain_timeout_seconds"`
+
+	// Measurement Protocol endpoint hits are posted to, and whether to use
+	// GA4's validation endpoint (/debug/mp/collect) next to it instead.
+	CollectorURL   string `json:"collector_url" yaml:"collector_url"`
+	DebugCollector bool   `json:"debug_collector" yaml:"debug_collector"`
+
+	// Check each payload against GA4's validation endpoint before sending
+	// it, logging any problems, and with validate_reject not sending
+	// payloads that have them.
+	Validate       bool `json:"validate" yaml:"validate"`
+	ValidateReject bool `json:"validate_reject" yaml:"validate_reject"`
+
+	// Log payloads instead of sending them, for trying the beacon out
+	// without a real api_secret. Also set by -dry-run.
+	DryRun bool `json:"dry_run" yaml:"dry_run"`
+
+	// Minutes of inactivity after which a client's next hit starts a new
+	// session (default 30).
+	SessionTimeoutMinutes int `json:"session_timeout_minutes" yaml:"session_timeout_minutes"`
+
+	// Delivery workers (default 4) and how many hits may wait for them
+	// (default 1000) before new ones are dropped.
+	Workers   int `json:"workers" yaml:"workers"`
+	QueueSize int `json:"queue_size" yaml:"queue_size"`
+
+	// Most posts to GA in flight at once, across workers, batches and
+	// retries (default no limit). Others wait for a free slot.
+	MaxConcurrentSends int `json:"max_concurrent_sends" yaml:"max_concurrent_sends"`
+
+	// Directory to keep queued hits in until they are delivered, so hits
+	// still queued when the process stops are sent after it restarts.
+	QueueDir string `json:"queue_dir" yaml:"queue_dir"`
+
+	// Hits waiting in memory beyond which new ones are written to
+	// queue_dir instead, and read back as delivery catches up (default
+	// 0, never). Requires queue_dir.
+	QueueSpillDepth int `json:"queue_spill_depth" yaml:"queue_spill_depth"`
+
+	// Milliseconds a worker's send may take before it is logged as slow
+	// (default 2000, -1 disables).
+	SlowSendThresholdMs int `json:"slow_send_threshold_ms" yaml:"slow_send_threshold_ms"`
+
+	// Retries of a post that failed with a network error, 429 or 5xx
+	// (default 3, -1 to disable).
+	MaxRetries int `json:"max_retries" yaml:"max_retries"`
+
+	// Retries per second allowed across all deliveries (default no
+	// limit). Failed posts beyond it aren't retried: they stay in
+	// queue_dir for the next start, or are dropped.
+	RetryBudgetPerSecond float64 `json:"retry_budget_per_second" yaml:"retry_budget_per_second"`
+
+	// Directory to load static/ and page.html from instead of the copies
+	// built into the binary.
+	StaticDir string `json:"static_dir" yaml:"static_dir"`
+
+	// User agents whose hits are served but not sent to GA, as
+	// case-insensitive substrings or /regex/. They add to a built-in list
+	// of common bots unless ReplaceDefaultBots is set. AllowedUserAgents
+	// are never treated as bots.
+	BotUserAgents      []string `json:"bot_user_agents" yaml:"bot_user_agents"`
+	ReplaceDefaultBots bool     `json:"replace_default_bots" yaml:"replace_default_bots"`
+	AllowedUserAgents  []string `json:"allowed_user_agents" yaml:"allowed_user_agents"`
+
+	// Treat DNT: 1 like ?consent=denied.
+	RespectDNT bool `json:"respect_dnt" yaml:"respect_dnt"`
+
+	// What happens to hits from visitors who opted out: "skip" (default)
+	// serves the image without tracking, "send" sends the hit with ad
+	// consent denied and non-personalized ads.
+	DeniedConsentMode string `json:"denied_consent_mode" yaml:"denied_consent_mode"`
+
+	// Consent assumed for hits that don't pass ?consent_<type>=, keyed by
+	// ad_user_data, ad_personalization or analytics_storage, with values
+	// "granted" or "denied".
+	ConsentDefaults map[string]string `json:"consent_defaults" yaml:"consent_defaults"`
+
+	// Hits per minute allowed from one client IP, and from one cid, before
+	// further hits are served but not sent (0 disables). RateLimitBurst
+	// is how many may arrive at once (default RateLimitPerMinute).
+	RateLimitPerMinute int `json:"rate_limit_per_minute" yaml:"rate_limit_per_minute"`
+	RateLimitBurst     int `json:"rate_limit_burst" yaml:"rate_limit_burst"`
+
+	// "text" (default) or "json" log lines.
+	LogFormat string `json:"log_format" yaml:"log_format"`
+
+	// Milliseconds to hold a client's hits so they are sent to GA
+	// together, up to 25 events per request (0 disables batching).
+	BatchWindowMillis int `json:"batch_window_ms" yaml:"batch_window_ms"`
+
+	// Origins whose pages may fetch badges and post to /collect from
+	// JavaScript, or "*" for any.
+	AllowedOrigins []string `json:"allowed_origins" yaml:"allowed_origins"`
+
+	// Port to listen on (default 8080), overridden by $PORT and -port.
+	Port string `json:"port" yaml:"port"`
+
+	// Address to listen on, such as 127.0.0.1:8080 or [::1]:8080, taking
+	// precedence over the port. Overridden by -addr.
+	ListenAddr string `json:"listen_addr" yaml:"listen_addr"`
+
+	// "ga4" (default) posts GA4 Measurement Protocol JSON. "ua" posts
+	// classic Universal Analytics hits instead, with measurement_id
+	// holding the UA-XXXXX-Y tracking id and no api_secret needed.
+	Mode string `json:"mode" yaml:"mode"`
+
+	// The kind of GA4 stream hits go to: "web" (default), or "firebase"
+	// for app streams, with measurement_id holding the firebase_app_id
+	// and clients identified by app_instance_id.
+	StreamType string `json:"stream_type" yaml:"stream_type"`
+
+	// Query params that are never sent as custom params, on top of the
+	// ones the beacon uses itself.
+	ReservedParams []string `json:"reserved_params" yaml:"reserved_params"`
+
+	// Patterns of param names, as path.Match globs, that query params are
+	// never sent as, with or without a custom_ prefix, so clients can't
+	// pass off GA4's own params. Unset uses defaultDeniedParams; an empty
+	// list allows every name.
+	DeniedParams []string `json:"denied_params" yaml:"denied_params"`
+
+	// Separate beacons served under their own path prefixes.
+	Beacons []BeaconConfig `json:"beacons" yaml:"beacons"`
+
+	// Seconds within which a repeat hit from the same cid on the same page
+	// is served but not sent (default 2, -1 disables).
+	DedupWindowSeconds int `json:"dedup_window_seconds" yaml:"dedup_window_seconds"`
+
+	// Share of hits sent to GA, between 0 and 1 (default 1, all of them).
+	// The rest still get their image and count on the badge. With
+	// sticky_sampling each client is consistently in or out.
+	SampleRate     float64 `json:"sample_rate" yaml:"sample_rate"`
+	StickySampling bool    `json:"sticky_sampling" yaml:"sticky_sampling"`
+
+	// Most query params sent as custom_ params per hit (default 10, -1
+	// for none), and the longest param value sent (default 100).
+	MaxCustomParams     int `json:"max_custom_params" yaml:"max_custom_params"`
+	MaxParamValueLength int `json:"max_param_value_length" yaml:"max_param_value_length"`
+
+	// Serve HTTPS with this certificate and key instead of plain HTTP,
+	// and with http_redirect_port, redirect plain HTTP on that port to it.
+	TLSCert          string `json:"tls_cert" yaml:"tls_cert"`
+	TLSKey           string `json:"tls_key" yaml:"tls_key"`
+	HTTPRedirectPort string `json:"http_redirect_port" yaml:"http_redirect_port"`
+
+	// Enables /admin/accounts for holders of this token.
+	AdminToken string `json:"admin_token" yaml:"admin_token"`
+
+	// With admin_user set, requests under protected_paths (default
+	// defaultProtectedPaths) need these HTTP Basic Auth credentials.
+	AdminUser      string   `json:"admin_user" yaml:"admin_user"`
+	AdminPassword  string   `json:"admin_password" yaml:"admin_password"`
+	ProtectedPaths []string `json:"protected_paths" yaml:"protected_paths"`
+
+	// Built from the settings above by prepare.
+	bots, allowedBots *uaMatcher
+	proxies           []*net.IPNet
+	sessionIDs        SessionIDStrategy
+	reserved          map[string]bool
+}
+
+// prepare builds what the running beacon derives from c's settings: the
+// bot filter, trusted proxies, session id strategy and reserved params.
+func (c *Config) prepare() error {
+	var err error
+	if c.bots, c.allowedBots, err = botFilter(c); err != nil {
+		return err
+	}
+	if c.proxies, err = parseTrustedProxies(c.TrustedProxies); err != nil {
+		return err
+	}
+	if c.sessionIDs, err = newSessionIDStrategy(c.SessionStrategy); err != nil {
+		return err
+	}
+	c.reserved = reservedParamSet(c.ReservedParams)
+	c.Beacons = append([]BeaconConfig(nil), c.Beacons...)
+	for i := range c.Beacons {
+		if c.Beacons[i].ReservedParams != nil {
+			c.Beacons[i].reserved = reservedParamSet(c.Beacons[i].ReservedParams)
+		}
+	}
+	return nil
+}
+
+// hasCredentials reports whether hits can be delivered anywhere: either the
+// top-level pair or at least one account or beacon is configured.
+func (c *Config) hasCredentials() bool {
+	top := Credentials{MeasurementID: c.MeasurementID, APISecret: c.APISecret}
+	if top.complete(c) || len(c.Accounts) > 0 {
+		return true
+	}
+	for i := range c.Beacons {
+		if c.Beacons[i].credentials().complete(c) {
+			return true
+		}
+	}
+	return false
+}
+
+// Credentials identify the GA4 data stream a hit is delivered to.
+type Credentials struct {
+	MeasurementID string `json:"measurement_id" yaml:"measurement_id"`
+	APISecret     string `json:"api_secret" yaml:"api_secret"`
 }
 
-var config Config
+// complete reports whether creds are enough to send hits under c: UA mode
+// and dry runs need only a measurement id, GA4 also needs the API secret.
+func (creds Credentials) complete(c *Config) bool {
+	if c.Mode == "ua" || c.DryRun {
+		return creds.MeasurementID != ""
+	}
+	return creds.MeasurementID != "" && creds.APISecret != ""
+}
+
+// liveConfig holds the running config. It is replaced whole, never
+// modified, so a reload can swap it under running requests.
+var liveConfig atomic.Pointer[Config]
+
+func init() {
+	c := &Config{}
+	c.prepare()
+	liveConfig.Store(c)
+}
+
+// config returns the running config, which callers must not modify.
+func config() *Config {
+	return liveConfig.Load()
+}
 
 var (
-	pixel        = mustReadFile("static/pixel.gif")
-	badge        = mustReadFile("static/badge.svg")
-	badgeGif     = mustReadFile("static/badge.gif")
-	badgeFlat    = mustReadFile("static/badge-flat.svg")
-	badgeFlatGif = mustReadFile("static/badge-flat.gif")
-	pageTemplate = template.Must(template.New("page").ParseFiles("page.html"))
+	// recentHits remembers the last delivered hit per cid when
+	// min_hit_interval is set.
+	recentHits *ttlCache[time.Time]
+
+	hitsThrottled = newCounter("beacon_hits_throttled_total", "Hits skipped because the cid was seen within min_hit_interval.")
+	eventsExpired = newCounter("beacon_events_expired_total", "Hits dropped because they were older than GA4 accepts.")
+	hitsReceived  = newCounter("beacon_hits_total", "Hits received, by account and image type.")
+	gaPosts       = newCounter("beacon_ga_posts_total", "Posts to the GA collector, by result.")
 )
 
+// Upper bound on the number of cids tracked for hit throttling.
+const maxTrackedClients = 100000
+
 // GA4 Event structure
 type GA4Event struct {
 	Name   string                 `json:"name"`
@@ -45,61 +460,590 @@ type GA4Event struct {
 
 // GA4 Payload structure
 type GA4Payload struct {
-	ClientID string     `json:"client_id"`
-	Events   []GA4Event `json:"events"`
+	ClientID           string     `json:"client_id,omitempty"`
+	AppInstanceID      string     `json:"app_instance_id,omitempty"`
+	UserID             string     `json:"user_id,omitempty"`
+	TimestampMicros    int64      `json:"timestamp_micros,omitempty"`
+	NonPersonalizedAds bool       `json:"non_personalized_ads,omitempty"`
+	Consent            *Consent   `json:"consent,omitempty"`
+	Events             []GA4Event `json:"events"`
+
+	// Time the hit was accepted, used to correct or drop late deliveries.
+	Received time.Time `json:"-"`
+}
+
+// GA4 only accepts events up to 72 hours in the past.
+const maxEventAge = 72 * time.Hour
+
+const defaultDeliveryTimeout = 10 * time.Second
+
+const defaultGATimeout = 10 * time.Second
+
+const defaultShutdownGrace = 10 * time.Second
+
+const defaultDrainTimeout = 15 * time.Second
+
+const defaultRequestTimeout = 10 * time.Second
+
+// Largest request line and headers accepted, which leaves room for
+// cookies and long referers.
+const maxHeaderBytes = 16 << 10
+
+const defaultPort = "8080"
+
+const defaultCollectorURL = "https://www.google-analytics.com/mp/collect"
+
+// gaClient is shared by all deliveries so connections to the collector are
+// pooled and reused.
+var gaClient = newGAClient(defaultGATimeout)
+
+// sendSlots, with max_concurrent_sends set, holds a token for each post to
+// GA in flight, so a burst of deliveries waits for a free slot instead of
+// opening ever more connections to Google.
+var sendSlots chan struct{}
+
+// acquireSendSlot waits until a post to GA may be made, or until c is
+// done. The caller must call release once the post is over.
+func acquireSendSlot(c context.Context) (release func(), err error) {
+	slots := sendSlots
+	if slots == nil {
+		return func() {}, nil
+	}
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, nil
+	case <-c.Done():
+		return nil, c.Err()
+	}
 }
 
-func loadConfig() error {
-	configFile := "config.json"
-	if envConfig := os.Getenv("CONFIG_FILE"); envConfig != "" {
-		configFile = envConfig
+func newGAClient(timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			DialContext:         (&net.Dialer{Timeout: timeout, KeepAlive: 30 * time.Second}).DialContext,
+			TLSHandshakeTimeout: timeout,
+			MaxIdleConns:        100,
+			MaxIdleConnsPerHost: 32,
+			IdleConnTimeout:     90 * time.Second,
+		},
 	}
+}
+
+// loadConfig reads the config file and applies the environment and flags
+// over it, returning an error if the result can't be run with.
+func loadConfig() (Config, error) {
+	var cfg Config
 
+	// Without a config file, the credentials can still come from the
+	// environment or flags.
+	configFile, explicit := configPath()
 	data, err := ioutil.ReadFile(configFile)
-	if err != nil {
-		return fmt.Errorf("failed to read config file %s: %v", configFile, err)
+	switch {
+	case os.IsNotExist(err) && !explicit:
+	case err != nil:
+		return cfg, fmt.Errorf("failed to read config file %s: %v", configFile, err)
+	default:
+		if err := unmarshalConfig(configFile, data, &cfg); err != nil {
+			return cfg, fmt.Errorf("failed to parse config file: %v", err)
+		}
 	}
+	applyOverrides(&cfg)
 
-	if err := json.Unmarshal(data, &config); err != nil {
-		return fmt.Errorf("failed to parse config file: %v", err)
+	if err := cfg.validate(); err != nil {
+		return cfg, err
 	}
+	if cfg.NormalizeAccount == "lowercase" {
+		cfg.BadgeEventAccounts = normalizeAccountKeys(cfg.BadgeEventAccounts)
+		cfg.AccountMetadata = normalizeAccountKeys(cfg.AccountMetadata)
+		cfg.Accounts = normalizeAccountKeys(cfg.Accounts)
+	}
+	return cfg, cfg.prepare()
+}
 
-	if config.MeasurementID == "" || config.APISecret == "" {
-		return fmt.Errorf("measurement_id and api_secret are required in config file")
+// validate reports the first setting in c that is missing or invalid.
+func (c *Config) validate() error {
+	for account, creds := range c.Accounts {
+		if !creds.complete(c) {
+			return fmt.Errorf("account %q requires measurement_id and api_secret", account)
+		}
+	}
+	if err := validateBeacons(c.Beacons, c); err != nil {
+		return err
+	}
+	if !c.hasCredentials() {
+		return fmt.Errorf("measurement_id and api_secret are required, in the config file, as GA_MEASUREMENT_ID and GA_API_SECRET, as -measurement-id and -api-secret, or per account or beacon")
+	}
+
+	for name, v := range c.DefaultParams {
+		if err := validateName("param", name); err != nil {
+			return fmt.Errorf("default_params: %v", err)
+		}
+		switch v.(type) {
+		case string, float64, bool:
+		default:
+			return fmt.Errorf("default_params: %s must be a string, number or boolean", name)
+		}
+	}
+
+	headerParams := make(map[string]string, len(c.HeaderParams))
+	for header, name := range c.HeaderParams {
+		if header == "" {
+			return fmt.Errorf("header_params: header name must not be empty")
+		}
+		if err := validateName("param", name); err != nil {
+			return fmt.Errorf("header_params %s: %v", header, err)
+		}
+		if paramMatches(defaultDeniedParams, name) {
+			return fmt.Errorf("header_params %s: param name %q is one GA4 or the beacon sets itself", header, name)
+		}
+		if other, ok := headerParams[name]; ok {
+			return fmt.Errorf("header_params: %s and %s both map to %q", other, header, name)
+		}
+		headerParams[name] = header
+	}
+
+	for name, stream := range c.Streams {
+		if !stream.complete(c) {
+			return fmt.Errorf("stream %q requires measurement_id and api_secret", name)
+		}
+	}
+
+	if c.RateLimitPerMinute < 0 || c.RateLimitBurst < 0 {
+		return fmt.Errorf("rate_limit_per_minute and rate_limit_burst must not be negative")
+	}
+	if c.MaxRetries < -1 {
+		return fmt.Errorf("max_retries must be -1 (disabled) or greater")
+	}
+	if c.RetryBudgetPerSecond < 0 {
+		return fmt.Errorf("retry_budget_per_second must not be negative")
+	}
+	if c.QueueSpillDepth < 0 || c.QueueSpillDepth > cmp.Or(c.QueueSize, defaultQueueSize) {
+		return fmt.Errorf("queue_spill_depth must be between 0 and queue_size")
+	}
+	if c.QueueSpillDepth > 0 && c.QueueDir == "" {
+		return fmt.Errorf("queue_spill_depth requires queue_dir")
+	}
+	switch c.CounterBackend {
+	case "", "memory":
+	case "file":
+		if c.CounterFile == "" {
+			return fmt.Errorf("counter_backend file requires counter_file")
+		}
+	default:
+		return fmt.Errorf("unknown counter_backend %q", c.CounterBackend)
+	}
+	if c.StaleCountSeconds < -1 {
+		return fmt.Errorf("stale_count_seconds must be -1 (disabled) or greater")
+	}
+	if c.MaxDailyCounts < 0 {
+		return fmt.Errorf("max_daily_counts must not be negative")
+	}
+	if c.WarmFromGA && (c.GACredentialsFile == "" || len(c.GAPropertyIDs) == 0) {
+		return fmt.Errorf("warm_from_ga requires ga_credentials_file and ga_property_ids")
+	}
+	if c.RequestTimeoutSeconds < -1 {
+		return fmt.Errorf("request_timeout_seconds must be -1 (no limit) or greater")
+	}
+	if c.MaxBodyBytes < 0 {
+		return fmt.Errorf("max_body_bytes must not be negative")
+	}
+	if c.DrainTimeoutSeconds < 0 {
+		return fmt.Errorf("drain_timeout_seconds must not be negative")
+	}
+	if c.MinHitInterval < 0 {
+		return fmt.Errorf("min_hit_interval must not be negative")
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		return fmt.Errorf("tls_cert and tls_key must be set together")
+	}
+	if c.StableCIDFallback && c.StableCIDSalt == "" {
+		return fmt.Errorf("stable_cid_fallback requires stable_cid_salt")
+	}
+	if c.ListenAddr != "" {
+		if err := validListenAddr(c.ListenAddr); err != nil {
+			return fmt.Errorf("listen_addr: %v", err)
+		}
+	}
+	if c.HTTPRedirectPort != "" && c.TLSCert == "" {
+		return fmt.Errorf("http_redirect_port requires tls_cert and tls_key")
+	}
+	if c.MaxCustomParams < -1 {
+		return fmt.Errorf("max_custom_params must be -1 (none) or greater")
+	}
+	if c.MaxParamValueLength < 0 {
+		return fmt.Errorf("max_param_value_length must not be negative")
+	}
+	if c.SampleRate < 0 || c.SampleRate > 1 {
+		return fmt.Errorf("sample_rate must be between 0 and 1")
+	}
+	if c.DedupWindowSeconds < -1 {
+		return fmt.Errorf("dedup_window_seconds must be -1 (disabled) or greater")
+	}
+	if c.NormalizeAccount != "" && c.NormalizeAccount != "none" && c.NormalizeAccount != "lowercase" {
+		return fmt.Errorf("unknown normalize_account %q", c.NormalizeAccount)
+	}
+	if c.LogFormat != "" && c.LogFormat != "text" && c.LogFormat != "json" {
+		return fmt.Errorf("unknown log_format %q", c.LogFormat)
+	}
+
+	for _, pattern := range c.IgnorePaths {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid ignore_paths entry %q: %v", pattern, err)
+		}
+	}
+	if _, ok := sameSiteModes[strings.ToLower(c.Cookie.SameSite)]; c.Cookie.SameSite != "" && !ok {
+		return fmt.Errorf("unknown cookie same_site %q", c.Cookie.SameSite)
+	}
+	if c.Cookie.MaxAge < 0 {
+		return fmt.Errorf("cookie max_age must not be negative")
+	}
+	if c.RootRedirect != nil && *c.RootRedirect != "" {
+		if err := validRootRedirect(*c.RootRedirect); err != nil {
+			return fmt.Errorf("root_redirect: %v", err)
+		}
+	}
+	for _, pattern := range c.AllowedAccounts {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid allowed_accounts pattern %q", pattern)
+		}
+	}
+	if (c.AdminUser == "") != (c.AdminPassword == "") {
+		return fmt.Errorf("admin_user and admin_password must be set together")
+	}
+	for _, p := range c.ProtectedPaths {
+		if !strings.HasPrefix(p, "/") || p == "/" {
+			return fmt.Errorf("protected_paths entry %q must start with / and not be / alone", p)
+		}
+	}
+	for _, pattern := range c.DeniedParams {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid denied_params pattern %q", pattern)
+		}
+	}
+	if c.UnlistedAccounts != "" && c.UnlistedAccounts != "image" && c.UnlistedAccounts != "not_found" {
+		return fmt.Errorf("unknown unlisted_accounts %q", c.UnlistedAccounts)
+	}
+	if c.DeniedConsentMode != "" && c.DeniedConsentMode != "skip" && c.DeniedConsentMode != "send" {
+		return fmt.Errorf("unknown denied_consent_mode %q", c.DeniedConsentMode)
+	}
+	for typ, v := range c.ConsentDefaults {
+		if !slices.Contains(consentTypes, typ) {
+			return fmt.Errorf("unknown consent type %q in consent_defaults", typ)
+		}
+		if parseConsent(v) == "" {
+			return fmt.Errorf("consent_defaults %s must be granted or denied, not %q", typ, v)
+		}
+	}
+	if c.IPMode != "" && c.IPMode != "full" && c.IPMode != "none" {
+		return fmt.Errorf("unknown ip_mode %q", c.IPMode)
+	}
+	if c.DefaultEventName != "" {
+		if err := validateName("event", c.DefaultEventName); err != nil {
+			return fmt.Errorf("default_event_name: %v", err)
+		}
+	}
+	if !validBadgeEvent(c.BadgeEvent) {
+		return fmt.Errorf("unknown badge_event %q", c.BadgeEvent)
+	}
+	for account, mode := range c.BadgeEventAccounts {
+		if !validBadgeEvent(mode) {
+			return fmt.Errorf("unknown badge_event %q for account %s", mode, account)
+		}
+	}
+	if c.Mode != "" && c.Mode != "ga4" && c.Mode != "ua" {
+		return fmt.Errorf("unknown mode %q", c.Mode)
+	}
+	switch c.StreamType {
+	case "", "web":
+	case "firebase":
+		if c.Mode == "ua" {
+			return fmt.Errorf("stream_type firebase requires mode ga4")
+		}
+	default:
+		return fmt.Errorf("unknown stream_type %q", c.StreamType)
+	}
+	if c.CollectorURL != "" {
+		if u, err := url.Parse(c.CollectorURL); err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("invalid collector_url %q", c.CollectorURL)
+		}
+	}
+	if c.GADialTimeoutSeconds < 0 {
+		return fmt.Errorf("ga_dial_timeout_seconds must not be negative")
+	}
+	if c.MaxConcurrentSends < 0 {
+		return fmt.Errorf("max_concurrent_sends must not be negative")
+	}
+	if c.BadgeCacheSeconds < 0 {
+		return fmt.Errorf("badge_cache_seconds must not be negative")
+	}
+	if c.SlowSendThresholdMs < -1 {
+		return fmt.Errorf("slow_send_threshold_ms must be -1 (disabled) or greater")
+	}
+	if c.Workers < 0 || c.QueueSize < 0 {
+		return fmt.Errorf("workers and queue_size must not be negative")
+	}
+	if c.BatchWindowMillis < 0 {
+		return fmt.Errorf("batch_window_ms must not be negative")
+	}
+	if c.DeliveryTimeout < 0 {
+		return fmt.Errorf("delivery_timeout must not be negative")
 	}
 
-	log.Printf("Loaded config: Measurement ID = %s", config.MeasurementID)
 	return nil
 }
 
-func main() {
-	// Load configuration
-	if err := loadConfig(); err != nil {
-		log.Fatal(err)
+// applyConfig makes cfg the running config and sets up the state that
+// lives for the whole run: the rate limiter, throttle and dedup caches, GA
+// client and geo DB.
+func applyConfig(cfg Config) error {
+	if err := cfg.prepare(); err != nil {
+		return err
+	}
+	liveConfig.Store(&cfg)
+	if err := setupLogging(); err != nil {
+		return err
+	}
+
+	hitLimiter = nil
+	if cfg.RateLimitPerMinute > 0 {
+		burst := cfg.RateLimitBurst
+		if burst == 0 {
+			burst = cfg.RateLimitPerMinute
+		}
+		hitLimiter = newRateLimiter(cfg.RateLimitPerMinute, burst)
 	}
 
-	http.HandleFunc("/", handler)
+	recentHits = nil
+	if cfg.MinHitInterval > 0 {
+		recentHits = newTTLCache[time.Time](maxTrackedClients, time.Duration(cfg.MinHitInterval)*time.Second)
+	}
+
+	recentPages = nil
+	if cfg.DedupWindowSeconds >= 0 {
+		recentPages = newTTLCache[time.Time](maxTrackedClients, dedupWindow())
+	}
+	recentKeys = newTTLCache[time.Time](maxTrackedClients, idempotencyWindow)
+
+	lastCounts = nil
+	if ttl := staleCountTTL(); ttl > 0 {
+		lastCounts = newTTLCache[staleCount](maxCountedAccounts, ttl)
+	}
+
+	retryBudget = nil
+	if cfg.RetryBudgetPerSecond > 0 {
+		retryBudget = newRetryLimiter(cfg.RetryBudgetPerSecond, time.Now())
+	}
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
-		log.Printf("Defaulting to port %s", port)
+	if cfg.GADialTimeoutSeconds > 0 {
+		gaClient = newGAClient(time.Duration(cfg.GADialTimeoutSeconds) * time.Second)
 	}
 
-	log.Printf("Listening on port %s", port)
-	if err := http.ListenAndServe(":"+port, nil); err != nil {
+	sendSlots = nil
+	if cfg.MaxConcurrentSends > 0 {
+		sendSlots = make(chan struct{}, cfg.MaxConcurrentSends)
+	}
+
+	geo = nil
+	if cfg.GeoDBPath != "" {
+		if db, err := openMMDB(cfg.GeoDBPath); err != nil {
+			slog.Warn("cannot open geo_db_path, skipping local geo lookups", "err", err)
+		} else {
+			geo = db
+		}
+	}
+	return nil
+}
+
+func main() {
+	if err := parseFlags(os.Args[1:]); err != nil {
+		os.Exit(2)
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
 		log.Fatal(err)
 	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go reloadOnHangup(ctx)
+
+	if err := run(ctx, cfg); err != nil {
+		fatal("server failed", err)
+	}
+}
+
+// fatal logs err and exits, for errors the beacon can't run with.
+func fatal(msg string, err error) {
+	slog.Error(msg, "err", err)
+	os.Exit(1)
 }
 
-func mustReadFile(path string) []byte {
-	b, err := ioutil.ReadFile(path)
+// run serves the beacon with cfg until ctx is cancelled, then stops
+// accepting connections and waits up to shutdown_grace_seconds for in-flight
+// requests, and the GA hits they are sending, to complete.
+func run(ctx context.Context, cfg Config) error {
+	if err := applyConfig(cfg); err != nil {
+		return err
+	}
+	slog.Info("loaded config", "measurement_id", config().MeasurementID)
+	if err := loadAssets(config().StaticDir); err != nil {
+		return fmt.Errorf("cannot load assets: %v", err)
+	}
+	store, err := newCounterStore(config())
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("cannot open counter store: %v", err)
+	}
+	hitCounts = store
+	dailyHits = newDailyCounter(cmp.Or(config().MaxDailyCounts, defaultMaxDailyCounts))
+	if config().WarmFromGA {
+		go warmCounters(ctx, store)
+	}
+	if file, ok := store.(*fileCounterStore); ok {
+		go flushCounters(ctx, file)
+		defer func() {
+			if err := file.Flush(); err != nil {
+				slog.Error("cannot write counter_file", "err", err)
+			}
+		}()
+	}
+
+	workers, size := defaultWorkers, defaultQueueSize
+	if config().Workers > 0 {
+		workers = config().Workers
+	}
+	if config().QueueSize > 0 {
+		size = config().QueueSize
+	}
+	var sender Sender = gaSender{}
+	if config().BatchWindowMillis > 0 {
+		sender = newBatcher(sender, time.Duration(config().BatchWindowMillis)*time.Millisecond)
+	}
+	// Opened before the queue, so it is closed only after the queue is
+	// drained.
+	var wal *hitLog
+	var replay []walHit
+	if dir := config().QueueDir; dir != "" {
+		wal, replay, err = openHitLog(dir)
+		if err != nil {
+			return fmt.Errorf("cannot open queue_dir: %v", err)
+		}
+		defer wal.Close()
+	}
+	var spill *hitSpill
+	if depth := config().QueueSpillDepth; depth > 0 {
+		spill, err = openHitSpill(config().QueueDir)
+		if err != nil {
+			return fmt.Errorf("cannot open queue_dir: %v", err)
+		}
+		defer spill.Close()
+	}
+	queue := newSendQueue(sender, wal, workers, size)
+	if spill != nil {
+		queue.SpillTo(spill, config().QueueSpillDepth)
 	}
-	return b
+	if len(replay) > 0 {
+		slog.Info("replaying undelivered hits from queue_dir", "hits", len(replay))
+		go queue.Replay(replay)
+	}
+
+	// Deliver whatever the last requests queued before returning, but
+	// don't hold up the exit for long.
+	defer func() {
+		drain := defaultDrainTimeout
+		if config().DrainTimeoutSeconds > 0 {
+			drain = time.Duration(config().DrainTimeoutSeconds) * time.Second
+		}
+		if n := queue.Drain(drain); n > 0 {
+			slog.Warn("delivery queue not drained, dropping hits", "hits", n, "timeout", drain)
+		}
+	}()
+
+	addr := listenAddr()
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	_, port, _ := net.SplitHostPort(addr)
+	if tlsEnabled() {
+		tlsConfig, err := newTLSConfig(config().TLSCert, config().TLSKey)
+		if err != nil {
+			ln.Close()
+			return fmt.Errorf("cannot load tls_cert and tls_key: %v", err)
+		}
+		ln = tls.NewListener(ln, tlsConfig)
+	}
+	timeout := requestTimeout()
+	httpServer := &http.Server{
+		Handler:           withBeacons(withAdminAuth(newMux(&server{sender: queue}))),
+		ReadHeaderTimeout: timeout,
+		ReadTimeout:       timeout,
+		WriteTimeout:      timeout,
+		MaxHeaderBytes:    maxHeaderBytes,
+	}
+	slog.Info("listening", "addr", ln.Addr().String(), "tls", tlsEnabled())
+	if config().DryRun {
+		slog.Warn("dry run: hits are logged, not sent to GA")
+	}
+
+	if redirectPort := config().HTTPRedirectPort; redirectPort != "" {
+		redirectServer := &http.Server{
+			Addr:              ":" + redirectPort,
+			Handler:           httpsRedirect(port),
+			ReadHeaderTimeout: timeout,
+			ReadTimeout:       timeout,
+			WriteTimeout:      timeout,
+			MaxHeaderBytes:    maxHeaderBytes,
+		}
+		go func() {
+			if err := redirectServer.ListenAndServe(); err != http.ErrServerClosed {
+				slog.Error("HTTP redirect server failed", "err", err)
+			}
+		}()
+		defer redirectServer.Close()
+	}
+
+	errc := make(chan error, 1)
+	go func() { errc <- httpServer.Serve(ln) }()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+
+	grace := defaultShutdownGrace
+	if config().ShutdownGraceSeconds > 0 {
+		grace = time.Duration(config().ShutdownGraceSeconds) * time.Second
+	}
+	slog.Info("shutting down, waiting for in-flight requests", "grace", grace)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	return httpServer.Shutdown(shutdownCtx)
+}
+
+// newMux routes requests to srv and the operational endpoints.
+func newMux(srv *server) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", withGzip(metricsHandler))
+	mux.HandleFunc("/livez", livezHandler)
+	mux.HandleFunc("/healthz", healthzHandler)
+	mux.HandleFunc("/version", versionHandler)
+	mux.HandleFunc("/favicon.ico", faviconHandler)
+	mux.HandleFunc("/debug/stream", debugStreamHandler)
+	mux.HandleFunc("/admin/accounts", withGzip(adminAccountsHandler))
+	mux.HandleFunc("/collect/", withCORS(srv.collectHandler))
+	mux.HandleFunc("/stats/", withCORS(statsHandler))
+	mux.HandleFunc("/debug/", withGzip(debugEchoHandler))
+	mux.HandleFunc("/", withCORS(withGzip(srv.handler)))
+	return mux
 }
 
+// generateUUID sets cid to a random RFC 4122 version 4 UUID in its
+// canonical hyphenated form.
 func generateUUID(cid *string) error {
 	b := make([]byte, 16)
 	_, err := rand.Read(b)
@@ -107,102 +1051,669 @@ func generateUUID(cid *string) error {
 		return err
 	}
 
-	b[8] = (b[8] | 0x80) & 0xBF // what's the purpose ?
-	b[6] = (b[6] | 0x40) & 0x4F // what's the purpose ?
-	*cid = hex.EncodeToString(b)
+	b[6] = (b[6] & 0x0F) | 0x40 // version 4
+	b[8] = (b[8] & 0x3F) | 0x80 // RFC 4122 variant
+	h := hex.EncodeToString(b)
+	*cid = h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
 	return nil
 }
 
-func generateSessionID() string {
-	now := time.Now().Unix()
-	return strconv.FormatInt(now, 10)
+// stableClientID derives a client id from ip and ua for
+// stable_cid_fallback, so a visitor whose browser doesn't keep cookies
+// gets the same id on every hit. It is UUID-shaped, and keyed with
+// stable_cid_salt so the IP can't be recovered from it.
+func stableClientID(ip, ua string) string {
+	mac := hmac.New(sha256.New, []byte(config().StableCIDSalt))
+	fmt.Fprintf(mac, "%s\n%s", ip, ua)
+	b := mac.Sum(nil)[:16]
+	b[6] = (b[6] & 0x0F) | 0x50 // version 5, name-based
+	b[8] = (b[8] & 0x3F) | 0x80 // RFC 4122 variant
+	h := hex.EncodeToString(b)
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+}
+
+// Client ids callers may supply themselves: GA's own "<random>.<timestamp>"
+// form, as in the _ga cookie, or a UUID like generateUUID makes.
+var clientIDPattern = regexp.MustCompile(`^(\d{1,20}\.\d{1,20}|[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12})$`)
+
+// clientIDOverride returns the client id passed as ?cid= or an X-Client-ID
+// header, if it is well-formed.
+func clientIDOverride(header http.Header, query url.Values) (string, bool) {
+	for _, v := range []string{query.Get("cid"), header.Get("X-Client-ID")} {
+		if v == "" {
+			continue
+		}
+		if clientIDPattern.MatchString(v) {
+			return v, true
+		}
+		slog.Warn("ignoring malformed client id override", "cid", v)
+	}
+	return "", false
+}
+
+// GA4 ignores a user_id longer than this.
+const maxUserIDLength = 256
+
+// validUserID reports whether v can be sent as user_id: not blank and
+// within maxUserIDLength.
+func validUserID(v string) bool {
+	return strings.TrimSpace(v) != "" && len(v) <= maxUserIDLength
+}
+
+// userIDOverride returns the signed-in user's id passed as ?uid= or an
+// X-User-ID header, if it is valid.
+func userIDOverride(header http.Header, query url.Values) (string, bool) {
+	for _, v := range []string{query.Get("uid"), header.Get("X-User-ID")} {
+		if v == "" {
+			continue
+		}
+		if validUserID(v) {
+			return v, true
+		}
+		slog.Warn("ignoring invalid user id", "length", len(v))
+	}
+	return "", false
 }
 
-var delayHit = delay.Func("collect", logHit)
+var delayHit = delay.Func("collect", (&server{sender: gaSender{}}).logHit)
+
+// credentialsFor picks where a hit is delivered: the named stream if it
+// exists, then the account's own property, then the top-level pair. It
+// reports false when none of them is configured.
+func credentialsFor(c context.Context, account, stream string) (Credentials, bool) {
+	if stream != "" {
+		if creds, ok := config().Streams[stream]; ok {
+			return creds, true
+		}
+		slog.Warn("unknown stream, using default", "stream", stream)
+	}
+	if b := beaconFrom(c); b != nil && b.credentials().complete(config()) {
+		return b.credentials(), true
+	}
+	if creds, ok := config().Accounts[account]; ok {
+		return creds, true
+	}
+	creds := Credentials{MeasurementID: config().MeasurementID, APISecret: config().APISecret}
+	return creds, creds.complete(config())
+}
 
-func sendToGA(c context.Context, ua string, ip string, cid string, payload GA4Payload) error {
-	client := &http.Client{}
+// deliveryTimeout bounds the whole delivery of a hit, however many requests
+// it takes.
+func deliveryTimeout() time.Duration {
+	if config().DeliveryTimeout > 0 {
+		return time.Duration(config().DeliveryTimeout) * time.Second
+	}
+	return defaultDeliveryTimeout
+}
 
-	jsonPayload, err := json.Marshal(payload)
+// collectorURL builds the Measurement Protocol URL for creds, on the
+// configured collector or its /debug validation counterpart.
+func collectorURL(creds Credentials, debug bool) string {
+	base := defaultCollectorURL
+	if config().CollectorURL != "" {
+		base = config().CollectorURL
+	}
+	u, err := url.Parse(base)
 	if err != nil {
-		log.Printf("Error marshaling JSON: %s", err.Error())
-		return err
+		u, _ = url.Parse(defaultCollectorURL)
+	}
+	if debug && !strings.HasPrefix(u.Path, "/debug/") {
+		u.Path = "/debug" + u.Path
 	}
 
-	// Build URL with config values
-	beaconURL := fmt.Sprintf("https://www.google-analytics.com/mp/collect?measurement_id=%s&api_secret=%s", 
-		config.MeasurementID, config.APISecret)
+	q := u.Query()
+	if firebaseStream() {
+		q.Set("firebase_app_id", creds.MeasurementID)
+	} else {
+		q.Set("measurement_id", creds.MeasurementID)
+	}
+	q.Set("api_secret", creds.APISecret)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
 
-	req, _ := http.NewRequest("POST", beaconURL, bytes.NewBuffer(jsonPayload))
-	req.Header.Add("User-Agent", ua)
-	req.Header.Add("Content-Type", "application/json")
+func sendToGA(c context.Context, ua string, ip string, cid string, creds Credentials, payload GA4Payload) error {
+	c, cancel := context.WithTimeout(c, deliveryTimeout())
+	defer cancel()
 
-	if resp, err := client.Do(req); err != nil {
-		log.Printf("GA collector POST error: %s", err.Error())
-		return err
+	// Hits carry the time they were received as timestamp_micros, but GA4
+	// silently discards those that have since fallen outside its window.
+	if !payload.Received.IsZero() {
+		if age := time.Since(payload.Received); age > maxEventAge {
+			eventsExpired.Inc()
+			logger(c).Warn("dropping hit beyond GA4's window", "cid", cid, "age", age.Round(time.Second))
+			return nil
+		}
+	}
+
+	if config().Validate && !uaMode() && !config().DryRun {
+		messages, err := validatePayload(c, creds, payload)
+		if err != nil {
+			logger(c).Warn("cannot validate payload", "cid", cid, "err", err)
+		} else if len(messages) > 0 {
+			payloadsInvalid.Inc()
+			logger(c).Warn("payload failed validation", "cid", cid, "messages", joinMessages(messages))
+			if config().ValidateReject {
+				// Keep one bad event from costing the rest of a batch.
+				valid, invalid, ok := validEvents(payload, messages)
+				if !ok {
+					return fmt.Errorf("payload failed validation: %s", joinMessages(messages))
+				}
+				payloadsPartial.Inc()
+				for _, code := range invalid {
+					eventsInvalid.Inc("code", cmp.Or(code, "unknown"))
+				}
+				logger(c).Warn("sending only the events that passed validation", "cid", cid, "sent", len(valid.Events), "left_out", len(invalid))
+				payload = valid
+			}
+		}
+	}
+
+	var body []byte
+	contentType, beaconURL := "application/json", collectorURL(creds, config().DebugCollector)
+	if uaMode() {
+		hits := uaHits(creds, ua, cid, payload)
+		if len(hits) == 0 {
+			return nil
+		}
+		if len(hits) > uaMaxBatchHits {
+			half := len(payload.Events) / 2
+			first, rest := payload, payload
+			first.Events, rest.Events = payload.Events[:half], payload.Events[half:]
+			return errors.Join(sendToGA(c, ua, ip, cid, creds, first), sendToGA(c, ua, ip, cid, creds, rest))
+		}
+		body = []byte(strings.Join(hits, "\n"))
+		contentType, beaconURL = "application/x-www-form-urlencoded", uaCollectorURL(len(hits), config().DebugCollector)
 	} else {
-		log.Printf("GA collector status: %v, cid: %v, ip: %s", resp.Status, cid, ip)
-		log.Printf("Reported payload: %v", string(jsonPayload))
+		jsonPayload, err := json.Marshal(payload)
+		if err != nil {
+			logger(c).Error("cannot marshal payload", "cid", cid, "err", err)
+			return err
+		}
+		body = jsonPayload
 	}
-	return nil
+
+	if config().DryRun {
+		logger(c).Info("dry run, not sending hit", "measurement_id", creds.MeasurementID, "cid", cid, "payload", payloadForLog(payload))
+		return nil
+	}
+
+	// Retries share the delivery deadline on c, so they can't extend the
+	// time spent on one hit.
+	for attempt := 0; ; attempt++ {
+		req, _ := http.NewRequestWithContext(c, "POST", beaconURL, bytes.NewReader(body))
+		req.Header.Add("User-Agent", ua)
+		req.Header.Add("Content-Type", contentType)
+		if id := requestID(c); id != "" {
+			req.Header.Set("X-Request-ID", id)
+		}
+
+		release, err := acquireSendSlot(c)
+		if err != nil {
+			logger(c).Error("no free send slot before the delivery deadline", "cid", cid, "err", err)
+			return err
+		}
+		resp, err := gaClient.Do(req)
+		release()
+		if err != nil || resp.StatusCode >= 300 {
+			gaPosts.Inc("result", "failure")
+		} else {
+			gaPosts.Inc("result", "success")
+		}
+		if err != nil {
+			recordDelivery(false)
+			err = redactURLError(err)
+			logger(c).Error("GA collector POST failed", "cid", cid, "err", err)
+		} else {
+			resp.Body.Close()
+			// A throttling or failing collector isn't delivering, though
+			// it answered.
+			recordDelivery(!retryableStatus(resp.StatusCode))
+			level := slog.LevelInfo
+			if resp.StatusCode >= 300 {
+				level = slog.LevelError
+			}
+			logger(c).Log(c, level, "GA collector responded", "status", resp.Status, "measurement_id", creds.MeasurementID, "cid", cid, "ip", logIP(ip))
+			if debugEnabled() {
+				logger(c).Debug("reported payload", "payload", payloadForLog(payload))
+			}
+			if resp.StatusCode < 300 {
+				return nil
+			}
+			err = fmt.Errorf("GA collector returned %s", resp.Status)
+			if !retryableStatus(resp.StatusCode) {
+				return err
+			}
+		}
+
+		if attempt >= maxRetries() || c.Err() != nil {
+			return err
+		}
+		if !retryAllowed(time.Now()) {
+			logger(c).Warn("retry budget used up, not retrying hit", "cid", cid, "retry_budget_per_second", config().RetryBudgetPerSecond)
+			return err
+		}
+		wait := retryDelay(attempt, resp)
+		gaRetries.Inc()
+		logger(c).Warn("retrying hit", "cid", cid, "wait", wait.Round(time.Millisecond), "retry", attempt+1, "max_retries", maxRetries())
+		select {
+		case <-time.After(wait):
+		case <-c.Done():
+			return err
+		}
+	}
+}
+
+func (s *server) logHit(c context.Context, params []string, query url.Values, header http.Header, ua string, ip string, cid string, session sessionInfo, newClient bool, received time.Time) error {
+	payload, err := buildPayload(c, params, query, header, ua, ip, cid, session, newClient, received)
+	if err != nil {
+		hitsDropped.Inc("reason", "invalid_name")
+		logger(c).Warn("not sending hit with invalid names", "account", params[0], "cid", cid, "err", err)
+		return err
+	}
+	publishDebugEvent(params[0], payload)
+
+	creds, ok := credentialsFor(c, params[0], query.Get("stream"))
+	if !ok {
+		logger(c).Warn("no GA4 property configured for account, not sending", "account", params[0])
+		return nil
+	}
+	logger(c).Info("hit", "account", params[0], "cid", cid, "events", len(payload.Events))
+	meta := HitMeta{Creds: creds, Account: params[0], UA: ua, IP: ip, CID: cid, Stream: query.Get("stream"), Beacon: beaconPrefix(c), RequestID: requestID(c)}
+	return s.sender.Send(c, meta, payload)
 }
 
-func logHit(c context.Context, params []string, query url.Values, ua string, ip string, cid string) error {
-	
+// buildPayload builds the GA4 payload for a hit on the account and page in
+// params. It fails only for names strict_names refuses.
+func buildPayload(c context.Context, params []string, query url.Values, header http.Header, ua string, ip string, cid string, session sessionInfo, newClient bool, received time.Time) (GA4Payload, error) {
+	name, err := hitEventName(c, query)
+	if err != nil {
+		return GA4Payload{}, err
+	}
+
 	// Create GA4 payload matching the Apps Script structure
 	event := GA4Event{
-		Name: "page_view",
+		Name: name,
 		Params: map[string]interface{}{
-			"session_id":          generateSessionID(),
-			"user_agent":          ua,
-			"ip_address":          ip,
-			"timestamp":           time.Now().Format(time.RFC3339),
+			"session_id":     session.ID,
+			"session_number": session.Number,
+			"user_agent":     ua,
+			"timestamp":      received.Format(time.RFC3339),
+
+			"engagement_time_msec": engagementTime(query),
+			"session_engaged":      "1",
 		},
 	}
 
-	// Add any additional query parameters as custom parameters
-	for key, values := range query {
-		if len(values) > 0 && !isReservedParam(key) {
-			event.Params["custom_"+key] = values[0]
+	page := ""
+	if len(params) == 2 {
+		page = params[1]
+	}
+	addPageParams(event.Params, page, query)
+
+	// Geolocate locally first, so ip_mode can keep the address itself out
+	// of GA without losing geography.
+	addGeoParams(event.Params, ip)
+	if config().IPMode != "none" {
+		if anonymizeIPEnabled() {
+			event.Params["ip_address"] = anonymizeIP(ip)
+		} else {
+			event.Params["ip_address"] = ip
+		}
+	}
+
+	addHeaderParams(event.Params, header)
+	if config().NetworkHints {
+		addNetworkHints(event.Params, header)
+	}
+	if config().ParseUserAgent {
+		addDeviceParams(event.Params, ua)
+	}
+
+	// Add any additional query parameters as custom parameters, ahead of
+	// the configured ones, which only get the room left under GA4's limit.
+	if err := addCustomParams(c, event.Params, query); err != nil {
+		return GA4Payload{}, err
+	}
+	mergeParams(c, event.Params, config().AccountMetadata[params[0]], query)
+	mergeParams(c, event.Params, config().DefaultParams, query)
+
+	events := []GA4Event{event}
+	if style := imageStyle(query); style != "pixel" && style != "beacon" {
+		render := GA4Event{Name: "badge_render", Params: map[string]interface{}{}}
+		for k, v := range event.Params {
+			render.Params[k] = v
+		}
+		render.Params["account"] = params[0]
+		render.Params["badge_style"] = style
+
+		switch badgeEventMode(params[0]) {
+		case "also":
+			events = append(events, render)
+		case "instead":
+			events = []GA4Event{render}
 		}
 	}
 
+	// GA4 expects first_visit on a client's first hit and session_start at
+	// the beginning of each session, ahead of the hit's own events.
+	lifecycle := []GA4Event{}
+	if newClient {
+		lifecycle = append(lifecycle, sessionEvent("first_visit", session))
+	}
+	if session.New {
+		lifecycle = append(lifecycle, sessionEvent("session_start", session))
+	}
+	events = append(lifecycle, events...)
+
+	// Timing the hit at receipt keeps queued and retried deliveries from
+	// being recorded late.
 	payload := GA4Payload{
-		ClientID: cid,
-		Events:   []GA4Event{event},
+		TimestampMicros: received.UnixMicro(),
+		Events:          events,
+		Received:        received,
+
+		NonPersonalizedAds: config().NonPersonalizedAds || isTruthy(query.Get("npa")),
+	}
+	setClientIdentity(&payload, query, cid)
+	if uid, ok := userIDOverride(header, query); ok {
+		payload.UserID = uid
+	}
+	if trackingDenied(header, query) {
+		payload.Consent = &Consent{AdUserData: consentDenied, AdPersonalization: consentDenied}
+		payload.NonPersonalizedAds = true
+	} else {
+		payload.Consent = requestedConsent(query)
+	}
+
+	if config().TimestampParam != "" {
+		v := query.Get(config().TimestampParam)
+		if v == "" {
+			v = header.Get(config().TimestampParam)
+		}
+		if v != "" {
+			if t, err := parseEventTime(v, payload.Received); err != nil {
+				logger(c).Warn("ignoring timestamp param", "param", config().TimestampParam, "cid", cid, "err", err)
+			} else {
+				payload.TimestampMicros = t.UnixMicro()
+			}
+		}
+	}
+
+	return payload, nil
+}
+
+// sessionEvent builds a lifecycle event carrying the session params.
+func sessionEvent(name string, session sessionInfo) GA4Event {
+	return GA4Event{
+		Name: name,
+		Params: map[string]interface{}{
+			"session_id":     session.ID,
+			"session_number": session.Number,
+		},
+	}
+}
+
+// throttleHit reports whether cid already had a hit delivered within
+// min_hit_interval. Skipped hits don't extend the interval, so a client
+// polling faster than the limit still gets one delivery per interval.
+func throttleHit(cid string, now time.Time) bool {
+	if recentHits == nil {
+		return false
+	}
+	if _, ok := recentHits.Get(cid, now); ok {
+		return true
+	}
+	recentHits.Add(cid, now, now)
+	return false
+}
+
+func validBadgeEvent(mode string) bool {
+	return mode == "" || mode == "also" || mode == "instead"
+}
+
+// badgeEventMode returns the badge_event setting that applies to account.
+func badgeEventMode(account string) string {
+	if mode, ok := config().BadgeEventAccounts[account]; ok {
+		return mode
+	}
+	return config().BadgeEvent
+}
+
+// ignoredPath reports whether p matches an ignore_paths entry.
+func ignoredPath(p string) bool {
+	for _, pattern := range config().IgnorePaths {
+		switch {
+		case strings.HasSuffix(pattern, "/"):
+			if strings.HasPrefix(p, pattern) {
+				return true
+			}
+		case strings.ContainsAny(pattern, "*?["):
+			if ok, _ := path.Match(pattern, p); ok {
+				return true
+			}
+		case p == pattern:
+			return true
+		}
 	}
+	return false
+}
+
+// knownAccount reports whether account is named in the config, as a key
+// of accounts, account_metadata, badge_event_accounts or ga_property_ids,
+// or matches a non-empty allowed_accounts. Only known accounts get their
+// own metric series, since anyone can make up others.
+func knownAccount(account string) bool {
+	c := config()
+	if _, ok := c.Accounts[account]; ok {
+		return true
+	}
+	if _, ok := c.AccountMetadata[account]; ok {
+		return true
+	}
+	if _, ok := c.BadgeEventAccounts[account]; ok {
+		return true
+	}
+	if _, ok := c.GAPropertyIDs[account]; ok {
+		return true
+	}
+	return len(c.AllowedAccounts) > 0 && allowedAccount(account)
+}
 
-	return sendToGA(c, ua, ip, cid, payload)
+// metricAccount is the account label for account's metric series:
+// account itself if it is known, or "other".
+func metricAccount(account string) string {
+	if knownAccount(account) {
+		return account
+	}
+	return "other"
+}
+
+// allowedAccount reports whether account matches allowed_accounts, or the
+// list is empty.
+func allowedAccount(account string) bool {
+	patterns := config().AllowedAccounts
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(normalizeAccount(pattern), account); ok {
+			return true
+		}
+	}
+	return false
 }
 
-// Helper function to check if a parameter is reserved
-func isReservedParam(param string) bool {
-	reserved := []string{"referer", "pixel", "gif", "flat", "flat-gif", "useReferer"}
-	for _, r := range reserved {
-		if param == r {
+// retiredAccount reports whether account is listed in retired_accounts.
+func retiredAccount(account string) bool {
+	for _, retired := range config().RetiredAccounts {
+		if normalizeAccount(retired) == account {
 			return true
 		}
 	}
 	return false
 }
 
-func handler(w http.ResponseWriter, r *http.Request) {
-	c := r.Context()
-	params := strings.SplitN(strings.Trim(r.URL.Path, "/"), "/", 2)
+// Account names are GA ids or project names: letters, digits, '.', '_'
+// and '-'.
+var accountPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// validAccount reports whether account is safe to use as an account name,
+// in paths, cookies and the account page.
+func validAccount(account string) bool {
+	return accountPattern.MatchString(account)
+}
+
+// normalizeAccount applies the normalize_account setting to an account
+// path segment.
+func normalizeAccount(account string) string {
+	if config().NormalizeAccount == "lowercase" {
+		return strings.ToLower(account)
+	}
+	return account
+}
+
+// normalizeAccountKeys re-keys a per-account config map by normalized
+// account.
+func normalizeAccountKeys[V any](m map[string]V) map[string]V {
+	if m == nil {
+		return nil
+	}
+	out := make(map[string]V, len(m))
+	for account, v := range m {
+		out[normalizeAccount(account)] = v
+	}
+	return out
+}
+
+// imageStyle names the image a hit is answered with, based on the style
+// params in query. The ?pixel, ?gif, ?flat and ?flat-gif flags take
+// precedence over ?style=, and ?beacon, for no image at all, over those.
+func imageStyle(query url.Values) string {
+	for _, style := range []string{"beacon", "pixel", "gif", "flat", "flat-gif", "png"} {
+		if _, ok := query[style]; ok {
+			return style
+		}
+	}
+	switch style := query.Get("style"); style {
+	case "flat", "flat-square", "for-the-badge":
+		return style
+	}
+	return "svg"
+}
+
+// imageType groups image styles for metrics: "pixel", "gif", "png",
+// "svg" or "none".
+func imageType(style string) string {
+	switch style {
+	case "pixel", "png":
+		return style
+	case "gif", "flat-gif":
+		return "gif"
+	case "beacon":
+		return "none"
+	}
+	return "svg"
+}
+
+// setBeaconMode marks a hit from a client asking for JSON, such as a
+// fetch() call, as ?beacon, since it has no use for an image.
+func setBeaconMode(r *http.Request, query url.Values) {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		if mediaType, _, err := mime.ParseMediaType(accept); err == nil && mediaType == "application/json" {
+			query.Set("beacon", "")
+			return
+		}
+	}
+}
+
+// writeBadge renders the SVG badge in style with the account's hit count
+// (see badgeValue), the ?label= text, the ?color= color and the ?logo=
+// logo, falling back to the static badge if rendering fails.
+func writeBadge(w http.ResponseWriter, style string, static []byte, query url.Values, account string) {
+	logo, _ := badgeLogo(query.Get("logo"))
+	count := badgeValue(badgeCount(w, account), query)
+	b, err := renderBadge(style, badgeLabel(query.Get("label")), count, query.Get("color"), logo)
+	if err != nil {
+		slog.Error("cannot render badge", "err", err)
+		w.Write(static)
+		return
+	}
+	w.Write(b)
+}
+
+// writeStaticImage writes one of the fixed images with an ETag and
+// Last-Modified, answering a matching conditional request with 304. With
+// a maxAge of 0 the response must be revalidated every time, so the hit
+// is counted; otherwise browsers may reuse it for maxAge seconds.
+func writeStaticImage(w http.ResponseWriter, r *http.Request, style string, query url.Values, b []byte, maxAge int) {
+	sum := sha256.New()
+	sum.Write(b)
+	fmt.Fprintf(sum, "\x00%s\x00%s", style, query.Get("color"))
+	w.Header().Set("ETag", fmt.Sprintf(`"%x"`, sum.Sum(nil)[:16]))
+	if maxAge > 0 {
+		w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", maxAge))
+	} else {
+		w.Header().Set("Cache-Control", "no-cache, private")
+	}
+	http.ServeContent(w, r, "", assetsModified, bytes.NewReader(b))
+}
+
+// setNoStore keeps a response that shows a live count, or none at all,
+// out of every cache.
+func setNoStore(w http.ResponseWriter) {
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate, private")
+	w.Header().Set("Expires", time.Now().Format(http.TimeFormat))
+}
+
+// Query params the beacon itself interprets, which are never sent as
+// custom params.
+var defaultReservedParams = []string{"referer", "pixel", "gif", "flat", "flat-gif", "useReferer", "stream", "logo", "npa", "label", "color", "style", "consent", "cid", "dl", "dt", "png", "uid", "et", "event", "consent_ad_user_data", "consent_ad_personalization", "consent_analytics_storage", "aiid", "ik", "exact", "beacon"}
+
+// reservedParamSet returns defaultReservedParams plus extra.
+func reservedParamSet(extra []string) map[string]bool {
+	set := make(map[string]bool, len(defaultReservedParams)+len(extra))
+	for _, p := range defaultReservedParams {
+		set[p] = true
+	}
+	for _, p := range extra {
+		set[p] = true
+	}
+	return set
+}
+
+// isReservedParam reports whether param is reserved for the beacon c's
+// request was routed to.
+func isReservedParam(c context.Context, param string) bool {
+	if b := beaconFrom(c); b != nil && b.reserved != nil {
+		return b.reserved[param]
+	}
+	return config().reserved[param]
+}
+
+// hitParams splits a hit's path into account and page, and parses its
+// query, adding the Referer, cut down by cleanReferer, as "referer". With
+// ?useReferer, the referring host and path replace the page.
+//
+// A hit path is /<account>/<page>: the first segment is the account and
+// everything after it, however many segments deep, is the page, so
+// /my-project/docs/intro is page "docs/intro" of my-project. /<account>
+// alone is the account page. A page with empty segments or control
+// characters is an error.
+func hitParams(r *http.Request, hitPath string) ([]string, url.Values, error) {
+	params := strings.SplitN(strings.Trim(hitPath, "/"), "/", 2)
+	if len(params) == 2 && !validPage(params[1]) {
+		return nil, nil, fmt.Errorf("malformed page path %q", params[1])
+	}
 	query, _ := url.ParseQuery(r.URL.RawQuery)
-	refOrg := r.Header.Get("Referer")
+	setBeaconMode(r, query)
+	refOrg := cleanReferer(r.Header.Get("Referer"))
 
 	// Add referer to query for tracking
 	if refOrg != "" {
 		query.Set("referer", refOrg)
 	}
 
-	// / -> redirect
-	if len(params[0]) == 0 {
-		http.Redirect(w, r, "https://github.com/igrigorik/ga-beacon", http.StatusFound)
-		return
-	}
-
 	// activate referrer path if ?useReferer is used and if referer exists
 	if _, ok := query["useReferer"]; ok {
 		if len(refOrg) != 0 {
@@ -210,66 +1721,217 @@ func handler(w http.ResponseWriter, r *http.Request) {
 			if len(referer) != 0 {
 				// if the useReferer is present and the referer information exists
 				//  the path is ignored and the beacon referer information is used instead.
-				params = strings.SplitN(strings.Trim(r.URL.Path, "/")+"/"+referer, "/", 2)
+				params = strings.SplitN(strings.Trim(hitPath, "/")+"/"+referer, "/", 2)
 			}
 		}
 	}
+	return params, query, nil
+}
+
+// validPage reports whether a hit's page has no empty segments, as in
+// /account/a//b, and no control characters.
+func validPage(page string) bool {
+	for _, segment := range strings.Split(page, "/") {
+		if segment == "" {
+			return false
+		}
+	}
+	return utf8.ValidString(page) && strings.IndexFunc(page, unicode.IsControl) < 0
+}
+
+// server holds what the hit handler depends on, so it can be driven
+// without reaching the real GA collector.
+type server struct {
+	// sender receives every hit the handler produces.
+	sender Sender
+}
+
+func (s *server) handler(w http.ResponseWriter, r *http.Request) {
+	c := withRequestID(r.Context(), incomingRequestID(r))
+	received := time.Now()
+
+	if ignoredPath(r.URL.Path) {
+		query, _ := url.ParseQuery(r.URL.RawQuery)
+		setBeaconMode(r, query)
+		writeImage(w, r, query, normalizeAccount(strings.SplitN(strings.Trim(r.URL.Path, "/"), "/", 2)[0]))
+		return
+	}
+
+	params, query, err := hitParams(r, r.URL.Path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// / -> redirect, or the landing page
+	if len(params[0]) == 0 {
+		serveRoot(w, r)
+		return
+	}
+	if !validAccount(params[0]) {
+		http.Error(w, "invalid account", http.StatusBadRequest)
+		return
+	}
+
+	// Collapse casing variants of the account before it is used for
+	// anything else. The cookie keeps the path as requested, since browsers
+	// match cookie paths case-sensitively.
+	cookiePath := fmt.Sprint(beaconPrefix(c), "/", params[0])
+	params[0] = normalizeAccount(params[0])
+
+	if retiredAccount(params[0]) {
+		http.Error(w, "account retired", http.StatusGone)
+		return
+	}
+	unlisted := !allowedAccount(params[0])
+	if unlisted && config().UnlistedAccounts == "not_found" {
+		http.NotFound(w, r)
+		return
+	}
 
 	// /account -> account template
 	if len(params) == 1 {
+		nonce, err := newNonce()
+		if err != nil {
+			http.Error(w, "could not show account page", 500)
+			logger(c).Error("cannot generate nonce", "err", err)
+			return
+		}
 		templateParams := struct {
 			Account string
 			Referer string
+			Nonce   string
 		}{
 			Account: params[0],
-			Referer: refOrg,
+			Referer: r.Header.Get("Referer"),
+			Nonce:   nonce,
 		}
+		setPageHeaders(w, nonce)
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
 		if err := pageTemplate.ExecuteTemplate(w, "page.html", templateParams); err != nil {
 			http.Error(w, "could not show account page", 500)
-			log.Printf("Cannot execute template: %v", err)
+			logger(c).Error("cannot execute template", "err", err)
 		}
 		return
 	}
 
+	if unlisted {
+		hitsDropped.Inc("reason", "unlisted_account")
+		logger(c).Debug("not tracking account outside allowed_accounts", "account", params[0])
+		writeImage(w, r, query, params[0])
+		return
+	}
+
+	hitsReceived.Inc("account", metricAccount(params[0]), "type", imageType(imageStyle(query)))
+
+	// page_location defaults to the beacon URL itself.
+	if !validPageLocation(query.Get("dl")) {
+		query.Set("dl", pageLocation(r, params))
+	}
+
+	// Visitors who opted out get the image and no cookie.
+	if skipDeniedHits() && trackingDenied(r.Header, query) {
+		hitsNotTracked.Inc()
+		writeImage(w, r, query, params[0])
+		return
+	}
+
 	// /account/page -> GIF + log pageview to GA collector
 	var cid string
-	if cookie, err := r.Cookie("cid"); err != nil {
-		if err := generateUUID(&cid); err != nil {
-			log.Printf("Failed to generate client UUID: %v", err)
+	newClient := false
+	if override, ok := clientIDOverride(r.Header, query); ok {
+		cid = override
+		logger(c).Debug("using supplied cid", "cid", cid)
+	} else if cookie, err := readCookie(r, cidCookieName()); err != nil {
+		if config().StableCIDFallback {
+			// Whether the visitor is new can't be told, so no
+			// first_visit is sent for derived ids.
+			cid = stableClientID(clientIP(r), r.Header.Get("User-Agent"))
+			logger(c).Debug("derived stable cid", "cid", cid)
+			setCookies(w, cidCookie(r, cid, cookiePath))
+		} else if err := generateUUID(&cid); err != nil {
+			logger(c).Error("cannot generate client id", "err", err)
 		} else {
-			log.Printf("Generated new client UUID: %v", cid)
-			http.SetCookie(w, &http.Cookie{Name: "cid", Value: cid, Path: fmt.Sprint("/", params[0])})
+			newClient = true
+			logger(c).Debug("generated new cid", "cid", cid)
+			setCookies(w, cidCookie(r, cid, cookiePath))
 		}
 	} else {
 		cid = cookie.Value
-		log.Printf("Existing CID found: %v", cid)
+		logger(c).Debug("existing cid found", "cid", cid)
 	}
 
 	if len(cid) != 0 {
-		var cacheUntil = time.Now().Format(http.TimeFormat)
-		w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate, private")
-		w.Header().Set("Expires", cacheUntil)
 		w.Header().Set("CID", cid)
+		if config().NetworkHints {
+			w.Header().Set("Accept-CH", networkHintHeaders)
+		}
 
-		logHit(c, params, query, r.Header.Get("User-Agent"), r.RemoteAddr, cid)
+		ip := clientIP(r)
+		if ua := r.Header.Get("User-Agent"); isBot(ua) {
+			botHits.Inc()
+			logger(c).Info("skipping hit from bot", "cid", cid, "user_agent", ua)
+		} else if rateLimited(ip, cid, time.Now()) {
+			hitsDropped.Inc("reason", "rate_limited")
+			logger(c).Warn("dropping hit over rate limit", "cid", cid, "ip", logIP(ip))
+		} else if throttleHit(cid, time.Now()) {
+			hitsThrottled.Inc()
+			logger(c).Info("skipping hit within min_hit_interval", "cid", cid)
+		} else if duplicateHit(cid, params, time.Now()) {
+			hitsDropped.Inc("reason", "duplicate")
+			logger(c).Info("skipping duplicate hit", "cid", cid)
+		} else if repeatedKey(params[0], idempotencyKey(r.Header, query), time.Now()) {
+			hitsDropped.Inc("reason", "repeated_key")
+			logger(c).Info("skipping hit with an idempotency key already seen", "cid", cid)
+		} else {
+			countHit(params[0])
+			session := touchSession(r, cid, time.Now())
+			if sampledOut(cid) {
+				hitsSampledOut.Inc()
+				logger(c).Debug("skipping hit left out by sample_rate", "cid", cid)
+			} else {
+				s.logHit(c, params, query, r.Header, r.Header.Get("User-Agent"), ip, cid, session, newClient, received)
+			}
+		}
 		// delayHit.Call(c, params, r.Header.Get("User-Agent"), cid)
 	}
 
-	// Write out GIF pixel or badge, based on presence of "pixel" param.
-	if _, ok := query["pixel"]; ok {
+	writeImage(w, r, query, params[0])
+}
+
+// writeImage writes out the GIF pixel or badge, based on the style params
+// in query, or 204 No Content for ?beacon. SVG and PNG badges show
+// account's hit count and are never cached; the GIF badges may be, for
+// badge_cache_seconds.
+func writeImage(w http.ResponseWriter, r *http.Request, query url.Values, account string) {
+	switch style := imageStyle(query); style {
+	case "beacon":
+		setNoStore(w)
+		w.WriteHeader(http.StatusNoContent)
+	case "pixel":
+		if query.Get("pixel") == "png" {
+			w.Header().Set("Content-Type", "image/png")
+			writeStaticImage(w, r, style, query, pixelPNG, 0)
+			return
+		}
 		w.Header().Set("Content-Type", "image/gif")
-		w.Write(pixel)
-	} else if _, ok := query["gif"]; ok {
+		writeStaticImage(w, r, style, query, pixel, 0)
+	case "gif":
 		w.Header().Set("Content-Type", "image/gif")
-		w.Write(badgeGif)
-	} else if _, ok := query["flat"]; ok {
-		w.Header().Set("Content-Type", "image/svg+xml")
-		w.Write(badgeFlat)
-	} else if _, ok := query["flat-gif"]; ok {
+		writeStaticImage(w, r, style, query, badgeGif, config().BadgeCacheSeconds)
+	case "flat-gif":
 		w.Header().Set("Content-Type", "image/gif")
-		w.Write(badgeFlatGif)
-	} else {
+		writeStaticImage(w, r, style, query, badgeFlatGif, config().BadgeCacheSeconds)
+	case "png":
+		setNoStore(w)
+		writePNGBadge(w, query, account)
+	case "flat", "flat-square", "for-the-badge":
+		setNoStore(w)
+		w.Header().Set("Content-Type", "image/svg+xml")
+		writeBadge(w, style, badgeFlat, query, account)
+	default:
+		setNoStore(w)
 		w.Header().Set("Content-Type", "image/svg+xml")
-		w.Write(badge)
+		writeBadge(w, style, badge, query, account)
 	}
-}
\ No newline at end of file
+}
@@ -0,0 +1,1381 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image/png"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestThrottleHit(t *testing.T) {
+	useConfig(t, Config{MinHitInterval: 10})
+	start := time.Unix(1700000000, 0)
+	tests := []struct {
+		cid  string
+		at   time.Duration
+		want bool
+	}{
+		{"a", 0, false},
+		{"a", 3 * time.Second, true},
+		{"b", 3 * time.Second, false}, // other clients aren't held back
+		{"a", 9 * time.Second, true},  // skipped hits don't extend the interval
+		{"a", 11 * time.Second, false},
+		{"a", 12 * time.Second, true},
+	}
+	for _, tt := range tests {
+		if got := throttleHit(tt.cid, start.Add(tt.at)); got != tt.want {
+			t.Errorf("hit from %s at +%v: throttled = %v, want %v", tt.cid, tt.at, got, tt.want)
+		}
+	}
+}
+
+func TestMinHitIntervalSkipsRapidHits(t *testing.T) {
+	tests := []struct {
+		interval      int
+		wantDelivered int
+	}{
+		{0, 5},
+		{60, 1},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.interval), func(t *testing.T) {
+			useConfig(t, withTestCreds(Config{MinHitInterval: tt.interval}))
+			sender := &recordingSender{}
+			s := &server{sender: sender}
+			before := hitsThrottled.Value()
+
+			for i := 0; i < 5; i++ {
+				w := serveHit(t, s, fmt.Sprintf("/acct/page-%d?pixel", i), "rapid-cid")
+				if w.Code != 200 {
+					t.Fatalf("hit %d: status %d, want the pixel served", i, w.Code)
+				}
+			}
+			if n := len(sender.sent()); n != tt.wantDelivered {
+				t.Errorf("delivered %d hits, want %d", n, tt.wantDelivered)
+			}
+			if n := hitsThrottled.Value() - before; int(n) != 5-tt.wantDelivered {
+				t.Errorf("beacon_hits_throttled_total rose by %v, want %d", n, 5-tt.wantDelivered)
+			}
+
+			serveHit(t, s, "/acct/other?pixel", "other-cid")
+			if n := len(sender.sent()); n != tt.wantDelivered+1 {
+				t.Errorf("hit from another cid not delivered")
+			}
+		})
+	}
+}
+
+func TestSendToGAHandlesAgedHits(t *testing.T) {
+	tests := []struct {
+		name     string
+		age      time.Duration
+		wantSent bool
+	}{
+		{"fresh", 0, true},
+		{"queued for an hour", time.Hour, true},
+		{"just inside GA4's window", maxEventAge - time.Minute, true},
+		{"beyond GA4's window", maxEventAge + time.Minute, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			collector := newFakeCollector(t, Config{MaxRetries: -1})
+			received := time.Now().Add(-tt.age)
+			payload := GA4Payload{
+				ClientID:        "cid",
+				TimestampMicros: received.UnixMicro(),
+				Received:        received,
+				Events:          []GA4Event{{Name: "page_view", Params: map[string]interface{}{}}},
+			}
+			before := eventsExpired.Value()
+
+			creds := Credentials{MeasurementID: "G-TEST", APISecret: "secret"}
+			if err := sendToGA(context.Background(), "test-agent", "192.0.2.1", "cid", creds, payload); err != nil {
+				t.Fatalf("sendToGA: %v", err)
+			}
+			posted := collector.posted()
+			if !tt.wantSent {
+				if len(posted) != 0 {
+					t.Errorf("posted %d payloads, want the hit dropped", len(posted))
+				}
+				if n := eventsExpired.Value() - before; n != 1 {
+					t.Errorf("beacon_events_expired_total rose by %v, want 1", n)
+				}
+				return
+			}
+			if len(posted) != 1 {
+				t.Fatalf("posted %d payloads, want 1", len(posted))
+			}
+			if got := posted[0].TimestampMicros; got != received.UnixMicro() {
+				t.Errorf("timestamp_micros = %d, want the receive time %d", got, received.UnixMicro())
+			}
+		})
+	}
+}
+
+func TestDeliveryTimeoutBoundsRetries(t *testing.T) {
+	tests := []struct {
+		name  string
+		stall func(w http.ResponseWriter, r *http.Request)
+	}{
+		{"collector never answers", func(w http.ResponseWriter, r *http.Request) {
+			<-r.Context().Done()
+		}},
+		{"collector answers slowly with 503", func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-time.After(400 * time.Millisecond):
+				w.WriteHeader(http.StatusServiceUnavailable)
+			case <-r.Context().Done():
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var attempts atomic.Int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				attempts.Add(1)
+				// Only once the body is read does the server notice the
+				// client hanging up.
+				io.Copy(io.Discard, r.Body)
+				tt.stall(w, r)
+			}))
+			defer srv.Close()
+			useConfig(t, withTestCreds(Config{CollectorURL: srv.URL, DeliveryTimeout: 1, MaxRetries: 10}))
+
+			start := time.Now()
+			err := sendToGA(context.Background(), "test-agent", "192.0.2.1", "cid", Credentials{MeasurementID: "G-TEST", APISecret: "secret"}, GA4Payload{ClientID: "cid"})
+			took := time.Since(start)
+			if err == nil {
+				t.Error("sendToGA succeeded against a stalling collector")
+			}
+			if took > 1500*time.Millisecond {
+				t.Errorf("sendToGA took %v, want it cut off at delivery_timeout", took.Round(time.Millisecond))
+			}
+			if n := attempts.Load(); n > 4 {
+				t.Errorf("%d attempts within one second", n)
+			}
+		})
+	}
+}
+
+func TestIgnoredPath(t *testing.T) {
+	useConfig(t, Config{IgnorePaths: []string{"/health/ping", "/monitor/", "/*/status", "/probe-?"}})
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"/health/ping", true},       // exact
+		{"/health/ping/more", false}, // exact entries aren't prefixes
+		{"/health", false},
+		{"/monitor/", true}, // prefix
+		{"/monitor/uptime/check", true},
+		{"/monitoring/page", false},
+		{"/acct/status", true},       // glob
+		{"/acct/page/status", false}, // * doesn't cross /
+		{"/probe-1", true},
+		{"/probe-12", false},
+		{"/acct/page", false},
+	}
+	for _, tt := range tests {
+		if got := ignoredPath(tt.path); got != tt.want {
+			t.Errorf("ignoredPath(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestIgnoredPathsAreNotTracked(t *testing.T) {
+	useConfig(t, withTestCreds(Config{IgnorePaths: []string{"/acct/health"}}))
+	hitCounts = newMemoryCounterStore()
+	t.Cleanup(func() { hitCounts = newMemoryCounterStore() })
+	sender := &recordingSender{}
+	s := &server{sender: sender}
+
+	w := serveHit(t, s, "/acct/health?pixel", "")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/gif" {
+		t.Errorf("ignored path got %d %q, want the pixel", w.Code, w.Header().Get("Content-Type"))
+	}
+	if c := w.Header().Get("Set-Cookie"); c != "" {
+		t.Errorf("ignored path set a cookie: %s", c)
+	}
+	if n := len(sender.sent()); n != 0 {
+		t.Errorf("ignored path sent %d hits", n)
+	}
+	if n, _ := hitCounts.Get("acct"); n != 0 {
+		t.Errorf("ignored path counted %d hits", n)
+	}
+
+	serveHit(t, s, "/acct/page?pixel", "")
+	if n := len(sender.sent()); n != 1 {
+		t.Errorf("other path sent %d hits, want 1", n)
+	}
+}
+
+func TestRetiredAccountsGetGone(t *testing.T) {
+	useConfig(t, withTestCreds(Config{RetiredAccounts: []string{"Old-Project"}, NormalizeAccount: "lowercase"}))
+	tests := []struct {
+		target   string
+		wantCode int
+		wantSent int
+	}{
+		{"/old-project/page?pixel", http.StatusGone, 0},
+		{"/Old-Project/page", http.StatusGone, 0},
+		{"/OLD-PROJECT", http.StatusGone, 0},
+		{"/old-project/page?beacon", http.StatusGone, 0},
+		{"/new-project/page?pixel", http.StatusOK, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			sender := &recordingSender{}
+			w := serveHit(t, &server{sender: sender}, tt.target, "")
+			if w.Code != tt.wantCode {
+				t.Errorf("status %d, want %d", w.Code, tt.wantCode)
+			}
+			if n := len(sender.sent()); n != tt.wantSent {
+				t.Errorf("sent %d hits, want %d", n, tt.wantSent)
+			}
+			if tt.wantCode == http.StatusGone && w.Header().Get("Set-Cookie") != "" {
+				t.Error("retired account set a cookie")
+			}
+		})
+	}
+
+	w := httptest.NewRecorder()
+	statsHandler(w, httptest.NewRequest("GET", "/stats/old-project", nil))
+	if w.Code != http.StatusGone {
+		t.Errorf("/stats/ for a retired account: status %d, want 410", w.Code)
+	}
+}
+
+func TestGenerateUUID(t *testing.T) {
+	// Version 4 in the 13th digit, RFC 4122 variant (8, 9, a or b) in the
+	// 17th.
+	v4 := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	seen := make(map[string]bool)
+	for i := 0; i < 500; i++ {
+		var cid string
+		if err := generateUUID(&cid); err != nil {
+			t.Fatal(err)
+		}
+		if !v4.MatchString(cid) {
+			t.Fatalf("generateUUID() = %q, want an RFC 4122 v4 UUID", cid)
+		}
+		if seen[cid] {
+			t.Fatalf("generateUUID() repeated %q", cid)
+		}
+		seen[cid] = true
+	}
+}
+
+func TestGAClientTimesOut(t *testing.T) {
+	tests := []struct {
+		name        string
+		delay       time.Duration
+		wantTimeout bool
+	}{
+		{"collector answers in time", 0, false},
+		{"collector hangs past the timeout", 2 * time.Second, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.Copy(io.Discard, r.Body)
+				select {
+				case <-time.After(tt.delay):
+					w.WriteHeader(http.StatusNoContent)
+				case <-r.Context().Done():
+				}
+			}))
+			defer srv.Close()
+			useConfig(t, withTestCreds(Config{CollectorURL: srv.URL, MaxRetries: -1}))
+			saved := gaClient
+			gaClient = newGAClient(100 * time.Millisecond)
+			t.Cleanup(func() { gaClient = saved })
+
+			start := time.Now()
+			err := sendToGA(context.Background(), "test-agent", "192.0.2.1", "cid", Credentials{MeasurementID: "G-TEST", APISecret: "secret"}, GA4Payload{ClientID: "cid"})
+			if took := time.Since(start); took > time.Second {
+				t.Errorf("sendToGA took %v, want it cut off by the client timeout", took.Round(time.Millisecond))
+			}
+			var nerr net.Error
+			timedOut := errors.As(err, &nerr) && nerr.Timeout()
+			if timedOut != tt.wantTimeout {
+				t.Errorf("sendToGA() = %v, want a timeout error: %v", err, tt.wantTimeout)
+			}
+			if !tt.wantTimeout && err != nil {
+				t.Errorf("sendToGA() = %v, want nil", err)
+			}
+		})
+	}
+}
+
+func TestPerAccountCredentials(t *testing.T) {
+	f := newFakeCollector(t, Config{Accounts: map[string]Credentials{
+		"projA": {MeasurementID: "G-AAAA", APISecret: "secret-a"},
+		"projB": {MeasurementID: "G-BBBB", APISecret: "secret-b"},
+	}})
+	tests := []struct {
+		target     string
+		wantID     string
+		wantSecret string
+	}{
+		{"/projA/x?pixel", "G-AAAA", "secret-a"},
+		{"/projB/x?pixel", "G-BBBB", "secret-b"},
+		{"/other/x?pixel", "G-TEST", "secret"},
+	}
+	for i, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			serveHit(t, &server{sender: gaSender{}}, tt.target, "")
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			if len(f.requests) != i+1 {
+				t.Fatalf("collector got %d requests, want %d", len(f.requests), i+1)
+			}
+			q := f.requests[i].URL.Query()
+			if got := q.Get("measurement_id"); got != tt.wantID {
+				t.Errorf("measurement_id = %q, want %q", got, tt.wantID)
+			}
+			if got := q.Get("api_secret"); got != tt.wantSecret {
+				t.Errorf("api_secret = %q, want %q", got, tt.wantSecret)
+			}
+		})
+	}
+}
+
+func TestConfigRequiresCredentials(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  Config
+		wantErr bool
+	}{
+		{"top-level pair", withTestCreds(Config{}), false},
+		{"account pair only", Config{Accounts: map[string]Credentials{
+			"projA": {MeasurementID: "G-AAAA", APISecret: "secret-a"},
+		}}, false},
+		{"incomplete account pair", withTestCreds(Config{Accounts: map[string]Credentials{
+			"projA": {MeasurementID: "G-AAAA"},
+		}}), true},
+		{"none", Config{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.config.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() = %v, want error: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRunShutsDownGracefully(t *testing.T) {
+	tests := []struct {
+		name       string
+		grace      int
+		finishWith time.Duration // how long after shutdown the request finishes
+		wantErr    bool
+	}{
+		{"request finishes within the grace period", 5, 200 * time.Millisecond, false},
+		{"request outlives the grace period", 1, 1500 * time.Millisecond, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr := freeAddr(t)
+			f := newFakeCollector(t, Config{ListenAddr: addr, ShutdownGraceSeconds: tt.grace})
+			saved := hitCounts
+			t.Cleanup(func() { hitCounts = saved })
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			done := make(chan error, 1)
+			go func() { done <- run(ctx, *config()) }()
+			waitForListener(t, addr)
+
+			// Start a request whose body is still arriving at shutdown.
+			body, bodyW := io.Pipe()
+			resp := make(chan int, 1)
+			go func() {
+				r, err := http.Post("http://"+addr+"/collect/acct", "application/json", body)
+				if err != nil {
+					resp <- 0
+					return
+				}
+				r.Body.Close()
+				resp <- r.StatusCode
+			}()
+			bodyW.Write([]byte(`{"client_id": "1234567890.1700000000", `))
+			time.Sleep(100 * time.Millisecond)
+			cancel()
+
+			deadline := time.Now().Add(time.Second)
+			for {
+				conn, err := net.Dial("tcp", addr)
+				if err != nil {
+					break
+				}
+				conn.Close()
+				if time.Now().After(deadline) {
+					t.Fatal("still accepting connections after shutdown")
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			go func() {
+				time.Sleep(tt.finishWith)
+				bodyW.Write([]byte(`"events": [{"name": "shutdown_test"}]}`))
+				bodyW.Close()
+			}()
+			select {
+			case err := <-done:
+				if (err != nil) != tt.wantErr {
+					t.Errorf("run() = %v, want error: %v", err, tt.wantErr)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("run didn't return after shutdown")
+			}
+			if tt.wantErr {
+				<-resp
+				return
+			}
+			if code := <-resp; code != http.StatusAccepted {
+				t.Errorf("in-flight request got status %d, want 202", code)
+			}
+			var names []string
+			for _, p := range f.posted() {
+				for _, e := range p.Events {
+					names = append(names, e.Name)
+				}
+			}
+			if !strings.Contains(strings.Join(names, ","), "shutdown_test") {
+				t.Errorf("event from the in-flight request wasn't delivered, got %v", names)
+			}
+		})
+	}
+}
+
+func TestRun(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  func(addr string) Config
+		wantErr string // "" when run should serve until cancelled
+	}{
+		{"serves until cancelled", func(addr string) Config { return Config{ListenAddr: addr} }, ""},
+		{"address in use", func(addr string) Config {
+			ln, err := net.Listen("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { ln.Close() })
+			return Config{ListenAddr: addr}
+		}, "address already in use"},
+		{"missing static_dir", func(addr string) Config {
+			return Config{ListenAddr: addr, StaticDir: filepath.Join(t.TempDir(), "missing")}
+		}, "cannot load assets"},
+		{"missing tls_cert", func(addr string) Config {
+			dir := t.TempDir()
+			return Config{ListenAddr: addr, TLSCert: filepath.Join(dir, "cert.pem"), TLSKey: filepath.Join(dir, "key.pem")}
+		}, "tls_cert"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr := freeAddr(t)
+			f := newFakeCollector(t, tt.config(addr))
+			saved := hitCounts
+			t.Cleanup(func() {
+				hitCounts = saved
+				if err := loadAssets(""); err != nil {
+					t.Errorf("restoring embedded assets: %v", err)
+				}
+			})
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			done := make(chan error, 1)
+			go func() { done <- run(ctx, *config()) }()
+
+			if tt.wantErr != "" {
+				select {
+				case err := <-done:
+					if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+						t.Errorf("run() = %v, want %q", err, tt.wantErr)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatal("run didn't fail")
+				}
+				return
+			}
+
+			waitForListener(t, addr)
+			for path, want := range map[string]int{
+				"/healthz":   http.StatusOK,
+				"/acct/page": http.StatusOK,
+				"/":          http.StatusFound,
+			} {
+				req, _ := http.NewRequest("GET", "http://"+addr+path, nil)
+				// Go's default User-Agent is filtered as a bot.
+				req.Header.Set("User-Agent", "Mozilla/5.0")
+				resp, err := http.DefaultTransport.RoundTrip(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				resp.Body.Close()
+				if resp.StatusCode != want {
+					t.Errorf("GET %s: %d, want %d", path, resp.StatusCode, want)
+				}
+			}
+			cancel()
+			select {
+			case err := <-done:
+				if err != nil {
+					t.Errorf("run() = %v after cancel, want nil", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("run didn't return after cancel")
+			}
+			// Hits queued before shutdown are delivered before run returns.
+			if n := len(f.posted()); n != 1 {
+				t.Errorf("collector got %d payloads, want the page hit", n)
+			}
+		})
+	}
+}
+
+// freeAddr returns a loopback address nothing is listening on.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// waitForListener waits for something to accept connections on addr.
+func waitForListener(t *testing.T, addr string) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("nothing listening on %s: %v", addr, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSendToGARequest(t *testing.T) {
+	tests := []struct {
+		name      string
+		path      string // of collector_url
+		debug     bool
+		wantPath  string
+		wantQuery url.Values
+	}{
+		{"collector_url", "/mp/collect", false, "/mp/collect",
+			url.Values{"measurement_id": {"G-TEST"}, "api_secret": {"secret"}}},
+		{"debug endpoint", "/mp/collect", true, "/debug/mp/collect",
+			url.Values{"measurement_id": {"G-TEST"}, "api_secret": {"secret"}}},
+		{"debug collector_url kept as is", "/debug/mp/collect", true, "/debug/mp/collect",
+			url.Values{"measurement_id": {"G-TEST"}, "api_secret": {"secret"}}},
+		{"proxy with its own query", "/proxy/collect?region=eu", false, "/proxy/collect",
+			url.Values{"region": {"eu"}, "measurement_id": {"G-TEST"}, "api_secret": {"secret"}}},
+	}
+	payload := GA4Payload{ClientID: "1234.5678", Events: []GA4Event{{Name: "page_view", Params: map[string]interface{}{"page_location": "https://example.com/"}}}}
+	const wantBody = `{"client_id":"1234.5678","events":[{"name":"page_view","params":{"page_location":"https://example.com/"}}]}`
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got *http.Request
+			var body []byte
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = r
+				body, _ = io.ReadAll(r.Body)
+				w.WriteHeader(http.StatusNoContent)
+			}))
+			defer srv.Close()
+			useConfig(t, withTestCreds(Config{CollectorURL: srv.URL + tt.path, DebugCollector: tt.debug}))
+
+			err := sendToGA(context.Background(), "test-agent/1.0", "192.0.2.1", "1234.5678", Credentials{MeasurementID: "G-TEST", APISecret: "secret"}, payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got == nil {
+				t.Fatal("collector got no request")
+			}
+			if got.Method != "POST" || got.URL.Path != tt.wantPath {
+				t.Errorf("request = %s %s, want POST %s", got.Method, got.URL.Path, tt.wantPath)
+			}
+			if q := got.URL.Query(); !reflect.DeepEqual(q, tt.wantQuery) {
+				t.Errorf("query = %v, want %v", q, tt.wantQuery)
+			}
+			if ct := got.Header.Get("Content-Type"); ct != "application/json" {
+				t.Errorf("Content-Type = %q, want application/json", ct)
+			}
+			if ua := got.Header.Get("User-Agent"); ua != "test-agent/1.0" {
+				t.Errorf("User-Agent = %q, want the visitor's", ua)
+			}
+			if string(body) != wantBody {
+				t.Errorf("body = %s, want %s", body, wantBody)
+			}
+		})
+	}
+}
+
+func TestLifecycleEvents(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+		cid    string // cookie, "" for a first-time visitor
+		active bool   // client already has an ongoing session
+		want   string
+	}{
+		{"first-time visitor", Config{}, "", false, "[first_visit session_start page_view]"},
+		{"returning visitor in a fresh session", Config{}, "1111.2222", false, "[session_start page_view]"},
+		{"returning visitor mid-session", Config{}, "3333.4444", true, "[page_view]"},
+		{"derived client id", Config{StableCIDFallback: true}, "", false, "[session_start page_view]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, withTestCreds(tt.config))
+			if tt.active {
+				touchSession(httptest.NewRequest("GET", "/acct/page", nil), tt.cid, time.Now())
+			}
+			sender := &recordingSender{}
+			serveHit(t, &server{sender: sender}, "/acct/page?pixel", tt.cid)
+			sent := sender.sent()
+			if len(sent) != 1 {
+				t.Fatalf("sent %d hits, want 1", len(sent))
+			}
+			if got := eventNames(sent[0].Payload); got != tt.want {
+				t.Errorf("events = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandlerSendsPayload(t *testing.T) {
+	useConfig(t, withTestCreds(Config{}))
+	tests := []struct {
+		target       string
+		wantAccount  string
+		wantLocation string
+		wantPath     string
+	}{
+		{"/acct/page", "acct", "http://example.com/acct/page", "/page"},
+		{"/acct/docs/intro?pixel", "acct", "http://example.com/acct/docs/intro", "/docs/intro"},
+		{"/other/page?gif", "other", "http://example.com/other/page", "/page"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			sender := &recordingSender{}
+			if w := serveHit(t, &server{sender: sender}, tt.target, "1111.2222"); w.Code != http.StatusOK {
+				t.Fatalf("status %d, want 200", w.Code)
+			}
+			sent := sender.sent()
+			if len(sent) != 1 {
+				t.Fatalf("sent %d hits, want 1", len(sent))
+			}
+			meta, payload := sent[0].Meta, sent[0].Payload
+			if meta.Account != tt.wantAccount || meta.CID != "1111.2222" || meta.Creds.MeasurementID != "G-TEST" {
+				t.Errorf("meta = %+v, want account %s, cid 1111.2222 and the test credentials", meta, tt.wantAccount)
+			}
+			if payload.ClientID != "1111.2222" {
+				t.Errorf("client_id = %q, want the cookie's", payload.ClientID)
+			}
+			event := payload.Events[len(payload.Events)-1]
+			if event.Name != "page_view" {
+				t.Fatalf("last event = %s, want page_view", event.Name)
+			}
+			if got := event.Params["page_location"]; got != tt.wantLocation {
+				t.Errorf("page_location = %v, want %s", got, tt.wantLocation)
+			}
+			if got := event.Params["page_path"]; got != tt.wantPath {
+				t.Errorf("page_path = %v, want %s", got, tt.wantPath)
+			}
+		})
+	}
+}
+
+func TestClientIDOverride(t *testing.T) {
+	useConfig(t, withTestCreds(Config{}))
+	tests := []struct {
+		name       string
+		target     string
+		header     string // X-Client-ID
+		cookie     string
+		want       string // "" for a generated id
+		wantCookie bool
+	}{
+		{"?cid=", "/acct/page?pixel&cid=1234567890.1700000000", "", "", "1234567890.1700000000", false},
+		{"X-Client-ID", "/acct/page?pixel", "0d6e3b2a-3f0c-4c59-9a0e-2b8d3c1f7a66", "", "0d6e3b2a-3f0c-4c59-9a0e-2b8d3c1f7a66", false},
+		{"?cid= before X-Client-ID", "/acct/page?pixel&cid=1.2", "3.4", "", "1.2", false},
+		{"override beats the cookie", "/acct/page?pixel&cid=1.2", "", "5.6", "1.2", false},
+		{"malformed ?cid=", "/acct/page?pixel&cid=<script>", "", "", "", true},
+		{"malformed ?cid= keeps the cookie", "/acct/page?pixel&cid=nope", "", "5.6", "5.6", false},
+		{"malformed ?cid=, valid header", "/acct/page?pixel&cid=nope", "3.4", "", "3.4", false},
+		{"no override", "/acct/page?pixel", "", "", "", true},
+	}
+	uuid := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sender := &recordingSender{}
+			// A page of its own, so the hit isn't taken for a repeat.
+			target := strings.Replace(tt.target, "/page", fmt.Sprintf("/page-%d", i), 1)
+			r := httptest.NewRequest("GET", target, nil)
+			if tt.header != "" {
+				r.Header.Set("X-Client-ID", tt.header)
+			}
+			if tt.cookie != "" {
+				r.AddCookie(&http.Cookie{Name: cidCookieName(), Value: tt.cookie})
+			}
+			w := httptest.NewRecorder()
+			(&server{sender: sender}).handler(w, r)
+
+			sent := sender.sent()
+			if len(sent) != 1 {
+				t.Fatalf("sent %d hits, want 1", len(sent))
+			}
+			p := sent[0].Payload
+			switch {
+			case tt.want == "" && !uuid.MatchString(p.ClientID):
+				t.Errorf("client_id = %q, want a generated UUID", p.ClientID)
+			case tt.want != "" && p.ClientID != tt.want:
+				t.Errorf("client_id = %q, want %q", p.ClientID, tt.want)
+			}
+			setsCookie := strings.Contains(strings.Join(w.Header().Values("Set-Cookie"), "\n"), cidCookieName()+"=")
+			if setsCookie != tt.wantCookie {
+				t.Errorf("cid cookie set: %v, want %v", setsCookie, tt.wantCookie)
+			}
+			for _, e := range p.Events {
+				if v, ok := e.Params["custom_cid"]; ok {
+					t.Errorf("%s has custom_cid = %v, want cid reserved", e.Name, v)
+				}
+			}
+		})
+	}
+}
+
+func TestUserID(t *testing.T) {
+	useConfig(t, withTestCreds(Config{}))
+	tooLong := strings.Repeat("u", maxUserIDLength+1)
+	tests := []struct {
+		name   string
+		query  string
+		header string // X-User-ID
+		want   string
+	}{
+		{"?uid=", "uid=user-42", "", "user-42"},
+		{"X-User-ID", "", "user-43", "user-43"},
+		{"?uid= before X-User-ID", "uid=user-42", "user-43", "user-42"},
+		{"longest accepted", "uid=" + strings.Repeat("u", maxUserIDLength), "", strings.Repeat("u", maxUserIDLength)},
+		{"too long", "uid=" + tooLong, "", ""},
+		{"too long, valid header", "uid=" + tooLong, "user-43", "user-43"},
+		{"whitespace", "uid=%20%20", "", ""},
+		{"empty", "uid=", "", ""},
+		{"none", "", "", ""},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sender := &recordingSender{}
+			r := httptest.NewRequest("GET", fmt.Sprintf("/acct/uid-%d?%s", i, tt.query), nil)
+			if tt.header != "" {
+				r.Header.Set("X-User-ID", tt.header)
+			}
+			(&server{sender: sender}).handler(httptest.NewRecorder(), r)
+
+			sent := sender.sent()
+			if len(sent) != 1 {
+				t.Fatalf("sent %d hits, want 1", len(sent))
+			}
+			p := sent[0].Payload
+			if p.UserID != tt.want {
+				t.Errorf("user_id = %q, want %q", p.UserID, tt.want)
+			}
+			for _, e := range p.Events {
+				if v, ok := e.Params["custom_uid"]; ok {
+					t.Errorf("%s has custom_uid = %v, want uid reserved", e.Name, v)
+				}
+			}
+			b, _ := json.Marshal(p)
+			if strings.Contains(string(b), `"user_id"`) != (tt.want != "") {
+				t.Errorf("payload JSON %s, want user_id only when set", b)
+			}
+		})
+	}
+}
+
+func TestTimestampMicrosIsReceiveTime(t *testing.T) {
+	useConfig(t, withTestCreds(Config{}))
+	tests := []struct {
+		name   string
+		target string
+	}{
+		{"pixel", "/acct/page-a?pixel"},
+		{"badge", "/acct/page-b"},
+		{"beacon", "/acct/page-c?beacon"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sender := &recordingSender{}
+			before := time.Now()
+			serveHit(t, &server{sender: sender}, tt.target, "1111.2222")
+			after := time.Now()
+			sent := sender.sent()
+			if len(sent) != 1 {
+				t.Fatalf("sent %d hits, want 1", len(sent))
+			}
+			p := sent[0].Payload
+			if p.TimestampMicros != p.Received.UnixMicro() {
+				t.Errorf("timestamp_micros = %d, want the receive time %d", p.TimestampMicros, p.Received.UnixMicro())
+			}
+			if p.TimestampMicros < before.UnixMicro() || p.TimestampMicros > after.UnixMicro() {
+				t.Errorf("timestamp_micros = %d, want within the request, %d to %d", p.TimestampMicros, before.UnixMicro(), after.UnixMicro())
+			}
+
+			b, err := json.Marshal(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var decoded struct {
+				TimestampMicros int64 `json:"timestamp_micros"`
+			}
+			if err := json.Unmarshal(b, &decoded); err != nil {
+				t.Fatal(err)
+			}
+			if decoded.TimestampMicros != p.TimestampMicros {
+				t.Errorf("timestamp_micros in JSON = %d, want %d", decoded.TimestampMicros, p.TimestampMicros)
+			}
+		})
+	}
+}
+
+func TestBeaconMode(t *testing.T) {
+	useConfig(t, withTestCreds(Config{}))
+	if err := loadAssets(""); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		target   string
+		accept   string
+		want204  bool
+		wantType string // beacon_hits_total type
+	}{
+		{"?beacon", "/acct/page-a?beacon", "", true, "none"},
+		{"Accept: application/json", "/acct/page-b", "application/json", true, "none"},
+		{"JSON among other types", "/acct/page-c", "text/plain, application/json; q=0.9", true, "none"},
+		{"?beacon over ?gif", "/acct/page-d?gif&beacon", "", true, "none"},
+		{"?beacon over ?style=", "/acct/page-e?style=flat&beacon", "", true, "none"},
+		{"image Accept", "/acct/page-f?pixel", "image/avif,image/webp,*/*", false, "pixel"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sender := &recordingSender{}
+			r := httptest.NewRequest("GET", tt.target, nil)
+			if tt.accept != "" {
+				r.Header.Set("Accept", tt.accept)
+			}
+			before := hitsReceived.Value("account", "other", "type", tt.wantType)
+			w := httptest.NewRecorder()
+			(&server{sender: sender}).handler(w, r)
+
+			if tt.want204 {
+				if w.Code != http.StatusNoContent || w.Body.Len() != 0 {
+					t.Fatalf("status %d with a %d-byte body, want 204 and no body", w.Code, w.Body.Len())
+				}
+			} else if w.Code != http.StatusOK || w.Body.Len() == 0 {
+				t.Fatalf("status %d with a %d-byte body, want 200 and an image", w.Code, w.Body.Len())
+			}
+			if w.Header().Get("Set-Cookie") == "" {
+				t.Error("no cid cookie set for a new client")
+			}
+			sent := sender.sent()
+			if len(sent) != 1 {
+				t.Fatalf("sent %d hits, want 1", len(sent))
+			}
+			events := sent[0].Payload.Events
+			if v, ok := events[len(events)-1].Params["custom_beacon"]; ok {
+				t.Errorf("custom_beacon = %v, want ?beacon kept out of custom params", v)
+			}
+			if got := hitsReceived.Value("account", "other", "type", tt.wantType) - before; got != 1 {
+				t.Errorf("beacon_hits_total{type=%s} rose by %v, want 1", tt.wantType, got)
+			}
+		})
+	}
+}
+
+func TestAccountPageEscapesInput(t *testing.T) {
+	useConfig(t, Config{})
+	if err := loadAssets(""); err != nil {
+		t.Fatal(err)
+	}
+	const script = `<script>alert(1)</script>`
+	tests := []struct {
+		name     string
+		target   string
+		referer  string
+		wantCode int
+	}{
+		{"script in the account", "/" + url.PathEscape(script), "", http.StatusBadRequest},
+		{"quote in the account", "/acct'-alert(1)-'", "", http.StatusBadRequest},
+		{"script in the page's account", "/" + url.PathEscape(`"><img src=x onerror=alert(1)>`) + "/page", "", http.StatusBadRequest},
+		{"script in the referer", "/acct", `https://example.com/"><script>alert(1)</script>`, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", tt.target, nil)
+			if tt.referer != "" {
+				r.Header.Set("Referer", tt.referer)
+			}
+			w := httptest.NewRecorder()
+			(&server{sender: &recordingSender{}}).handler(w, r)
+
+			if w.Code != tt.wantCode {
+				t.Fatalf("status %d, want %d", w.Code, tt.wantCode)
+			}
+			body := w.Body.String()
+			for _, raw := range []string{script, "onerror=alert", `"><`} {
+				if strings.Contains(body, raw) {
+					t.Errorf("response contains %q unescaped:\n%s", raw, body)
+				}
+			}
+		})
+	}
+}
+
+func TestPixelResponses(t *testing.T) {
+	if err := loadAssets(""); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		config   Config
+		method   string
+		target   string
+		header   map[string]string
+		wantType string
+		wantBody []byte
+	}{
+		{"GIF", Config{}, "GET", "/acct/pixel-a?pixel", nil, "image/gif", pixel},
+		{"PNG", Config{}, "GET", "/acct/pixel-b?pixel=png", nil, "image/png", pixelPNG},
+		{"HEAD", Config{}, "HEAD", "/acct/pixel-c?pixel", nil, "image/gif", nil},
+		{"tracking denied", Config{DeniedConsentMode: "skip"}, "GET", "/acct/pixel-d?pixel&consent=denied", nil, "image/gif", pixel},
+		{"bot", Config{}, "GET", "/acct/pixel-e?pixel=png", map[string]string{"User-Agent": "Googlebot/2.1"}, "image/png", pixelPNG},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, withTestCreds(tt.config))
+			r := httptest.NewRequest(tt.method, tt.target, nil)
+			for k, v := range tt.header {
+				r.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			newMux(&server{sender: &recordingSender{}}).ServeHTTP(w, r)
+
+			if w.Code != http.StatusOK || w.Header().Get("Content-Type") != tt.wantType {
+				t.Errorf("status %d, Content-Type %q; want 200 %s", w.Code, w.Header().Get("Content-Type"), tt.wantType)
+			}
+			size := len(pixel)
+			if tt.wantType == "image/png" {
+				size = len(pixelPNG)
+			}
+			if cl := w.Header().Get("Content-Length"); cl != strconv.Itoa(size) {
+				t.Errorf("Content-Length = %q, want %d", cl, size)
+			}
+			if !bytes.Equal(w.Body.Bytes(), tt.wantBody) {
+				t.Errorf("body = %d bytes, want %d", w.Body.Len(), len(tt.wantBody))
+			}
+		})
+	}
+
+	img, err := png.Decode(bytes.NewReader(pixelPNG))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := img.Bounds(); b.Dx() != 1 || b.Dy() != 1 {
+		t.Errorf("PNG pixel is %dx%d, want 1x1", b.Dx(), b.Dy())
+	}
+	if _, _, _, a := img.At(0, 0).RGBA(); a != 0 {
+		t.Errorf("PNG pixel alpha = %d, want transparent", a)
+	}
+}
+
+func TestHitPaths(t *testing.T) {
+	useConfig(t, withTestCreds(Config{}))
+	tests := []struct {
+		name        string
+		path        string
+		wantCode    int
+		wantAccount string
+		wantPage    string
+	}{
+		{"account and page", "/a/b", http.StatusOK, "a", "b"},
+		{"deep page", "/a/b/c/d", http.StatusOK, "a", "b/c/d"},
+		{"trailing slash", "/a/b/", http.StatusOK, "a", "b"},
+		{"empty segment", "/a//b", http.StatusBadRequest, "", ""},
+		{"empty deep segment", "/a/b//c", http.StatusBadRequest, "", ""},
+		{"control character", "/a/b\x01c", http.StatusBadRequest, "", ""},
+		{"newline", "/a/b\nc", http.StatusBadRequest, "", ""},
+		{"invalid UTF-8", "/a/b\xffc", http.StatusBadRequest, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Build the URL by hand: url.Parse refuses control characters
+			// before the handler would see them.
+			r := httptest.NewRequest("GET", "/?pixel", nil)
+			r.URL.Path = tt.path
+			r.Header.Set("User-Agent", "Mozilla/5.0")
+			params, _, err := hitParams(r, r.URL.Path)
+			if (err != nil) != (tt.wantCode == http.StatusBadRequest) {
+				t.Fatalf("hitParams() error = %v", err)
+			}
+			if err == nil && (params[0] != tt.wantAccount || params[1] != tt.wantPage) {
+				t.Errorf("hitParams() = %q, want account %q, page %q", params, tt.wantAccount, tt.wantPage)
+			}
+
+			sender := &recordingSender{}
+			w := httptest.NewRecorder()
+			(&server{sender: sender}).handler(w, r)
+			if w.Code != tt.wantCode {
+				t.Errorf("status %d, want %d", w.Code, tt.wantCode)
+			}
+			wantSent := 0
+			if tt.wantCode == http.StatusOK {
+				wantSent = 1
+			}
+			if n := len(sender.sent()); n != wantSent {
+				t.Errorf("sent %d hits, want %d", n, wantSent)
+			}
+			if tt.wantCode == http.StatusBadRequest && w.Header().Get("Set-Cookie") != "" {
+				t.Error("malformed path set a cookie")
+			}
+		})
+	}
+}
+
+func TestStableClientID(t *testing.T) {
+	const ua = "Mozilla/5.0 (X11; Linux x86_64)"
+	useConfig(t, withTestCreds(Config{StableCIDFallback: true, StableCIDSalt: "salt"}))
+	base := stableClientID("203.0.113.7", ua)
+	if !clientIDPattern.MatchString(base) {
+		t.Errorf("stableClientID() = %q, want a valid client id", base)
+	}
+	tests := []struct {
+		name     string
+		salt     string
+		ip, ua   string
+		wantSame bool
+	}{
+		{"same ip and ua", "salt", "203.0.113.7", ua, true},
+		{"different ip", "salt", "203.0.113.8", ua, false},
+		{"different ua", "salt", "203.0.113.7", ua + " Firefox/121.0", false},
+		{"ip and ua run together", "salt", "203.0.113.7" + ua[:1], ua[1:], false},
+		{"different salt", "pepper", "203.0.113.7", ua, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, withTestCreds(Config{StableCIDFallback: true, StableCIDSalt: tt.salt}))
+			if got := stableClientID(tt.ip, tt.ua); (got == base) != tt.wantSame {
+				t.Errorf("stableClientID() = %q, base %q, want same: %v", got, base, tt.wantSame)
+			}
+		})
+	}
+}
+
+func TestStableCIDFallback(t *testing.T) {
+	if c := withTestCreds(Config{StableCIDFallback: true}); c.validate() == nil {
+		t.Error("stable_cid_fallback without stable_cid_salt validated")
+	}
+
+	const ua = "Mozilla/5.0 (X11; Linux x86_64)"
+	tests := []struct {
+		name     string
+		fallback bool
+		ip, ua   string
+		cookie   string
+		wantSame bool // as the first hit from 203.0.113.7 with ua
+	}{
+		{"same ip and ua", true, "203.0.113.7", ua, "", true},
+		{"different ip", true, "203.0.113.8", ua, "", false},
+		{"different ua", true, "203.0.113.7", "Mozilla/5.0 (Windows NT 10.0)", "", false},
+		{"cookie wins", true, "203.0.113.7", ua, "1.2", false},
+		{"fallback off", false, "203.0.113.7", ua, "", false},
+	}
+	cidOf := func(t *testing.T, page, ip, ua, cookie string) (string, GA4Payload) {
+		t.Helper()
+		sender := &recordingSender{}
+		r := httptest.NewRequest("GET", "/acct/"+page+"?pixel", nil)
+		r.RemoteAddr = ip + ":4321"
+		r.Header.Set("User-Agent", ua)
+		if cookie != "" {
+			r.AddCookie(&http.Cookie{Name: cidCookieName(), Value: cookie})
+		}
+		(&server{sender: sender}).handler(httptest.NewRecorder(), r)
+		sent := sender.sent()
+		if len(sent) != 1 {
+			t.Fatalf("sent %d hits, want 1", len(sent))
+		}
+		return sent[0].Payload.ClientID, sent[0].Payload
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, withTestCreds(Config{StableCIDFallback: tt.fallback, StableCIDSalt: "salt"}))
+			first, payload := cidOf(t, fmt.Sprintf("first-%d", i), "203.0.113.7", ua, "")
+			for _, e := range payload.Events {
+				if tt.fallback && e.Name == "first_visit" {
+					t.Error("derived client id sent first_visit")
+				}
+			}
+			got, _ := cidOf(t, fmt.Sprintf("second-%d", i), tt.ip, tt.ua, tt.cookie)
+			if (got == first) != tt.wantSame {
+				t.Errorf("client_id %q, first hit %q, want same: %v", got, first, tt.wantSame)
+			}
+		})
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   Config
+		noSecret bool
+		wantSent int // requests reaching the collector
+	}{
+		{"dry run", Config{DryRun: true}, false, 0},
+		{"dry run without api_secret", Config{DryRun: true}, true, 0},
+		{"dry run with validate", Config{DryRun: true, Validate: true}, false, 0},
+		{"sending", Config{}, false, 1},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeCollector(t, tt.config)
+			if tt.noSecret {
+				c := *config()
+				c.APISecret = ""
+				useConfig(t, c)
+			}
+			logs := captureLogs(t)
+			r := httptest.NewRequest("GET", fmt.Sprintf("/acct/dry-%d?pixel", i), nil)
+			r.Header.Set("User-Agent", "Mozilla/5.0")
+			w := httptest.NewRecorder()
+			(&server{sender: gaSender{}}).handler(w, r)
+			if w.Code != http.StatusOK {
+				t.Errorf("status %d, want 200", w.Code)
+			}
+
+			f.mu.Lock()
+			n := len(f.requests)
+			f.mu.Unlock()
+			if n != tt.wantSent {
+				t.Errorf("collector got %d requests, want %d", n, tt.wantSent)
+			}
+			logged := strings.Contains(logs.String(), "dry run, not sending hit")
+			if logged != (tt.wantSent == 0) {
+				t.Errorf("dry run logged: %v, want %v:\n%s", logged, tt.wantSent == 0, logs)
+			}
+			if logged && !strings.Contains(logs.String(), `\"page_location\"`) {
+				t.Errorf("dry run log has no payload:\n%s", logs)
+			}
+		})
+	}
+}
+
+func TestSendToGAFollowsContext(t *testing.T) {
+	tests := []struct {
+		name   string
+		ctx    func() (context.Context, context.CancelFunc)
+		cancel time.Duration // when to cancel, after the post arrives; 0 for never
+	}{
+		{"cancelled mid-post", func() (context.Context, context.CancelFunc) { return context.WithCancel(context.Background()) }, 100 * time.Millisecond},
+		{"deadline mid-post", func() (context.Context, context.CancelFunc) {
+			return context.WithTimeout(context.Background(), 200*time.Millisecond)
+		}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			arrived := make(chan struct{}, 10)
+			aborted := make(chan struct{}, 10)
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.Copy(io.Discard, r.Body)
+				arrived <- struct{}{}
+				select {
+				case <-r.Context().Done():
+					aborted <- struct{}{}
+				case <-time.After(5 * time.Second):
+					w.WriteHeader(http.StatusNoContent)
+				}
+			}))
+			defer srv.Close()
+			useConfig(t, withTestCreds(Config{CollectorURL: srv.URL, MaxRetries: 3}))
+
+			ctx, cancel := tt.ctx()
+			defer cancel()
+			if tt.cancel > 0 {
+				go func() {
+					<-arrived
+					time.Sleep(tt.cancel)
+					cancel()
+				}()
+			}
+			start := time.Now()
+			err := sendToGA(ctx, "test-agent", "192.0.2.1", "cid", Credentials{MeasurementID: "G-TEST", APISecret: "secret"}, GA4Payload{ClientID: "cid"})
+			if took := time.Since(start); took > time.Second {
+				t.Errorf("sendToGA took %v, want it to stop with its context", took.Round(time.Millisecond))
+			}
+			if !errors.Is(err, ctx.Err()) || ctx.Err() == nil {
+				t.Errorf("sendToGA() = %v, want the context's error %v", err, ctx.Err())
+			}
+			select {
+			case <-aborted:
+			case <-time.After(time.Second):
+				t.Error("collector didn't see the post aborted")
+			}
+		})
+	}
+}
+
+func TestMaxConcurrentSends(t *testing.T) {
+	tests := []struct {
+		limit    int
+		wantPeak int32
+	}{
+		{0, 6}, // no limit
+		{1, 1},
+		{2, 2},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.limit), func(t *testing.T) {
+			var inFlight, peak atomic.Int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.Copy(io.Discard, r.Body)
+				n := inFlight.Add(1)
+				for p := peak.Load(); n > p && !peak.CompareAndSwap(p, n); p = peak.Load() {
+				}
+				time.Sleep(50 * time.Millisecond)
+				inFlight.Add(-1)
+				w.WriteHeader(http.StatusNoContent)
+			}))
+			defer srv.Close()
+			useConfig(t, withTestCreds(Config{CollectorURL: srv.URL, MaxConcurrentSends: tt.limit}))
+
+			errs := make(chan error, 6)
+			for i := 0; i < cap(errs); i++ {
+				go func() {
+					errs <- sendToGA(context.Background(), "test-agent", "192.0.2.1", "cid", Credentials{MeasurementID: "G-TEST", APISecret: "secret"}, GA4Payload{ClientID: "cid"})
+				}()
+			}
+			for i := 0; i < cap(errs); i++ {
+				if err := <-errs; err != nil {
+					t.Errorf("sendToGA() = %v, want it to wait for a slot", err)
+				}
+			}
+			if got := peak.Load(); got != tt.wantPeak {
+				t.Errorf("%d posts in flight at once, want %d", got, tt.wantPeak)
+			}
+		})
+	}
+}
+
+func TestSendSlotWaitEndsWithContext(t *testing.T) {
+	var posts atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		posts.Add(1)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+	useConfig(t, withTestCreds(Config{CollectorURL: srv.URL, MaxConcurrentSends: 1, MaxRetries: -1}))
+
+	// Take the only slot, as a post in flight would.
+	release, err := acquireSendSlot(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = sendToGA(ctx, "test-agent", "192.0.2.1", "cid", Credentials{MeasurementID: "G-TEST", APISecret: "secret"}, GA4Payload{ClientID: "cid"})
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("sendToGA waited %v, want it to give up with its context", took.Round(time.Millisecond))
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("sendToGA() = %v, want context.DeadlineExceeded", err)
+	}
+	if n := posts.Load(); n != 0 {
+		t.Errorf("collector got %d posts without a free slot", n)
+	}
+}
+
+func TestAllowedAccounts(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   Config
+		method   string
+		target   string
+		wantCode int
+		wantSent bool
+	}{
+		{"no allowlist", Config{}, "GET", "/anyone/page?pixel", http.StatusOK, true},
+		{"listed", Config{AllowedAccounts: []string{"docs", "blog"}}, "GET", "/blog/page?pixel", http.StatusOK, true},
+		{"glob", Config{AllowedAccounts: []string{"docs-*"}}, "GET", "/docs-v2/page?pixel", http.StatusOK, true},
+		{"glob after normalizing", Config{AllowedAccounts: []string{"Docs-*"}, NormalizeAccount: "lowercase"}, "GET", "/DOCS-V2/page?pixel", http.StatusOK, true},
+		{"unlisted gets the image", Config{AllowedAccounts: []string{"docs-*"}}, "GET", "/stranger/page?pixel", http.StatusOK, false},
+		{"unlisted badge", Config{AllowedAccounts: []string{"docs-*"}}, "GET", "/stranger/page", http.StatusOK, false},
+		{"unlisted gets 404", Config{AllowedAccounts: []string{"docs-*"}, UnlistedAccounts: "not_found"}, "GET", "/stranger/page?pixel", http.StatusNotFound, false},
+		{"unlisted /collect", Config{AllowedAccounts: []string{"docs-*"}}, "POST", "/collect/stranger", http.StatusNotFound, false},
+		{"listed /collect", Config{AllowedAccounts: []string{"docs-*"}}, "POST", "/collect/docs-v2", http.StatusAccepted, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, withTestCreds(tt.config))
+			sender := &recordingSender{}
+			r := httptest.NewRequest(tt.method, tt.target, strings.NewReader(`{"events": [{"name": "download"}]}`))
+			r.Header.Set("User-Agent", "Mozilla/5.0")
+			w := httptest.NewRecorder()
+			newMux(&server{sender: sender}).ServeHTTP(w, r)
+
+			if w.Code != tt.wantCode {
+				t.Errorf("status %d, want %d", w.Code, tt.wantCode)
+			}
+			if sent := len(sender.sent()) > 0; sent != tt.wantSent {
+				t.Errorf("hit sent: %v, want %v", sent, tt.wantSent)
+			}
+			if !tt.wantSent && w.Header().Get("Set-Cookie") != "" {
+				t.Errorf("untracked account set a cookie: %s", w.Header().Get("Set-Cookie"))
+			}
+		})
+	}
+}
+
+func TestAllowedAccountsValidated(t *testing.T) {
+	tests := []struct {
+		config  Config
+		wantErr bool
+	}{
+		{Config{AllowedAccounts: []string{"docs", "blog-*"}, UnlistedAccounts: "image"}, false},
+		{Config{UnlistedAccounts: "not_found"}, false},
+		{Config{AllowedAccounts: []string{"docs-["}}, true},
+		{Config{UnlistedAccounts: "drop"}, true},
+	}
+	for _, tt := range tests {
+		c := withTestCreds(tt.config)
+		if err := c.validate(); (err != nil) != tt.wantErr {
+			t.Errorf("allowed_accounts %q, unlisted_accounts %q: validate() = %v, want error: %v", tt.config.AllowedAccounts, tt.config.UnlistedAccounts, err, tt.wantErr)
+		}
+	}
+}
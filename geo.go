@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+)
+
+// geoLocator maps a client IP to ISO country and region codes.
+type geoLocator interface {
+	Lookup(ip net.IP) (country, region string, ok bool)
+}
+
+// geo is set when geo_db_path points at a readable MaxMind DB.
+var geo geoLocator
+
+// addGeoParams sets geo_country and geo_region for ip when a locator is
+// configured and knows the address.
+func addGeoParams(params map[string]interface{}, ip string) {
+	if geo == nil {
+		return
+	}
+	addr := hostIP(ip)
+	if addr == nil {
+		return
+	}
+	country, region, ok := geo.Lookup(addr)
+	if !ok {
+		return
+	}
+	if country != "" {
+		params["geo_country"] = country
+	}
+	if region != "" {
+		params["geo_region"] = region
+	}
+}
+
+// hostIP parses an address that may carry a port, as in r.RemoteAddr.
+func hostIP(addr string) net.IP {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	return net.ParseIP(addr)
+}
+
+// mmdbReader is a minimal reader for MaxMind DB files (GeoLite2/GeoIP2
+// Country and City), covering just what country/region lookups need.
+// See https://maxmind.github.io/MaxMind-DB/ for the format.
+type mmdbReader struct {
+	buf        []byte
+	data       []byte
+	nodeCount  uint
+	recordSize uint
+	ipv4Start  uint
+	ipv6       bool
+}
+
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+func openMMDB(path string) (*mmdbReader, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	i := bytes.LastIndex(buf, mmdbMetadataMarker)
+	if i < 0 {
+		return nil, errors.New("not a MaxMind DB file")
+	}
+	metaStart := i + len(mmdbMetadataMarker)
+	raw, _, err := (&mmdbDecoder{buf: buf[metaStart:]}).decode(0)
+	if err != nil {
+		return nil, fmt.Errorf("bad metadata: %v", err)
+	}
+	meta, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("bad metadata")
+	}
+
+	r := &mmdbReader{buf: buf}
+	nodeCount, _ := meta["node_count"].(uint64)
+	recordSize, _ := meta["record_size"].(uint64)
+	ipVersion, _ := meta["ip_version"].(uint64)
+	r.nodeCount, r.recordSize, r.ipv6 = uint(nodeCount), uint(recordSize), ipVersion == 6
+	if recordSize != 24 && recordSize != 28 && recordSize != 32 {
+		return nil, fmt.Errorf("unsupported record size %d", recordSize)
+	}
+
+	treeSize := r.nodeCount * r.recordSize / 4
+	if treeSize+16 > uint(i) {
+		return nil, errors.New("search tree exceeds file")
+	}
+	r.data = buf[treeSize+16 : i]
+
+	// IPv4 addresses live under ::/96 in an IPv6 tree.
+	if r.ipv6 {
+		node := uint(0)
+		for b := 0; b < 96 && node < r.nodeCount; b++ {
+			node = r.record(node, 0)
+		}
+		r.ipv4Start = node
+	}
+	return r, nil
+}
+
+// record returns the left (bit 0) or right (bit 1) record of node.
+func (r *mmdbReader) record(node, bit uint) uint {
+	switch r.recordSize {
+	case 24:
+		b := r.buf[node*6+bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		b := r.buf[node*7:]
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(r.buf[node*8+bit*4:]))
+	}
+}
+
+func (r *mmdbReader) Lookup(ip net.IP) (string, string, bool) {
+	node, bits := uint(0), net.IP(nil)
+	if v4 := ip.To4(); v4 != nil {
+		bits = v4
+		node = r.ipv4Start
+	} else if r.ipv6 {
+		bits = ip.To16()
+	}
+	if bits == nil {
+		return "", "", false
+	}
+
+	for i := 0; i < len(bits)*8 && node < r.nodeCount; i++ {
+		node = r.record(node, uint(bits[i/8]>>(7-uint(i%8))&1))
+	}
+	if node <= r.nodeCount {
+		return "", "", false
+	}
+
+	raw, _, err := (&mmdbDecoder{buf: r.data}).decode(node - r.nodeCount - 16)
+	if err != nil {
+		return "", "", false
+	}
+	rec, _ := raw.(map[string]interface{})
+	country := isoCode(rec["country"])
+	region := ""
+	if subdivisions, ok := rec["subdivisions"].([]interface{}); ok && len(subdivisions) > 0 {
+		region = isoCode(subdivisions[0])
+	}
+	return country, region, country != "" || region != ""
+}
+
+func isoCode(v interface{}) string {
+	m, _ := v.(map[string]interface{})
+	code, _ := m["iso_code"].(string)
+	return code
+}
+
+// mmdbDecoder decodes values from an MMDB data section. Integers of all
+// widths decode to uint64 (int32 to int64), floats to float64.
+type mmdbDecoder struct {
+	buf []byte
+}
+
+var errMMDBCorrupt = errors.New("corrupt MaxMind DB data")
+
+// Deepest nesting of maps, arrays and pointers decode follows. Real
+// databases nest a handful of levels; anything deeper is corrupt, or a
+// pointer cycle.
+const maxMMDBDepth = 32
+
+// decode decodes the value at offset, returning it along with the offset
+// just past it.
+func (d *mmdbDecoder) decode(offset uint) (interface{}, uint, error) {
+	return d.decodeAt(offset, 0)
+}
+
+func (d *mmdbDecoder) decodeAt(offset uint, depth int) (interface{}, uint, error) {
+	if offset >= uint(len(d.buf)) || depth > maxMMDBDepth {
+		return nil, 0, errMMDBCorrupt
+	}
+	ctrl := d.buf[offset]
+	offset++
+	typ := uint(ctrl >> 5)
+
+	if typ == 1 {
+		ptr, next, err := d.pointer(ctrl, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		v, _, err := d.decodeAt(ptr, depth+1)
+		return v, next, err
+	}
+	if typ == 0 {
+		if offset >= uint(len(d.buf)) {
+			return nil, 0, errMMDBCorrupt
+		}
+		typ = 7 + uint(d.buf[offset])
+		offset++
+	}
+
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if offset+n > uint(len(d.buf)) {
+			return nil, 0, errMMDBCorrupt
+		}
+		extra := uint(0)
+		for _, b := range d.buf[offset : offset+n] {
+			extra = extra<<8 | uint(b)
+		}
+		offset += n
+		size = []uint{29, 285, 65821}[n-1] + extra
+	}
+
+	switch typ {
+	case 7: // map
+		// Each entry takes at least two bytes, which bounds the size a
+		// corrupt header can make us allocate.
+		m := make(map[string]interface{}, min(size, uint(len(d.buf))-offset))
+		for i := uint(0); i < size; i++ {
+			k, next, err := d.decodeAt(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			v, next, err := d.decodeAt(next, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, _ := k.(string)
+			m[key] = v
+			offset = next
+		}
+		return m, offset, nil
+	case 11: // array
+		a := make([]interface{}, 0, min(size, uint(len(d.buf))-offset))
+		for i := uint(0); i < size; i++ {
+			v, next, err := d.decodeAt(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, v)
+			offset = next
+		}
+		return a, offset, nil
+	case 14: // boolean, stored in the size field
+		return size != 0, offset, nil
+	}
+
+	if offset+size > uint(len(d.buf)) {
+		return nil, 0, errMMDBCorrupt
+	}
+	b := d.buf[offset : offset+size]
+	offset += size
+	switch typ {
+	case 2: // utf8 string
+		return string(b), offset, nil
+	case 3: // double
+		if size != 8 {
+			return nil, 0, errMMDBCorrupt
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+	case 4: // bytes
+		return append([]byte(nil), b...), offset, nil
+	case 5, 6, 9, 10: // uint16, uint32, uint64, uint128 (truncated)
+		v := uint64(0)
+		for _, c := range b {
+			v = v<<8 | uint64(c)
+		}
+		return v, offset, nil
+	case 8: // int32
+		v := int32(0)
+		for _, c := range b {
+			v = v<<8 | int32(c)
+		}
+		return int64(v), offset, nil
+	case 15: // float
+		if size != 4 {
+			return nil, 0, errMMDBCorrupt
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), offset, nil
+	}
+	return nil, 0, fmt.Errorf("unsupported MaxMind DB type %d", typ)
+}
+
+// pointer resolves a pointer's target offset, returning it along with the
+// offset just past the pointer itself.
+func (d *mmdbDecoder) pointer(ctrl byte, offset uint) (uint, uint, error) {
+	n := uint(ctrl>>3&0x3) + 1
+	if offset+n > uint(len(d.buf)) {
+		return 0, 0, errMMDBCorrupt
+	}
+	p := uint(0)
+	if n < 4 {
+		p = uint(ctrl & 0x7)
+	}
+	for _, b := range d.buf[offset : offset+n] {
+		p = p<<8 | uint(b)
+	}
+	p += []uint{0, 2048, 526336, 0}[n-1]
+	return p, offset + n, nil
+}
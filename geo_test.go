@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// mmdbWriter encodes values in the MaxMind DB data format, for building
+// test databases.
+type mmdbWriter struct {
+	bytes.Buffer
+}
+
+func (w *mmdbWriter) ctrl(typ, size int) {
+	if size >= 29 {
+		panic("test values must be short")
+	}
+	if typ <= 7 {
+		w.WriteByte(byte(typ<<5 | size))
+		return
+	}
+	w.WriteByte(byte(size))
+	w.WriteByte(byte(typ - 7))
+}
+
+func (w *mmdbWriter) string(s string) {
+	w.ctrl(2, len(s))
+	w.WriteString(s)
+}
+
+func (w *mmdbWriter) uint(v uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	w.ctrl(6, 4)
+	w.Write(b[:])
+}
+
+// pointer writes a pointer to offset, which must be below 2048.
+func (w *mmdbWriter) pointer(offset int) {
+	w.WriteByte(byte(1<<5 | offset>>8&0x7))
+	w.WriteByte(byte(offset))
+}
+
+// value writes a string, uint32, []interface{}, map[string]interface{}
+// or mmdbPointer.
+func (w *mmdbWriter) value(v interface{}) {
+	switch v := v.(type) {
+	case string:
+		w.string(v)
+	case uint32:
+		w.uint(v)
+	case mmdbPointer:
+		w.pointer(int(v))
+	case []interface{}:
+		w.ctrl(11, len(v))
+		for _, e := range v {
+			w.value(e)
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		w.ctrl(7, len(v))
+		for _, k := range keys {
+			w.string(k)
+			w.value(v[k])
+		}
+	default:
+		panic("unsupported test value")
+	}
+}
+
+// mmdbPointer is a pointer to an offset in the data section.
+type mmdbPointer int
+
+// mmdbNode is a node of the search tree being built; a child is nil,
+// another node, or the data offset of a record (as an int).
+type mmdbNode struct {
+	children [2]interface{}
+}
+
+// buildMMDB writes a MaxMind DB mapping each network to the record at its
+// data offset, after data, the prefix of the data section, and returns its
+// path. IPv4 networks in an IPv6 database go under ::/96.
+func buildMMDB(t *testing.T, ipVersion, recordSize int, data []byte, networks map[string]int) string {
+	t.Helper()
+	root := &mmdbNode{}
+	for cidr, offset := range networks {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ip, ones := n.IP, 0
+		if v4 := ip.To4(); v4 != nil {
+			ip = v4
+		}
+		ones, _ = n.Mask.Size()
+		if ipVersion == 6 && len(ip) == 4 {
+			ip, ones = net.IP(append(make([]byte, 12), ip...)), ones+96
+		}
+		node := root
+		for i := 0; i < ones; i++ {
+			bit := ip[i/8] >> (7 - i%8) & 1
+			if i == ones-1 {
+				node.children[bit] = offset
+				break
+			}
+			next, ok := node.children[bit].(*mmdbNode)
+			if !ok {
+				next = &mmdbNode{}
+				node.children[bit] = next
+			}
+			node = next
+		}
+	}
+
+	// Number the nodes breadth first, root first.
+	nodes := []*mmdbNode{root}
+	index := map[*mmdbNode]int{root: 0}
+	for i := 0; i < len(nodes); i++ {
+		for _, c := range nodes[i].children {
+			if n, ok := c.(*mmdbNode); ok {
+				index[n] = len(nodes)
+				nodes = append(nodes, n)
+			}
+		}
+	}
+	nodeCount := len(nodes)
+
+	var tree bytes.Buffer
+	for _, n := range nodes {
+		var records [2]uint32
+		for bit, c := range n.children {
+			switch c := c.(type) {
+			case nil:
+				records[bit] = uint32(nodeCount)
+			case *mmdbNode:
+				records[bit] = uint32(index[c])
+			case int:
+				records[bit] = uint32(nodeCount + 16 + c)
+			}
+		}
+		l, r := records[0], records[1]
+		switch recordSize {
+		case 24:
+			tree.Write([]byte{byte(l >> 16), byte(l >> 8), byte(l), byte(r >> 16), byte(r >> 8), byte(r)})
+		case 28:
+			tree.Write([]byte{byte(l >> 16), byte(l >> 8), byte(l), byte(l>>20&0xf0 | r>>24&0x0f), byte(r >> 16), byte(r >> 8), byte(r)})
+		case 32:
+			binary.Write(&tree, binary.BigEndian, records)
+		}
+	}
+
+	var meta mmdbWriter
+	meta.value(map[string]interface{}{
+		"node_count":  uint32(nodeCount),
+		"record_size": uint32(recordSize),
+		"ip_version":  uint32(ipVersion),
+	})
+
+	var file bytes.Buffer
+	file.Write(tree.Bytes())
+	file.Write(make([]byte, 16))
+	file.Write(data)
+	file.Write(mmdbMetadataMarker)
+	file.Write(meta.Bytes())
+
+	path := filepath.Join(t.TempDir(), "test.mmdb")
+	if err := os.WriteFile(path, file.Bytes(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// geoFixture returns the data section of a test database and the offsets
+// of its records: one for the US (California), and one for Germany whose
+// country is a pointer into the US record's neighbour.
+func geoFixture() (data []byte, us, de int) {
+	var w mmdbWriter
+	us = w.Len()
+	w.value(map[string]interface{}{
+		"country":      map[string]interface{}{"iso_code": "US"},
+		"subdivisions": []interface{}{map[string]interface{}{"iso_code": "CA"}},
+	})
+	germany := w.Len()
+	w.value(map[string]interface{}{"iso_code": "DE"})
+	de = w.Len()
+	w.value(map[string]interface{}{"country": mmdbPointer(germany)})
+	return w.Bytes(), us, de
+}
+
+func TestMMDBLookup(t *testing.T) {
+	data, us, de := geoFixture()
+	networks := map[string]int{"198.51.100.0/24": us, "203.0.113.0/24": de, "2001:db8::/32": de}
+
+	tests := []struct {
+		ip                    string
+		wantCountry, wantRegn string
+		wantOK                bool
+	}{
+		{"198.51.100.7", "US", "CA", true},
+		{"203.0.113.200", "DE", "", true},
+		{"192.0.2.1", "", "", false},
+		{"2001:db8::1", "DE", "", true},
+		{"2001:db9::1", "", "", false},
+	}
+	for _, ipVersion := range []int{4, 6} {
+		for _, recordSize := range []int{24, 28, 32} {
+			path := buildMMDB(t, ipVersion, recordSize, data, networks)
+			db, err := openMMDB(path)
+			if err != nil {
+				t.Fatalf("v%d/%d: openMMDB: %v", ipVersion, recordSize, err)
+			}
+			for _, tt := range tests {
+				ip := net.ParseIP(tt.ip)
+				if ipVersion == 4 && ip.To4() == nil {
+					continue
+				}
+				country, region, ok := db.Lookup(ip)
+				if country != tt.wantCountry || region != tt.wantRegn || ok != tt.wantOK {
+					t.Errorf("v%d/%d: Lookup(%s) = %q, %q, %t, want %q, %q, %t", ipVersion, recordSize, tt.ip,
+						country, region, ok, tt.wantCountry, tt.wantRegn, tt.wantOK)
+				}
+			}
+		}
+	}
+}
+
+func TestMMDBDecodeRejectsCorruptData(t *testing.T) {
+	// A map of one entry whose value nests arrays far deeper than any
+	// real database.
+	var deep mmdbWriter
+	deep.ctrl(7, 1)
+	deep.string("k")
+	for i := 0; i < 100; i++ {
+		deep.ctrl(11, 1)
+	}
+	deep.string("leaf")
+
+	var loop mmdbWriter
+	loop.pointer(0)
+
+	tests := map[string][]byte{
+		"pointer to itself": loop.Bytes(),
+		"deep nesting":      deep.Bytes(),
+		"truncated string":  {2<<5 | 10, 'a'},
+		"huge map header":   {7<<5 | 31, 0xff, 0xff, 0xff},
+		"empty":             {},
+	}
+	for name, buf := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, _, err := (&mmdbDecoder{buf: buf}).decode(0)
+			if !errors.Is(err, errMMDBCorrupt) {
+				t.Errorf("decode err = %v, want errMMDBCorrupt", err)
+			}
+		})
+	}
+}
+
+func TestLookupWithPointerCycleFails(t *testing.T) {
+	var w mmdbWriter
+	w.pointer(0)
+	db, err := openMMDB(buildMMDB(t, 4, 24, w.Bytes(), map[string]int{"198.51.100.0/24": 0}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok := db.Lookup(net.ParseIP("198.51.100.1")); ok {
+		t.Error("Lookup through a pointer cycle succeeded")
+	}
+}
+
+func TestGeoParamsAndIPMode(t *testing.T) {
+	data, us, _ := geoFixture()
+	path := buildMMDB(t, 6, 28, data, map[string]int{"198.51.100.0/24": us})
+
+	tests := []struct {
+		ipMode string
+		ip     string
+		want   map[string]interface{}
+		absent []string
+	}{
+		{"", "198.51.100.7", map[string]interface{}{"geo_country": "US", "geo_region": "CA", "ip_address": "198.51.100.0"}, nil},
+		{"none", "198.51.100.7", map[string]interface{}{"geo_country": "US", "geo_region": "CA"}, []string{"ip_address"}},
+		{"", "192.0.2.1", map[string]interface{}{"ip_address": "192.0.2.0"}, []string{"geo_country", "geo_region"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ipMode+"/"+tt.ip, func(t *testing.T) {
+			useConfig(t, Config{MeasurementID: "G-TEST", APISecret: "secret", GeoDBPath: path, IPMode: tt.ipMode})
+			params := hitEventParams(t, tt.ip)
+			for k, v := range tt.want {
+				if params[k] != v {
+					t.Errorf("%s = %v, want %v", k, params[k], v)
+				}
+			}
+			for _, k := range tt.absent {
+				if v, ok := params[k]; ok {
+					t.Errorf("%s = %v, want it left out", k, v)
+				}
+			}
+		})
+	}
+}
+
+func TestGeoParamsSkippedWithoutDB(t *testing.T) {
+	garbage := filepath.Join(t.TempDir(), "garbage.mmdb")
+	if err := os.WriteFile(garbage, []byte("not a MaxMind DB"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name, path string
+	}{
+		{"no geo_db_path", ""},
+		{"missing file", filepath.Join(t.TempDir(), "missing.mmdb")},
+		{"not a MaxMind DB", garbage},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, Config{MeasurementID: "G-TEST", APISecret: "secret", GeoDBPath: tt.path})
+			params := hitEventParams(t, "198.51.100.7")
+			for _, k := range []string{"geo_country", "geo_region"} {
+				if v, ok := params[k]; ok {
+					t.Errorf("%s = %v, want it left out", k, v)
+				}
+			}
+			if params["ip_address"] != "198.51.100.0" {
+				t.Errorf("ip_address = %v, want the hit sent as usual", params["ip_address"])
+			}
+		})
+	}
+}
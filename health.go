@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+const defaultHealthDegradedAfter = 60 * time.Second
+
+// The delivery queue counts as saturated from this fraction of capacity.
+const queueSaturation = 0.9
+
+// deliveryHealth tracks how long deliveries to GA have been failing without
+// a single success in between, and how long the queue has been saturated.
+var deliveryHealth struct {
+	mu             sync.Mutex
+	failingSince   time.Time
+	saturatedSince time.Time
+}
+
+func recordDelivery(ok bool) {
+	deliveryHealth.mu.Lock()
+	defer deliveryHealth.mu.Unlock()
+
+	switch {
+	case ok:
+		deliveryHealth.failingSince = time.Time{}
+	case deliveryHealth.failingSince.IsZero():
+		deliveryHealth.failingSince = time.Now()
+	}
+}
+
+func recordQueueDepth(depth, capacity int) {
+	saturated := capacity > 0 && float64(depth) >= queueSaturation*float64(capacity)
+
+	deliveryHealth.mu.Lock()
+	defer deliveryHealth.mu.Unlock()
+
+	switch {
+	case !saturated:
+		deliveryHealth.saturatedSince = time.Time{}
+	case deliveryHealth.saturatedSince.IsZero():
+		deliveryHealth.saturatedSince = time.Now()
+	}
+}
+
+// deliveryDegraded reports whether deliveries have been failing, or the
+// delivery queue has been saturated, for longer than health_degraded_after.
+func deliveryDegraded(now time.Time) bool {
+	after := defaultHealthDegradedAfter
+	if config().HealthDegradedAfter > 0 {
+		after = time.Duration(config().HealthDegradedAfter) * time.Second
+	}
+
+	deliveryHealth.mu.Lock()
+	defer deliveryHealth.mu.Unlock()
+	since := func(t time.Time) bool { return !t.IsZero() && now.Sub(t) > after }
+	return since(deliveryHealth.failingSince) || since(deliveryHealth.saturatedSince)
+}
+
+// livezHandler only confirms the process is serving requests.
+func livezHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("ok"))
+}
+
+// healthzHandler reports readiness: it fails until a usable config is
+// loaded and, when health_require_delivery is set, while the beacon can't
+// deliver hits, so load balancers can take the instance out of rotation.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if !config().hasCredentials() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("not configured"))
+		return
+	}
+	if config().HealthRequireDelivery && deliveryDegraded(time.Now()) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("delivery degraded"))
+		return
+	}
+	w.Write([]byte("ok"))
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHealthz(t *testing.T) {
+	tests := []struct {
+		name       string
+		config     Config
+		path       string
+		wantStatus int
+		wantBody   string
+		wantHeader map[string]string
+	}{
+		{"configured", withTestCreds(Config{}), "/healthz", http.StatusOK, "ok", nil},
+		{"unconfigured", Config{}, "/healthz", http.StatusServiceUnavailable, "not configured", nil},
+		{"missing api secret", Config{MeasurementID: "G-TEST"}, "/healthz", http.StatusServiceUnavailable, "not configured", nil},
+		{"root still redirects", withTestCreds(Config{}), "/", http.StatusFound, "",
+			map[string]string{"Location": defaultRootRedirect}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, tt.config)
+			sender := &recordingSender{}
+			w := httptest.NewRecorder()
+			newMux(&server{sender: sender}).ServeHTTP(w, httptest.NewRequest("GET", tt.path, nil))
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.wantBody != "" && w.Body.String() != tt.wantBody {
+				t.Errorf("body = %q, want %q", w.Body.String(), tt.wantBody)
+			}
+			for k, v := range tt.wantHeader {
+				if got := w.Header().Get(k); got != v {
+					t.Errorf("%s = %q, want %q", k, got, v)
+				}
+			}
+			if c := w.Header().Get("Set-Cookie"); c != "" {
+				t.Errorf("Set-Cookie = %q, want no cookies", c)
+			}
+			if n := len(sender.sent()); n != 0 {
+				t.Errorf("sent %d hits, want none", n)
+			}
+		})
+	}
+}
+
+// resetDeliveryHealth clears the delivery health state for the test and
+// restores it afterwards.
+func resetDeliveryHealth(t *testing.T) {
+	t.Helper()
+	deliveryHealth.mu.Lock()
+	failing, saturated := deliveryHealth.failingSince, deliveryHealth.saturatedSince
+	deliveryHealth.failingSince, deliveryHealth.saturatedSince = time.Time{}, time.Time{}
+	deliveryHealth.mu.Unlock()
+	t.Cleanup(func() {
+		deliveryHealth.mu.Lock()
+		deliveryHealth.failingSince, deliveryHealth.saturatedSince = failing, saturated
+		deliveryHealth.mu.Unlock()
+	})
+}
+
+func TestDeliveryDegraded(t *testing.T) {
+	tests := []struct {
+		name      string
+		after     int           // health_degraded_after
+		failing   time.Duration // how long deliveries have failed, 0 if not
+		saturated time.Duration // how long the queue has been saturated
+		want      bool
+	}{
+		{"healthy", 0, 0, 0, false},
+		{"failing briefly", 0, 30 * time.Second, 0, false},
+		{"failing past the default", 0, 90 * time.Second, 0, true},
+		{"failing past health_degraded_after", 10, 20 * time.Second, 0, true},
+		{"saturated briefly", 0, 0, 30 * time.Second, false},
+		{"saturated past the default", 0, 0, 90 * time.Second, true},
+		{"saturated past health_degraded_after", 10, 0, 20 * time.Second, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, withTestCreds(Config{HealthDegradedAfter: tt.after}))
+			resetDeliveryHealth(t)
+			now := time.Now()
+			deliveryHealth.mu.Lock()
+			if tt.failing > 0 {
+				deliveryHealth.failingSince = now.Add(-tt.failing)
+			}
+			if tt.saturated > 0 {
+				deliveryHealth.saturatedSince = now.Add(-tt.saturated)
+			}
+			deliveryHealth.mu.Unlock()
+			if got := deliveryDegraded(now); got != tt.want {
+				t.Errorf("deliveryDegraded() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeliveryHealthFollowsCollector(t *testing.T) {
+	tests := []struct {
+		status      int
+		wantFailing bool
+	}{
+		{http.StatusNoContent, false},
+		{http.StatusBadRequest, false},
+		{http.StatusTooManyRequests, true},
+		{http.StatusServiceUnavailable, true},
+	}
+	for _, tt := range tests {
+		t.Run(http.StatusText(tt.status), func(t *testing.T) {
+			f := newFakeCollector(t, Config{MaxRetries: -1})
+			f.status = tt.status
+			resetDeliveryHealth(t)
+			sendToGA(context.Background(), "ua", "", "1.1", Credentials{MeasurementID: "G-TEST", APISecret: "secret"},
+				GA4Payload{ClientID: "1.1", Events: []GA4Event{{Name: "page_view"}}})
+			deliveryHealth.mu.Lock()
+			failing := !deliveryHealth.failingSince.IsZero()
+			deliveryHealth.mu.Unlock()
+			if failing != tt.wantFailing {
+				t.Errorf("delivery failing = %v after a %d, want %v", failing, tt.status, tt.wantFailing)
+			}
+		})
+	}
+}
+
+func TestQueueSaturation(t *testing.T) {
+	tests := []struct {
+		depth, capacity int
+		want            bool
+	}{
+		{0, 10, false},
+		{8, 10, false},
+		{9, 10, true},
+		{10, 10, true},
+		{0, 0, false},
+	}
+	for _, tt := range tests {
+		resetDeliveryHealth(t)
+		recordQueueDepth(tt.depth, tt.capacity)
+		deliveryHealth.mu.Lock()
+		saturated := !deliveryHealth.saturatedSince.IsZero()
+		deliveryHealth.mu.Unlock()
+		if saturated != tt.want {
+			t.Errorf("%d of %d queued: saturated = %v, want %v", tt.depth, tt.capacity, saturated, tt.want)
+		}
+	}
+}
+
+func TestHealthEndpointsWhileDegraded(t *testing.T) {
+	tests := []struct {
+		name       string
+		config     Config
+		path       string
+		wantStatus int
+		wantBody   string
+	}{
+		{"healthz with health_require_delivery", withTestCreds(Config{HealthRequireDelivery: true}), "/healthz", http.StatusServiceUnavailable, "delivery degraded"},
+		{"healthz without", withTestCreds(Config{}), "/healthz", http.StatusOK, "ok"},
+		{"livez", withTestCreds(Config{HealthRequireDelivery: true}), "/livez", http.StatusOK, "ok"},
+		{"livez unconfigured", Config{}, "/livez", http.StatusOK, "ok"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, tt.config)
+			resetDeliveryHealth(t)
+			deliveryHealth.mu.Lock()
+			deliveryHealth.failingSince = time.Now().Add(-2 * defaultHealthDegradedAfter)
+			deliveryHealth.mu.Unlock()
+
+			w := httptest.NewRecorder()
+			newMux(&server{sender: &recordingSender{}}).ServeHTTP(w, httptest.NewRequest("GET", tt.path, nil))
+			if w.Code != tt.wantStatus || w.Body.String() != tt.wantBody {
+				t.Errorf("%s = %d %q, want %d %q", tt.path, w.Code, w.Body.String(), tt.wantStatus, tt.wantBody)
+			}
+		})
+	}
+}
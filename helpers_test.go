@@ -0,0 +1,145 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// useConfig runs c, as applyConfig would at startup, for the rest of the
+// test, and restores the config before it afterwards.
+func useConfig(t *testing.T, c Config) {
+	t.Helper()
+	old := *config()
+	if err := applyConfig(c); err != nil {
+		t.Fatalf("applyConfig: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := applyConfig(old); err != nil {
+			t.Errorf("restoring config: %v", err)
+		}
+	})
+}
+
+// sentHit is a hit a recordingSender received.
+type sentHit struct {
+	Meta    HitMeta
+	Payload GA4Payload
+}
+
+// recordingSender is a Sender that keeps what it is sent, failing with err
+// if set.
+type recordingSender struct {
+	mu   sync.Mutex
+	hits []sentHit
+	err  error
+}
+
+func (s *recordingSender) Send(ctx context.Context, meta HitMeta, payload GA4Payload) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hits = append(s.hits, sentHit{meta, payload})
+	return s.err
+}
+
+func (s *recordingSender) sent() []sentHit {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]sentHit(nil), s.hits...)
+}
+
+// payloadFor builds the payload a hit request r from ip would send, for a
+// returning client in an ongoing session.
+func payloadFor(t *testing.T, r *http.Request, ip string) GA4Payload {
+	t.Helper()
+	params, query, err := hitParams(r, r.URL.Path)
+	if err != nil {
+		t.Fatalf("hitParams: %v", err)
+	}
+	session := sessionInfo{ID: "1700000000", Number: 1}
+	payload, err := buildPayload(context.Background(), params, query, r.Header, r.Header.Get("User-Agent"), ip, "test-cid", session, false, time.Now())
+	if err != nil {
+		t.Fatalf("buildPayload: %v", err)
+	}
+	return payload
+}
+
+// hitEventParams returns the params of the event a pixel hit on
+// /acct/page from ip would send.
+func hitEventParams(t *testing.T, ip string) map[string]interface{} {
+	t.Helper()
+	payload := payloadFor(t, httptest.NewRequest("GET", "/acct/page?pixel", nil), ip)
+	if len(payload.Events) != 1 {
+		t.Fatalf("got %d events, want 1", len(payload.Events))
+	}
+	return payload.Events[0].Params
+}
+
+// serveHit sends a request for target to s's handler as the client with
+// cid in its cookie, or as a new client if cid is empty.
+func serveHit(t *testing.T, s *server, target, cid string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest("GET", target, nil)
+	if cid != "" {
+		r.AddCookie(&http.Cookie{Name: cidCookieName(), Value: cid})
+	}
+	w := httptest.NewRecorder()
+	s.handler(w, r)
+	return w
+}
+
+// withTestCreds returns c with a measurement id and API secret, so hits
+// under it are sent.
+func withTestCreds(c Config) Config {
+	c.MeasurementID, c.APISecret = "G-TEST", "secret"
+	return c
+}
+
+// fakeCollector is a GA4 collector that records the payloads posted to it
+// and answers with status (204 if unset).
+type fakeCollector struct {
+	*httptest.Server
+	mu       sync.Mutex
+	payloads []GA4Payload
+	requests []*http.Request
+	status   int
+}
+
+// newFakeCollector starts a fakeCollector and points collector_url at it
+// for the rest of the test, on top of c.
+func newFakeCollector(t *testing.T, c Config) *fakeCollector {
+	t.Helper()
+	f := &fakeCollector{}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var p GA4Payload
+		json.NewDecoder(r.Body).Decode(&p)
+		f.mu.Lock()
+		f.payloads = append(f.payloads, p)
+		f.requests = append(f.requests, r)
+		status := f.status
+		f.mu.Unlock()
+		w.WriteHeader(cmp.Or(status, http.StatusNoContent))
+	}))
+	t.Cleanup(f.Close)
+	c.CollectorURL = f.URL + "/mp/collect"
+	useConfig(t, withTestCreds(c))
+	return f
+}
+
+func (f *fakeCollector) posted() []GA4Payload {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]GA4Payload(nil), f.payloads...)
+}
+
+// fixedCountStore counts every account at n and ignores new hits, so a
+// badge renders the same on every request.
+type fixedCountStore struct{ n int64 }
+
+func (s fixedCountStore) Incr(string) (int64, error) { return s.n, nil }
+func (s fixedCountStore) Get(string) (int64, error)  { return s.n, nil }
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// listenAddr is the address the beacon serves on: listen_addr, or else
+// the port on all interfaces.
+func listenAddr() string {
+	if config().ListenAddr != "" {
+		return config().ListenAddr
+	}
+	port := config().Port
+	if port == "" {
+		port = defaultPort
+	}
+	return ":" + port
+}
+
+// requestTimeout is how long a connection gets to send each request and
+// read its response, or 0 for no limit.
+func requestTimeout() time.Duration {
+	switch n := config().RequestTimeoutSeconds; {
+	case n < 0:
+		return 0
+	case n > 0:
+		return time.Duration(n) * time.Second
+	}
+	return defaultRequestTimeout
+}
+
+// validListenAddr checks that addr is a host:port with an IP address or
+// host name, or nothing for all interfaces, and a port number.
+func validListenAddr(addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return fmt.Errorf("invalid port %q", port)
+	}
+	if host != "" && net.ParseIP(host) == nil && !hostNamePattern.MatchString(host) {
+		return fmt.Errorf("invalid host %q", host)
+	}
+	return nil
+}
+
+var hostNamePattern = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9.-]*[A-Za-z0-9])?$`)
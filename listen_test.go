@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestListenAddrPrecedence(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		env  string // PORT
+		args []string
+		want string
+	}{
+		{"default", ``, "", nil, ":8080"},
+		{"port", `"port": "9000"`, "", nil, ":9000"},
+		{"listen_addr beats port", `"port": "9000", "listen_addr": "127.0.0.1:9001"`, "", nil, "127.0.0.1:9001"},
+		{"listen_addr beats PORT", `"listen_addr": "127.0.0.1:9001"`, "9002", nil, "127.0.0.1:9001"},
+		{"listen_addr beats -port", `"listen_addr": "127.0.0.1:9001"`, "", []string{"-port", "9003"}, "127.0.0.1:9001"},
+		{"-addr beats listen_addr", `"listen_addr": "127.0.0.1:9001"`, "9002", []string{"-addr", "[::1]:9004"}, "[::1]:9004"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.json")
+			body := `{"measurement_id": "G-TEST", "api_secret": "s"`
+			if tt.file != "" {
+				body += ", " + tt.file
+			}
+			if err := os.WriteFile(path, []byte(body+"}"), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			t.Setenv("PORT", tt.env)
+			t.Setenv("GA_MEASUREMENT_ID", "")
+			t.Setenv("GA_API_SECRET", "")
+			old := flags
+			t.Cleanup(func() { flags = old })
+			flags = cliFlags{}
+			if err := parseFlags(append([]string{"-config", path}, tt.args...)); err != nil {
+				t.Fatal(err)
+			}
+			cfg, err := loadConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+			useConfig(t, cfg)
+			if got := listenAddr(); got != tt.want {
+				t.Errorf("listenAddr() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidListenAddr(t *testing.T) {
+	tests := []struct {
+		addr    string
+		wantErr bool
+	}{
+		{":8080", false},
+		{"127.0.0.1:8080", false},
+		{"[::1]:8080", false},
+		{"beacon.internal:0", false},
+		{"127.0.0.1", true},
+		{"127.0.0.1:http", true},
+		{"127.0.0.1:70000", true},
+		{"bad_host:8080", true},
+		{"::1:8080", true},
+	}
+	for _, tt := range tests {
+		if err := validListenAddr(tt.addr); (err != nil) != tt.wantErr {
+			t.Errorf("validListenAddr(%q) = %v, want error: %v", tt.addr, err, tt.wantErr)
+		}
+	}
+}
+
+func TestRunBindsListenAddr(t *testing.T) {
+	// Find the port run picked from its "listening" log line. setupLogging
+	// writes to os.Stderr as it is when the config is applied.
+	stderr, err := os.CreateTemp(t.TempDir(), "stderr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stderr.Close()
+	saved := os.Stderr
+	os.Stderr = stderr
+	t.Cleanup(func() { os.Stderr = saved })
+
+	newFakeCollector(t, Config{ListenAddr: "127.0.0.1:0"})
+	savedCounts := hitCounts
+	t.Cleanup(func() { hitCounts = savedCounts })
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- run(ctx, *config()) }()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("run() = %v", err)
+		}
+	})
+
+	listening := regexp.MustCompile(`msg=listening addr=127\.0\.0\.1:(\d+)`)
+	var port string
+	for deadline := time.Now().Add(2 * time.Second); port == ""; time.Sleep(10 * time.Millisecond) {
+		out, _ := os.ReadFile(stderr.Name())
+		if m := listening.FindSubmatch(out); m != nil {
+			port = string(m[1])
+		} else if time.Now().After(deadline) {
+			t.Fatalf("no listening address logged:\n%s", out)
+		}
+	}
+
+	resp, err := http.Get("http://" + net.JoinHostPort("127.0.0.1", port) + "/healthz")
+	if err != nil {
+		t.Fatalf("request on listen_addr: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("/healthz on listen_addr: %d, want 200", resp.StatusCode)
+	}
+	// 127.0.0.2 is loopback too, but not the interface bound.
+	if conn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.2", port), time.Second); err == nil {
+		conn.Close()
+		t.Error("connection on another interface accepted")
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	tests := []struct {
+		seconds int
+		want    time.Duration
+		wantErr bool
+	}{
+		{0, defaultRequestTimeout, false},
+		{-1, 0, false},
+		{3, 3 * time.Second, false},
+		{-2, 0, true},
+	}
+	for _, tt := range tests {
+		c := withTestCreds(Config{RequestTimeoutSeconds: tt.seconds})
+		if err := c.validate(); (err != nil) != tt.wantErr {
+			t.Errorf("request_timeout_seconds %d: validate() = %v, want error: %v", tt.seconds, err, tt.wantErr)
+		}
+		if tt.wantErr {
+			continue
+		}
+		useConfig(t, c)
+		if got := requestTimeout(); got != tt.want {
+			t.Errorf("request_timeout_seconds %d: requestTimeout() = %v, want %v", tt.seconds, got, tt.want)
+		}
+	}
+}
+
+func TestRunRequestTimeout(t *testing.T) {
+	// GA takes far longer than the request timeout to answer.
+	release := make(chan struct{})
+	slowGA := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-time.After(5 * time.Second):
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(slowGA.Close)
+	t.Cleanup(func() { close(release) })
+
+	addr := freeAddr(t)
+	useConfig(t, withTestCreds(Config{
+		ListenAddr:            addr,
+		CollectorURL:          slowGA.URL + "/mp/collect",
+		RequestTimeoutSeconds: 1,
+		DrainTimeoutSeconds:   1,
+	}))
+	savedCounts := hitCounts
+	t.Cleanup(func() { hitCounts = savedCounts })
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- run(ctx, *config()) }()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("run() = %v", err)
+		}
+	})
+	waitForListener(t, addr)
+
+	t.Run("pixel answered before GA", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "http://"+addr+"/acct/slow-ga?pixel", nil)
+		req.Header.Set("User-Agent", "Mozilla/5.0")
+		start := time.Now()
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+			t.Errorf("pixel took %v with GA stalled", elapsed)
+		}
+		if err != nil || resp.StatusCode != http.StatusOK || !bytes.Equal(body, pixel) {
+			t.Errorf("pixel: %d %q (%v), want 200 with the GIF", resp.StatusCode, body, err)
+		}
+	})
+
+	t.Run("stalled client cut off", func(t *testing.T) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		// Never finish the request headers.
+		if _, err := conn.Write([]byte("GET /healthz HTTP/1.1\r\nHost: x\r\n")); err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		start := time.Now()
+		io.Copy(io.Discard, conn)
+		if elapsed := time.Since(start); elapsed > 3*time.Second {
+			t.Errorf("stalled connection held open for %v, want about 1s", elapsed)
+		}
+	})
+}
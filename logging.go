@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+)
+
+const redactedValue = "***"
+
+// setupLogging installs the default logger: text lines unless log_format
+// is "json", and with debug messages when debug is on.
+func setupLogging() error {
+	opts := &slog.HandlerOptions{Level: slog.LevelInfo}
+	if debugEnabled() {
+		opts.Level = slog.LevelDebug
+	}
+	switch config().LogFormat {
+	case "", "text":
+		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, opts)))
+	case "json":
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, opts)))
+	default:
+		return fmt.Errorf("unknown log_format %q", config().LogFormat)
+	}
+	return nil
+}
+
+type requestIDKey struct{}
+
+// newRequestID returns a random id tying together the log lines of one
+// request.
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Request ids accepted from an X-Request-ID header, as set by proxies and
+// load balancers.
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// incomingRequestID returns r's X-Request-ID when it is a plausible id, so
+// logs line up with the proxy's, or else a new one.
+func incomingRequestID(r *http.Request) string {
+	if id := r.Header.Get("X-Request-ID"); requestIDPattern.MatchString(id) {
+		return id
+	}
+	return newRequestID()
+}
+
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// logger returns the default logger, with the request id carried by ctx
+// attached when there is one.
+func logger(ctx context.Context) *slog.Logger {
+	if id := requestID(ctx); id != "" {
+		return slog.Default().With("request_id", id)
+	}
+	return slog.Default()
+}
+
+// isRedactedParam reports whether the event param name carries a value
+// listed in log_redact_params, either directly or as the custom_ param a
+// query param of that name becomes, with or without a GA-style ep. or
+// epn. prefix.
+func isRedactedParam(name string) bool {
+	for _, r := range config().LogRedactParams {
+		if name == r || name == customParamName(r) || name == customParamName("ep."+r) || name == customParamName("epn."+r) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactPayload returns a copy of payload with redacted param values
+// masked. The original is left untouched since it is still to be sent.
+func redactPayload(payload GA4Payload) GA4Payload {
+	if len(config().LogRedactParams) == 0 {
+		return payload
+	}
+
+	events := make([]GA4Event, len(payload.Events))
+	for i, event := range payload.Events {
+		params := make(map[string]interface{}, len(event.Params))
+		for k, v := range event.Params {
+			if isRedactedParam(k) {
+				v = redactedValue
+			}
+			params[k] = v
+		}
+		events[i] = GA4Event{Name: event.Name, Params: params}
+	}
+	payload.Events = events
+	return payload
+}
+
+// payloadForLog renders payload as JSON with redacted params masked.
+func payloadForLog(payload GA4Payload) string {
+	b, err := json.Marshal(redactPayload(payload))
+	if err != nil {
+		return err.Error()
+	}
+	return string(b)
+}
+
+// streamPayload returns a copy of payload fit to show to /debug/stream
+// clients: redacted like payloadForLog, with ip_address shown as logIP
+// shows it and, unless debug is on, the user id, client and app instance
+// ids and user agent masked.
+func streamPayload(payload GA4Payload) GA4Payload {
+	payload = redactPayload(payload)
+	debug := debugEnabled()
+	if !debug {
+		for _, id := range []*string{&payload.ClientID, &payload.AppInstanceID, &payload.UserID} {
+			if *id != "" {
+				*id = redactedValue
+			}
+		}
+	}
+	events := make([]GA4Event, len(payload.Events))
+	for i, event := range payload.Events {
+		params := make(map[string]interface{}, len(event.Params))
+		for k, v := range event.Params {
+			switch ip, isString := v.(string); {
+			case k == "ip_address" && isString:
+				v = logIP(ip)
+			case k == "user_agent" && !debug:
+				v = redactedValue
+			}
+			params[k] = v
+		}
+		events[i] = GA4Event{Name: event.Name, Params: params}
+	}
+	payload.Events = events
+	return payload
+}
+
+// debugEnabled reports whether verbose, potentially sensitive logging such
+// as full payloads is on, via the debug setting or a DEBUG env var.
+func debugEnabled() bool {
+	return config().Debug || os.Getenv("DEBUG") != ""
+}
+
+// logIP anonymizes ip for logs, unless debug mode is on and anonymize_ip
+// is off.
+func logIP(ip string) string {
+	if debugEnabled() && !anonymizeIPEnabled() {
+		return ip
+	}
+	if addr := anonymizeIP(ip); addr != "" {
+		return addr
+	}
+	return "-"
+}
+
+// redactURLError masks the api_secret in the URL that the HTTP client
+// includes in its errors, so they can be logged and returned safely.
+func redactURLError(err error) error {
+	var uerr *url.Error
+	if !errors.As(err, &uerr) {
+		return err
+	}
+	u, perr := url.Parse(uerr.URL)
+	if perr != nil {
+		return &url.Error{Op: uerr.Op, URL: "<unparseable>", Err: uerr.Err}
+	}
+	q := u.Query()
+	if q.Has("api_secret") {
+		q.Set("api_secret", redactedValue)
+		u.RawQuery = q.Encode()
+	}
+	return &url.Error{Op: uerr.Op, URL: u.String(), Err: uerr.Err}
+}
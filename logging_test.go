@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// captureLogs sends everything logged, debug messages included, to the
+// returned buffer for the rest of the test.
+func captureLogs(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	old := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	t.Cleanup(func() { slog.SetDefault(old) })
+	return &buf
+}
+
+func TestLogFormat(t *testing.T) {
+	tests := []struct {
+		format string
+		check  func(t *testing.T, out string)
+	}{
+		{"json", func(t *testing.T, out string) {
+			for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+				var entry map[string]interface{}
+				if err := json.Unmarshal([]byte(line), &entry); err != nil {
+					t.Fatalf("not a JSON line: %s", line)
+				}
+				if entry["msg"] != "GA collector responded" {
+					continue
+				}
+				if entry["level"] != "INFO" || entry["request_id"] != "req-123" || entry["cid"] != "1111.2222" {
+					t.Errorf("level, request_id and cid missing or wrong: %s", line)
+				}
+				return
+			}
+			t.Errorf("no delivery logged:\n%s", out)
+		}},
+		{"text", func(t *testing.T, out string) {
+			for _, want := range []string{"level=INFO", `msg="GA collector responded"`, "request_id=req-123", "cid=1111.2222"} {
+				if !strings.Contains(out, want) {
+					t.Errorf("%s missing from logs:\n%s", want, out)
+				}
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			// setupLogging writes to os.Stderr as it is when the config
+			// is applied.
+			f, err := os.CreateTemp(t.TempDir(), "stderr")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			stderr := os.Stderr
+			os.Stderr = f
+			newFakeCollector(t, Config{LogFormat: tt.format})
+			os.Stderr = stderr
+
+			r := httptest.NewRequest("GET", "/acct/page?pixel", nil)
+			r.Header.Set("X-Request-ID", "req-123")
+			r.AddCookie(&http.Cookie{Name: cidCookieName(), Value: "1111.2222"})
+			(&server{sender: gaSender{}}).handler(httptest.NewRecorder(), r)
+
+			out, err := os.ReadFile(f.Name())
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.check(t, string(out))
+		})
+	}
+}
+
+func TestRedactedParamsNeverLogged(t *testing.T) {
+	const secret = "s3cr3t-token-value"
+	target := "/acct/page?pixel&token=" + secret + "&ep.token=" + secret + "&keep=visible"
+
+	tests := []struct {
+		name   string
+		config Config
+		run    func(t *testing.T) string // returns output other than logs
+	}{
+		{"delivered", Config{Debug: true}, func(t *testing.T) string {
+			serveHit(t, &server{sender: gaSender{}}, target, "cid-1")
+			return ""
+		}},
+		{"dry run", Config{Debug: true, DryRun: true}, func(t *testing.T) string {
+			serveHit(t, &server{sender: gaSender{}}, target, "cid-2")
+			return ""
+		}},
+		{"debug echo", Config{Debug: true}, func(t *testing.T) string {
+			w := httptest.NewRecorder()
+			debugEchoHandler(w, httptest.NewRequest("GET", "/debug"+target, nil))
+			return w.Body.String()
+		}},
+		{"debug stream", Config{Debug: true}, func(t *testing.T) string {
+			client := &debugStreamClient{events: make(chan debugStreamEvent, 1)}
+			debugStream.mu.Lock()
+			if debugStream.clients == nil {
+				debugStream.clients = make(map[*debugStreamClient]bool)
+			}
+			debugStream.clients[client] = true
+			debugStream.mu.Unlock()
+			defer func() {
+				debugStream.mu.Lock()
+				delete(debugStream.clients, client)
+				debugStream.mu.Unlock()
+			}()
+
+			serveHit(t, &server{sender: &recordingSender{}}, target, "cid-3")
+			select {
+			case ev := <-client.events:
+				return payloadForLog(ev.Payload)
+			case <-time.After(time.Second):
+				t.Fatal("no event on the debug stream")
+				return ""
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.config.LogRedactParams = []string{"token"}
+			collector := newFakeCollector(t, tt.config)
+			logs := captureLogs(t)
+
+			out := tt.run(t)
+			all := logs.String() + out
+			if strings.Contains(all, secret) {
+				t.Errorf("redacted value appears in output:\n%s", all)
+			}
+			if out != "" && !strings.Contains(out, "visible") {
+				t.Errorf("other params missing from output:\n%s", out)
+			}
+			if tt.name == "delivered" {
+				posted := collector.posted()
+				if len(posted) != 1 || posted[0].Events[len(posted[0].Events)-1].Params["custom_token"] != secret {
+					t.Errorf("GA was not sent the real value: %+v", posted)
+				}
+				if !strings.Contains(logs.String(), redactedValue) {
+					t.Errorf("logged payload doesn't show the mask:\n%s", logs)
+				}
+			}
+		})
+	}
+}
+
+func TestRedactPayloadLeavesOriginal(t *testing.T) {
+	useConfig(t, Config{LogRedactParams: []string{"token"}})
+	payload := GA4Payload{Events: []GA4Event{{Name: "page_view", Params: map[string]interface{}{
+		"token": "a", "custom_token": "b", "custom_ep_token": "c", "custom_epn_token": "d", "tokens": "e",
+	}}}}
+	redacted := redactPayload(payload)
+
+	tests := []struct {
+		param string
+		want  interface{}
+	}{
+		{"token", redactedValue},
+		{"custom_token", redactedValue},
+		{"custom_ep_token", redactedValue},
+		{"custom_epn_token", redactedValue},
+		{"tokens", "e"},
+	}
+	for _, tt := range tests {
+		if got := redacted.Events[0].Params[tt.param]; got != tt.want {
+			t.Errorf("redacted %s = %v, want %v", tt.param, got, tt.want)
+		}
+	}
+	if payload.Events[0].Params["token"] != "a" {
+		t.Error("redactPayload changed the payload to be sent")
+	}
+}
+
+func TestAPISecretNeverLogged(t *testing.T) {
+	const secret = "k9-api-secret-value"
+	target := "/acct/page?pixel&marker=payload-marker"
+	fullIP := regexp.MustCompile(`ip=192\.0\.2\.1\b`)
+
+	tests := []struct {
+		name        string
+		debug       bool
+		debugEnv    string
+		status      int  // collector's answer
+		unreachable bool // collector is down
+		wantPayload bool // payload and, with anonymize_ip off, full IP logged
+	}{
+		{"delivered", false, "", http.StatusNoContent, false, false},
+		{"rejected", false, "", http.StatusBadRequest, false, false},
+		{"unreachable", false, "", 0, true, false},
+		{"debug setting", true, "", http.StatusNoContent, false, true},
+		{"DEBUG env var", false, "1", http.StatusNoContent, false, true},
+		{"unreachable in debug", true, "", 0, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("DEBUG", tt.debugEnv)
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+			}))
+			defer srv.Close()
+			if tt.unreachable {
+				srv.Close()
+			}
+			anonymize := false
+			useConfig(t, Config{MeasurementID: "G-TEST", APISecret: secret, CollectorURL: srv.URL + "/mp/collect", Debug: tt.debug, MaxRetries: -1, AnonymizeIP: &anonymize})
+			logs := captureLogs(t)
+
+			serveHit(t, &server{sender: gaSender{}}, target, "cid-1")
+			out := logs.String()
+			if strings.Contains(out, secret) {
+				t.Errorf("api_secret appears in logs:\n%s", out)
+			}
+			if !tt.unreachable && !strings.Contains(out, "measurement_id=G-TEST") {
+				t.Errorf("measurement_id missing from logs:\n%s", out)
+			}
+			if got := strings.Contains(out, "payload-marker"); got != tt.wantPayload {
+				t.Errorf("payload logged: %v, want %v:\n%s", got, tt.wantPayload, out)
+			}
+			if got := fullIP.MatchString(out); got != tt.wantPayload {
+				t.Errorf("full IP logged: %v, want %v:\n%s", got, tt.wantPayload, out)
+			}
+		})
+	}
+}
+
+func TestRequestIDReachesLogsAndGA(t *testing.T) {
+	logged := regexp.MustCompile(`msg="GA collector responded".* request_id=(\S+)`)
+	tests := []struct {
+		name   string
+		header string // X-Request-ID
+		want   string // "" for a generated id
+	}{
+		{"from X-Request-ID", "lb-7f3a:42", "lb-7f3a:42"},
+		{"generated", "", ""},
+		{"malformed X-Request-ID", "id with spaces", ""},
+		{"overlong X-Request-ID", strings.Repeat("a", 129), ""},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeCollector(t, Config{})
+			logs := captureLogs(t)
+			r := httptest.NewRequest("GET", fmt.Sprintf("/acct/request-id-%d?pixel", i), nil)
+			if tt.header != "" {
+				r.Header.Set("X-Request-ID", tt.header)
+			}
+			(&server{sender: gaSender{}}).handler(httptest.NewRecorder(), r)
+
+			m := logged.FindStringSubmatch(logs.String())
+			if m == nil {
+				t.Fatalf("no delivery logged with a request_id:\n%s", logs)
+			}
+			id := m[1]
+			if tt.want != "" && id != tt.want {
+				t.Errorf("logged request_id = %s, want %s", id, tt.want)
+			}
+			if tt.want == "" && (id == tt.header || !requestIDPattern.MatchString(id)) {
+				t.Errorf("logged request_id = %q, want a new id", id)
+			}
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			if len(f.requests) != 1 {
+				t.Fatalf("collector got %d requests, want 1", len(f.requests))
+			}
+			if got := f.requests[0].Header.Get("X-Request-ID"); got != id {
+				t.Errorf("GA request X-Request-ID = %q, want the logged %q", got, id)
+			}
+		})
+	}
+}
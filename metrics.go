@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// metric is a counter or gauge rendered in the Prometheus text format on
+// /metrics. Label sets are passed as alternating name/value pairs.
+type metric struct {
+	name string
+	help string
+	kind string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+// collector is anything rendered on /metrics.
+type collector interface {
+	write(w *strings.Builder)
+}
+
+var (
+	metricsMu sync.Mutex
+	registry  []collector
+)
+
+func newMetric(kind, name, help string) *metric {
+	m := &metric{name: name, help: help, kind: kind, values: make(map[string]float64)}
+	metricsMu.Lock()
+	registry = append(registry, m)
+	metricsMu.Unlock()
+	return m
+}
+
+func newCounter(name, help string) *metric { return newMetric("counter", name, help) }
+
+func newGauge(name, help string) *metric { return newMetric("gauge", name, help) }
+
+// Inc adds one to the series identified by labels.
+func (m *metric) Inc(labels ...string) { m.Add(1, labels...) }
+
+// Add adds v to the series identified by labels.
+func (m *metric) Add(v float64, labels ...string) {
+	key := labelString(labels)
+	m.mu.Lock()
+	m.values[key] += v
+	m.mu.Unlock()
+}
+
+// Set replaces the value of the series identified by labels.
+func (m *metric) Set(v float64, labels ...string) {
+	key := labelString(labels)
+	m.mu.Lock()
+	m.values[key] = v
+	m.mu.Unlock()
+}
+
+// Value returns the current value of the series identified by labels.
+func (m *metric) Value(labels ...string) float64 {
+	key := labelString(labels)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.values[key]
+}
+
+func labelString(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		v := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(labels[i+1])
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, labels[i], v))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (m *metric) write(w *strings.Builder) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+	if len(m.values) == 0 {
+		fmt.Fprintf(w, "%s 0\n", m.name)
+		return
+	}
+	keys := make([]string, 0, len(m.values))
+	for k := range m.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s%s %v\n", m.name, k, m.values[k])
+	}
+}
+
+// histogram counts observations into cumulative buckets, rendered as a
+// Prometheus histogram without labels.
+type histogram struct {
+	name    string
+	help    string
+	buckets []float64 // upper bounds, ascending
+
+	mu     sync.Mutex
+	counts []uint64 // per bucket, plus one for +Inf
+	sum    float64
+}
+
+func newHistogram(name, help string, buckets []float64) *histogram {
+	h := &histogram{name: name, help: help, buckets: buckets, counts: make([]uint64, len(buckets)+1)}
+	metricsMu.Lock()
+	registry = append(registry, h)
+	metricsMu.Unlock()
+	return h
+}
+
+// Observe records v in the first bucket it fits under.
+func (h *histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.buckets, v)
+	h.mu.Lock()
+	h.counts[i]++
+	h.sum += v
+	h.mu.Unlock()
+}
+
+func (h *histogram) write(w *strings.Builder) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	var total uint64
+	for i, le := range h.buckets {
+		total += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=\"%v\"} %d\n", h.name, le, total)
+	}
+	total += h.counts[len(h.buckets)]
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, total)
+	fmt.Fprintf(w, "%s_sum %v\n%s_count %d\n", h.name, h.sum, h.name, total)
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	var b strings.Builder
+	metricsMu.Lock()
+	for _, m := range registry {
+		m.write(&b)
+	}
+	metricsMu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write([]byte(b.String()))
+}
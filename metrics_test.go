@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bufio"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// scrapeMetrics fetches /metrics and returns its samples by series, such
+// as `beacon_hits_total{account="a",type="pixel"}`.
+func scrapeMetrics(t *testing.T) map[string]float64 {
+	t.Helper()
+	w := httptest.NewRecorder()
+	metricsHandler(w, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+	samples := make(map[string]float64)
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndexByte(line, ' ')
+		v, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			t.Fatalf("bad sample %q: %v", line, err)
+		}
+		samples[line[:i]] = v
+	}
+	return samples
+}
+
+func TestMetricsCountHits(t *testing.T) {
+	useConfig(t, Config{
+		MeasurementID: "G-TEST",
+		APISecret:     "secret",
+		Accounts:      map[string]Credentials{"known": {MeasurementID: "G-KNOWN", APISecret: "s"}},
+	})
+	s := &server{sender: &recordingSender{}}
+
+	before := scrapeMetrics(t)
+	for _, path := range []string{"/known/a?pixel", "/known/b?pixel", "/known/c", "/made-up-1/a?pixel", "/made-up-2/a?pixel"} {
+		s.handler(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+	after := scrapeMetrics(t)
+
+	for series, want := range map[string]float64{
+		`beacon_hits_total{account="known",type="pixel"}`: 2,
+		`beacon_hits_total{account="known",type="svg"}`:   1,
+		`beacon_hits_total{account="other",type="pixel"}`: 2,
+	} {
+		if got := after[series] - before[series]; got != want {
+			t.Errorf("%s went up by %v, want %v", series, got, want)
+		}
+	}
+	for series := range after {
+		if strings.Contains(series, "made-up") {
+			t.Errorf("unknown account got its own series %s", series)
+		}
+	}
+}
+
+func TestMetricAccount(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  Config
+		account string
+		want    string
+	}{
+		{"unconfigured", Config{}, "anything", "other"},
+		{"per-account credentials", Config{Accounts: map[string]Credentials{"a": {}}}, "a", "a"},
+		{"account metadata", Config{AccountMetadata: map[string]map[string]interface{}{"a": nil}}, "a", "a"},
+		{"allowed by pattern", Config{AllowedAccounts: []string{"proj-*"}}, "proj-x", "proj-x"},
+		{"not allowed", Config{AllowedAccounts: []string{"proj-*"}}, "other-x", "other"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.config.MeasurementID, tt.config.APISecret = "G-TEST", "secret"
+			for a := range tt.config.Accounts {
+				tt.config.Accounts[a] = Credentials{MeasurementID: "G-A", APISecret: "s"}
+			}
+			useConfig(t, tt.config)
+			if got := metricAccount(tt.account); got != tt.want {
+				t.Errorf("metricAccount(%q) = %q, want %q", tt.account, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	tests := []struct {
+		name    string
+		observe []float64
+		want    []string
+	}{
+		{"empty", nil, []string{
+			`h_bucket{le="0.1"} 0`, `h_bucket{le="1"} 0`, `h_bucket{le="+Inf"} 0`, "h_sum 0", "h_count 0",
+		}},
+		{"cumulative buckets", []float64{0.05, 0.1, 0.5, 3}, []string{
+			`h_bucket{le="0.1"} 2`, `h_bucket{le="1"} 3`, `h_bucket{le="+Inf"} 4`, "h_sum 3.65", "h_count 4",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Built by hand, not newHistogram, to stay off /metrics.
+			buckets := []float64{0.1, 1}
+			h := &histogram{name: "h", help: "A test histogram.", buckets: buckets, counts: make([]uint64, len(buckets)+1)}
+			for _, v := range tt.observe {
+				h.Observe(v)
+			}
+			var w strings.Builder
+			h.write(&w)
+			got := strings.Split(strings.TrimSpace(w.String()), "\n")
+			want := append([]string{"# HELP h A test histogram.", "# TYPE h histogram"}, tt.want...)
+			if strings.Join(got, "\n") != strings.Join(want, "\n") {
+				t.Errorf("rendered\n%s\nwant\n%s", w.String(), strings.Join(want, "\n"))
+			}
+		})
+	}
+}
@@ -0,0 +1,475 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// GA4 truncates or rejects event param values longer than this, unless
+// max_param_value_length raises it (as GA4 360 allows).
+const maxParamValueLength = 100
+
+// GA4 takes this many params per event.
+const maxEventParams = 25
+
+// The beacon uses about half of GA4's params itself, so by default only
+// this many custom params are sent.
+const defaultMaxCustomParams = 10
+
+// GA4 rejects param names longer than this.
+const maxParamNameLength = 40
+
+var invalidParamNameChars = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+func paramValueLimit() int {
+	if config().MaxParamValueLength > 0 {
+		return config().MaxParamValueLength
+	}
+	return maxParamValueLength
+}
+
+func maxCustomParams() int {
+	switch n := config().MaxCustomParams; {
+	case n < 0:
+		return 0
+	case n > 0:
+		return n
+	}
+	return defaultMaxCustomParams
+}
+
+// The page params GA4 allows to be longer.
+const (
+	maxPageLocationLength = 1000
+	maxPageReferrerLength = 420
+	maxPageTitleLength    = 300
+)
+
+// Engagement time reported with a page view when ?et= doesn't give one.
+// GA4 counts a page view as engaged only when it has some.
+const defaultEngagementTimeMsec = 100
+
+// engagementTime returns the ?et= value in milliseconds if it is a positive
+// integer, and defaultEngagementTimeMsec otherwise.
+func engagementTime(query url.Values) int64 {
+	if v := query.Get("et"); v != "" {
+		if ms, err := strconv.ParseInt(v, 10, 64); err == nil && ms > 0 {
+			return ms
+		}
+	}
+	return defaultEngagementTimeMsec
+}
+
+// Event sent for a hit unless default_event_name or ?event= says otherwise.
+const defaultEventName = "page_view"
+
+// hitEventName returns the ?event= name if it is a valid GA4 event name,
+// or else default_event_name, or else page_view. With strict_names an
+// invalid ?event= is an error instead.
+func hitEventName(c context.Context, query url.Values) (string, error) {
+	if v := query.Get("event"); v != "" {
+		err := validateName("event", v)
+		if err == nil {
+			return v, nil
+		}
+		if config().StrictNames {
+			return "", err
+		}
+		logger(c).Warn("ignoring event param", "err", err)
+	}
+	if b := beaconFrom(c); b != nil && b.DefaultEventName != "" {
+		return b.DefaultEventName, nil
+	}
+	if config().DefaultEventName != "" {
+		return config().DefaultEventName, nil
+	}
+	return defaultEventName, nil
+}
+
+// sanitizeParamValue strips line breaks and truncates v to GA4's limit
+// without splitting a UTF-8 sequence.
+func sanitizeParamValue(v string) string {
+	return truncateParamValue(v, paramValueLimit())
+}
+
+// addCustomParams adds the query params the beacon doesn't interpret itself
+// as custom_ params, typed by customParam. Names are reduced to the
+// characters GA4 allows and string values are truncated like other params;
+// params left without a usable name are dropped first, and of the rest
+// only the first max_custom_params by name, and no more than fit under
+// maxEventParams, are kept. With strict_names, a name GA4 would reject is
+// an error instead of being repaired.
+func addCustomParams(c context.Context, params map[string]interface{}, query url.Values) error {
+	var keys []string
+	for key, values := range query {
+		if len(values) > 0 && !isReservedParam(c, key) && key != config().TimestampParam {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	type customValue struct {
+		key, name string
+		value     interface{}
+	}
+	var custom []customValue
+	for _, key := range keys {
+		name, value := customParam(key, query.Get(key))
+		if name == "" {
+			continue
+		}
+		if deniedParam(name) {
+			logger(c).Warn("dropping custom param named like a GA4 param", "param", key)
+			continue
+		}
+		if config().StrictNames {
+			if err := validateName("param", "custom_"+name); err != nil {
+				return err
+			}
+		}
+		name = customParamName(name)
+		if err := validateName("param", name); err != nil {
+			logger(c).Warn("dropping custom param", "err", err)
+			continue
+		}
+		custom = append(custom, customValue{key, name, value})
+	}
+
+	keysOf := func(vs []customValue) []string {
+		var keys []string
+		for _, v := range vs {
+			keys = append(keys, v.key)
+		}
+		return keys
+	}
+	if max := maxCustomParams(); len(custom) > max {
+		logger(c).Warn("dropping custom params over max_custom_params", "dropped", keysOf(custom[max:]), "max_custom_params", max)
+		custom = custom[:max]
+	}
+	if room := max(maxEventParams-len(params), 0); len(custom) > room {
+		logger(c).Warn("dropping custom params over GA4's limit", "dropped", keysOf(custom[room:]), "limit", maxEventParams)
+		custom = custom[:room]
+	}
+	for _, v := range custom {
+		value := v.value
+		if s, ok := value.(string); ok {
+			value = sanitizeParamValue(s)
+		}
+		params[v.name] = value
+	}
+	return nil
+}
+
+// defaultDeniedParams are the names of params GA4 collects or sets itself,
+// or reserves, which denied_params blocks unless it is set.
+var defaultDeniedParams = []string{
+	"ga_*", "google_*", "firebase_*", "gtm_*", "_*",
+	"session_id", "session_number", "session_engaged", "engagement_time_msec",
+	"page_location", "page_path", "page_referrer", "page_title",
+	"ip_address", "user_agent", "timestamp", "debug_mode",
+	"gclid", "dclid", "gbraid", "wbraid", "srsltid",
+}
+
+func deniedParamPatterns() []string {
+	if config().DeniedParams != nil {
+		return config().DeniedParams
+	}
+	return defaultDeniedParams
+}
+
+// deniedParam reports whether a custom query param named name matches
+// denied_params, taken with and without a custom_ prefix, so custom_ga_x
+// is blocked like ga_x. Names are matched in lower case.
+func deniedParam(name string) bool {
+	return paramMatches(deniedParamPatterns(), name)
+}
+
+// paramMatches reports whether name, with or without a custom_ prefix,
+// matches one of the glob patterns. Names are matched in lower case.
+func paramMatches(patterns []string, name string) bool {
+	name = strings.ToLower(name)
+	bare := strings.TrimPrefix(name, "custom_")
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+		if ok, _ := path.Match(pattern, bare); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// customParamName maps a query param name to a GA4 param name: custom_
+// followed by the name with anything but letters, digits and underscores
+// replaced by underscores, within maxParamNameLength.
+func customParamName(name string) string {
+	name = "custom_" + invalidParamNameChars.ReplaceAllString(name, "_")
+	if len(name) > maxParamNameLength {
+		name = name[:maxParamNameLength]
+	}
+	return name
+}
+
+// truncateParamValue strips line breaks and truncates v to max bytes
+// without splitting a UTF-8 sequence.
+func truncateParamValue(v string, max int) string {
+	v = strings.NewReplacer("\r", "", "\n", "").Replace(v)
+	if len(v) <= max {
+		return v
+	}
+	cut := max
+	for cut > 0 && !utf8.RuneStart(v[cut]) {
+		cut--
+	}
+	return v[:cut]
+}
+
+// pageLocation is the page_location of a hit that doesn't pass ?dl=: the
+// beacon URL for the account and page, without the query, with the host
+// lowercased and the path escaped.
+func pageLocation(r *http.Request, params []string) string {
+	scheme := "http"
+	if isHTTPS(r) {
+		scheme = "https"
+	}
+	path := beaconPrefix(r.Context()) + "/" + strings.Join(params, "/")
+	return (&url.URL{Scheme: scheme, Host: strings.ToLower(r.Host), Path: path}).String()
+}
+
+// pagePath is the page_path of a hit on page: every segment of it, however
+// deep, below the account, so /my-project/docs/guide/intro is
+// /docs/guide/intro.
+func pagePath(page string) string {
+	return sanitizeParamValue("/" + page)
+}
+
+// validPageLocation reports whether a ?dl= value is an absolute http(s)
+// URL.
+func validPageLocation(v string) bool {
+	u, err := url.Parse(v)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// cleanReferer cuts a Referer down to its scheme, host and path. The query,
+// fragment and any credentials are dropped, since they can carry tokens or
+// personal data. Anything but an http(s) URL comes back empty.
+func cleanReferer(ref string) string {
+	u, err := url.Parse(ref)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return ""
+	}
+	return u.Scheme + "://" + u.Host + u.EscapedPath()
+}
+
+// addPageParams sets GA4's page_path from the hit's page, and its
+// page_location, page_title and page_referrer from the ?dl=, ?dt= and
+// referer values in query.
+func addPageParams(params map[string]interface{}, page string, query url.Values) {
+	if page != "" {
+		params["page_path"] = pagePath(page)
+	}
+	if v := query.Get("dl"); validPageLocation(v) {
+		params["page_location"] = truncateParamValue(v, maxPageLocationLength)
+	}
+	if v := query.Get("dt"); v != "" {
+		params["page_title"] = truncateParamValue(v, maxPageTitleLength)
+	}
+	if v := query.Get("referer"); v != "" {
+		params["page_referrer"] = truncateParamValue(v, maxPageReferrerLength)
+	}
+}
+
+// addHeaderParams copies the request headers listed in header_params into
+// params, under their configured param names. Missing headers are skipped.
+func addHeaderParams(params map[string]interface{}, header http.Header) {
+	for name, param := range config().HeaderParams {
+		if v := header.Get(name); v != "" {
+			params[param] = sanitizeParamValue(v)
+		}
+	}
+}
+
+// Client Hints describing the visitor's network, requested via Accept-CH
+// when network_hints is enabled.
+const networkHintHeaders = "Save-Data, Downlink, ECT, RTT"
+
+var effectiveConnectionTypes = map[string]bool{"slow-2g": true, "2g": true, "3g": true, "4g": true}
+
+// addNetworkHints maps the network Client Hints a browser sent into params.
+// Hints that are absent or malformed are left out.
+func addNetworkHints(params map[string]interface{}, header http.Header) {
+	hint := func(name string) string {
+		if v := header.Get("Sec-CH-" + name); v != "" {
+			return strings.TrimSpace(v)
+		}
+		return strings.TrimSpace(header.Get(name))
+	}
+
+	if v := hint("Save-Data"); v != "" {
+		if strings.EqualFold(v, "on") {
+			params["save_data"] = 1
+		} else {
+			params["save_data"] = 0
+		}
+	}
+	if v, err := strconv.ParseFloat(hint("Downlink"), 64); err == nil && v >= 0 {
+		params["downlink"] = v
+	}
+	if v := strings.ToLower(strings.Trim(hint("ECT"), `"`)); effectiveConnectionTypes[v] {
+		params["effective_connection_type"] = v
+	}
+	if v, err := strconv.Atoi(hint("RTT")); err == nil && v >= 0 {
+		params["rtt"] = v
+	}
+}
+
+// boolParamValue converts a flag-like value for a param listed in
+// boolean_params to GA4's numeric 1/0. Other values are returned unchanged.
+func boolParamValue(key, v string) interface{} {
+	listed := false
+	for _, name := range config().BooleanParams {
+		if name == key {
+			listed = true
+			break
+		}
+	}
+	if !listed {
+		return v
+	}
+
+	switch strings.ToLower(v) {
+	case "false", "no", "0":
+		return 0
+	}
+	if isTruthy(v) {
+		return 1
+	}
+	return v
+}
+
+// Values sent as numbers without a type hint: plain integers and decimals,
+// without leading zeros that would be lost (as in zip codes or ids).
+var numericParamPattern = regexp.MustCompile(`^-?(0|[1-9][0-9]*)(\.[0-9]+)?$`)
+
+// customParam returns the name and typed value of a custom query param. An
+// "n." prefix on the name forces a numeric value and "s." a string;
+// without one, boolean_params become 1/0 and clean numbers become numbers.
+// A forced number that doesn't parse is sent as a string.
+func customParam(key, v string) (string, interface{}) {
+	if name, ok := strings.CutPrefix(key, "s."); ok {
+		return name, v
+	}
+	if name, ok := strings.CutPrefix(key, "n."); ok {
+		if n, ok := parseNumber(v); ok {
+			return name, n
+		}
+		return name, v
+	}
+	if b := boolParamValue(key, v); b != v {
+		return key, b
+	}
+	if numericParamPattern.MatchString(v) {
+		if n, ok := parseNumber(v); ok {
+			return key, n
+		}
+	}
+	return key, v
+}
+
+// parseNumber parses v as an int64 if it is one, or else a finite float64.
+func parseNumber(v string) (interface{}, bool) {
+	v = strings.TrimSpace(v)
+	if i, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return i, true
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || math.IsInf(f, 0) || math.IsNaN(f) {
+		return nil, false
+	}
+	return f, true
+}
+
+// GA4 rejects events dated more than this far in the future.
+const maxClockSkew = time.Minute
+
+// parseEventTime parses v according to timestamp_format: "unix" (default),
+// "unix_ms", "unix_micros" or a Go time layout. The result must fall within
+// the window GA4 accepts events for.
+func parseEventTime(v string, now time.Time) (time.Time, error) {
+	var t time.Time
+	switch config().TimestampFormat {
+	case "", "unix", "unix_ms", "unix_micros":
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return t, err
+		}
+		switch config().TimestampFormat {
+		case "unix_ms":
+			t = time.UnixMilli(n)
+		case "unix_micros":
+			t = time.UnixMicro(n)
+		default:
+			t = time.Unix(n, 0)
+		}
+	default:
+		var err error
+		if t, err = time.Parse(config().TimestampFormat, v); err != nil {
+			return t, err
+		}
+	}
+
+	if now.Sub(t) > maxEventAge || t.Sub(now) > maxClockSkew {
+		return t, fmt.Errorf("%v is outside GA4's accepted window", t.Format(time.RFC3339))
+	}
+	return t, nil
+}
+
+// isTruthy reports whether a flag-like query value is set.
+func isTruthy(v string) bool {
+	switch strings.ToLower(v) {
+	case "1", "true", "yes":
+		return true
+	}
+	return false
+}
+
+// mergeParams adds configured params to an event. Params already set, or
+// supplied by the request itself, are left to the more specific source.
+// String values are truncated like other params, and params that would
+// take the event past GA4's maxEventParams are dropped, in name order.
+func mergeParams(c context.Context, params map[string]interface{}, extra map[string]interface{}, query url.Values) {
+	keys := make([]string, 0, len(extra))
+	for k := range extra {
+		if _, ok := params[k]; ok {
+			continue
+		}
+		if query.Has(k) {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	if room := max(maxEventParams-len(params), 0); len(keys) > room {
+		logger(c).Warn("dropping configured params over GA4's limit", "dropped", keys[room:], "limit", maxEventParams)
+		keys = keys[:room]
+	}
+	for _, k := range keys {
+		v := extra[k]
+		if s, ok := v.(string); ok {
+			v = sanitizeParamValue(s)
+		}
+		params[k] = v
+	}
+}
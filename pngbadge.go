@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Rendered PNG badges are kept for a while, keyed by their text and color,
+// so a popular badge isn't rasterized on every view.
+const (
+	maxCachedPNGBadges = 1024
+	pngBadgeTTL        = 10 * time.Minute
+)
+
+// Layout of PNG badges, in pixels.
+const (
+	pngBadgeHeight  = 20
+	pngBadgePadding = 6
+	pngGlyphAdvance = 6 // glyph width plus one column of spacing
+)
+
+var pngBadges = newTTLCache[[]byte](maxCachedPNGBadges, pngBadgeTTL)
+
+// pixelPNG is the transparent 1x1 image served for ?pixel=png.
+var pixelPNG = func() []byte {
+	var buf bytes.Buffer
+	png.Encode(&buf, image.NewNRGBA(image.Rect(0, 0, 1, 1)))
+	return buf.Bytes()
+}()
+
+// writePNGBadge writes the ?png badge, showing account's hit count with
+// the ?label= text and ?color= color, falling back to the flat GIF badge
+// if it can't be rendered.
+func writePNGBadge(w http.ResponseWriter, query url.Values, account string) {
+	count := badgeValue(badgeCount(w, account), query)
+	b, err := pngBadge(badgeLabel(query.Get("label")), count, query.Get("color"))
+	if err != nil {
+		slog.Error("cannot render badge", "err", err)
+		w.Header().Set("Content-Type", "image/gif")
+		w.Write(badgeFlatGif)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(b)
+}
+
+// pngBadge returns the PNG badge for label, value and color, from
+// pngBadges when it was rendered recently.
+func pngBadge(label, value, color string) ([]byte, error) {
+	now := time.Now()
+	key := label + "\x00" + value + "\x00" + color
+	if b, ok := pngBadges.Get(key, now); ok {
+		return b, nil
+	}
+	b, err := renderPNGBadge(label, value, color)
+	if err != nil {
+		return nil, err
+	}
+	pngBadges.Add(key, b, now)
+	return b, nil
+}
+
+// renderPNGBadge rasterizes a flat badge with label on a grey left segment
+// and value on a right segment in color, a ?color= value. Text is drawn in
+// a built-in 5x7 bitmap font; runes outside printable ASCII show as "?".
+func renderPNGBadge(label, value, color string) ([]byte, error) {
+	leftWidth := pngTextWidth(label) + 2*pngBadgePadding
+	rightWidth := pngTextWidth(value) + 2*pngBadgePadding
+	img := image.NewNRGBA(image.Rect(0, 0, leftWidth+rightWidth, pngBadgeHeight))
+
+	fillRect(img, 0, leftWidth, hexColor("#555"))
+	fillRect(img, leftWidth, leftWidth+rightWidth, hexColor(badgeColor(color, "#007ec6")))
+	roundCorners(img)
+
+	white := hexColor("#fff")
+	top := (pngBadgeHeight - 7) / 2
+	drawText(img, pngBadgePadding, top, label, white)
+	drawText(img, leftWidth+pngBadgePadding, top, value, white)
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func pngTextWidth(s string) int {
+	n := len([]rune(s))
+	if n == 0 {
+		return 0
+	}
+	return n*pngGlyphAdvance - 1
+}
+
+func fillRect(img *image.NRGBA, x0, x1 int, c color.NRGBA) {
+	for y := 0; y < pngBadgeHeight; y++ {
+		for x := x0; x < x1; x++ {
+			img.SetNRGBA(x, y, c)
+		}
+	}
+}
+
+// roundCorners clears the outermost pixels of each corner, for a 2px
+// radius.
+func roundCorners(img *image.NRGBA) {
+	maxX, maxY := img.Bounds().Dx()-1, img.Bounds().Dy()-1
+	for _, p := range [][2]int{{0, 0}, {1, 0}, {0, 1}} {
+		img.SetNRGBA(p[0], p[1], color.NRGBA{})
+		img.SetNRGBA(maxX-p[0], p[1], color.NRGBA{})
+		img.SetNRGBA(p[0], maxY-p[1], color.NRGBA{})
+		img.SetNRGBA(maxX-p[0], maxY-p[1], color.NRGBA{})
+	}
+}
+
+func drawText(img *image.NRGBA, x, y int, s string, c color.NRGBA) {
+	for _, r := range s {
+		if r < ' ' || r > '~' {
+			r = '?'
+		}
+		for col, bits := range font5x7[r-' '] {
+			for row := 0; row < 7; row++ {
+				if bits&(1<<row) != 0 {
+					img.SetNRGBA(x+col, y+row, c)
+				}
+			}
+		}
+		x += pngGlyphAdvance
+	}
+}
+
+// hexColor parses a "#rgb" or "#rrggbb" color as returned by badgeColor.
+// Anything else gives opaque black.
+func hexColor(s string) color.NRGBA {
+	c := color.NRGBA{A: 0xff}
+	if len(s) == 4 {
+		s = "#" + string([]byte{s[1], s[1], s[2], s[2], s[3], s[3]})
+	}
+	if len(s) != 7 {
+		return c
+	}
+	v, err := strconv.ParseUint(s[1:], 16, 32)
+	if err != nil {
+		return c
+	}
+	c.R, c.G, c.B = uint8(v>>16), uint8(v>>8), uint8(v)
+	return c
+}
+
+// font5x7 holds the glyphs for ' ' through '~', one byte per column with
+// the top row in the low bit.
+var font5x7 = [95][5]byte{
+	{0x00, 0x00, 0x00, 0x00, 0x00}, // ' '
+	{0x00, 0x00, 0x5f, 0x00, 0x00}, // !
+	{0x00, 0x07, 0x00, 0x07, 0x00}, // "
+	{0x14, 0x7f, 0x14, 0x7f, 0x14}, // #
+	{0x24, 0x2a, 0x7f, 0x2a, 0x12}, // $
+	{0x23, 0x13, 0x08, 0x64, 0x62}, // %
+	{0x36, 0x49, 0x55, 0x22, 0x50}, // &
+	{0x00, 0x05, 0x03, 0x00, 0x00}, // '
+	{0x00, 0x1c, 0x22, 0x41, 0x00}, // (
+	{0x00, 0x41, 0x22, 0x1c, 0x00}, // )
+	{0x14, 0x08, 0x3e, 0x08, 0x14}, // *
+	{0x08, 0x08, 0x3e, 0x08, 0x08}, // +
+	{0x00, 0x50, 0x30, 0x00, 0x00}, // ,
+	{0x08, 0x08, 0x08, 0x08, 0x08}, // -
+	{0x00, 0x60, 0x60, 0x00, 0x00}, // .
+	{0x20, 0x10, 0x08, 0x04, 0x02}, // /
+	{0x3e, 0x51, 0x49, 0x45, 0x3e}, // 0
+	{0x00, 0x42, 0x7f, 0x40, 0x00}, // 1
+	{0x42, 0x61, 0x51, 0x49, 0x46}, // 2
+	{0x21, 0x41, 0x45, 0x4b, 0x31}, // 3
+	{0x18, 0x14, 0x12, 0x7f, 0x10}, // 4
+	{0x27, 0x45, 0x45, 0x45, 0x39}, // 5
+	{0x3c, 0x4a, 0x49, 0x49, 0x30}, // 6
+	{0x01, 0x71, 0x09, 0x05, 0x03}, // 7
+	{0x36, 0x49, 0x49, 0x49, 0x36}, // 8
+	{0x06, 0x49, 0x49, 0x29, 0x1e}, // 9
+	{0x00, 0x36, 0x36, 0x00, 0x00}, // :
+	{0x00, 0x56, 0x36, 0x00, 0x00}, // ;
+	{0x08, 0x14, 0x22, 0x41, 0x00}, // <
+	{0x14, 0x14, 0x14, 0x14, 0x14}, // =
+	{0x00, 0x41, 0x22, 0x14, 0x08}, // >
+	{0x02, 0x01, 0x51, 0x09, 0x06}, // ?
+	{0x32, 0x49, 0x79, 0x41, 0x3e}, // @
+	{0x7e, 0x11, 0x11, 0x11, 0x7e}, // A
+	{0x7f, 0x49, 0x49, 0x49, 0x36}, // B
+	{0x3e, 0x41, 0x41, 0x41, 0x22}, // C
+	{0x7f, 0x41, 0x41, 0x22, 0x1c}, // D
+	{0x7f, 0x49, 0x49, 0x49, 0x41}, // E
+	{0x7f, 0x09, 0x09, 0x09, 0x01}, // F
+	{0x3e, 0x41, 0x49, 0x49, 0x7a}, // G
+	{0x7f, 0x08, 0x08, 0x08, 0x7f}, // H
+	{0x00, 0x41, 0x7f, 0x41, 0x00}, // I
+	{0x20, 0x40, 0x41, 0x3f, 0x01}, // J
+	{0x7f, 0x08, 0x14, 0x22, 0x41}, // K
+	{0x7f, 0x40, 0x40, 0x40, 0x40}, // L
+	{0x7f, 0x02, 0x0c, 0x02, 0x7f}, // M
+	{0x7f, 0x04, 0x08, 0x10, 0x7f}, // N
+	{0x3e, 0x41, 0x41, 0x41, 0x3e}, // O
+	{0x7f, 0x09, 0x09, 0x09, 0x06}, // P
+	{0x3e, 0x41, 0x51, 0x21, 0x5e}, // Q
+	{0x7f, 0x09, 0x19, 0x29, 0x46}, // R
+	{0x46, 0x49, 0x49, 0x49, 0x31}, // S
+	{0x01, 0x01, 0x7f, 0x01, 0x01}, // T
+	{0x3f, 0x40, 0x40, 0x40, 0x3f}, // U
+	{0x1f, 0x20, 0x40, 0x20, 0x1f}, // V
+	{0x3f, 0x40, 0x38, 0x40, 0x3f}, // W
+	{0x63, 0x14, 0x08, 0x14, 0x63}, // X
+	{0x07, 0x08, 0x70, 0x08, 0x07}, // Y
+	{0x61, 0x51, 0x49, 0x45, 0x43}, // Z
+	{0x00, 0x7f, 0x41, 0x41, 0x00}, // [
+	{0x02, 0x04, 0x08, 0x10, 0x20}, // \
+	{0x00, 0x41, 0x41, 0x7f, 0x00}, // ]
+	{0x04, 0x02, 0x01, 0x02, 0x04}, // ^
+	{0x40, 0x40, 0x40, 0x40, 0x40}, // _
+	{0x00, 0x01, 0x02, 0x04, 0x00}, // `
+	{0x20, 0x54, 0x54, 0x54, 0x78}, // a
+	{0x7f, 0x48, 0x44, 0x44, 0x38}, // b
+	{0x38, 0x44, 0x44, 0x44, 0x20}, // c
+	{0x38, 0x44, 0x44, 0x48, 0x7f}, // d
+	{0x38, 0x54, 0x54, 0x54, 0x18}, // e
+	{0x08, 0x7e, 0x09, 0x01, 0x02}, // f
+	{0x0c, 0x52, 0x52, 0x52, 0x3e}, // g
+	{0x7f, 0x08, 0x04, 0x04, 0x78}, // h
+	{0x00, 0x44, 0x7d, 0x40, 0x00}, // i
+	{0x20, 0x40, 0x44, 0x3d, 0x00}, // j
+	{0x7f, 0x10, 0x28, 0x44, 0x00}, // k
+	{0x00, 0x41, 0x7f, 0x40, 0x00}, // l
+	{0x7c, 0x04, 0x18, 0x04, 0x78}, // m
+	{0x7c, 0x08, 0x04, 0x04, 0x78}, // n
+	{0x38, 0x44, 0x44, 0x44, 0x38}, // o
+	{0x7c, 0x14, 0x14, 0x14, 0x08}, // p
+	{0x08, 0x14, 0x14, 0x18, 0x7c}, // q
+	{0x7c, 0x08, 0x04, 0x04, 0x08}, // r
+	{0x48, 0x54, 0x54, 0x54, 0x20}, // s
+	{0x04, 0x3f, 0x44, 0x40, 0x20}, // t
+	{0x3c, 0x40, 0x40, 0x20, 0x7c}, // u
+	{0x1c, 0x20, 0x40, 0x20, 0x1c}, // v
+	{0x3c, 0x40, 0x30, 0x40, 0x3c}, // w
+	{0x44, 0x28, 0x10, 0x28, 0x44}, // x
+	{0x0c, 0x50, 0x50, 0x50, 0x3c}, // y
+	{0x44, 0x64, 0x54, 0x4c, 0x44}, // z
+	{0x00, 0x08, 0x36, 0x41, 0x00}, // {
+	{0x00, 0x00, 0x7f, 0x00, 0x00}, // |
+	{0x00, 0x41, 0x36, 0x08, 0x00}, // }
+	{0x08, 0x04, 0x08, 0x10, 0x08}, // ~
+}
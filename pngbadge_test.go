@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"image/color"
+	"image/png"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestPNGBadge(t *testing.T) {
+	tests := []struct {
+		name      string
+		query     url.Values
+		count     int64
+		wantText  string // label and value, for the width
+		wantColor color.NRGBA
+	}{
+		{"default", url.Values{"png": {""}}, 7, "pageviews" + "7", hexColor("#007ec6")},
+		{"label", url.Values{"png": {""}, "label": {"hits"}}, 7, "hits" + "7", hexColor("#007ec6")},
+		{"named color", url.Values{"png": {""}, "color": {"brightgreen"}}, 7, "pageviews" + "7", hexColor("#4c1")},
+		{"hex color", url.Values{"png": {""}, "color": {"ff8800"}}, 7, "pageviews" + "7", hexColor("#ff8800")},
+		{"large count", url.Values{"png": {""}}, 1_500_000, "pageviews" + "1.5M", hexColor("#007ec6")},
+		{"exact count", url.Values{"png": {""}, "exact": {""}}, 1_500_000, "pageviews" + "1500000", hexColor("#007ec6")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, Config{})
+			hitCounts = fixedCountStore{tt.count}
+			t.Cleanup(func() { hitCounts = newMemoryCounterStore() })
+
+			w := httptest.NewRecorder()
+			writeImage(w, httptest.NewRequest("GET", "/acct/page?png", nil), tt.query, "acct")
+			if ct := w.Header().Get("Content-Type"); ct != "image/png" {
+				t.Fatalf("Content-Type = %q, want image/png", ct)
+			}
+			img, err := png.Decode(w.Body)
+			if err != nil {
+				t.Fatalf("png.Decode: %v", err)
+			}
+			b := img.Bounds()
+			// Each segment pads its text on both sides, and glyphs but
+			// the last in a segment are followed by a spacing column.
+			wantWidth := len(tt.wantText)*pngGlyphAdvance - 2 + 4*pngBadgePadding
+			if b.Dx() != wantWidth || b.Dy() != pngBadgeHeight {
+				t.Errorf("size = %dx%d, want %dx%d", b.Dx(), b.Dy(), wantWidth, pngBadgeHeight)
+			}
+			// The bottom right, just inside the rounded corner, is the
+			// value segment's background.
+			if got := color.NRGBAModel.Convert(img.At(b.Max.X-3, b.Max.Y-1)).(color.NRGBA); got != tt.wantColor {
+				t.Errorf("value segment color = %v, want %v", got, tt.wantColor)
+			}
+		})
+	}
+}
+
+func TestPNGBadgeIsCached(t *testing.T) {
+	first, err := pngBadge("cached", "42", "red")
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := pngBadge("cached", "42", "red")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if &first[0] != &again[0] {
+		t.Error("second render of the same badge was not served from the cache")
+	}
+	other, err := pngBadge("cached", "43", "red")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(first, other) {
+		t.Error("badges with different counts are identical")
+	}
+}
+
+func TestHexColor(t *testing.T) {
+	tests := []struct {
+		s    string
+		want color.NRGBA
+	}{
+		{"#ff8800", color.NRGBA{0xff, 0x88, 0x00, 0xff}},
+		{"#4c1", color.NRGBA{0x44, 0xcc, 0x11, 0xff}},
+		{"#zzzzzz", color.NRGBA{A: 0xff}},
+		{"red", color.NRGBA{A: 0xff}},
+		{"", color.NRGBA{A: 0xff}},
+	}
+	for _, tt := range tests {
+		if got := hexColor(tt.s); got != tt.want {
+			t.Errorf("hexColor(%q) = %v, want %v", tt.s, got, tt.want)
+		}
+	}
+}
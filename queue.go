@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	defaultWorkers   = 4
+	defaultQueueSize = 1000
+
+	defaultSlowSendThreshold = 2 * time.Second
+
+	// How often spilled hits are checked for room to read them back.
+	unspillInterval = 100 * time.Millisecond
+)
+
+var (
+	hitsDropped  = newCounter("beacon_hits_dropped_total", "Hits dropped before delivery, by reason.")
+	queueDepth   = newGauge("beacon_queue_depth", "Hits waiting in the delivery queue.")
+	queueLatency = newHistogram("beacon_queue_latency_seconds", "Time from queueing a hit to delivering it.",
+		[]float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60})
+)
+
+// slowSendThreshold is how long a worker's send may take before it is
+// logged as slow, or 0 if slow_send_threshold_ms disables the warning.
+func slowSendThreshold() time.Duration {
+	switch n := config().SlowSendThresholdMs; {
+	case n < 0:
+		return 0
+	case n > 0:
+		return time.Duration(n) * time.Millisecond
+	}
+	return defaultSlowSendThreshold
+}
+
+// warnIfSlow logs a send to GA for meta's hit that took longer than
+// slow_send_threshold_ms.
+func warnIfSlow(ctx context.Context, meta HitMeta, took time.Duration) {
+	if threshold := slowSendThreshold(); threshold > 0 && took > threshold {
+		logger(ctx).Warn("slow send to GA", "account", meta.Account, "cid", meta.CID, "took", took, "threshold", threshold)
+	}
+}
+
+var (
+	errQueueFull   = errors.New("delivery queue full")
+	errQueueClosed = errors.New("delivery queue closed")
+)
+
+// delivery is a hit waiting to be sent to GA.
+type delivery struct {
+	Meta    HitMeta
+	Payload GA4Payload
+
+	// walID is the hit's id in the queue_dir log, or 0 if it isn't in one.
+	walID uint64
+
+	// queued is when the hit entered the queue.
+	queued time.Time
+}
+
+// sendQueue decouples GA delivery from request handling: it is a Sender
+// that enqueues without blocking, while a fixed pool of workers drains the
+// queue through the wrapped Sender.
+type sendQueue struct {
+	sender Sender
+	mu     sync.RWMutex
+	closed bool
+	ch     chan delivery
+	wg     sync.WaitGroup
+
+	// wal, when queue_dir is set, keeps queued hits on disk until they are
+	// delivered.
+	wal *hitLog
+
+	// spill, when queue_spill_depth is set, takes hits that arrive while
+	// spillDepth of them are already waiting in memory.
+	spill      *hitSpill
+	spillDepth int
+
+	// ctx is what workers deliver on. Drain cancels it when it gives up,
+	// aborting posts still in flight.
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newSendQueue(sender Sender, wal *hitLog, workers, size int) *sendQueue {
+	q := &sendQueue{sender: sender, wal: wal, ch: make(chan delivery, size)}
+	q.ctx, q.cancel = context.WithCancel(context.Background())
+	for i := 0; i < workers; i++ {
+		q.wg.Add(1)
+		go q.work()
+	}
+	return q
+}
+
+func (q *sendQueue) work() {
+	defer q.wg.Done()
+	for d := range q.ch {
+		q.observe()
+		if q.ctx.Err() != nil {
+			// Drain gave up; what's left is dropped, or replayed from
+			// queue_dir on the next start.
+			continue
+		}
+		ctx := withRequestID(q.ctx, d.Meta.RequestID)
+		if async, ok := q.sender.(asyncSender); ok {
+			// Handing the hit over doesn't deliver it; wait to hear
+			// from the post.
+			async.SendAsync(ctx, d.Meta, d.Payload, func(err error) { q.delivered(d, err) })
+			continue
+		}
+		start := time.Now()
+		err := q.sender.Send(ctx, d.Meta, d.Payload)
+		warnIfSlow(ctx, d.Meta, time.Since(start))
+		q.delivered(d, err)
+	}
+}
+
+// delivered records how sending d went. Once GA has it, its time in the
+// queue is observed and it is marked done in queue_dir; otherwise it stays
+// there to be sent again on the next start.
+func (q *sendQueue) delivered(d delivery, err error) {
+	if err != nil {
+		return
+	}
+	queueLatency.Observe(time.Since(d.queued).Seconds())
+	if d.walID != 0 {
+		q.wal.Done(d.walID)
+	}
+}
+
+// SpillTo has hits arriving while depth of them are waiting in memory
+// written to spill instead, and read back as delivery catches up. Call it
+// before the first Send.
+func (q *sendQueue) SpillTo(spill *hitSpill, depth int) {
+	q.spill, q.spillDepth = spill, depth
+	go q.unspill()
+}
+
+// unspill moves spilled hits back into the queue, up to spillDepth of
+// them, whenever it has fallen to half that: delivery has caught up.
+func (q *sendQueue) unspill() {
+	ticker := time.NewTicker(unspillInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		q.mu.RLock()
+		if q.closed {
+			q.mu.RUnlock()
+			return
+		}
+		if len(q.ch) <= q.spillDepth/2 {
+			for len(q.ch) < q.spillDepth {
+				h, ok := q.spill.Next()
+				if !ok {
+					break
+				}
+				d, ok := readBack(h)
+				if !ok {
+					continue
+				}
+				if q.wal != nil {
+					d.walID = q.wal.Append(d.Meta, d.Payload)
+				}
+				q.ch <- d
+			}
+			q.observe()
+		}
+		q.mu.RUnlock()
+	}
+}
+
+// Replay queues hits left in queue_dir by an earlier run, waiting for room
+// in the queue rather than dropping them.
+func (q *sendQueue) Replay(hits []walHit) {
+	for _, h := range hits {
+		d, ok := readBack(h)
+		if !ok {
+			q.wal.Done(h.ID)
+			continue
+		}
+		d.walID = h.ID
+		q.mu.RLock()
+		if q.closed {
+			q.mu.RUnlock()
+			return
+		}
+		q.ch <- d
+		q.observe()
+		q.mu.RUnlock()
+	}
+}
+
+// readBack turns a hit read from queue_dir into a delivery. It reports
+// false, dropping the hit, when no property is configured for it any more.
+func readBack(h walHit) (delivery, bool) {
+	meta, ok := h.Meta.hitMeta()
+	if !ok {
+		hitsDropped.Inc("reason", "no_credentials")
+		slog.Warn("no GA4 property configured for hit read back from queue_dir, dropping it", "account", h.Meta.Account, "cid", h.Meta.CID)
+		return delivery{}, false
+	}
+	h.Payload.Received = h.Received
+	return delivery{Meta: meta, Payload: h.Payload, queued: time.Now()}, true
+}
+
+// Send hands the hit to the workers, dropping it when the queue is full or
+// already closed for shutdown. ctx is not used; workers deliver on their
+// own context, since the hit outlives the request that queued it.
+func (q *sendQueue) Send(ctx context.Context, meta HitMeta, payload GA4Payload) error {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	if q.closed {
+		hitsDropped.Inc("reason", "shutdown")
+		return errQueueClosed
+	}
+	// Once spilling, keep at it until the spill is read back, so hits
+	// are delivered in order.
+	if q.spill != nil && (len(q.ch) >= q.spillDepth || q.spill.Len() > 0) {
+		err := q.spill.Append(walHit{Meta: storeMeta(meta), Payload: payload, Received: payload.Received})
+		if err == nil {
+			return nil
+		}
+		logger(ctx).Warn("cannot spill hit to queue_dir, queueing it in memory", "cid", meta.CID, "err", err)
+	}
+	d := delivery{Meta: meta, Payload: payload, queued: time.Now()}
+	if q.wal != nil {
+		d.walID = q.wal.Append(meta, payload)
+	}
+	select {
+	case q.ch <- d:
+		q.observe()
+		return nil
+	default:
+		if d.walID != 0 {
+			q.wal.Done(d.walID)
+		}
+		hitsDropped.Inc("reason", "queue_full")
+		logger(ctx).Warn("delivery queue full, dropping hit", "cid", meta.CID)
+		return errQueueFull
+	}
+}
+
+// Drain stops accepting hits and waits up to timeout for the workers to
+// deliver the ones already queued, and for any batches they handed off to
+// be sent. When it gives up, posts still in flight are cancelled and it
+// returns how many hits were still waiting; it returns 0 once the queue is
+// empty.
+func (q *sendQueue) Drain(timeout time.Duration) int {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.ch)
+	}
+	q.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		// Batches are posted on the workers' context, so they must be
+		// sent before it is cancelled.
+		if b, ok := q.sender.(*batcher); ok {
+			b.Close()
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+		q.cancel()
+		return 0
+	case <-time.After(timeout):
+		n := len(q.ch)
+		q.cancel()
+		return n
+	}
+}
+
+func (q *sendQueue) observe() {
+	queueDepth.Set(float64(len(q.ch)))
+	recordQueueDepth(len(q.ch), cap(q.ch))
+}
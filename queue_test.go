@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSendQueueOverflow(t *testing.T) {
+	tests := []struct {
+		workers, size, hits int
+	}{
+		{1, 1, 5},
+		{2, 5, 20},
+		{4, 10, 10},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d workers, %d queued, %d hits", tt.workers, tt.size, tt.hits), func(t *testing.T) {
+			// The collector holds every post until gate is closed, so the
+			// queue fills up behind the workers.
+			gate := make(chan struct{})
+			var collected atomic.Int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				<-gate
+				collected.Add(1)
+				w.WriteHeader(http.StatusNoContent)
+			}))
+			defer srv.Close()
+			useConfig(t, withTestCreds(Config{CollectorURL: srv.URL + "/mp/collect"}))
+
+			q := newSendQueue(gaSender{}, nil, tt.workers, tt.size)
+			before := hitsDropped.Value("reason", "queue_full")
+			accepted := 0
+			for i := 0; i < tt.hits; i++ {
+				err := q.Send(context.Background(), HitMeta{Creds: Credentials{MeasurementID: "G-TEST", APISecret: "secret"}, CID: fmt.Sprint(i)}, GA4Payload{ClientID: fmt.Sprint(i)})
+				switch {
+				case err == nil:
+					accepted++
+				case !errors.Is(err, errQueueFull):
+					t.Fatalf("Send #%d: %v", i, err)
+				}
+			}
+			// Each worker may have taken a hit off the queue already.
+			if accepted < min(tt.size, tt.hits) || accepted > tt.size+tt.workers {
+				t.Errorf("accepted %d hits, want %d to %d", accepted, tt.size, tt.size+tt.workers)
+			}
+			if dropped := hitsDropped.Value("reason", "queue_full") - before; int(dropped) != tt.hits-accepted {
+				t.Errorf("beacon_hits_dropped_total{reason=queue_full} rose by %v, want %d", dropped, tt.hits-accepted)
+			}
+
+			close(gate)
+			if n := q.Drain(5 * time.Second); n != 0 {
+				t.Errorf("Drain left %d hits", n)
+			}
+			if got := int(collected.Load()); got != accepted {
+				t.Errorf("collector got %d hits, want all %d accepted", got, accepted)
+			}
+			if err := q.Send(context.Background(), HitMeta{}, GA4Payload{}); !errors.Is(err, errQueueClosed) {
+				t.Errorf("Send after Drain = %v, want errQueueClosed", err)
+			}
+		})
+	}
+}
+
+// slowSender takes delay to deliver each hit, giving up when its context
+// is cancelled.
+type slowSender struct {
+	delay     time.Duration
+	delivered atomic.Int32
+	cancelled atomic.Int32
+}
+
+func (s *slowSender) Send(ctx context.Context, meta HitMeta, payload GA4Payload) error {
+	select {
+	case <-time.After(s.delay):
+		s.delivered.Add(1)
+		return nil
+	case <-ctx.Done():
+		s.cancelled.Add(1)
+		return ctx.Err()
+	}
+}
+
+func TestSendQueueDrainTimeout(t *testing.T) {
+	tests := []struct {
+		name          string
+		workers, hits int
+		delay         time.Duration
+		timeout       time.Duration
+		wantLeft      int
+	}{
+		{"drained in time", 2, 6, 10 * time.Millisecond, 2 * time.Second, 0},
+		{"one slow worker", 1, 5, time.Second, 100 * time.Millisecond, 4},
+		{"two slow workers", 2, 6, time.Second, 100 * time.Millisecond, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sender := &slowSender{delay: tt.delay}
+			q := newSendQueue(sender, nil, tt.workers, tt.hits)
+			for i := 0; i < tt.hits; i++ {
+				if err := q.Send(context.Background(), HitMeta{CID: fmt.Sprint(i)}, GA4Payload{}); err != nil {
+					t.Fatalf("Send #%d: %v", i, err)
+				}
+			}
+			// Let the workers pick up their first hits.
+			time.Sleep(20 * time.Millisecond)
+
+			start := time.Now()
+			left := q.Drain(tt.timeout)
+			if elapsed := time.Since(start); elapsed > tt.timeout+time.Second {
+				t.Errorf("Drain took %v, want at most about %v", elapsed, tt.timeout)
+			}
+			if left != tt.wantLeft {
+				t.Errorf("Drain left %d hits, want %d", left, tt.wantLeft)
+			}
+			if left > 0 {
+				// The posts in flight at the timeout are cancelled.
+				deadline := time.Now().Add(time.Second)
+				for int(sender.cancelled.Load()) < tt.workers && time.Now().Before(deadline) {
+					time.Sleep(5 * time.Millisecond)
+				}
+				if got := int(sender.cancelled.Load()); got != tt.workers {
+					t.Errorf("%d in-flight sends cancelled, want %d", got, tt.workers)
+				}
+			} else if got := int(sender.delivered.Load()); got != tt.hits {
+				t.Errorf("delivered %d hits, want %d", got, tt.hits)
+			}
+			if err := q.Send(context.Background(), HitMeta{}, GA4Payload{}); !errors.Is(err, errQueueClosed) {
+				t.Errorf("Send after Drain = %v, want errQueueClosed", err)
+			}
+		})
+	}
+}
+
+func TestSlowSendWarning(t *testing.T) {
+	tests := []struct {
+		name        string
+		thresholdMs int
+		sender      Sender
+		wantWarning bool
+		wantLatency float64 // deliveries observed in beacon_queue_latency_seconds
+		above       string  // a bucket the observation must fall above
+	}{
+		{"slower than the threshold", 50, &slowSender{delay: 100 * time.Millisecond}, true, 1, `le="0.05"`},
+		{"faster than the threshold", 1000, &slowSender{delay: 10 * time.Millisecond}, false, 1, `le="0.005"`},
+		{"warning disabled", -1, &slowSender{delay: 100 * time.Millisecond}, false, 1, `le="0.05"`},
+		{"failed sends not observed", 50, &recordingSender{err: errors.New("collector down")}, false, 0, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, Config{SlowSendThresholdMs: tt.thresholdMs})
+			logs := captureLogs(t)
+			before := scrapeMetrics(t)
+
+			q := newSendQueue(tt.sender, nil, 1, 1)
+			if err := q.Send(context.Background(), HitMeta{Account: "acct", CID: "1111.2222"}, GA4Payload{}); err != nil {
+				t.Fatalf("Send: %v", err)
+			}
+			if n := q.Drain(5 * time.Second); n != 0 {
+				t.Fatalf("Drain left %d hits", n)
+			}
+
+			out := logs.String()
+			warned := strings.Contains(out, "slow send to GA")
+			if warned != tt.wantWarning {
+				t.Fatalf("slow send warning logged = %v, want %v:\n%s", warned, tt.wantWarning, out)
+			}
+			if warned && (!strings.Contains(out, "account=acct") || !strings.Contains(out, "cid=1111.2222")) {
+				t.Errorf("warning lacks the account and cid:\n%s", out)
+			}
+
+			after := scrapeMetrics(t)
+			const series = "beacon_queue_latency_seconds"
+			count := after[series+"_count"] - before[series+"_count"]
+			if count != tt.wantLatency {
+				t.Fatalf("%s_count rose by %v, want %v", series, count, tt.wantLatency)
+			}
+			if tt.above == "" {
+				return
+			}
+			bucket := series + "_bucket{" + tt.above + "}"
+			if rose := after[bucket] - before[bucket]; rose != 0 {
+				t.Errorf("%s rose by %v, want the latency above it", bucket, rose)
+			}
+		})
+	}
+}
+
+func TestSlowSendThreshold(t *testing.T) {
+	tests := []struct {
+		ms      int
+		want    time.Duration
+		wantErr bool
+	}{
+		{0, defaultSlowSendThreshold, false},
+		{-1, 0, false},
+		{250, 250 * time.Millisecond, false},
+		{-2, 0, true},
+	}
+	for _, tt := range tests {
+		c := withTestCreds(Config{SlowSendThresholdMs: tt.ms})
+		if err := c.validate(); (err != nil) != tt.wantErr {
+			t.Errorf("slow_send_threshold_ms %d: err = %v, want error %v", tt.ms, err, tt.wantErr)
+		}
+		if tt.wantErr {
+			continue
+		}
+		useConfig(t, c)
+		if got := slowSendThreshold(); got != tt.want {
+			t.Errorf("slow_send_threshold_ms %d: threshold %v, want %v", tt.ms, got, tt.want)
+		}
+	}
+}
+
+func TestSendQueueDrainsBatches(t *testing.T) {
+	tests := []struct {
+		name   string
+		window time.Duration
+		hits   int
+	}{
+		{"within the window", time.Minute, 3},
+		{"over a full batch", time.Minute, maxPayloadEvents + 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeCollector(t, Config{})
+			q := newSendQueue(newBatcher(gaSender{}, tt.window), nil, 2, tt.hits)
+			for i := 0; i < tt.hits; i++ {
+				meta := HitMeta{Creds: Credentials{MeasurementID: "G-TEST", APISecret: "secret"}, CID: "1.1"}
+				if err := q.Send(context.Background(), meta, GA4Payload{ClientID: "1.1", Events: []GA4Event{{Name: "page_view"}}}); err != nil {
+					t.Fatalf("Send #%d: %v", i, err)
+				}
+			}
+			if n := q.Drain(5 * time.Second); n != 0 {
+				t.Fatalf("Drain left %d hits", n)
+			}
+			events := 0
+			for _, p := range f.posted() {
+				events += len(p.Events)
+			}
+			if events != tt.hits {
+				t.Errorf("collector got %d events, want all %d, sent before the queue's context was cancelled", events, tt.hits)
+			}
+		})
+	}
+}
+
+func TestSlowSendWarningWithBatching(t *testing.T) {
+	tests := []struct {
+		name        string
+		window      time.Duration
+		delay       time.Duration // of the batch's post
+		wantWarning bool
+		above       string // a bucket the queue latency must fall above
+	}{
+		{"slow post", 10 * time.Millisecond, 100 * time.Millisecond, true, `le="0.05"`},
+		{"long window, fast post", 100 * time.Millisecond, 0, false, `le="0.05"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, Config{SlowSendThresholdMs: 50})
+			logs := captureLogs(t)
+			before := scrapeMetrics(t)
+
+			q := newSendQueue(newBatcher(&slowSender{delay: tt.delay}, tt.window), nil, 1, 1)
+			payload := GA4Payload{ClientID: "1111.2222", Events: []GA4Event{{Name: "page_view"}}}
+			if err := q.Send(context.Background(), HitMeta{Account: "acct", CID: "1111.2222"}, payload); err != nil {
+				t.Fatalf("Send: %v", err)
+			}
+			// Let the window close, rather than have Drain flush the batch.
+			time.Sleep(tt.window + tt.delay + 50*time.Millisecond)
+			if n := q.Drain(5 * time.Second); n != 0 {
+				t.Fatalf("Drain left %d hits", n)
+			}
+
+			out := logs.String()
+			warned := strings.Contains(out, "slow send to GA")
+			if warned != tt.wantWarning {
+				t.Errorf("slow send warning logged = %v, want %v:\n%s", warned, tt.wantWarning, out)
+			}
+			if warned && (!strings.Contains(out, "account=acct") || !strings.Contains(out, "cid=1111.2222")) {
+				t.Errorf("warning lacks the account and cid:\n%s", out)
+			}
+
+			after := scrapeMetrics(t)
+			const series = "beacon_queue_latency_seconds"
+			if count := after[series+"_count"] - before[series+"_count"]; count != 1 {
+				t.Fatalf("%s_count rose by %v, want 1, once the batch was posted", series, count)
+			}
+			bucket := series + "_bucket{" + tt.above + "}"
+			if rose := after[bucket] - before[bucket]; rose != 0 {
+				t.Errorf("%s rose by %v, want the latency above it", bucket, rose)
+			}
+		})
+	}
+}
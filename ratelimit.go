@@ -0,0 +1,72 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter keeps a token bucket per key, refilled at a steady rate up
+// to burst. Buckets live in a bounded cache and expire once they would be
+// full again, which is no different from a fresh bucket.
+type rateLimiter struct {
+	mu      sync.Mutex
+	rate    float64 // tokens per second
+	burst   float64
+	buckets *ttlCache[tokenBucket]
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// hitLimiter is set when rate_limit_per_minute is.
+var hitLimiter *rateLimiter
+
+func newRateLimiter(perMinute, burst int) *rateLimiter {
+	rate := float64(perMinute) / 60
+	refill := time.Duration(float64(burst) / rate * float64(time.Second))
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: newTTLCache[tokenBucket](maxTrackedClients, refill),
+	}
+}
+
+// Allow takes a token from the bucket of every key if all of them have one
+// to spare, and reports whether it did.
+func (l *rateLimiter) Allow(now time.Time, keys ...string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	buckets := make([]tokenBucket, len(keys))
+	ok := true
+	for i, key := range keys {
+		b, found := l.buckets.Get(key, now)
+		if !found {
+			b = tokenBucket{tokens: l.burst, last: now}
+		}
+		b.tokens = min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+		b.last = now
+		if b.tokens < 1 {
+			ok = false
+		}
+		buckets[i] = b
+	}
+	for i, key := range keys {
+		if ok {
+			buckets[i].tokens--
+		}
+		l.buckets.Add(key, buckets[i], now)
+	}
+	return ok
+}
+
+// rateLimited reports whether a hit from ip and cid exceeds either's rate
+// limit.
+func rateLimited(ip, cid string, now time.Time) bool {
+	if hitLimiter == nil {
+		return false
+	}
+	return !hitLimiter.Allow(now, "ip:"+ip, "cid:"+cid)
+}
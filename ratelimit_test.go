@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	tests := []struct {
+		name      string
+		perMinute int
+		burst     int
+		at        []time.Duration // when each hit arrives
+		want      []bool
+	}{
+		{"burst then refused", 60, 2, []time.Duration{0, 0, 0}, []bool{true, true, false}},
+		{"refills at the rate", 60, 1, []time.Duration{0, 500 * time.Millisecond, time.Second}, []bool{true, false, true}},
+		{"never beyond the burst", 60, 2, []time.Duration{0, time.Hour, time.Hour, time.Hour}, []bool{true, true, true, false}},
+		{"slow rate", 1, 1, []time.Duration{0, 30 * time.Second, time.Minute}, []bool{true, false, true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newRateLimiter(tt.perMinute, tt.burst)
+			for i, at := range tt.at {
+				if got := l.Allow(start.Add(at), "key"); got != tt.want[i] {
+					t.Errorf("hit %d at %v: Allow = %v, want %v", i, at, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimiterChecksEveryKey(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	l := newRateLimiter(60, 1)
+	if !l.Allow(now, "ip:a", "cid:1") {
+		t.Fatal("first hit refused")
+	}
+	// ip:b has a token but cid:1 doesn't, so neither is taken.
+	if l.Allow(now, "ip:b", "cid:1") {
+		t.Error("hit allowed with the cid's bucket empty")
+	}
+	if !l.Allow(now, "ip:b", "cid:2") {
+		t.Error("refused hit took ip:b's token")
+	}
+}
+
+func TestRateLimitedHitsAreNotSent(t *testing.T) {
+	const limit = 3
+	tests := []struct {
+		name     string
+		ip       func(i int) string
+		cid      func(i int) string
+		wantSent int
+	}{
+		{"same client", func(int) string { return "192.0.2.1:1234" }, func(int) string { return "1111.2222" }, limit},
+		{"same IP, new cids", func(int) string { return "192.0.2.1:1234" }, func(i int) string { return fmt.Sprintf("1111.%d", i) }, limit},
+		{"same cid, new IPs", func(i int) string { return fmt.Sprintf("192.0.2.%d:1234", i+1) }, func(int) string { return "1111.2222" }, limit},
+		{"different clients", func(i int) string { return fmt.Sprintf("192.0.2.%d:1234", i+1) }, func(i int) string { return fmt.Sprintf("1111.%d", i) }, limit + 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, withTestCreds(Config{RateLimitPerMinute: limit}))
+			sender := &recordingSender{}
+			before := hitsDropped.Value("reason", "rate_limited")
+			for i := 0; i < limit+1; i++ {
+				r := httptest.NewRequest("GET", fmt.Sprintf("/acct/page-%d?pixel", i), nil)
+				r.RemoteAddr = tt.ip(i)
+				r.AddCookie(&http.Cookie{Name: cidCookieName(), Value: tt.cid(i)})
+				w := httptest.NewRecorder()
+				(&server{sender: sender}).handler(w, r)
+				if w.Code != http.StatusOK {
+					t.Errorf("hit %d: status %d, want the image served", i, w.Code)
+				}
+			}
+			if n := len(sender.sent()); n != tt.wantSent {
+				t.Errorf("sent %d hits, want %d", n, tt.wantSent)
+			}
+			if got := hitsDropped.Value("reason", "rate_limited") - before; int(got) != limit+1-tt.wantSent {
+				t.Errorf("beacon_hits_dropped_total{reason=rate_limited} rose by %v, want %d", got, limit+1-tt.wantSent)
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"maps"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+)
+
+// reloadConfig loads the config again and, if it is valid, swaps it in
+// for the running one. Otherwise the running config is kept. Settings
+// that size or start long-lived state (see restartSettings) keep their
+// old values until a restart.
+func reloadConfig() error {
+	cfg, err := loadConfig()
+	if err != nil {
+		slog.Error("config reload failed, keeping the running config", "err", err)
+		return err
+	}
+	if changed := restartSettings(config(), &cfg); len(changed) > 0 {
+		slog.Warn("some settings only take effect on restart", "settings", changed)
+	}
+	liveConfig.Store(&cfg)
+	if err := setupLogging(); err != nil {
+		slog.Warn("cannot apply logging settings", "err", err)
+	}
+	slog.Info("reloaded config", "measurement_id", cfg.MeasurementID)
+	return nil
+}
+
+// restartSettings names the settings that differ between old and new but
+// are only read at startup.
+func restartSettings(old, new *Config) []string {
+	var changed []string
+	for name, differs := range map[string]bool{
+		"port":                    old.Port != new.Port || old.ListenAddr != new.ListenAddr,
+		"tls_cert":                old.TLSCert != new.TLSCert || old.TLSKey != new.TLSKey,
+		"http_redirect_port":      old.HTTPRedirectPort != new.HTTPRedirectPort,
+		"workers":                 old.Workers != new.Workers,
+		"queue_size":              old.QueueSize != new.QueueSize,
+		"max_concurrent_sends":    old.MaxConcurrentSends != new.MaxConcurrentSends,
+		"queue_dir":               old.QueueDir != new.QueueDir,
+		"queue_spill_depth":       old.QueueSpillDepth != new.QueueSpillDepth,
+		"batch_window_ms":         old.BatchWindowMillis != new.BatchWindowMillis,
+		"static_dir":              old.StaticDir != new.StaticDir,
+		"rate_limit_per_minute":   old.RateLimitPerMinute != new.RateLimitPerMinute || old.RateLimitBurst != new.RateLimitBurst,
+		"min_hit_interval":        old.MinHitInterval != new.MinHitInterval,
+		"dedup_window_seconds":    old.DedupWindowSeconds != new.DedupWindowSeconds,
+		"ga_dial_timeout_seconds": old.GADialTimeoutSeconds != new.GADialTimeoutSeconds,
+		"geo_db_path":             old.GeoDBPath != new.GeoDBPath,
+		"counter_backend":         old.CounterBackend != new.CounterBackend || old.CounterFile != new.CounterFile,
+		"max_daily_counts":        old.MaxDailyCounts != new.MaxDailyCounts,
+		"retry_budget_per_second": old.RetryBudgetPerSecond != new.RetryBudgetPerSecond,
+		"stale_count_seconds":     old.StaleCountSeconds != new.StaleCountSeconds,
+		"request_timeout_seconds": old.RequestTimeoutSeconds != new.RequestTimeoutSeconds,
+		"warm_from_ga":            old.WarmFromGA != new.WarmFromGA || old.GACredentialsFile != new.GACredentialsFile || !maps.Equal(old.GAPropertyIDs, new.GAPropertyIDs),
+	} {
+		if differs {
+			changed = append(changed, name)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// reloadOnHangup reloads the config on every SIGHUP until ctx is done.
+func reloadOnHangup(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-hup:
+			reloadConfig()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
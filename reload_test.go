@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// reloadTestSetup runs the test in a temp dir whose config.json holds
+// content, loads it and returns a function that rewrites the file.
+func reloadTestSetup(t *testing.T, content string) func(string) {
+	t.Helper()
+	t.Chdir(t.TempDir())
+	for _, k := range []string{"CONFIG_FILE", "GA_MEASUREMENT_ID", "GA_API_SECRET", "PORT"} {
+		t.Setenv(k, "")
+	}
+	old := flags
+	t.Cleanup(func() { flags = old })
+	flags = cliFlags{}
+
+	write := func(content string) {
+		t.Helper()
+		if err := os.WriteFile("config.json", []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(content)
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	useConfig(t, cfg)
+	return write
+}
+
+// sentMeasurementID serves a hit and returns the measurement id it was
+// sent to.
+func sentMeasurementID(t *testing.T, page string) string {
+	t.Helper()
+	sender := &recordingSender{}
+	serveHit(t, &server{sender: sender}, "/acct/"+page+"?pixel", "1234.5678")
+	sent := sender.sent()
+	if len(sent) != 1 {
+		t.Fatalf("sent %d hits, want 1", len(sent))
+	}
+	return sent[0].Meta.Creds.MeasurementID
+}
+
+func TestReloadConfig(t *testing.T) {
+	write := reloadTestSetup(t, `{"measurement_id": "G-FIRST", "api_secret": "s"}`)
+	steps := []struct {
+		name    string
+		content string
+		wantErr bool
+		wantID  string
+	}{
+		{"new measurement_id", `{"measurement_id": "G-SECOND", "api_secret": "s"}`, false, "G-SECOND"},
+		{"malformed file keeps the running config", `{"measurement_id": `, true, "G-SECOND"},
+		{"invalid config keeps the running config", `{"measurement_id": "G-THIRD"}`, true, "G-SECOND"},
+		{"valid again", `{"measurement_id": "G-FOURTH", "api_secret": "s"}`, false, "G-FOURTH"},
+	}
+	if id := sentMeasurementID(t, "start"); id != "G-FIRST" {
+		t.Fatalf("before reloading, hit sent to %s, want G-FIRST", id)
+	}
+	for i, step := range steps {
+		t.Run(step.name, func(t *testing.T) {
+			write(step.content)
+			if err := reloadConfig(); (err != nil) != step.wantErr {
+				t.Errorf("reloadConfig() = %v, want error: %v", err, step.wantErr)
+			}
+			if id := sentMeasurementID(t, fmt.Sprintf("step-%d", i)); id != step.wantID {
+				t.Errorf("hit sent to %s, want %s", id, step.wantID)
+			}
+		})
+	}
+}
+
+func TestReloadOnHangup(t *testing.T) {
+	write := reloadTestSetup(t, `{"measurement_id": "G-FIRST", "api_secret": "s"}`)
+	// Keep SIGHUP from killing the test binary if it arrives before
+	// reloadOnHangup is listening.
+	guard := make(chan os.Signal, 1)
+	signal.Notify(guard, syscall.SIGHUP)
+	defer signal.Stop(guard)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go reloadOnHangup(ctx)
+
+	write(`{"measurement_id": "G-SECOND", "api_secret": "s"}`)
+	deadline := time.Now().Add(2 * time.Second)
+	for config().MeasurementID != "G-SECOND" {
+		if time.Now().After(deadline) {
+			t.Fatalf("measurement_id = %s after SIGHUP, want G-SECOND", config().MeasurementID)
+		}
+		syscall.Kill(os.Getpid(), syscall.SIGHUP)
+		time.Sleep(20 * time.Millisecond)
+	}
+	if id := sentMeasurementID(t, "after-hup"); id != "G-SECOND" {
+		t.Errorf("hit sent to %s, want G-SECOND", id)
+	}
+}
+
+func TestRestartSettings(t *testing.T) {
+	tests := []struct {
+		name string
+		new  Config
+		want []string
+	}{
+		{"nothing changed", Config{Workers: 4}, nil},
+		{"live settings only", Config{Workers: 4, MeasurementID: "G-NEW", BotUserAgents: []string{"crawler"}}, nil},
+		{"port", Config{Workers: 4, Port: "9090"}, []string{"port"}},
+		{"several", Config{Workers: 8, QueueDir: "/var/spool/beacon", StaticDir: "/srv/static"}, []string{"queue_dir", "static_dir", "workers"}},
+		{"state built at startup", Config{Workers: 4, RetryBudgetPerSecond: 5, StaleCountSeconds: 60, RequestTimeoutSeconds: 3}, []string{"request_timeout_seconds", "retry_budget_per_second", "stale_count_seconds"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			old := Config{Workers: 4}
+			if got := restartSettings(&old, &tt.new); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("restartSettings() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReloadWarnsAboutRetryBudget(t *testing.T) {
+	write := reloadTestSetup(t, `{"measurement_id": "G-FIRST", "api_secret": "s", "retry_budget_per_second": 5}`)
+	if err := applyConfig(*config()); err != nil {
+		t.Fatal(err)
+	}
+	budget := retryBudget
+	logs := captureLogs(t)
+
+	write(`{"measurement_id": "G-FIRST", "api_secret": "s", "retry_budget_per_second": 50}`)
+	if err := reloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if out := logs.String(); !strings.Contains(out, "only take effect on restart") || !strings.Contains(out, "retry_budget_per_second") {
+		t.Errorf("reload logged no restart warning for retry_budget_per_second:\n%s", out)
+	}
+	if retryBudget != budget {
+		t.Error("retry budget replaced by the reload, want it kept until a restart")
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMaxRetries = 3
+	retryBaseDelay    = 500 * time.Millisecond
+	retryMaxDelay     = 30 * time.Second
+)
+
+var (
+	gaRetries              = newCounter("beacon_ga_retries_total", "Posts to GA retried after a network error, 429 or 5xx.")
+	retryBudgetExhausted   = newCounter("beacon_retry_budget_exhausted_total", "Failed posts not retried because retry_budget_per_second was used up.")
+	retryBudgetUtilization = newGauge("beacon_retry_budget_utilization", "Fraction of the retry_budget_per_second budget in use, from 0 to 1.")
+)
+
+// retryBudget is set when retry_budget_per_second is.
+var retryBudget *retryLimiter
+
+// retryLimiter is a single token bucket shared by every delivery, so that
+// during a GA outage retries are throttled collectively instead of each
+// queued hit retrying on its own schedule. It holds at most a second's
+// worth of retries.
+type retryLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // retries per second
+	burst  float64
+	bucket tokenBucket
+}
+
+func newRetryLimiter(perSecond float64, now time.Time) *retryLimiter {
+	burst := max(perSecond, 1)
+	return &retryLimiter{rate: perSecond, burst: burst, bucket: tokenBucket{tokens: burst, last: now}}
+}
+
+// Allow takes a retry from the budget if there is one to spare, and
+// reports whether it did.
+func (l *retryLimiter) Allow(now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b := &l.bucket
+	b.tokens = min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	ok := b.tokens >= 1
+	if ok {
+		b.tokens--
+	}
+	retryBudgetUtilization.Set(1 - b.tokens/l.burst)
+	return ok
+}
+
+// retryAllowed reports whether the shared retry budget, if any, has room
+// for another retry.
+func retryAllowed(now time.Time) bool {
+	if retryBudget == nil {
+		return true
+	}
+	if !retryBudget.Allow(now) {
+		retryBudgetExhausted.Inc()
+		return false
+	}
+	return true
+}
+
+// maxRetries is how many times a failed post is retried; max_retries of -1
+// disables retrying.
+func maxRetries() int {
+	switch {
+	case config().MaxRetries < 0:
+		return 0
+	case config().MaxRetries > 0:
+		return config().MaxRetries
+	}
+	return defaultMaxRetries
+}
+
+// retryableStatus reports whether a collector response is worth retrying.
+func retryableStatus(code int) bool {
+	return code == http.StatusTooManyRequests || code >= 500
+}
+
+// retryDelay returns how long to wait before retry number attempt+1: the
+// collector's Retry-After when it sent one, otherwise exponential backoff
+// with jitter. resp is nil after a network error.
+func retryDelay(attempt int, resp *http.Response) time.Duration {
+	if resp != nil {
+		if d, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+			return min(d, retryMaxDelay)
+		}
+	}
+
+	d := retryBaseDelay << attempt
+	if d <= 0 || d > retryMaxDelay {
+		d = retryMaxDelay
+	}
+	// Equal jitter: somewhere between half and all of the backoff.
+	return d/2 + rand.N(d/2+1)
+}
+
+// parseRetryAfter accepts both the delay-seconds and HTTP-date forms.
+func parseRetryAfter(v string, now time.Time) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return max(t.Sub(now), 0), true
+	}
+	return 0, false
+}
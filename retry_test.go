@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSendToGARetries(t *testing.T) {
+	tests := []struct {
+		name         string
+		maxRetries   int
+		statuses     []int // collector's answers in turn, the last repeated
+		wantAttempts int32
+		wantErr      bool
+	}{
+		{"fails twice then succeeds", 0, []int{503, 503, 204}, 3, false},
+		{"rate limited then succeeds", 0, []int{429, 204}, 2, false},
+		{"400 is not retried", 0, []int{400}, 1, true},
+		{"gives up after max_retries", 0, []int{500}, 4, true},
+		{"max_retries -1 disables retrying", -1, []int{503}, 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var attempts atomic.Int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := int(attempts.Add(1))
+				status := tt.statuses[min(n, len(tt.statuses))-1]
+				// Retry-After keeps the test from waiting out the backoff.
+				w.Header().Set("Retry-After", "0")
+				w.WriteHeader(status)
+			}))
+			defer srv.Close()
+			useConfig(t, withTestCreds(Config{CollectorURL: srv.URL, MaxRetries: tt.maxRetries}))
+
+			err := sendToGA(context.Background(), "test-agent", "192.0.2.1", "cid", Credentials{MeasurementID: "G-TEST", APISecret: "secret"}, GA4Payload{ClientID: "cid"})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("sendToGA() = %v, want error: %v", err, tt.wantErr)
+			}
+			if n := attempts.Load(); n != tt.wantAttempts {
+				t.Errorf("%d attempts, want %d", n, tt.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	withRetryAfter := func(v string) *http.Response {
+		return &http.Response{Header: http.Header{"Retry-After": {v}}}
+	}
+	tests := []struct {
+		name     string
+		attempt  int
+		resp     *http.Response
+		min, max time.Duration
+	}{
+		{"first retry", 0, nil, 250 * time.Millisecond, 500 * time.Millisecond},
+		{"third retry", 2, nil, time.Second, 2 * time.Second},
+		{"capped backoff", 10, nil, retryMaxDelay / 2, retryMaxDelay},
+		{"huge attempt", 100, nil, retryMaxDelay / 2, retryMaxDelay},
+		{"Retry-After seconds", 0, withRetryAfter("5"), 5 * time.Second, 5 * time.Second},
+		{"Retry-After capped", 0, withRetryAfter("3600"), retryMaxDelay, retryMaxDelay},
+		{"Retry-After date in the past", 0, withRetryAfter("Wed, 21 Oct 2015 07:28:00 GMT"), 0, 0},
+		{"malformed Retry-After", 0, withRetryAfter("soon"), 250 * time.Millisecond, 500 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := 0; i < 20; i++ {
+				if d := retryDelay(tt.attempt, tt.resp); d < tt.min || d > tt.max {
+					t.Fatalf("retryDelay = %v, want %v to %v", d, tt.min, tt.max)
+				}
+			}
+		})
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 5, 2, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		v      string
+		want   time.Duration
+		wantOK bool
+	}{
+		{"", 0, false},
+		{"0", 0, true},
+		{"120", 2 * time.Minute, true},
+		{"-5", 0, false},
+		{"Thu, 02 May 2024 10:00:30 GMT", 30 * time.Second, true},
+		{"Thu, 02 May 2024 09:00:00 GMT", 0, true},
+		{"tomorrow", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseRetryAfter(tt.v, now)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("parseRetryAfter(%q) = %v, %v, want %v, %v", tt.v, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestRetryLimiter(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	tests := []struct {
+		name      string
+		perSecond float64
+		at        []time.Duration // when each retry is asked for
+		want      []bool
+	}{
+		{"burst of one second", 2, []time.Duration{0, 0, 0}, []bool{true, true, false}},
+		{"refills over time", 2, []time.Duration{0, 0, 0, 500 * time.Millisecond, 500 * time.Millisecond}, []bool{true, true, false, true, false}},
+		{"never beyond the burst", 1, []time.Duration{0, 10 * time.Second, 10 * time.Second}, []bool{true, true, false}},
+		{"fractional rate", 0.5, []time.Duration{0, time.Second, 2 * time.Second}, []bool{true, false, true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newRetryLimiter(tt.perSecond, start)
+			for i, at := range tt.at {
+				if got := l.Allow(start.Add(at)); got != tt.want[i] {
+					t.Errorf("retry %d at %v: Allow = %v, want %v", i, at, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestRetryAllowedCountsExhaustion(t *testing.T) {
+	useConfig(t, Config{RetryBudgetPerSecond: 1})
+	before := retryBudgetExhausted.Value()
+	now := time.Now()
+	if !retryAllowed(now) {
+		t.Fatal("first retry refused")
+	}
+	if retryAllowed(now) {
+		t.Fatal("second retry in the same instant allowed")
+	}
+	if got := retryBudgetExhausted.Value() - before; got != 1 {
+		t.Errorf("beacon_retry_budget_exhausted_total rose by %v, want 1", got)
+	}
+	if got := retryBudgetUtilization.Value(); got != 1 {
+		t.Errorf("beacon_retry_budget_utilization = %v, want 1", got)
+	}
+
+	useConfig(t, Config{})
+	for i := 0; i < 10; i++ {
+		if !retryAllowed(now) {
+			t.Fatal("retry refused without a budget")
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// Where / redirects unless root_redirect says otherwise.
+const defaultRootRedirect = "https://github.com/igrigorik/ga-beacon"
+
+// landingPage is served at / when root_redirect is set to "".
+const landingPage = `<!DOCTYPE html>
+<html>
+<head>
+  <meta charset="utf-8">
+  <title>GA4 Beacon</title>
+</head>
+<body>
+<h1>GA4 Beacon</h1>
+<p>This service records page views in Google Analytics 4 from an image embedded in a page:</p>
+<pre>&lt;img src="/&lt;account&gt;/&lt;page&gt;" alt="Analytics"&gt;</pre>
+<p>Add <code>?pixel</code> for an invisible 1x1 image instead of a badge.</p>
+</body>
+</html>
+`
+
+// rootRedirect is where / redirects, or "" to serve landingPage instead.
+func rootRedirect() string {
+	if config().RootRedirect == nil {
+		return defaultRootRedirect
+	}
+	return *config().RootRedirect
+}
+
+// validRootRedirect reports whether v is an http(s) URL or an absolute
+// path on this host.
+func validRootRedirect(v string) error {
+	u, err := url.Parse(v)
+	if err != nil {
+		return err
+	}
+	if u.Scheme == "" && u.Host == "" && len(u.Path) > 0 && u.Path[0] == '/' {
+		return nil
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("must be an http(s) URL or a path starting with /")
+	}
+	return nil
+}
+
+// serveRoot answers /, with a redirect to rootRedirect or the landing page.
+func serveRoot(w http.ResponseWriter, r *http.Request) {
+	if target := rootRedirect(); target != "" {
+		http.Redirect(w, r, target, http.StatusFound)
+		return
+	}
+	nonce, err := newNonce()
+	if err != nil {
+		http.Error(w, "cannot generate nonce", http.StatusInternalServerError)
+		return
+	}
+	setPageHeaders(w, nonce)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	fmt.Fprint(w, landingPage)
+}
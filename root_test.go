@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRootRedirect(t *testing.T) {
+	tests := []struct {
+		name         string
+		config       string // JSON config
+		wantCode     int
+		wantLocation string
+	}{
+		{"default", `{}`, http.StatusFound, defaultRootRedirect},
+		{"custom URL", `{"root_redirect": "https://docs.example.com/beacon"}`, http.StatusFound, "https://docs.example.com/beacon"},
+		{"path", `{"root_redirect": "/help"}`, http.StatusFound, "/help"},
+		{"landing page", `{"root_redirect": ""}`, http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var c Config
+			if err := json.Unmarshal([]byte(tt.config), &c); err != nil {
+				t.Fatal(err)
+			}
+			useConfig(t, withTestCreds(c))
+			sender := &recordingSender{}
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Header.Set("User-Agent", "Mozilla/5.0")
+			w := httptest.NewRecorder()
+			newMux(&server{sender: sender}).ServeHTTP(w, r)
+
+			if w.Code != tt.wantCode {
+				t.Fatalf("status %d, want %d", w.Code, tt.wantCode)
+			}
+			if got := w.Header().Get("Location"); got != tt.wantLocation {
+				t.Errorf("Location %q, want %q", got, tt.wantLocation)
+			}
+			if n := len(sender.sent()); n != 0 {
+				t.Errorf("sent %d hits, want none", n)
+			}
+			if tt.wantCode != http.StatusOK {
+				return
+			}
+			if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+				t.Errorf("Content-Type %q, want HTML", ct)
+			}
+			if !strings.Contains(w.Body.String(), "<h1>GA4 Beacon</h1>") {
+				t.Errorf("landing page missing:\n%s", w.Body)
+			}
+			if w.Header().Get("Content-Security-Policy") == "" {
+				t.Error("landing page has no Content-Security-Policy")
+			}
+		})
+	}
+}
+
+func TestValidRootRedirect(t *testing.T) {
+	tests := []struct {
+		target  string
+		wantErr bool
+	}{
+		{"https://docs.example.com/beacon", false},
+		{"http://example.com", false},
+		{"/help", false},
+		{"help", true},
+		{"//evil.example.com", true},
+		{"javascript:alert(1)", true},
+		{"ftp://example.com", true},
+		{"https://", true},
+	}
+	for _, tt := range tests {
+		target := tt.target
+		c := withTestCreds(Config{RootRedirect: &target})
+		if err := c.validate(); (err != nil) != tt.wantErr {
+			t.Errorf("root_redirect %q: validate() = %v, want error: %v", tt.target, err, tt.wantErr)
+		}
+	}
+}
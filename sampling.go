@@ -0,0 +1,32 @@
+package main
+
+import (
+	"hash/fnv"
+	"math/rand/v2"
+)
+
+var hitsSampledOut = newCounter("beacon_hits_sampled_out_total", "Hits counted on the badge but not sent to GA because of sample_rate.")
+
+// sampleRate is the share of hits sent to GA: sample_rate, or all of them.
+func sampleRate() float64 {
+	if r := config().SampleRate; r > 0 {
+		return r
+	}
+	return 1
+}
+
+// sampledOut reports whether a hit from cid is left out of GA by
+// sample_rate. With sticky_sampling the choice comes from a hash of cid,
+// so a client's hits are either all sent or none are.
+func sampledOut(cid string) bool {
+	rate := sampleRate()
+	if rate >= 1 {
+		return false
+	}
+	if config().StickySampling {
+		h := fnv.New64a()
+		h.Write([]byte(cid))
+		return float64(h.Sum64()>>11)/(1<<53) >= rate
+	}
+	return rand.Float64() >= rate
+}
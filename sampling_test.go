@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"testing"
+)
+
+func TestSampledOut(t *testing.T) {
+	const n = 20000
+	tests := []struct {
+		name   string
+		rate   float64
+		sticky bool
+		want   float64 // share of hits sent
+	}{
+		{"default", 0, false, 1},
+		{"all", 1, false, 1},
+		{"half", 0.5, false, 0.5},
+		{"tenth", 0.1, false, 0.1},
+		{"half, sticky", 0.5, true, 0.5},
+		{"tenth, sticky", 0.1, true, 0.1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, withTestCreds(Config{SampleRate: tt.rate, StickySampling: tt.sticky}))
+			sent := 0
+			for i := 0; i < n; i++ {
+				if !sampledOut(fmt.Sprintf("%d.1700000000", i)) {
+					sent++
+				}
+			}
+			if got := float64(sent) / n; math.Abs(got-tt.want) > 0.02 {
+				t.Errorf("sent %.3f of hits, want about %.3f", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStickySampling(t *testing.T) {
+	tests := []struct {
+		sticky     bool
+		wantStable bool
+	}{
+		{true, true},
+		{false, false},
+	}
+	for _, tt := range tests {
+		useConfig(t, withTestCreds(Config{SampleRate: 0.5, StickySampling: tt.sticky}))
+		for _, cid := range []string{"1234.5678", "0d6e3b2a-3f0c-4c59-9a0e-2b8d3c1f7a66"} {
+			first, stable := sampledOut(cid), true
+			for i := 0; i < 200; i++ {
+				if sampledOut(cid) != first {
+					stable = false
+				}
+			}
+			if stable != tt.wantStable {
+				t.Errorf("sticky_sampling %v: cid %s consistently in or out: %v, want %v", tt.sticky, cid, stable, tt.wantStable)
+			}
+		}
+	}
+}
+
+func TestSampledOutHitsAreServedAndCounted(t *testing.T) {
+	useConfig(t, withTestCreds(Config{SampleRate: 0.5, StickySampling: true}))
+	// One client sampled in and one sampled out.
+	cids := map[bool]string{}
+	for i := 0; len(cids) < 2; i++ {
+		cid := fmt.Sprintf("%d.1700000000", i)
+		if _, ok := cids[sampledOut(cid)]; !ok {
+			cids[sampledOut(cid)] = cid
+		}
+	}
+	tests := []struct {
+		name     string
+		cid      string
+		wantSent int
+	}{
+		{"sampled in", cids[false], 1},
+		{"sampled out", cids[true], 0},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			saved := hitCounts
+			hitCounts = newMemoryCounterStore()
+			t.Cleanup(func() { hitCounts = saved })
+			sender := &recordingSender{}
+			w := serveHit(t, &server{sender: sender}, fmt.Sprintf("/acct/sampled-%d?pixel", i), tt.cid)
+			if ct := w.Header().Get("Content-Type"); w.Code != http.StatusOK || ct != "image/gif" {
+				t.Errorf("status %d, Content-Type %q; want the pixel", w.Code, ct)
+			}
+			if n := len(sender.sent()); n != tt.wantSent {
+				t.Errorf("sent %d hits, want %d", n, tt.wantSent)
+			}
+			if n, _ := hitCounts.Get("acct"); n != 1 {
+				t.Errorf("counted %d hits, want 1", n)
+			}
+		})
+	}
+
+	for _, rate := range []float64{-0.1, 1.1} {
+		if c := withTestCreds(Config{SampleRate: rate}); c.validate() == nil {
+			t.Errorf("sample_rate %v validated", rate)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"strings"
+)
+
+// defaultPageCSP lets the account page run its own inline script, marked
+// with the per-response nonce, and load and report to Google Analytics,
+// and nothing else. {nonce} is replaced with the nonce.
+const defaultPageCSP = "default-src 'none'; " +
+	"script-src 'nonce-{nonce}' https://www.google-analytics.com; " +
+	"img-src https://www.google-analytics.com; " +
+	"connect-src https://www.google-analytics.com; " +
+	"base-uri 'none'; form-action 'none'; frame-ancestors 'none'"
+
+// defaultPageHeaders are the security headers sent with the account page.
+// Images are left without them, since they are meant to be embedded.
+var defaultPageHeaders = map[string]string{
+	"Content-Security-Policy": defaultPageCSP,
+	"X-Content-Type-Options":  "nosniff",
+	"Referrer-Policy":         "no-referrer",
+	"X-Frame-Options":         "DENY",
+}
+
+// newNonce returns a random nonce for the account page's Content-Security-
+// Policy.
+func newNonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+// setPageHeaders sets the security headers for the account page:
+// defaultPageHeaders, as replaced or added to by security_headers, where
+// an empty value leaves a header out. {nonce} in a value becomes nonce.
+func setPageHeaders(w http.ResponseWriter, nonce string) {
+	headers := make(map[string]string, len(defaultPageHeaders))
+	for name, v := range defaultPageHeaders {
+		headers[name] = v
+	}
+	for name, v := range config().SecurityHeaders {
+		headers[http.CanonicalHeaderKey(name)] = v
+	}
+	for name, v := range headers {
+		if v != "" {
+			w.Header().Set(name, strings.ReplaceAll(v, "{nonce}", nonce))
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestSecurityHeaders(t *testing.T) {
+	if err := loadAssets(""); err != nil {
+		t.Fatal(err)
+	}
+	pageHeaders := []string{"Content-Security-Policy", "X-Content-Type-Options", "Referrer-Policy", "X-Frame-Options"}
+	tests := []struct {
+		name    string
+		headers map[string]string // security_headers
+		target  string
+		want    map[string]string // "" means the header is absent
+	}{
+		{"account page", nil, "/acct", map[string]string{
+			"X-Content-Type-Options": "nosniff", "Referrer-Policy": "no-referrer", "X-Frame-Options": "DENY",
+		}},
+		{"replaced and added", map[string]string{"referrer-policy": "same-origin", "Permissions-Policy": "camera=()"}, "/acct", map[string]string{
+			"Referrer-Policy": "same-origin", "Permissions-Policy": "camera=()", "X-Frame-Options": "DENY",
+		}},
+		{"left out", map[string]string{"X-Frame-Options": ""}, "/acct", map[string]string{
+			"X-Frame-Options": "", "X-Content-Type-Options": "nosniff",
+		}},
+		{"svg badge", nil, "/acct/page", nil},
+		{"pixel", nil, "/acct/page-p?pixel", nil},
+		{"gif badge", nil, "/acct/page-g?gif", nil},
+	}
+	nonceAttr := regexp.MustCompile(`<script nonce="([^"]+)">`)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, withTestCreds(Config{SecurityHeaders: tt.headers}))
+			r := httptest.NewRequest("GET", tt.target, nil)
+			r.Header.Set("User-Agent", "Mozilla/5.0")
+			w := httptest.NewRecorder()
+			(&server{sender: &recordingSender{}}).handler(w, r)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d, want 200", w.Code)
+			}
+
+			if tt.want == nil {
+				// Images are meant to be embedded anywhere.
+				for _, name := range pageHeaders {
+					if v := w.Header().Get(name); v != "" {
+						t.Errorf("%s: %s on an image", name, v)
+					}
+				}
+				return
+			}
+			for name, want := range tt.want {
+				if got := w.Header().Get(name); got != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+			// The CSP lets the page's own script run, by its nonce.
+			m := nonceAttr.FindStringSubmatch(w.Body.String())
+			if m == nil {
+				t.Fatalf("no nonced script in the page:\n%s", w.Body)
+			}
+			// The attribute may escape characters of the nonce, such as +.
+			nonce := html.UnescapeString(m[1])
+			csp := w.Header().Get("Content-Security-Policy")
+			if !strings.Contains(csp, "'nonce-"+nonce+"'") || !strings.Contains(csp, "default-src 'none'") {
+				t.Errorf("Content-Security-Policy %q doesn't allow the page's script nonce %q", csp, nonce)
+			}
+		})
+	}
+}
+
+func TestNonceIsFresh(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		n, err := newNonce()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(n) < 22 || seen[n] {
+			t.Fatalf("nonce %q is short or repeated", n)
+		}
+		seen[n] = true
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import "context"
+
+// HitMeta carries what delivery needs to know about a hit besides its
+// payload.
+type HitMeta struct {
+	Creds   Credentials
+	Account string
+	UA      string
+	IP      string
+	CID     string
+
+	// Stream and Beacon are the ?stream= and the beacon path_prefix that
+	// Creds were picked by, so they can be picked again for a hit read
+	// back from queue_dir.
+	Stream string
+	Beacon string
+
+	// RequestID ties log lines about the delivery to the request that
+	// produced it, even once queued.
+	RequestID string
+}
+
+// Sender delivers a hit's payload to GA, or hands it off to something
+// that will.
+type Sender interface {
+	Send(ctx context.Context, meta HitMeta, payload GA4Payload) error
+}
+
+// asyncSender is a Sender, such as the batcher, that may deliver a hit
+// after Send returns, calling done with the outcome once it has.
+type asyncSender interface {
+	SendAsync(ctx context.Context, meta HitMeta, payload GA4Payload, done func(error))
+}
+
+// gaSender posts payloads straight to the GA collector.
+type gaSender struct{}
+
+func (gaSender) Send(ctx context.Context, meta HitMeta, payload GA4Payload) error {
+	return sendToGA(ctx, meta.UA, meta.IP, meta.CID, meta.Creds, payload)
+}
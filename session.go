@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultSessionTimeout = 30 * time.Minute
+
+// How long a client's session count is remembered after its last hit.
+const sessionMemory = 30 * 24 * time.Hour
+
+// sessionInfo describes the session a hit belongs to.
+type sessionInfo struct {
+	ID     string
+	Number int
+	New    bool
+}
+
+type sessionState struct {
+	id       string
+	number   int
+	lastSeen time.Time
+}
+
+var (
+	sessionsMu sync.Mutex
+	sessions   = newTTLCache[sessionState](maxTrackedClients, sessionMemory)
+)
+
+func sessionTimeout() time.Duration {
+	if config().SessionTimeoutMinutes > 0 {
+		return time.Duration(config().SessionTimeoutMinutes) * time.Minute
+	}
+	return defaultSessionTimeout
+}
+
+// touchSession returns the session for a hit from cid at now. A hit within
+// the session timeout of the client's previous one continues its session;
+// otherwise a new session is started, with its id from the session_strategy and
+// the client's session count incremented.
+func touchSession(r *http.Request, cid string, now time.Time) sessionInfo {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+
+	state, ok := sessions.Get(cid, now)
+	if ok && now.Sub(state.lastSeen) < sessionTimeout() {
+		state.lastSeen = now
+		sessions.Add(cid, state, now)
+		return sessionInfo{ID: state.id, Number: state.number}
+	}
+
+	state = sessionState{
+		id:       config().sessionIDs.SessionID(r, cid, now),
+		number:   state.number + 1,
+		lastSeen: now,
+	}
+	sessions.Add(cid, state, now)
+	return sessionInfo{ID: state.id, Number: state.number, New: true}
+}
+
+// peekSession returns what touchSession would for a hit, without
+// recording it.
+func peekSession(r *http.Request, cid string, now time.Time) sessionInfo {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+
+	state, ok := sessions.Get(cid, now)
+	if ok && now.Sub(state.lastSeen) < sessionTimeout() {
+		return sessionInfo{ID: state.id, Number: state.number}
+	}
+	return sessionInfo{ID: config().sessionIDs.SessionID(r, cid, now), Number: state.number + 1, New: true}
+}
+
+// SessionIDStrategy produces the GA4 session_id for a hit from client cid.
+type SessionIDStrategy interface {
+	SessionID(r *http.Request, cid string, now time.Time) string
+}
+
+func newSessionIDStrategy(name string) (SessionIDStrategy, error) {
+	switch name {
+	case "", "timestamp":
+		return timestampSessionID{}, nil
+	case "random":
+		return randomSessionID{}, nil
+	case "cid":
+		return cidSessionID{}, nil
+	case "ga_cookie":
+		return gaCookieSessionID{fallback: timestampSessionID{}}, nil
+	}
+	return nil, fmt.Errorf("unknown session_strategy %q", name)
+}
+
+// timestampSessionID uses the Unix time a session starts at as its id.
+type timestampSessionID struct{}
+
+func (timestampSessionID) SessionID(r *http.Request, cid string, now time.Time) string {
+	return strconv.FormatInt(now.Unix(), 10)
+}
+
+// randomSessionID uses a random positive 31-bit number per session.
+type randomSessionID struct{}
+
+func (randomSessionID) SessionID(r *http.Request, cid string, now time.Time) string {
+	var b [4]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return timestampSessionID{}.SessionID(r, cid, now)
+	}
+	return strconv.FormatUint(uint64(binary.BigEndian.Uint32(b[:])&0x7fffffff), 10)
+}
+
+// cidSessionID derives the id from the cid and the time the session starts,
+// so a client's sessions get distinct ids that are reproducible from both.
+type cidSessionID struct{}
+
+func (cidSessionID) SessionID(r *http.Request, cid string, now time.Time) string {
+	h := fnv.New32a()
+	h.Write([]byte(cid))
+	h.Write([]byte(strconv.FormatInt(now.Unix(), 10)))
+	return strconv.FormatUint(uint64(h.Sum32()&0x7fffffff), 10)
+}
+
+// gaCookieSessionID reuses the session id from a gtag.js `_ga_<container>`
+// cookie when the beacon shares a domain with the tracked site.
+type gaCookieSessionID struct {
+	fallback SessionIDStrategy
+}
+
+func (s gaCookieSessionID) SessionID(r *http.Request, cid string, now time.Time) string {
+	for _, c := range r.Cookies() {
+		if !strings.HasPrefix(c.Name, "_ga_") {
+			continue
+		}
+		if id := parseGASessionCookie(c.Value); id != "" {
+			return id
+		}
+	}
+	return s.fallback.SessionID(r, cid, now)
+}
+
+// parseGASessionCookie extracts the session id from both the
+// "GS1.1.<session>.<number>..." and "GS2.1.s<session>$o<number>..." formats.
+func parseGASessionCookie(v string) string {
+	parts := strings.Split(v, ".")
+	if len(parts) < 3 {
+		return ""
+	}
+	id := parts[2]
+	if strings.HasPrefix(parts[0], "GS2") {
+		id, _, _ = strings.Cut(strings.TrimPrefix(id, "s"), "$")
+	}
+	if _, err := strconv.ParseUint(id, 10, 64); err != nil {
+		return ""
+	}
+	return id
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestTouchSession(t *testing.T) {
+	start := time.Date(2024, 5, 2, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name       string
+		timeout    int // session_timeout_minutes
+		gap        time.Duration
+		wantSame   bool
+		wantNumber int
+	}{
+		{"5 minutes apart", 0, 5 * time.Minute, true, 1},
+		{"29 minutes apart", 0, 29 * time.Minute, true, 1},
+		{"40 minutes apart", 0, 40 * time.Minute, false, 2},
+		{"a day apart", 0, 24 * time.Hour, false, 2},
+		{"within a longer timeout", 60, 40 * time.Minute, true, 1},
+		{"past a shorter timeout", 10, 15 * time.Minute, false, 2},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, Config{SessionTimeoutMinutes: tt.timeout})
+			r := httptest.NewRequest("GET", "/acct/page", nil)
+			cid := "session-cid-" + strconv.Itoa(i)
+
+			first := touchSession(r, cid, start)
+			if !first.New || first.Number != 1 {
+				t.Fatalf("first hit: %+v, want a new session number 1", first)
+			}
+			second := touchSession(r, cid, start.Add(tt.gap))
+			if same := second.ID == first.ID; same != tt.wantSame {
+				t.Errorf("session ids %q and %q, want the same: %v", first.ID, second.ID, tt.wantSame)
+			}
+			if second.New == tt.wantSame {
+				t.Errorf("second hit New = %v, want %v", second.New, !tt.wantSame)
+			}
+			if second.Number != tt.wantNumber {
+				t.Errorf("session_number = %d, want %d", second.Number, tt.wantNumber)
+			}
+		})
+	}
+}
+
+func TestSessionIDStrategies(t *testing.T) {
+	now := time.Date(2024, 5, 2, 10, 0, 0, 0, time.UTC)
+	plain := httptest.NewRequest("GET", "/acct/page", nil)
+	withGA := httptest.NewRequest("GET", "/acct/page", nil)
+	withGA.AddCookie(&http.Cookie{Name: "_ga_ABC123", Value: "GS1.1.1714600000.3.1.1714600100.0.0.0"})
+
+	tests := []struct {
+		strategy string
+		r        *http.Request
+		want     string // "" to only check the id is a positive number
+	}{
+		{"", plain, "1714644000"},
+		{"timestamp", plain, "1714644000"},
+		{"random", plain, ""},
+		{"cid", plain, ""},
+		{"ga_cookie", withGA, "1714600000"},
+		{"ga_cookie", plain, "1714644000"}, // falls back to timestamp
+	}
+	for _, tt := range tests {
+		s, err := newSessionIDStrategy(tt.strategy)
+		if err != nil {
+			t.Fatalf("newSessionIDStrategy(%q): %v", tt.strategy, err)
+		}
+		id := s.SessionID(tt.r, "cid-1", now)
+		if n, err := strconv.ParseInt(id, 10, 64); err != nil || n <= 0 {
+			t.Errorf("%q strategy gave %q, want a positive number", tt.strategy, id)
+		}
+		if tt.want != "" && id != tt.want {
+			t.Errorf("%q strategy gave %q, want %q", tt.strategy, id, tt.want)
+		}
+	}
+
+	if _, err := newSessionIDStrategy("sequential"); err == nil {
+		t.Error("unknown strategy accepted")
+	}
+}
+
+func TestCIDSessionIDPerSession(t *testing.T) {
+	start := time.Date(2024, 5, 2, 1, 0, 0, 0, time.UTC)
+	r := httptest.NewRequest("GET", "/acct/page", nil)
+	s := cidSessionID{}
+	id := s.SessionID(r, "cid-1", start)
+	if got := s.SessionID(r, "cid-1", start); got != id {
+		t.Errorf("same client, same start: %q, want %q", got, id)
+	}
+	if got := s.SessionID(r, "cid-1", start.Add(2*time.Hour)); got == id {
+		t.Error("same client, later session on the same day: id unchanged")
+	}
+	if got := s.SessionID(r, "cid-2", start); got == id {
+		t.Error("other client, same start: same id")
+	}
+}
+
+func TestCIDSessionsSameDay(t *testing.T) {
+	useConfig(t, Config{SessionStrategy: "cid"})
+	r := httptest.NewRequest("GET", "/acct/page", nil)
+	start := time.Date(2024, 5, 2, 9, 0, 0, 0, time.UTC)
+	first := touchSession(r, "cid-same-day", start)
+	again := touchSession(r, "cid-same-day", start.Add(10*time.Minute))
+	later := touchSession(r, "cid-same-day", start.Add(3*time.Hour))
+	if again.ID != first.ID {
+		t.Errorf("hit within the session: id %q, want %q", again.ID, first.ID)
+	}
+	if !later.New || later.ID == first.ID {
+		t.Errorf("session after the timeout: %+v, want a new session with an id other than %q", later, first.ID)
+	}
+}
+
+func TestRandomSessionIDVaries(t *testing.T) {
+	r := httptest.NewRequest("GET", "/acct/page", nil)
+	now := time.Now()
+	seen := make(map[string]bool)
+	for i := 0; i < 20; i++ {
+		seen[randomSessionID{}.SessionID(r, "cid", now)] = true
+	}
+	if len(seen) < 19 {
+		t.Errorf("20 random ids had only %d distinct values", len(seen))
+	}
+}
+
+func TestParseGASessionCookie(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"GS1.1.1714600000.3.1.1714600100.0.0.0", "1714600000"},
+		{"GS2.1.s1714600000$o3$g1$t1714600100$j0$l0$h0", "1714600000"},
+		{"GS1.1", ""},
+		{"GS1.1.notanumber.3", ""},
+		{"GS2.1.sabc$o3", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := parseGASessionCookie(tt.value); got != tt.want {
+			t.Errorf("parseGASessionCookie(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
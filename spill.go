@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	// Name of the file in queue_dir that hits spilled from the delivery
+	// queue are kept in.
+	spillFileName = "spill.jsonl"
+
+	// Most bytes of spilled hits kept on disk. Hits beyond that are
+	// queued in memory as usual, or dropped if the queue is full.
+	maxSpillBytes = 256 << 20
+)
+
+var (
+	queueSpilled    = newCounter("beacon_queue_spilled_total", "Hits written to queue_dir because the delivery queue was past queue_spill_depth.")
+	queueUnspilled  = newCounter("beacon_queue_unspilled_total", "Spilled hits read back into the delivery queue.")
+	queueSpillDepth = newGauge("beacon_queue_spill_depth", "Spilled hits waiting in queue_dir.")
+
+	errSpillFull = errors.New("spill file full")
+)
+
+// hitSpill is a first-in, first-out file of hits that the delivery queue
+// kept on disk rather than in memory. Hits are appended at the end and
+// read back from the front, and the file is emptied once all of them have
+// been read. Like the write-ahead log it isn't synced, and hits read back
+// just before a crash are read again after it.
+type hitSpill struct {
+	mu   sync.Mutex
+	path string
+	w    *os.File // appends
+	r    *os.File // reads from the front
+	rbuf *bufio.Reader
+	n    int   // hits not yet read
+	size int64 // bytes in the file, read or not
+	read int64 // bytes already read
+}
+
+// openHitSpill opens the spill file in dir, creating both if needed. Hits
+// spilled by an earlier run and never read back are read first.
+func openHitSpill(dir string) (*hitSpill, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	s := &hitSpill{path: filepath.Join(dir, spillFileName)}
+	w, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	r, err := os.Open(s.path)
+	if err != nil {
+		w.Close()
+		return nil, err
+	}
+	s.w, s.r, s.rbuf = w, r, bufio.NewReader(r)
+
+	// End a line cut short by a crash, so the next hit isn't appended to
+	// it. Reading skips it as malformed.
+	if info, err := w.Stat(); err == nil && info.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err := r.ReadAt(last, info.Size()-1); err == nil && last[0] != '\n' {
+			w.Write([]byte("\n"))
+		}
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxSpillBytes)
+	for scanner.Scan() {
+		s.n++
+		s.size += int64(len(scanner.Bytes())) + 1
+	}
+	err = scanner.Err()
+	if err == nil {
+		_, err = r.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	queueSpillDepth.Set(float64(s.n))
+	return s, nil
+}
+
+// Len returns how many spilled hits are waiting to be read back.
+func (s *hitSpill) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.n
+}
+
+// Append writes a hit to the end of the file.
+func (s *hitSpill) Append(h walHit) error {
+	line, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.w == nil {
+		return os.ErrClosed
+	}
+	if s.size+int64(len(line))+1 > maxSpillBytes {
+		return errSpillFull
+	}
+	n, err := s.w.Write(append(line, '\n'))
+	s.size += int64(n)
+	if err != nil {
+		return err
+	}
+	s.n++
+	queueSpilled.Inc()
+	queueSpillDepth.Set(float64(s.n))
+	return nil
+}
+
+// Next reads the oldest hit not yet read back, reporting false when there
+// are none.
+func (s *hitSpill) Next() (walHit, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.n > 0 && s.r != nil {
+		line, err := s.rbuf.ReadBytes('\n')
+		s.read += int64(len(line))
+		if err != nil {
+			// Give up on the rest rather than spilling on to a file
+			// that can't be read back.
+			slog.Error("cannot read spilled hits from queue_dir, dropping them", "hits", s.n, "err", err)
+			hitsDropped.Add(float64(s.n), "reason", "spill_unreadable")
+			s.n = 0
+			queueSpillDepth.Set(0)
+			s.reset()
+			return walHit{}, false
+		}
+		s.n--
+		queueSpillDepth.Set(float64(s.n))
+		if s.n == 0 {
+			s.reset()
+		}
+
+		var h walHit
+		if err := json.Unmarshal(line, &h); err != nil {
+			slog.Warn("skipping malformed line in queue_dir spill file", "err", err)
+			continue
+		}
+		queueUnspilled.Inc()
+		return h, true
+	}
+	return walHit{}, false
+}
+
+// reset empties the file once every hit in it has been read.
+func (s *hitSpill) reset() {
+	if err := s.w.Truncate(0); err != nil {
+		slog.Error("cannot empty queue_dir spill file", "err", err)
+		return
+	}
+	s.r.Seek(0, io.SeekStart)
+	s.rbuf.Reset(s.r)
+	s.size, s.read = 0, 0
+}
+
+// Close closes the file, first dropping the hits already read back from
+// it so they aren't read again on the next start.
+func (s *hitSpill) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.w == nil {
+		return nil
+	}
+	if s.read > 0 && s.n > 0 {
+		if err := s.compact(); err != nil {
+			slog.Error("cannot compact queue_dir spill file", "err", err)
+		}
+	}
+	err := errors.Join(s.w.Close(), s.r.Close())
+	s.w, s.r = nil, nil
+	return err
+}
+
+// compact replaces the file with one holding only the hits not yet read.
+func (s *hitSpill) compact() error {
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), spillFileName+".*")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tmp, s.rbuf)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
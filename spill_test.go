@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func spillHit(cid string) walHit {
+	return walHit{Meta: storedMeta{CID: cid}, Payload: GA4Payload{ClientID: cid}}
+}
+
+// readSpill reads back every hit left in s.
+func readSpill(s *hitSpill) []string {
+	var cids []string
+	for {
+		h, ok := s.Next()
+		if !ok {
+			return cids
+		}
+		cids = append(cids, h.Meta.CID)
+	}
+}
+
+func TestHitSpillKeepsUnreadHitsAcrossRestarts(t *testing.T) {
+	dir := t.TempDir()
+	s, err := openHitSpill(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cid := range []string{"a", "b", "c"} {
+		if err := s.Append(spillHit(cid)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if h, ok := s.Next(); !ok || h.Meta.CID != "a" {
+		t.Fatalf("Next = %q, %v, want a", h.Meta.CID, ok)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = openHitSpill(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if n := s.Len(); n != 2 {
+		t.Errorf("Len after reopening = %d, want 2", n)
+	}
+	if got := fmt.Sprint(readSpill(s)); got != "[b c]" {
+		t.Errorf("read back %s, want [b c]", got)
+	}
+	if info, err := os.Stat(filepath.Join(dir, spillFileName)); err != nil || info.Size() != 0 {
+		t.Errorf("spill file not emptied once read: %v, %v", info, err)
+	}
+
+	// Hits spilled after it was emptied are read as usual.
+	s.Append(spillHit("d"))
+	if got := fmt.Sprint(readSpill(s)); got != "[d]" {
+		t.Errorf("read back %s, want [d]", got)
+	}
+}
+
+func TestHitSpillSkipsLineCutShort(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, spillFileName), []byte(`{"meta":{"CID":"a"}}`+"\n"+`{"meta":{"CI`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	s, err := openHitSpill(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.Append(spillHit("b"))
+	if got := fmt.Sprint(readSpill(s)); got != "[a b]" {
+		t.Errorf("read back %s, want [a b]", got)
+	}
+}
+
+// gatedSender is a recordingSender whose sends wait for gate to close.
+type gatedSender struct {
+	recordingSender
+	gate chan struct{}
+}
+
+func (s *gatedSender) Send(ctx context.Context, meta HitMeta, payload GA4Payload) error {
+	<-s.gate
+	return s.recordingSender.Send(ctx, meta, payload)
+}
+
+func TestSendQueueSpillsAndReadsBack(t *testing.T) {
+	useConfig(t, withTestCreds(Config{}))
+	spill, err := openHitSpill(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spill.Close()
+
+	sender := &gatedSender{gate: make(chan struct{})}
+	q := newSendQueue(sender, nil, 1, 10)
+	q.SpillTo(spill, 2)
+	before := queueSpilled.Value()
+
+	const hits = 8
+	for i := 0; i < hits; i++ {
+		if err := q.Send(context.Background(), HitMeta{CID: fmt.Sprint(i)}, GA4Payload{}); err != nil {
+			t.Fatalf("Send #%d: %v", i, err)
+		}
+	}
+	// At most two wait in memory and one is with the blocked worker.
+	if spilled := queueSpilled.Value() - before; spilled < hits-3 {
+		t.Errorf("spilled %v hits, want at least %d", spilled, hits-3)
+	}
+
+	close(sender.gate)
+	deadline := time.Now().Add(5 * time.Second)
+	for len(sender.sent()) < hits && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := q.Drain(time.Second); n != 0 {
+		t.Errorf("Drain left %d hits", n)
+	}
+
+	sent := sender.sent()
+	if len(sent) != hits {
+		t.Fatalf("delivered %d hits, want %d", len(sent), hits)
+	}
+	for i, h := range sent {
+		if h.Meta.CID != fmt.Sprint(i) {
+			t.Errorf("delivery %d was hit %s, want hits in the order sent", i, h.Meta.CID)
+			break
+		}
+	}
+}
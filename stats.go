@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// statsResponse is what /stats/<account> reports.
+type statsResponse struct {
+	Account string `json:"account"`
+	Count   int64  `json:"count"`
+
+	// Days holds the hits counted on each of the last 30 days that had
+	// any, by UTC date.
+	Days map[string]int64 `json:"days"`
+}
+
+// statsHandler serves an account's badge count as JSON, for building on
+// without scraping the badge. Accounts without hits report 0. It sends
+// no hit itself.
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	account := strings.Trim(strings.TrimPrefix(r.URL.Path, "/stats/"), "/")
+	if account == "" || strings.Contains(account, "/") {
+		http.Error(w, "expected /stats/<account>", http.StatusNotFound)
+		return
+	}
+	if !validAccount(account) {
+		http.Error(w, "invalid account", http.StatusBadRequest)
+		return
+	}
+	account = normalizeAccount(account)
+	if retiredAccount(account) {
+		http.Error(w, "account retired", http.StatusGone)
+		return
+	}
+	if !allowedAccount(account) {
+		http.NotFound(w, r)
+		return
+	}
+
+	n, err := hitCounts.Get(account)
+	if err != nil {
+		logger(r.Context()).Error("cannot read hit count", "account", account, "err", err)
+		http.Error(w, "cannot read hit count", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=60")
+	json.NewEncoder(w).Encode(statsResponse{Account: account, Count: n, Days: dailyHits.Days(account, time.Now())})
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStatsHandler(t *testing.T) {
+	tests := []struct {
+		name      string
+		config    Config
+		method    string
+		target    string
+		down      bool // whether the counter store fails
+		wantCode  int
+		wantCount int64
+	}{
+		{"known account", Config{}, "GET", "/stats/acct", false, http.StatusOK, 3},
+		{"unknown account", Config{}, "GET", "/stats/nobody", false, http.StatusOK, 0},
+		{"normalized account", Config{NormalizeAccount: "lowercase"}, "GET", "/stats/ACCT", false, http.StatusOK, 3},
+		{"trailing slash", Config{}, "GET", "/stats/acct/", false, http.StatusOK, 3},
+		{"HEAD", Config{}, "HEAD", "/stats/acct", false, http.StatusOK, 0},
+		{"not allowed", Config{AllowedAccounts: []string{"other-*"}}, "GET", "/stats/acct", false, http.StatusNotFound, 0},
+		{"no account", Config{}, "GET", "/stats/", false, http.StatusNotFound, 0},
+		{"page", Config{}, "GET", "/stats/acct/page", false, http.StatusNotFound, 0},
+		{"invalid account", Config{}, "GET", "/stats/a%20b", false, http.StatusBadRequest, 0},
+		{"POST", Config{}, "POST", "/stats/acct", false, http.StatusMethodNotAllowed, 0},
+		{"store down", Config{}, "GET", "/stats/acct", true, http.StatusInternalServerError, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, withTestCreds(tt.config))
+			store := &flakyStore{memoryCounterStore: newMemoryCounterStore(), down: tt.down}
+			store.counts["acct"] = 3
+			saved := hitCounts
+			hitCounts = store
+			t.Cleanup(func() { hitCounts = saved })
+
+			sender := &recordingSender{}
+			r := httptest.NewRequest(tt.method, tt.target, nil)
+			r.Header.Set("User-Agent", "Mozilla/5.0")
+			w := httptest.NewRecorder()
+			newMux(&server{sender: sender}).ServeHTTP(w, r)
+
+			if w.Code != tt.wantCode {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.wantCode, w.Body)
+			}
+			if n := len(sender.sent()); n != 0 {
+				t.Errorf("sent %d hits, want none", n)
+			}
+			if n, _ := store.memoryCounterStore.Get("acct"); n != 3 {
+				t.Errorf("acct counted at %d after the request, want 3", n)
+			}
+			if w.Code != http.StatusOK || tt.method == "HEAD" {
+				return
+			}
+			if cc := w.Header().Get("Cache-Control"); cc != "public, max-age=60" {
+				t.Errorf("Cache-Control %q, want public, max-age=60", cc)
+			}
+			var got statsResponse
+			if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+				t.Fatalf("decoding %q: %v", w.Body.String(), err)
+			}
+			if got.Count != tt.wantCount {
+				t.Errorf("count = %d, want %d", got.Count, tt.wantCount)
+			}
+		})
+	}
+}
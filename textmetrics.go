@@ -0,0 +1,62 @@
+package main
+
+import "unicode"
+
+// Font size the badges' text is measured at, in pixels, and the font
+// units per em of verdanaWidths.
+const (
+	badgeFontSize  = 11
+	fontUnitsPerEm = 2048
+)
+
+// verdanaWidths are the advance widths of ' ' through '~' in Verdana, in
+// font units, as shields.io measures its badges. DejaVu Sans, which the
+// badges name first, runs a little wider; the segment padding absorbs it.
+var verdanaWidths = [...]uint16{
+	720, 823, 1038, 1876, 1427, 2479, 1663, 557, 1038, 1038, 1427, 1876, 823, 1038, 823, 1038, // ' ' to '/'
+	1427, 1427, 1427, 1427, 1427, 1427, 1427, 1427, 1427, 1427, // '0' to '9'
+	1038, 1038, 1876, 1876, 1876, 1222, 2247, // ':' to '@'
+	1401, 1410, 1432, 1577, 1295, 1177, 1587, 1540, 862, 1038, 1438, 1136, 1725, // 'A' to 'M'
+	1541, 1612, 1255, 1612, 1430, 1410, 1264, 1509, 1401, 2025, 1405, 1252, 1405, // 'N' to 'Z'
+	1038, 1038, 1038, 1876, 1427, 1427, // '[' to '`'
+	1236, 1276, 1064, 1276, 1212, 720, 1276, 1296, 562, 705, 1198, 562, 1992, // 'a' to 'm'
+	1296, 1243, 1276, 1276, 874, 1064, 807, 1296, 1198, 1651, 1198, 1198, 1055, // 'n' to 'z'
+	1300, 1038, 1300, 1876, // '{' to '~'
+}
+
+// Widths, in font units, assumed for characters outside verdanaWidths:
+// full-width scripts and emoji take a whole em, other letters about as
+// much as a capital.
+const (
+	wideRuneWidth  = fontUnitsPerEm
+	otherRuneWidth = 1400
+)
+
+// measureText returns the width s takes up in the badges' font, in pixels.
+// ASCII is measured with Verdana's own widths, and anything else
+// estimated, erring wide so text doesn't clip.
+func measureText(s string) float64 {
+	units := 0
+	for _, r := range s {
+		switch {
+		case r >= ' ' && r <= '~':
+			units += int(verdanaWidths[r-' '])
+		case unicode.In(r, unicode.Mn, unicode.Me, unicode.Cf) || unicode.IsControl(r):
+			// Combining marks, joiners and variation selectors take no
+			// space of their own.
+		case wideRune(r):
+			units += wideRuneWidth
+		default:
+			units += otherRuneWidth
+		}
+	}
+	return float64(units) * badgeFontSize / fontUnitsPerEm
+}
+
+// wideRune reports whether r is drawn a full em wide: CJK, kana, Hangul
+// and emoji.
+func wideRune(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul) ||
+		(r >= 0x1F000 && r <= 0x1FAFF) || (r >= 0x2600 && r <= 0x27BF) ||
+		(r >= 0xFF00 && r <= 0xFF60)
+}
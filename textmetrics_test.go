@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"regexp"
+	"strconv"
+	"testing"
+)
+
+func TestMeasureText(t *testing.T) {
+	// px is the width of n font units at the badge font size.
+	px := func(n int) float64 { return float64(n) * badgeFontSize / fontUnitsPerEm }
+	tests := []struct {
+		name string
+		text string
+		want float64
+	}{
+		{"empty", "", 0},
+		{"digit", "1", px(1427)},
+		{"count", "1,234", px(4*1427 + 823)},
+		{"label", "visits", px(1198 + 562 + 1064 + 562 + 807 + 1064)},
+		{"CJK", "訪問", px(2 * wideRuneWidth)},
+		{"emoji", "🚀", px(wideRuneWidth)},
+		{"emoji with variation selector", "❤️", px(wideRuneWidth)},
+		{"combining accent", "é", px(1212)},
+		{"other letters", "жé", px(2 * otherRuneWidth)},
+		{"invalid UTF-8", "\xff\xfe", px(2 * otherRuneWidth)},
+		{"control characters", "a\tb", px(1236 + 1276)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := measureText(tt.text); math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("measureText(%q) = %v, want %v", tt.text, got, tt.want)
+			}
+		})
+	}
+
+	if narrow, wide := measureText("iiii"), measureText("WWWW"); narrow >= wide {
+		t.Errorf("iiii measures %v, WWWW %v; want WWWW wider", narrow, wide)
+	}
+}
+
+func TestBadgeWidthFollowsText(t *testing.T) {
+	widthAttr := regexp.MustCompile(`<svg [^>]*width="(\d+)"`)
+	width := func(t *testing.T, style, label, value string) int {
+		t.Helper()
+		b, err := renderBadge(style, label, value, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := widthAttr.FindSubmatch(b)
+		if m == nil {
+			t.Fatalf("no width in %s", b)
+		}
+		n, _ := strconv.Atoi(string(m[1]))
+		return n
+	}
+	tests := []struct {
+		name               string
+		shortLabel, shortV string
+		longLabel, longV   string
+	}{
+		{"longer count", "visits", "7", "visits", "1,234,567"},
+		{"longer label", "hits", "42", "page views", "42"},
+		{"wide characters", "visits", "42", "訪問数の合計", "42"},
+		{"emoji", "visits", "42", "visits 🚀🚀", "42"},
+	}
+	for style := range badgeStyles {
+		for _, tt := range tests {
+			t.Run(style+"/"+tt.name, func(t *testing.T) {
+				short := width(t, style, tt.shortLabel, tt.shortV)
+				long := width(t, style, tt.longLabel, tt.longV)
+				if long <= short {
+					t.Errorf("%q/%q is %dpx wide, %q/%q %dpx; want the longer text wider", tt.longLabel, tt.longV, long, tt.shortLabel, tt.shortV, short)
+				}
+			})
+		}
+	}
+}
+
+func TestRenderBadgeIsCached(t *testing.T) {
+	first, err := renderBadge("svg", "visits", "42", "green", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, _ := renderBadge("svg", "visits", "42", "green", "")
+	if &first[0] != &again[0] {
+		t.Error("the same badge was rendered twice, want the cached one")
+	}
+	for _, other := range [][4]string{
+		{"svg", "visits", "43", "green"},
+		{"svg", "visits", "42", "red"},
+		{"flat", "visits", "42", "green"},
+	} {
+		b, err := renderBadge(other[0], other[1], other[2], other[3], "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Equal(b, first) {
+			t.Errorf("badge %q rendered the same as svg/visits/42/green", other)
+		}
+	}
+}
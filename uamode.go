@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// Universal Analytics Measurement Protocol endpoint, used in "ua" mode
+// unless collector_url is set.
+const defaultUACollectorURL = "https://www.google-analytics.com/collect"
+
+// Most hits UA accepts in one batch request.
+const uaMaxBatchHits = 20
+
+// GA4 collects these itself from page views; UA has no equivalent hit.
+var uaSkippedEvents = map[string]bool{
+	"first_visit":   true,
+	"session_start": true,
+}
+
+// uaMode reports whether hits go to Universal Analytics rather than GA4.
+func uaMode() bool {
+	return config().Mode == "ua"
+}
+
+// uaHits encodes payload as classic Measurement Protocol hits, one form
+// body per line: page_view becomes a pageview hit and other events become
+// event hits with the event name as the action. Only the page and IP
+// params have UA fields; custom, default and other event params are
+// dropped, as UA's custom dimensions are numbered slots set up per property
+// rather than named params.
+func uaHits(creds Credentials, ua, cid string, payload GA4Payload) []string {
+	var hits []string
+	for _, event := range payload.Events {
+		if uaSkippedEvents[event.Name] {
+			continue
+		}
+
+		v := url.Values{}
+		v.Set("v", "1")
+		v.Set("tid", creds.MeasurementID)
+		v.Set("cid", cid)
+		if payload.UserID != "" {
+			v.Set("uid", payload.UserID)
+		}
+		if event.Name == "page_view" {
+			v.Set("t", "pageview")
+		} else {
+			v.Set("t", "event")
+			v.Set("ec", "ga-beacon")
+			v.Set("ea", event.Name)
+		}
+		for param, field := range map[string]string{
+			"page_location": "dl",
+			"page_path":     "dp",
+			"page_title":    "dt",
+			"page_referrer": "dr",
+			"ip_address":    "uip",
+		} {
+			if s, ok := event.Params[param].(string); ok && s != "" {
+				v.Set(field, s)
+			}
+		}
+		if ua != "" {
+			v.Set("ua", ua)
+		}
+		if anonymizeIPEnabled() {
+			v.Set("aip", "1")
+		}
+		if !payload.Received.IsZero() {
+			v.Set("qt", fmt.Sprint(time.Since(payload.Received).Milliseconds()))
+		}
+		hits = append(hits, v.Encode())
+	}
+	return hits
+}
+
+// uaCollectorURL is where n UA hits are posted: the collect endpoint, or
+// its batch counterpart for more than one, on the configured collector or
+// its /debug validation counterpart.
+func uaCollectorURL(n int, debug bool) string {
+	base := defaultUACollectorURL
+	if config().CollectorURL != "" {
+		base = config().CollectorURL
+	}
+	u, err := url.Parse(base)
+	if err != nil {
+		u, _ = url.Parse(defaultUACollectorURL)
+	}
+	u.Path = path.Join("/", u.Path)
+	if n > 1 {
+		u.Path = path.Join(path.Dir(u.Path), "batch")
+	}
+	if debug && !strings.HasPrefix(u.Path, "/debug/") {
+		u.Path = "/debug" + u.Path
+	}
+	return u.String()
+}
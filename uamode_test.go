@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestUAMode(t *testing.T) {
+	pageView := GA4Event{Name: "page_view", Params: map[string]interface{}{
+		"page_location": "https://example.com/docs",
+		"page_path":     "/docs",
+		"page_title":    "Docs",
+		"ip_address":    "192.0.2.0",
+	}}
+	pageViewHit := url.Values{
+		"v": {"1"}, "tid": {"UA-1-1"}, "cid": {"1234.5678"}, "t": {"pageview"},
+		"dl": {"https://example.com/docs"}, "dp": {"/docs"}, "dt": {"Docs"},
+		"uip": {"192.0.2.0"}, "ua": {"test-agent/1.0"}, "aip": {"1"},
+	}
+	signUpHit := url.Values{
+		"v": {"1"}, "tid": {"UA-1-1"}, "cid": {"1234.5678"}, "t": {"event"},
+		"ec": {"ga-beacon"}, "ea": {"sign_up"}, "ua": {"test-agent/1.0"}, "aip": {"1"},
+	}
+	tests := []struct {
+		name     string
+		mode     string
+		events   []GA4Event
+		wantPath string
+		wantType string
+		wantBody string       // GA4 mode
+		wantHits []url.Values // UA mode, one per line
+	}{
+		{"ga4", "", []GA4Event{{Name: "page_view", Params: map[string]interface{}{"page_path": "/docs"}}},
+			"/mp/collect", "application/json",
+			`{"client_id":"1234.5678","events":[{"name":"page_view","params":{"page_path":"/docs"}}]}`, nil},
+		{"ua page view", "ua", []GA4Event{pageView}, "/mp/collect", "application/x-www-form-urlencoded", "",
+			[]url.Values{pageViewHit}},
+		{"ua skips session events", "ua", []GA4Event{{Name: "first_visit"}, {Name: "session_start"}, pageView},
+			"/mp/collect", "application/x-www-form-urlencoded", "", []url.Values{pageViewHit}},
+		{"ua batch", "ua", []GA4Event{pageView, {Name: "sign_up"}}, "/mp/batch", "application/x-www-form-urlencoded", "",
+			[]url.Values{pageViewHit, signUpHit}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got *http.Request
+			var body []byte
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = r
+				body, _ = io.ReadAll(r.Body)
+				w.WriteHeader(http.StatusNoContent)
+			}))
+			defer srv.Close()
+			useConfig(t, Config{Mode: tt.mode, MeasurementID: "UA-1-1", APISecret: "secret", CollectorURL: srv.URL + "/mp/collect"})
+
+			payload := GA4Payload{ClientID: "1234.5678", Events: tt.events}
+			creds := Credentials{MeasurementID: "UA-1-1", APISecret: "secret"}
+			if err := sendToGA(context.Background(), "test-agent/1.0", "192.0.2.1", "1234.5678", creds, payload); err != nil {
+				t.Fatal(err)
+			}
+			if got == nil {
+				t.Fatal("collector got no request")
+			}
+			if got.URL.Path != tt.wantPath {
+				t.Errorf("path = %s, want %s", got.URL.Path, tt.wantPath)
+			}
+			if ct := got.Header.Get("Content-Type"); ct != tt.wantType {
+				t.Errorf("Content-Type = %q, want %q", ct, tt.wantType)
+			}
+			if tt.wantHits == nil {
+				if string(body) != tt.wantBody {
+					t.Errorf("body = %s, want %s", body, tt.wantBody)
+				}
+				return
+			}
+			lines := strings.Split(string(body), "\n")
+			if len(lines) != len(tt.wantHits) {
+				t.Fatalf("got %d hits, want %d:\n%s", len(lines), len(tt.wantHits), body)
+			}
+			for i, line := range lines {
+				hit, err := url.ParseQuery(line)
+				if err != nil {
+					t.Fatalf("hit %d %q: %v", i, line, err)
+				}
+				if !reflect.DeepEqual(hit, tt.wantHits[i]) {
+					t.Errorf("hit %d = %v, want %v", i, hit, tt.wantHits[i])
+				}
+			}
+		})
+	}
+}
+
+func TestUAModeSplitsLargeBatches(t *testing.T) {
+	var mu sync.Mutex
+	var batches []int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		batches = append(batches, len(strings.Split(string(body), "\n")))
+		mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+	useConfig(t, Config{Mode: "ua", MeasurementID: "UA-1-1", CollectorURL: srv.URL + "/collect"})
+
+	var events []GA4Event
+	for i := 0; i < uaMaxBatchHits+5; i++ {
+		events = append(events, GA4Event{Name: fmt.Sprintf("event_%d", i)})
+	}
+	err := sendToGA(context.Background(), "test-agent/1.0", "192.0.2.1", "1234.5678", Credentials{MeasurementID: "UA-1-1"}, GA4Payload{Events: events})
+	if err != nil {
+		t.Fatal(err)
+	}
+	total := 0
+	for _, n := range batches {
+		if n > uaMaxBatchHits {
+			t.Errorf("batch of %d hits, want at most %d", n, uaMaxBatchHits)
+		}
+		total += n
+	}
+	if total != len(events) {
+		t.Errorf("sent %d hits in batches %v, want %d", total, batches, len(events))
+	}
+}
+
+func TestUACollectorURL(t *testing.T) {
+	tests := []struct {
+		collector string
+		n         int
+		debug     bool
+		want      string
+	}{
+		{"", 1, false, "https://www.google-analytics.com/collect"},
+		{"", 2, false, "https://www.google-analytics.com/batch"},
+		{"", 1, true, "https://www.google-analytics.com/debug/collect"},
+		{"https://proxy.example/ga/collect", 3, false, "https://proxy.example/ga/batch"},
+		{"https://proxy.example/debug/collect", 1, true, "https://proxy.example/debug/collect"},
+		{"https://proxy.example", 2, false, "https://proxy.example/batch"},
+		{"https://proxy.example", 2, true, "https://proxy.example/debug/batch"},
+		{"https://proxy.example/", 1, true, "https://proxy.example/debug/"},
+	}
+	for _, tt := range tests {
+		useConfig(t, Config{Mode: "ua", MeasurementID: "UA-1-1", CollectorURL: tt.collector})
+		if got := uaCollectorURL(tt.n, tt.debug); got != tt.want {
+			t.Errorf("uaCollectorURL(%d, %v) with collector_url %q = %s, want %s", tt.n, tt.debug, tt.collector, got, tt.want)
+		}
+	}
+}
+
+func TestUAModeBatchToBareCollector(t *testing.T) {
+	var got *http.Request
+	var body []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		body, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+	useConfig(t, Config{Mode: "ua", MeasurementID: "UA-1-1", CollectorURL: srv.URL})
+
+	events := []GA4Event{
+		{Name: "page_view", Params: map[string]interface{}{"page_path": "/docs", "custom_plan": "pro", "environment": "prod"}},
+		{Name: "sign_up", Params: map[string]interface{}{"custom_plan": "pro"}},
+	}
+	err := sendToGA(context.Background(), "test-agent/1.0", "192.0.2.1", "1234.5678", Credentials{MeasurementID: "UA-1-1"}, GA4Payload{Events: events})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got == nil {
+		t.Fatal("collector got no request")
+	}
+	if got.URL.Path != "/batch" {
+		t.Errorf("path = %s, want /batch", got.URL.Path)
+	}
+	want := []url.Values{
+		{"v": {"1"}, "tid": {"UA-1-1"}, "cid": {"1234.5678"}, "t": {"pageview"}, "dp": {"/docs"}, "ua": {"test-agent/1.0"}, "aip": {"1"}},
+		{"v": {"1"}, "tid": {"UA-1-1"}, "cid": {"1234.5678"}, "t": {"event"}, "ec": {"ga-beacon"}, "ea": {"sign_up"}, "ua": {"test-agent/1.0"}, "aip": {"1"}},
+	}
+	lines := strings.Split(string(body), "\n")
+	if len(lines) != len(want) {
+		t.Fatalf("got %d hits, want %d:\n%s", len(lines), len(want), body)
+	}
+	for i, line := range lines {
+		hit, err := url.ParseQuery(line)
+		if err != nil {
+			t.Fatalf("hit %d %q: %v", i, line, err)
+		}
+		if !reflect.DeepEqual(hit, want[i]) {
+			t.Errorf("hit %d = %v, want %v", i, hit, want[i])
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import "strings"
+
+// uaToken is a substring of a User-Agent that identifies an operating
+// system or browser. Earlier entries win, since many user agents name
+// the browsers and systems they are compatible with as well as their own.
+type uaToken struct {
+	token string
+	name  string
+}
+
+var uaOperatingSystems = []uaToken{
+	{"Windows Phone", "Windows Phone"},
+	{"Windows", "Windows"},
+	{"iPhone", "iOS"},
+	{"iPad", "iOS"},
+	{"iPod", "iOS"},
+	{"Android", "Android"},
+	{"CrOS", "Chrome OS"},
+	{"Mac OS X", "macOS"},
+	{"Macintosh", "macOS"},
+	{"Linux", "Linux"},
+}
+
+var uaBrowsers = []uaToken{
+	{"Edg/", "Edge"},
+	{"EdgiOS/", "Edge"},
+	{"EdgA/", "Edge"},
+	{"OPR/", "Opera"},
+	{"SamsungBrowser/", "Samsung Internet"},
+	{"Firefox/", "Firefox"},
+	{"FxiOS/", "Firefox"},
+	{"CriOS/", "Chrome"},
+	{"Chrome/", "Chrome"},
+	{"Safari/", "Safari"},
+}
+
+// parseUserAgent picks the device category ("desktop", "mobile" or
+// "tablet"), operating system and browser out of a User-Agent. Parts it
+// doesn't recognize come back empty.
+func parseUserAgent(ua string) (device, os, browser string) {
+	os = matchUAToken(ua, uaOperatingSystems)
+	browser = matchUAToken(ua, uaBrowsers)
+
+	switch {
+	case strings.Contains(ua, "iPad") || strings.Contains(ua, "Tablet"):
+		device = "tablet"
+	case os == "Android" && !strings.Contains(ua, "Mobile"):
+		device = "tablet"
+	case os == "iOS" || os == "Android" || os == "Windows Phone" || strings.Contains(ua, "Mobile"):
+		device = "mobile"
+	case os != "":
+		device = "desktop"
+	}
+	return device, os, browser
+}
+
+func matchUAToken(ua string, tokens []uaToken) string {
+	for _, t := range tokens {
+		if strings.Contains(ua, t.token) {
+			return t.name
+		}
+	}
+	return ""
+}
+
+// addDeviceParams sets device_category, operating_system and browser from
+// ua, leaving out whatever parseUserAgent can't tell.
+func addDeviceParams(params map[string]interface{}, ua string) {
+	device, os, browser := parseUserAgent(ua)
+	for name, v := range map[string]string{"device_category": device, "operating_system": os, "browser": browser} {
+		if v != "" {
+			params[name] = v
+		}
+	}
+}
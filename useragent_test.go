@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const (
+	desktopChromeUA = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36"
+	mobileSafariUA  = "Mozilla/5.0 (iPhone; CPU iPhone OS 17_1 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.1 Mobile/15E148 Safari/604.1"
+)
+
+func TestParseUserAgent(t *testing.T) {
+	tests := []struct {
+		name                string
+		ua                  string
+		device, os, browser string
+	}{
+		{"desktop Chrome", desktopChromeUA, "desktop", "Windows", "Chrome"},
+		{"mobile Safari", mobileSafariUA, "mobile", "iOS", "Safari"},
+		{"iPad", "Mozilla/5.0 (iPad; CPU OS 17_1 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.1 Mobile/15E148 Safari/604.1", "tablet", "iOS", "Safari"},
+		{"Android phone", "Mozilla/5.0 (Linux; Android 14; Pixel 8) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Mobile Safari/537.36", "mobile", "Android", "Chrome"},
+		{"Android tablet", "Mozilla/5.0 (Linux; Android 13; SM-X700) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36", "tablet", "Android", "Chrome"},
+		{"macOS Edge", "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36 Edg/120.0.0.0", "desktop", "macOS", "Edge"},
+		{"Linux Firefox", "Mozilla/5.0 (X11; Linux x86_64; rv:121.0) Gecko/20100101 Firefox/121.0", "desktop", "Linux", "Firefox"},
+		{"empty", "", "", "", ""},
+		{"garbage", "\x00not a browser \xff", "", "", ""},
+		{"huge", strings.Repeat("x", 1<<16), "", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			device, os, browser := parseUserAgent(tt.ua)
+			if device != tt.device || os != tt.os || browser != tt.browser {
+				t.Errorf("parseUserAgent() = %q, %q, %q, want %q, %q, %q", device, os, browser, tt.device, tt.os, tt.browser)
+			}
+		})
+	}
+}
+
+func TestDeviceParams(t *testing.T) {
+	tests := []struct {
+		name  string
+		parse bool
+		ua    string
+		want  map[string]string // device param name to value, "" when absent
+	}{
+		{"desktop Chrome", true, desktopChromeUA, map[string]string{"device_category": "desktop", "operating_system": "Windows", "browser": "Chrome"}},
+		{"mobile Safari", true, mobileSafariUA, map[string]string{"device_category": "mobile", "operating_system": "iOS", "browser": "Safari"}},
+		{"empty UA", true, "", map[string]string{"device_category": "", "operating_system": "", "browser": ""}},
+		{"parse_user_agent off", false, desktopChromeUA, map[string]string{"device_category": "", "operating_system": "", "browser": ""}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, Config{ParseUserAgent: tt.parse})
+			r := httptest.NewRequest("GET", "/acct/page?pixel", nil)
+			r.Header.Set("User-Agent", tt.ua)
+			params := payloadFor(t, r, "203.0.113.7").Events[0].Params
+			for name, want := range tt.want {
+				got, ok := params[name]
+				if want == "" {
+					if ok {
+						t.Errorf("%s = %v, want it left out", name, got)
+					}
+				} else if got != want {
+					t.Errorf("%s = %v, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	payloadsInvalid = newCounter("beacon_payloads_invalid_total", "Payloads GA4's validation endpoint reported problems with.")
+	payloadsPartial = newCounter("beacon_payloads_partial_total", "Payloads sent without the events GA4's validation endpoint reported problems with.")
+	eventsInvalid   = newCounter("beacon_events_invalid_total", "Events left out of partly valid payloads, by validation code.")
+)
+
+// validationMessage is a problem reported by /debug/mp/collect.
+type validationMessage struct {
+	FieldPath      string `json:"fieldPath"`
+	Description    string `json:"description"`
+	ValidationCode string `json:"validationCode"`
+}
+
+// validationResponse is the body returned by /debug/mp/collect.
+type validationResponse struct {
+	ValidationMessages []validationMessage `json:"validationMessages"`
+}
+
+func (m validationMessage) String() string {
+	return fmt.Sprintf("%s: %s (%s)", m.FieldPath, m.Description, m.ValidationCode)
+}
+
+// The endpoint names the event a message is about in its field path, as
+// in events[2].params, or in its description, as in "Event at index: [2]".
+var (
+	eventFieldPath   = regexp.MustCompile(`^events\[(\d+)\]`)
+	eventDescription = regexp.MustCompile(`(?i)\bevent at index: \[(\d+)\]`)
+)
+
+// event returns the index of the event m is about, reporting false if it
+// isn't about a particular event.
+func (m validationMessage) event() (int, bool) {
+	match := eventFieldPath.FindStringSubmatch(m.FieldPath)
+	if match == nil {
+		match = eventDescription.FindStringSubmatch(m.Description)
+	}
+	if match == nil {
+		return 0, false
+	}
+	i, err := strconv.Atoi(match[1])
+	return i, err == nil
+}
+
+func joinMessages(messages []validationMessage) string {
+	s := make([]string, len(messages))
+	for i, m := range messages {
+		s[i] = m.String()
+	}
+	return strings.Join(s, "; ")
+}
+
+// validEvents returns payload without the events that messages are about,
+// along with the validation code of each event left out. It reports false
+// when that can't save the payload: a message isn't about a particular
+// event, or no event would be left.
+func validEvents(payload GA4Payload, messages []validationMessage) (GA4Payload, map[int]string, bool) {
+	invalid := make(map[int]string)
+	for _, m := range messages {
+		i, ok := m.event()
+		if !ok || i >= len(payload.Events) {
+			return payload, nil, false
+		}
+		if _, seen := invalid[i]; !seen {
+			invalid[i] = m.ValidationCode
+		}
+	}
+	if len(invalid) == len(payload.Events) {
+		return payload, nil, false
+	}
+
+	valid := payload
+	valid.Events = make([]GA4Event, 0, len(payload.Events)-len(invalid))
+	for i, e := range payload.Events {
+		if _, ok := invalid[i]; !ok {
+			valid.Events = append(valid.Events, e)
+		}
+	}
+	return valid, invalid, true
+}
+
+// validatePayload posts payload to GA4's validation endpoint for creds and
+// returns its validation messages, if any. Nothing is recorded in GA.
+func validatePayload(c context.Context, creds Credentials, payload GA4Payload) ([]validationMessage, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(c, "POST", collectorURL(creds, true), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	release, err := acquireSendSlot(c)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := gaClient.Do(req)
+	release()
+	if err != nil {
+		return nil, redactURLError(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("validation endpoint returned %s", resp.Status)
+	}
+
+	var result validationResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("cannot parse validation response: %v", err)
+	}
+	return result.ValidationMessages, nil
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func eventNames(p GA4Payload) string {
+	names := make([]string, len(p.Events))
+	for i, e := range p.Events {
+		names[i] = e.Name
+	}
+	return fmt.Sprint(names)
+}
+
+func TestValidatePayload(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		body    string
+		want    []validationMessage
+		wantErr bool
+	}{
+		{"empty list", http.StatusOK, `{"validationMessages": []}`, nil, false},
+		{"no list", http.StatusOK, `{}`, nil, false},
+		{"messages", http.StatusOK, `{"validationMessages": [{"fieldPath": "events[0].name", "description": "Event name is reserved.", "validationCode": "NAME_RESERVED"}]}`,
+			[]validationMessage{{FieldPath: "events[0].name", Description: "Event name is reserved.", ValidationCode: "NAME_RESERVED"}}, false},
+		{"error status", http.StatusInternalServerError, ``, nil, true},
+		{"malformed response", http.StatusOK, `{"validationMessages": [`, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var path string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				path = r.URL.Path
+				w.WriteHeader(tt.status)
+				fmt.Fprint(w, tt.body)
+			}))
+			defer srv.Close()
+			useConfig(t, withTestCreds(Config{CollectorURL: srv.URL + "/mp/collect"}))
+
+			got, err := validatePayload(context.Background(), Credentials{MeasurementID: "G-TEST", APISecret: "secret"}, GA4Payload{ClientID: "cid", Events: []GA4Event{{Name: "page_view"}}})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("validatePayload() error = %v, want error: %v", err, tt.wantErr)
+			}
+			if path != "/debug/mp/collect" {
+				t.Errorf("posted to %s, want /debug/mp/collect", path)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("validatePayload() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidEvents(t *testing.T) {
+	payload := GA4Payload{Events: []GA4Event{{Name: "a"}, {Name: "b"}, {Name: "c"}}}
+	tests := []struct {
+		name     string
+		messages []validationMessage
+		want     string // events sent, or "" if the payload can't be saved
+		codes    map[int]string
+	}{
+		{
+			name:     "field path",
+			messages: []validationMessage{{FieldPath: "events[1].params.x", ValidationCode: "VALUE_INVALID"}},
+			want:     "[a c]",
+			codes:    map[int]string{1: "VALUE_INVALID"},
+		},
+		{
+			name:     "description",
+			messages: []validationMessage{{FieldPath: "events", Description: "Event at index: [0] has invalid name [_x].", ValidationCode: "NAME_RESERVED"}},
+			want:     "[b c]",
+			codes:    map[int]string{0: "NAME_RESERVED"},
+		},
+		{
+			name: "several about one event",
+			messages: []validationMessage{
+				{FieldPath: "events[2].name", ValidationCode: "NAME_INVALID"},
+				{FieldPath: "events[2].params", ValidationCode: "VALUE_INVALID"},
+			},
+			want:  "[a b]",
+			codes: map[int]string{2: "NAME_INVALID"},
+		},
+		{
+			name:     "not about an event",
+			messages: []validationMessage{{FieldPath: "client_id", ValidationCode: "VALUE_REQUIRED"}, {FieldPath: "events[0]"}},
+		},
+		{
+			name:     "event out of range",
+			messages: []validationMessage{{FieldPath: "events[3]"}},
+		},
+		{
+			name:     "every event invalid",
+			messages: []validationMessage{{FieldPath: "events[0]"}, {FieldPath: "events[1]"}, {FieldPath: "events[2]"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			valid, codes, ok := validEvents(payload, tt.messages)
+			if tt.want == "" {
+				if ok {
+					t.Fatalf("validEvents kept %s, want the payload rejected", eventNames(valid))
+				}
+				return
+			}
+			if !ok {
+				t.Fatal("validEvents rejected the payload")
+			}
+			if got := eventNames(valid); got != tt.want {
+				t.Errorf("sent %s, want %s", got, tt.want)
+			}
+			if fmt.Sprint(codes) != fmt.Sprint(tt.codes) {
+				t.Errorf("codes = %v, want %v", codes, tt.codes)
+			}
+		})
+	}
+	if len(payload.Events) != 3 {
+		t.Errorf("validEvents changed the payload it was given")
+	}
+}
+
+func TestSendToGADropsInvalidEvents(t *testing.T) {
+	var (
+		mu        sync.Mutex
+		collected []GA4Payload
+		messages  string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.URL.Path == "/debug/mp/collect" {
+			fmt.Fprintf(w, `{"validationMessages": %s}`, messages)
+			return
+		}
+		var p GA4Payload
+		json.NewDecoder(r.Body).Decode(&p)
+		collected = append(collected, p)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+	useConfig(t, Config{CollectorURL: srv.URL + "/mp/collect", Validate: true, ValidateReject: true, MaxRetries: -1})
+
+	payload := GA4Payload{ClientID: "cid", Events: []GA4Event{{Name: "good"}, {Name: "bad"}, {Name: "fine"}}}
+	creds := Credentials{MeasurementID: "G-TEST", APISecret: "secret"}
+	tests := []struct {
+		messages string
+		want     string // events collected, or "" for none
+		wantErr  bool
+	}{
+		{`[]`, "[good bad fine]", false},
+		{`[{"fieldPath": "events[1].name", "validationCode": "NAME_INVALID"}]`, "[good fine]", false},
+		{`[{"fieldPath": "client_id", "validationCode": "VALUE_REQUIRED"}]`, "", true},
+	}
+	for _, tt := range tests {
+		mu.Lock()
+		messages, collected = tt.messages, nil
+		mu.Unlock()
+		before := eventsInvalid.Value("code", "NAME_INVALID")
+
+		err := sendToGA(context.Background(), "test-agent", "192.0.2.1", "cid", creds, payload)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("messages %s: err = %v, want error %v", tt.messages, err, tt.wantErr)
+		}
+		mu.Lock()
+		got := ""
+		if len(collected) == 1 {
+			got = eventNames(collected[0])
+		} else if len(collected) > 1 {
+			got = fmt.Sprintf("%d posts", len(collected))
+		}
+		mu.Unlock()
+		if got != tt.want {
+			t.Errorf("messages %s: collected %q, want %q", tt.messages, got, tt.want)
+		}
+		if tt.want == "[good fine]" {
+			if n := eventsInvalid.Value("code", "NAME_INVALID") - before; n != 1 {
+				t.Errorf("beacon_events_invalid_total{code=NAME_INVALID} rose by %v, want 1", n)
+			}
+		}
+	}
+}
+
+func TestValidateOnlyLogs(t *testing.T) {
+	var validated, collected int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/debug/mp/collect" {
+			validated++
+			fmt.Fprint(w, `{"validationMessages": [{"fieldPath": "events[0].name", "validationCode": "NAME_INVALID"}]}`)
+			return
+		}
+		collected++
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+	useConfig(t, withTestCreds(Config{CollectorURL: srv.URL + "/mp/collect", Validate: true}))
+
+	err := sendToGA(context.Background(), "test-agent", "192.0.2.1", "cid", Credentials{MeasurementID: "G-TEST", APISecret: "secret"}, GA4Payload{ClientID: "cid", Events: []GA4Event{{Name: "bad"}}})
+	if err != nil {
+		t.Errorf("sendToGA() = %v, want the payload sent regardless", err)
+	}
+	if validated != 1 || collected != 1 {
+		t.Errorf("validated %d and collected %d times, want 1 each", validated, collected)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime/debug"
+)
+
+// Build details, set at link time with, for example:
+//
+//	go build -ldflags "-X main.version=1.2.0 -X main.commit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%FT%TZ)"
+//
+// Any left empty are filled from the module build info where it has them.
+var (
+	version   string
+	commit    string
+	buildDate string
+)
+
+// versionInfo is what /version reports.
+type versionInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"build_date"`
+	GoVersion string `json:"go_version"`
+}
+
+// buildVersion reads the -ldflags values, falling back to the module
+// version and VCS stamping Go records in the binary.
+func buildVersion() versionInfo {
+	v := versionInfo{Version: version, Commit: commit, BuildDate: buildDate}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return v
+	}
+	v.GoVersion = info.GoVersion
+	if v.Version == "" && info.Main.Version != "" {
+		v.Version = info.Main.Version
+	}
+	for _, s := range info.Settings {
+		switch {
+		case s.Key == "vcs.revision" && v.Commit == "":
+			v.Commit = s.Value
+		case s.Key == "vcs.time" && v.BuildDate == "":
+			v.BuildDate = s.Value
+		}
+	}
+	return v
+}
+
+// versionHandler reports the running build. It is read once, since it
+// can't change while the process runs.
+var versionHandler = func() http.HandlerFunc {
+	body, _ := json.Marshal(buildVersion())
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write(body)
+	}
+}()
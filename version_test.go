@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"runtime"
+	"sort"
+	"testing"
+)
+
+func TestVersionEndpoint(t *testing.T) {
+	useConfig(t, withTestCreds(Config{}))
+	sender := &recordingSender{}
+	w := httptest.NewRecorder()
+	newMux(&server{sender: sender}).ServeHTTP(w, httptest.NewRequest("GET", "/version", nil))
+
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("status %d, Content-Type %q; want 200 JSON", w.Code, w.Header().Get("Content-Type"))
+	}
+	var got map[string]string
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("not a JSON object of strings: %v\n%s", err, w.Body)
+	}
+	var keys []string
+	for k := range got {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	if want := []string{"build_date", "commit", "go_version", "version"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("keys = %v, want %v", keys, want)
+	}
+	if got["go_version"] != runtime.Version() {
+		t.Errorf("go_version = %q, want %q", got["go_version"], runtime.Version())
+	}
+	if n := len(sender.sent()); n != 0 {
+		t.Errorf("sent %d hits, want none", n)
+	}
+}
+
+func TestBuildVersion(t *testing.T) {
+	tests := []struct {
+		name                       string
+		version, commit, buildDate string
+	}{
+		{"from ldflags", "1.2.0", "0123abcd", "2026-10-01T12:00:00Z"},
+		{"version only", "1.2.0", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			saved := [3]string{version, commit, buildDate}
+			t.Cleanup(func() { version, commit, buildDate = saved[0], saved[1], saved[2] })
+			version, commit, buildDate = tt.version, tt.commit, tt.buildDate
+
+			v := buildVersion()
+			if v.Version != tt.version {
+				t.Errorf("version = %q, want %q", v.Version, tt.version)
+			}
+			// Without ldflags, the commit and date come from VCS stamping,
+			// which test binaries don't have.
+			if tt.commit != "" && (v.Commit != tt.commit || v.BuildDate != tt.buildDate) {
+				t.Errorf("commit, build_date = %q, %q, want %q, %q", v.Commit, v.BuildDate, tt.commit, tt.buildDate)
+			}
+			if v.GoVersion != runtime.Version() {
+				t.Errorf("go_version = %q, want %q", v.GoVersion, runtime.Version())
+			}
+		})
+	}
+}
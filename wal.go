@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// Name of the write-ahead log in queue_dir.
+	walFileName = "queue.wal"
+
+	// Most bytes of undelivered hits kept in the log. Hits accepted beyond
+	// that are still delivered, but not written down.
+	maxWALBytes = 64 << 20
+
+	// The log is compacted once it is this big and at least half of it is
+	// hits that have since been delivered.
+	walCompactBytes = 1 << 20
+)
+
+var walFull = newCounter("beacon_queue_dir_full_total", "Hits queued without being written to queue_dir because it was full.")
+
+// walHit is a queued hit as written to the log.
+type walHit struct {
+	ID       uint64     `json:"id"`
+	Meta     storedMeta `json:"meta"`
+	Payload  GA4Payload `json:"payload"`
+	Received time.Time  `json:"received"`
+}
+
+// storedMeta is what queue_dir keeps of a hit's HitMeta. The credentials
+// aren't written down, only the account, stream and beacon they were
+// picked by, and the client IP is kept as anonymizeIP leaves it.
+type storedMeta struct {
+	Account   string `json:"account"`
+	Stream    string `json:"stream,omitempty"`
+	Beacon    string `json:"beacon,omitempty"`
+	UA        string `json:"ua"`
+	IP        string `json:"ip"`
+	CID       string `json:"cid"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+func storeMeta(m HitMeta) storedMeta {
+	return storedMeta{
+		Account: m.Account, Stream: m.Stream, Beacon: m.Beacon,
+		UA: m.UA, IP: anonymizeIP(m.IP), CID: m.CID, RequestID: m.RequestID,
+	}
+}
+
+// hitMeta turns m back into a HitMeta, picking its credentials from the
+// current config. It reports false when they can't be: the beacon is gone
+// or no property is configured for the account any more.
+func (m storedMeta) hitMeta() (HitMeta, bool) {
+	ctx := context.Background()
+	if m.Beacon != "" {
+		b := beaconByPrefix(m.Beacon)
+		if b == nil {
+			return HitMeta{}, false
+		}
+		ctx = context.WithValue(ctx, beaconKey{}, b)
+	}
+	creds, ok := credentialsFor(ctx, m.Account, m.Stream)
+	return HitMeta{
+		Creds: creds, Account: m.Account, UA: m.UA, IP: m.IP, CID: m.CID,
+		Stream: m.Stream, Beacon: m.Beacon, RequestID: m.RequestID,
+	}, ok
+}
+
+// walEntry is one line of the log: a hit accepted for delivery, or the id
+// of one that has been delivered.
+type walEntry struct {
+	Hit  *walHit `json:"hit,omitempty"`
+	Done uint64  `json:"done,omitempty"`
+}
+
+// hitLog is a write-ahead log of the hits in the delivery queue, so that
+// hits still waiting when the process stops are delivered after it
+// restarts. Lines are appended without syncing, so the log survives the
+// process crashing but not the machine.
+type hitLog struct {
+	mu      sync.Mutex
+	path    string
+	f       *os.File
+	size    int64
+	nextID  uint64
+	pending map[uint64][]byte // encoded lines of undelivered hits
+	bytes   int64             // total length of pending
+}
+
+// openHitLog opens the log in dir, creating both if needed, and returns
+// the hits it holds that were never delivered, oldest first.
+func openHitLog(dir string) (*hitLog, []walHit, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, nil, err
+	}
+	l := &hitLog{path: filepath.Join(dir, walFileName), nextID: 1, pending: make(map[uint64][]byte)}
+
+	hits := make(map[uint64]walHit)
+	f, err := os.Open(l.path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, nil, err
+	}
+	if err == nil {
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(nil, maxWALBytes)
+		for scanner.Scan() {
+			var e walEntry
+			if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+				// A line cut short by a crash; the rest are still good.
+				slog.Warn("skipping malformed line in queue_dir log", "err", err)
+				continue
+			}
+			switch {
+			case e.Hit != nil:
+				hits[e.Hit.ID] = *e.Hit
+				l.pending[e.Hit.ID] = append([]byte(nil), scanner.Bytes()...)
+				l.nextID = max(l.nextID, e.Hit.ID+1)
+			case e.Done != 0:
+				delete(hits, e.Done)
+				delete(l.pending, e.Done)
+			}
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, nil, fmt.Errorf("cannot read %s: %v", l.path, err)
+		}
+	}
+	for _, line := range l.pending {
+		l.bytes += int64(len(line)) + 1
+	}
+
+	if err := l.rewrite(); err != nil {
+		return nil, nil, err
+	}
+
+	replay := make([]walHit, 0, len(hits))
+	for _, h := range hits {
+		replay = append(replay, h)
+	}
+	sort.Slice(replay, func(i, j int) bool { return replay[i].ID < replay[j].ID })
+	return l, replay, nil
+}
+
+// Append writes a hit to the log and returns its id, or 0 if it couldn't
+// be written.
+func (l *hitLog) Append(meta HitMeta, payload GA4Payload) uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return 0
+	}
+
+	id := l.nextID
+	line, err := json.Marshal(walEntry{Hit: &walHit{ID: id, Meta: storeMeta(meta), Payload: payload, Received: payload.Received}})
+	if err != nil {
+		slog.Error("cannot encode hit for queue_dir", "err", err)
+		return 0
+	}
+	if l.bytes+int64(len(line))+1 > maxWALBytes {
+		walFull.Inc()
+		return 0
+	}
+	if err := l.write(line); err != nil {
+		slog.Error("cannot write to queue_dir", "err", err)
+		return 0
+	}
+	l.nextID++
+	l.pending[id] = line
+	l.bytes += int64(len(line)) + 1
+	return id
+}
+
+// Done records that hit id has been delivered, so it isn't replayed.
+func (l *hitLog) Done(id uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	line, ok := l.pending[id]
+	if !ok || l.f == nil {
+		return
+	}
+	delete(l.pending, id)
+	l.bytes -= int64(len(line)) + 1
+
+	b, _ := json.Marshal(walEntry{Done: id})
+	if err := l.write(b); err != nil {
+		slog.Error("cannot write to queue_dir", "err", err)
+		return
+	}
+	if l.size >= walCompactBytes && l.size >= 2*l.bytes {
+		if err := l.rewrite(); err != nil {
+			slog.Error("cannot compact queue_dir log", "err", err)
+		}
+	}
+}
+
+// Close closes the log. Hits still pending are replayed on the next start.
+func (l *hitLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return nil
+	}
+	err := l.f.Close()
+	l.f = nil
+	return err
+}
+
+func (l *hitLog) write(line []byte) error {
+	n, err := l.f.Write(append(line, '\n'))
+	l.size += int64(n)
+	return err
+}
+
+// rewrite replaces the log with one holding only the pending hits, and
+// reopens it for appending. The old log is kept if that fails.
+func (l *hitLog) rewrite() error {
+	ids := make([]uint64, 0, len(l.pending))
+	for id := range l.pending {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	tmp, err := os.CreateTemp(filepath.Dir(l.path), walFileName+".*")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	for _, id := range ids {
+		w.Write(l.pending[id])
+		w.WriteByte('\n')
+	}
+	err = w.Flush()
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), l.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	if l.f != nil {
+		l.f.Close()
+	}
+	l.f, l.size = f, l.bytes
+	return nil
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// replayedCIDs returns the client ids of hits, in order.
+func replayedCIDs(hits []walHit) []string {
+	var cids []string
+	for _, h := range hits {
+		cids = append(cids, h.Meta.CID)
+	}
+	return cids
+}
+
+func TestHitLogReplaysUndelivered(t *testing.T) {
+	tests := []struct {
+		name       string
+		cids       []string // appended in order
+		delivered  []int    // indexes into cids marked Done
+		corrupt    string   // appended to the file before reopening
+		wantReplay string
+	}{
+		{"nothing delivered", []string{"a", "b", "c"}, nil, "", "[a b c]"},
+		{"some delivered", []string{"a", "b", "c", "d"}, []int{0, 2}, "", "[b d]"},
+		{"all delivered", []string{"a", "b"}, []int{1, 0}, "", "[]"},
+		{"line cut short by a crash", []string{"a", "b"}, []int{0}, `{"hit": {"id": 9, "me`, "[b]"},
+		{"empty log", nil, nil, "", "[]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			l, replay, err := openHitLog(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(replay) != 0 {
+				t.Fatalf("new log replayed %d hits", len(replay))
+			}
+			var ids []uint64
+			for _, cid := range tt.cids {
+				id := l.Append(HitMeta{CID: cid}, GA4Payload{ClientID: cid})
+				if id == 0 {
+					t.Fatalf("Append(%s) failed", cid)
+				}
+				ids = append(ids, id)
+			}
+			for _, i := range tt.delivered {
+				l.Done(ids[i])
+			}
+			if err := l.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if tt.corrupt != "" {
+				f, err := os.OpenFile(filepath.Join(dir, walFileName), os.O_WRONLY|os.O_APPEND, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				f.WriteString(tt.corrupt)
+				f.Close()
+			}
+
+			l, replay, err = openHitLog(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+			if got := fmt.Sprint(replayedCIDs(replay)); got != tt.wantReplay {
+				t.Errorf("replayed %s, want %s", got, tt.wantReplay)
+			}
+			// Hits logged after the restart get ids of their own.
+			id := l.Append(HitMeta{CID: "new"}, GA4Payload{})
+			for _, h := range replay {
+				if h.ID == id {
+					t.Errorf("new hit got id %d, already used by %s", id, h.Meta.CID)
+				}
+			}
+		})
+	}
+}
+
+func TestHitLogCompacts(t *testing.T) {
+	dir := t.TempDir()
+	l, _, err := openHitLog(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	pad := strings.Repeat("x", 4<<10)
+	var kept uint64
+	for i := 0; int64(i)*int64(len(pad)) < 2*walCompactBytes; i++ {
+		id := l.Append(HitMeta{CID: fmt.Sprint(i)}, GA4Payload{ClientID: pad})
+		if i == 0 {
+			kept = id
+			continue
+		}
+		l.Done(id)
+	}
+	info, err := os.Stat(filepath.Join(dir, walFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() >= walCompactBytes {
+		t.Errorf("log is %d bytes with one hit pending, want it compacted", info.Size())
+	}
+	l.Close()
+
+	_, replay, err := openHitLog(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(replay) != 1 || replay[0].ID != kept {
+		t.Errorf("replayed %v after compaction, want only hit %d", replayedCIDs(replay), kept)
+	}
+}
+
+func TestRunReplaysQueueDir(t *testing.T) {
+	dir := t.TempDir()
+	// Hits a previous run accepted but never delivered.
+	l, _, err := openHitLog(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	creds := Credentials{MeasurementID: "G-TEST", APISecret: "secret"}
+	for _, cid := range []string{"1.1", "2.2", "3.3"} {
+		id := l.Append(HitMeta{Creds: creds, Account: "acct", CID: cid}, GA4Payload{ClientID: cid, Events: []GA4Event{{Name: "page_view"}}})
+		if cid == "2.2" {
+			l.Done(id)
+		}
+	}
+	l.Close()
+
+	f := newFakeCollector(t, Config{QueueDir: dir})
+	saved := hitCounts
+	t.Cleanup(func() { hitCounts = saved })
+	// Each run replays what the one before left, then shuts down.
+	for i := 0; i < 2; i++ {
+		c := *config()
+		c.ListenAddr = freeAddr(t)
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error, 1)
+		go func() { done <- run(ctx, c) }()
+		waitForListener(t, c.ListenAddr)
+		for deadline := time.Now().Add(2 * time.Second); len(f.posted()) < 2 && time.Now().Before(deadline); {
+			time.Sleep(10 * time.Millisecond)
+		}
+		cancel()
+		if err := <-done; err != nil {
+			t.Fatalf("run #%d: %v", i+1, err)
+		}
+	}
+
+	var cids []string
+	for _, p := range f.posted() {
+		cids = append(cids, p.ClientID)
+	}
+	// Workers deliver in parallel, so in no set order.
+	sort.Strings(cids)
+	if got := fmt.Sprint(cids); got != "[1.1 3.3]" {
+		t.Errorf("collector got %s over two runs, want [1.1 3.3] once each", got)
+	}
+}
+
+func TestBatchedHitsStayLoggedUntilPosted(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		wantReplay string
+	}{
+		{"posted", 0, "[]"},
+		{"post rejected", http.StatusBadRequest, "[a b c]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeCollector(t, Config{})
+			f.status = tt.status
+			dir := t.TempDir()
+			l, _, err := openHitLog(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			q := newSendQueue(newBatcher(gaSender{}, time.Minute), l, 2, 10)
+			cids := []string{"a", "b", "c"}
+			for _, cid := range cids {
+				meta := HitMeta{Creds: Credentials{MeasurementID: "G-TEST", APISecret: "secret"}, CID: cid}
+				if err := q.Send(context.Background(), meta, GA4Payload{ClientID: cid, Events: []GA4Event{{Name: "page_view"}}}); err != nil {
+					t.Fatalf("Send(%s): %v", cid, err)
+				}
+			}
+
+			// Handed to the batcher, but not yet posted: still logged.
+			deadline := time.Now().Add(time.Second)
+			for len(q.ch) > 0 && time.Now().Before(deadline) {
+				time.Sleep(5 * time.Millisecond)
+			}
+			time.Sleep(20 * time.Millisecond)
+			l.mu.Lock()
+			pending := len(l.pending)
+			l.mu.Unlock()
+			if pending != len(cids) {
+				t.Errorf("%d hits logged while waiting in a batch, want %d", pending, len(cids))
+			}
+
+			if n := q.Drain(5 * time.Second); n != 0 {
+				t.Fatalf("Drain left %d hits", n)
+			}
+			if err := l.Close(); err != nil {
+				t.Fatal(err)
+			}
+			l, replay, err := openHitLog(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+			got := replayedCIDs(replay)
+			sort.Strings(got)
+			if fmt.Sprint(got) != tt.wantReplay {
+				t.Errorf("replayed %v, want %s", got, tt.wantReplay)
+			}
+		})
+	}
+}
+
+func TestQueueDirKeepsNoSecrets(t *testing.T) {
+	useConfig(t, Config{
+		MeasurementID: "G-TOP",
+		APISecret:     "top-secret",
+		Accounts:      map[string]Credentials{"docs": {MeasurementID: "G-DOCS", APISecret: "docs-secret"}},
+		Streams:       map[string]Credentials{"app": {MeasurementID: "G-APP", APISecret: "app-secret"}},
+		Beacons:       []BeaconConfig{{PathPrefix: "/blog", MeasurementID: "G-BLOG", APISecret: "blog-secret"}},
+	})
+	tests := []struct {
+		name     string
+		meta     HitMeta
+		reload   func(c *Config) // applied before reading the hit back
+		wantID   string          // "" if the hit is dropped
+		wantIPIn string
+	}{
+		{"top-level", HitMeta{Account: "acct", IP: "203.0.113.7"}, nil, "G-TOP", "203.0.113.0"},
+		{"account", HitMeta{Account: "docs", IP: "2001:db8:1:2::7"}, nil, "G-DOCS", "2001:db8:1::"},
+		{"stream", HitMeta{Account: "acct", Stream: "app", IP: "203.0.113.7"}, nil, "G-APP", "203.0.113.0"},
+		{"beacon", HitMeta{Account: "acct", Beacon: "/blog", IP: "203.0.113.7"}, nil, "G-BLOG", "203.0.113.0"},
+		{"secret rotated", HitMeta{Account: "docs"}, func(c *Config) {
+			c.Accounts = map[string]Credentials{"docs": {MeasurementID: "G-DOCS", APISecret: "docs-secret-2"}}
+		}, "G-DOCS", ""},
+		{"beacon removed", HitMeta{Account: "acct", Beacon: "/blog"}, func(c *Config) { c.Beacons = nil }, "", ""},
+		{"property removed", HitMeta{Account: "acct"}, func(c *Config) { c.MeasurementID, c.APISecret = "", "" }, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The credentials a live hit carries, which must not reach disk.
+			meta := tt.meta
+			meta.CID = "1111.2222"
+			meta.Creds, _ = credentialsFor(context.Background(), meta.Account, meta.Stream)
+			if b := beaconByPrefix(meta.Beacon); b != nil {
+				meta.Creds = b.credentials()
+			}
+
+			dir := t.TempDir()
+			l, _, err := openHitLog(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			l.Append(meta, GA4Payload{ClientID: meta.CID})
+			l.Close()
+			spill, err := openHitSpill(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := spill.Append(walHit{Meta: storeMeta(meta), Payload: GA4Payload{ClientID: meta.CID}}); err != nil {
+				t.Fatal(err)
+			}
+			spill.Close()
+			for _, name := range []string{walFileName, spillFileName} {
+				b, err := os.ReadFile(filepath.Join(dir, name))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if strings.Contains(string(b), "secret") {
+					t.Errorf("%s holds an api_secret:\n%s", name, b)
+				}
+				if meta.IP != "" && (strings.Contains(string(b), meta.IP) || !strings.Contains(string(b), tt.wantIPIn)) {
+					t.Errorf("%s holds IP %s, want only %s:\n%s", name, meta.IP, tt.wantIPIn, b)
+				}
+			}
+
+			if tt.reload != nil {
+				c := *config()
+				tt.reload(&c)
+				useConfig(t, c)
+			}
+			_, replay, err := openHitLog(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(replay) != 1 {
+				t.Fatalf("replayed %d hits, want 1", len(replay))
+			}
+			before := hitsDropped.Value("reason", "no_credentials")
+			d, ok := readBack(replay[0])
+			if tt.wantID == "" {
+				if ok {
+					t.Errorf("read back with %+v, want the hit dropped", d.Meta.Creds)
+				}
+				if got := hitsDropped.Value("reason", "no_credentials") - before; got != 1 {
+					t.Errorf("beacon_hits_dropped_total{reason=no_credentials} rose by %v, want 1", got)
+				}
+				return
+			}
+			if !ok {
+				t.Fatal("hit dropped, want it read back")
+			}
+			want, _ := credentialsFor(context.Background(), meta.Account, meta.Stream)
+			if b := beaconByPrefix(meta.Beacon); b != nil {
+				want = b.credentials()
+			}
+			if d.Meta.Creds != want || want.MeasurementID != tt.wantID {
+				t.Errorf("read back with %+v, want %+v from the config", d.Meta.Creds, want)
+			}
+			if d.Meta.CID != meta.CID || d.Meta.Account != meta.Account {
+				t.Errorf("read back as %+v, want cid and account kept", d.Meta)
+			}
+		})
+	}
+}
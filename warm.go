@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	// How long warming the counters from GA4 may take in all.
+	warmTimeout = time.Minute
+
+	// Earliest date the Data API accepts, so reports cover all history.
+	gaDataStartDate = "2015-08-14"
+
+	gaDataScope = "https://www.googleapis.com/auth/analytics.readonly"
+)
+
+// gaDataURL is the GA4 Data API, a variable so tests can swap it out.
+var gaDataURL = "https://analyticsdata.googleapis.com/v1beta"
+
+// serviceAccountKey is the part of a Google service account key file used
+// to authenticate to the Data API.
+type serviceAccountKey struct {
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+}
+
+// warmCounters seeds the badge count of every account in ga_property_ids
+// with its GA4 property's page views to date, so badges don't restart
+// from zero when moving to the beacon. Counts already higher are kept. An
+// account whose report fails keeps the count it has.
+func warmCounters(ctx context.Context, store CounterStore) {
+	seeder, ok := store.(interface{ Seed(account string, n int64) })
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, warmTimeout)
+	defer cancel()
+
+	token, err := gaDataToken(ctx, config().GACredentialsFile)
+	if err != nil {
+		slog.Warn("cannot authenticate to the GA4 Data API, badge counts start from zero", "err", err)
+		return
+	}
+	for account, property := range config().GAPropertyIDs {
+		n, err := propertyPageViews(ctx, token, property)
+		if err != nil {
+			slog.Warn("cannot read page views from GA4, badge count starts from zero", "account", account, "property", property, "err", err)
+			continue
+		}
+		seeder.Seed(account, n)
+		n, _ = store.Get(account)
+		setBadgeCount(account, n)
+		slog.Info("warmed badge count from GA4", "account", account, "count", n)
+	}
+}
+
+// gaDataToken exchanges the service account key in path for a read-only
+// Analytics access token, using the OAuth 2.0 JWT bearer flow.
+func gaDataToken(ctx context.Context, path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	var key serviceAccountKey
+	if err := json.Unmarshal(b, &key); err != nil {
+		return "", fmt.Errorf("cannot parse %s: %v", path, err)
+	}
+	if key.TokenURI == "" {
+		key.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+	assertion, err := signJWT(key, time.Now())
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	}
+	var result struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := postJSON(ctx, key.TokenURI, "", "application/x-www-form-urlencoded", []byte(form.Encode()), &result); err != nil {
+		return "", err
+	}
+	if result.AccessToken == "" {
+		return "", errors.New("no access_token in token response")
+	}
+	return result.AccessToken, nil
+}
+
+// signJWT returns the RS256-signed assertion requesting gaDataScope for
+// key.
+func signJWT(key serviceAccountKey, now time.Time) (string, error) {
+	block, _ := pem.Decode([]byte(key.PrivateKey))
+	if block == nil {
+		return "", errors.New("no PEM private_key in service account key")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return "", fmt.Errorf("cannot parse private_key: %v", err)
+	}
+	rsaKey, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return "", errors.New("private_key is not an RSA key")
+	}
+
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   key.ClientEmail,
+		"scope": gaDataScope,
+		"aud":   key.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	enc := base64.RawURLEncoding
+	unsigned := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+	sum := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(nil, rsaKey, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + enc.EncodeToString(sig), nil
+}
+
+// propertyPageViews returns GA4 property's page views over all its history.
+func propertyPageViews(ctx context.Context, token, property string) (int64, error) {
+	body, _ := json.Marshal(map[string]interface{}{
+		"dateRanges": []map[string]string{{"startDate": gaDataStartDate, "endDate": "today"}},
+		"metrics":    []map[string]string{{"name": "screenPageViews"}},
+	})
+	var report struct {
+		Rows []struct {
+			MetricValues []struct {
+				Value string `json:"value"`
+			} `json:"metricValues"`
+		} `json:"rows"`
+	}
+	u := gaDataURL + "/properties/" + url.PathEscape(property) + ":runReport"
+	if err := postJSON(ctx, u, token, "application/json", body, &report); err != nil {
+		return 0, err
+	}
+	// A property without page views has no rows at all.
+	if len(report.Rows) == 0 || len(report.Rows[0].MetricValues) == 0 {
+		return 0, nil
+	}
+	return strconv.ParseInt(report.Rows[0].MetricValues[0].Value, 10, 64)
+}
+
+// postJSON posts body to u, with token as bearer token if set, and decodes
+// the JSON response into result.
+func postJSON(ctx context.Context, u, token, contentType string, body []byte, result interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", req.URL.Host, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeGAData serves a token endpoint and the Data API's runReport, with
+// the page views in views per property; other properties fail.
+func fakeGAData(t *testing.T, pub *rsa.PublicKey, views map[string]string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/token":
+			parts := strings.Split(r.FormValue("assertion"), ".")
+			if len(parts) != 3 {
+				http.Error(w, "bad assertion", http.StatusBadRequest)
+				return
+			}
+			sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+			sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+			if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, sum[:], sig); err != nil {
+				http.Error(w, "bad signature", http.StatusUnauthorized)
+				return
+			}
+			fmt.Fprint(w, `{"access_token": "token"}`)
+		case r.Header.Get("Authorization") != "Bearer token":
+			http.Error(w, "unauthenticated", http.StatusUnauthorized)
+		case strings.HasSuffix(r.URL.Path, ":runReport"):
+			property := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/properties/"), ":runReport")
+			v, ok := views[property]
+			if !ok {
+				http.Error(w, "no such property", http.StatusForbidden)
+				return
+			}
+			fmt.Fprintf(w, `{"rows": [{"metricValues": [{"value": %q}]}]}`, v)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// writeServiceAccountKey writes a service account key file for key and
+// returns its path.
+func writeServiceAccountKey(t *testing.T, key *rsa.PrivateKey, tokenURI string) string {
+	t.Helper()
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := json.Marshal(serviceAccountKey{
+		ClientEmail: "beacon@example.iam.gserviceaccount.com",
+		PrivateKey:  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		TokenURI:    tokenURI,
+	})
+	path := filepath.Join(t.TempDir(), "key.json")
+	if err := os.WriteFile(path, b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestWarmCounters(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := fakeGAData(t, &key.PublicKey, map[string]string{"111": "1234", "222": "5", "333": "0"})
+	keyFile := writeServiceAccountKey(t, key, srv.URL+"/token")
+
+	old := gaDataURL
+	gaDataURL = srv.URL
+	t.Cleanup(func() { gaDataURL = old })
+
+	useConfig(t, Config{
+		WarmFromGA:        true,
+		GACredentialsFile: keyFile,
+		GAPropertyIDs:     map[string]string{"fresh": "111", "ahead": "222", "empty": "333", "broken": "999"},
+	})
+	store := newMemoryCounterStore()
+	store.counts["ahead"] = 10
+	store.counts["broken"] = 3
+
+	warmCounters(context.Background(), store)
+
+	tests := []struct {
+		account string
+		want    int64
+	}{
+		{"fresh", 1234},
+		{"ahead", 10},
+		{"empty", 0},
+		{"broken", 3},
+	}
+	for _, tt := range tests {
+		if n, _ := store.Get(tt.account); n != tt.want {
+			t.Errorf("count for %s = %d, want %d", tt.account, n, tt.want)
+		}
+	}
+	if got := badgeCounts.Value("account", "fresh"); got != 1234 {
+		t.Errorf("beacon_badge_count for fresh = %v, want 1234", got)
+	}
+}
+
+func TestWarmCountersFailsToZero(t *testing.T) {
+	useConfig(t, Config{
+		WarmFromGA:        true,
+		GACredentialsFile: filepath.Join(t.TempDir(), "missing.json"),
+		GAPropertyIDs:     map[string]string{"acct": "111"},
+	})
+	store := newMemoryCounterStore()
+	warmCounters(context.Background(), store)
+	if n, _ := store.Get("acct"); n != 0 {
+		t.Errorf("count = %d after failing to authenticate, want 0", n)
+	}
+}
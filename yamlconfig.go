@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// unmarshalConfig parses a config file into cfg: as YAML when path ends in
+// .yaml or .yml, and otherwise as JSON.
+func unmarshalConfig(path string, data []byte, cfg *Config) error {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(data, cfg); err != nil {
+			return err
+		}
+		// Free-form values decode differently from YAML than from JSON,
+		// which is what the params code expects.
+		for name, v := range cfg.DefaultParams {
+			cfg.DefaultParams[name] = jsonCompatible(v)
+		}
+		for _, params := range cfg.AccountMetadata {
+			for name, v := range params {
+				params[name] = jsonCompatible(v)
+			}
+		}
+		return nil
+	}
+	return json.Unmarshal(data, cfg)
+}
+
+// jsonCompatible converts a value decoded from YAML to what encoding/json
+// gives for the same data, however deeply it is nested: integers become
+// float64s, and maps with non-string keys get string keys.
+func jsonCompatible(v interface{}) interface{} {
+	switch v := v.(type) {
+	case int:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case uint64:
+		return float64(v)
+	case []interface{}:
+		for i, e := range v {
+			v[i] = jsonCompatible(e)
+		}
+		return v
+	case map[string]interface{}:
+		for k, e := range v {
+			v[k] = jsonCompatible(e)
+		}
+		return v
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[fmt.Sprint(k)] = jsonCompatible(e)
+		}
+		return m
+	}
+	return v
+}
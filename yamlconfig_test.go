@@ -0,0 +1,129 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const jsonTestConfig = `{
+  "measurement_id": "G-TEST",
+  "api_secret": "secret",
+  "sample_rate": 0.5,
+  "workers": 8,
+  "max_body_bytes": 1024,
+  "root_redirect": "",
+  "denied_params": [],
+  "allowed_accounts": ["proj-*"],
+  "anonymize_ip": false,
+  "cookie": {"name": "vid", "max_age": 60, "same_site": "lax"},
+  "accounts": {"proj-a": {"measurement_id": "G-A", "api_secret": "a"}},
+  "default_params": {"team": "web", "level": 3, "ratio": 1.5, "beta": true},
+  "account_metadata": {
+    "proj-a": {"tier": 2, "tags": [1, "two", {"n": 3}], "limits": {"daily": 100, "nested": {"deep": [4]}}}
+  },
+  "beacons": [{"path_prefix": "/docs", "reserved_params": ["q"]}],
+  "security_headers": {"X-Frame-Options": "DENY"}
+}`
+
+const yamlTestConfig = `
+measurement_id: G-TEST
+api_secret: secret
+sample_rate: 0.5
+workers: 8
+max_body_bytes: 1024
+root_redirect: ""
+denied_params: []
+allowed_accounts: [proj-*]
+anonymize_ip: false
+cookie:
+  name: vid
+  max_age: 60
+  same_site: lax
+accounts:
+  proj-a: {measurement_id: G-A, api_secret: a}
+default_params: {team: web, level: 3, ratio: 1.5, beta: true}
+account_metadata:
+  proj-a:
+    tier: 2
+    tags: [1, two, {n: 3}]
+    limits:
+      daily: 100
+      nested: {deep: [4]}
+beacons:
+  - path_prefix: /docs
+    reserved_params: [q]
+security_headers:
+  X-Frame-Options: DENY
+`
+
+func TestYAMLAndJSONConfigsMatch(t *testing.T) {
+	var fromJSON, fromYAML Config
+	if err := unmarshalConfig("config.json", []byte(jsonTestConfig), &fromJSON); err != nil {
+		t.Fatalf("JSON: %v", err)
+	}
+	for _, name := range []string{"config.yaml", "config.yml", "CONFIG.YML"} {
+		fromYAML = Config{}
+		if err := unmarshalConfig(name, []byte(yamlTestConfig), &fromYAML); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !reflect.DeepEqual(fromJSON, fromYAML) {
+			t.Errorf("%s differs from JSON:\nJSON: %#v\nYAML: %#v", name, fromJSON, fromYAML)
+		}
+	}
+
+	// Spot-check settings where unset and empty differ.
+	if fromYAML.DeniedParams == nil || len(fromYAML.DeniedParams) != 0 {
+		t.Errorf("denied_params = %#v, want an empty list", fromYAML.DeniedParams)
+	}
+	if fromYAML.RootRedirect == nil || *fromYAML.RootRedirect != "" {
+		t.Errorf("root_redirect = %v, want empty", fromYAML.RootRedirect)
+	}
+	if fromYAML.AnonymizeIP == nil || *fromYAML.AnonymizeIP {
+		t.Errorf("anonymize_ip = %v, want false", fromYAML.AnonymizeIP)
+	}
+}
+
+func TestLoadConfigByExtension(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{"config.json", jsonTestConfig, ""},
+		{"config.yaml", yamlTestConfig, ""},
+		{"config.conf", jsonTestConfig, ""},
+		{"config.conf", yamlTestConfig, "failed to parse config file"},
+		{"config.json", yamlTestConfig, "failed to parse config file"},
+		{"config.yaml", "measurement_id: [G-TEST\n", "failed to parse config file"},
+		{"config.yaml", "workers: many\n", "failed to parse config file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, tt.name)
+			if err := os.WriteFile(path, []byte(tt.content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			old := flags.config
+			flags.config = path
+			t.Cleanup(func() { flags.config = old })
+
+			cfg, err := loadConfig()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("loadConfig err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadConfig: %v", err)
+			}
+			if cfg.MeasurementID != "G-TEST" || cfg.Workers != 8 || cfg.Cookie.Name != "vid" {
+				t.Errorf("loadConfig gave %+v", cfg)
+			}
+		})
+	}
+}